@@ -0,0 +1,317 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogEntry is a JSON representation of a request.
+type accessLogEntry struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Method         string    `json:"method"`
+	URL            string    `json:"url"`
+	RemoteIP       string    `json:"remote_ip"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	ClientIdentity string    `json:"client_identity,omitempty"`
+	Repo           string    `json:"repo,omitempty"`
+	CommandType    string    `json:"command_type,omitempty"`
+	CacheState     string    `json:"cache_state,omitempty"`
+	ErrorCategory  string    `json:"error_category,omitempty"`
+	Status         int       `json:"status"`
+	RequestSize    int64     `json:"request_size"`
+	ResponseSize   int64     `json:"response_size"`
+	LatencyMs      int64     `json:"latency_msec"`
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is what the handlers learn about a request, such as the
+// upstream repository, for the request logs. It's updated only by the
+// goroutine serving the request. header is the response header that the
+// handlers can set before the response starts, or nil if the request is not
+// over HTTP. clientIdentity and remoteAddr are set for AuditLogger. hooks are
+// the RequestHooks whose BeforeRequest is called, hookRequest is the request
+// returned by the last one, and err is the error that the request failed
+// with, for AfterRequest.
+type requestInfo struct {
+	requestID      string
+	upstreamURL    string
+	commandType    string
+	cacheState     string
+	header         http.Header
+	clientIdentity string
+	remoteAddr     string
+	hooks          []RequestHook
+	hookRequest    *http.Request
+	err            error
+}
+
+// withRequestInfo attaches an empty requestInfo to the request.
+func withRequestInfo(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{}))
+}
+
+// requestInfoFromContext returns the requestInfo of the request. This
+// returns a throwaway value if there's none so that the callers don't need
+// to check.
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// NewJSONRequestLogger returns a RequestLogger that writes the requests in
+// JSON, one request per line. Each line is written with a single Write call.
+// In addition to the HTTP request, the request ID, the upstream repository,
+// the command type, the cache state, and the ErrorCategory of the failure are
+// logged for the requests that goblet handles, and so is the ClientIdentity of
+// the requests with a client certificate.
+func NewJSONRequestLogger(w io.Writer) func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+	return func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+		info := requestInfoFromContext(r.Context())
+		bs, err := json.Marshal(&accessLogEntry{
+			Time:           time.Now().Add(-latency),
+			RequestID:      info.requestID,
+			Method:         r.Method,
+			URL:            r.URL.String(),
+			RemoteIP:       r.RemoteAddr,
+			UserAgent:      r.UserAgent(),
+			ClientIdentity: ClientIdentity(r),
+			Repo:           info.upstreamURL,
+			CommandType:    info.commandType,
+			CacheState:     info.cacheState,
+			ErrorCategory:  string(ErrorCategoryOf(info.err)),
+			Status:         status,
+			RequestSize:    requestSize,
+			ResponseSize:   responseSize,
+			LatencyMs:      int64(latency / time.Millisecond),
+		})
+		if err != nil {
+			log.Printf("Cannot encode an access log entry: %v", err)
+			return
+		}
+		if _, err := w.Write(append(bs, '\n')); err != nil {
+			log.Printf("Cannot write an access log entry: %v", err)
+		}
+	}
+}
+
+// NewCombinedRequestLogger returns a RequestLogger that writes the requests in
+// the Combined Log Format of Apache, one request per line, so that the log
+// analyzers can read them as they are:
+//
+//	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /a HTTP/1.1" 200 2326 "-" "git/2.30.0" "request_id=... repo=... command_type=fetch cache_state=locally-served latency_ms=12"
+//
+// The user is the ClientIdentity of the request. The last field is an
+// extension with the request ID, the upstream repository, the command type,
+// the cache state, and the latency, with "-" for the unknown values. Each
+// line is written with a single Write call.
+func NewCombinedRequestLogger(w io.Writer) func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+	return func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+		info := requestInfoFromContext(r.Context())
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		uri := r.RequestURI
+		if uri == "" {
+			uri = r.URL.RequestURI()
+		}
+		size := "-"
+		if responseSize > 0 {
+			size = strconv.FormatInt(responseSize, 10)
+		}
+		line := fmt.Sprintf("%s - %s [%s] \"%s\" %d %s \"%s\" \"%s\" \"request_id=%s repo=%s command_type=%s cache_state=%s latency_ms=%d\"\n",
+			combinedLogField(host),
+			combinedLogField(ClientIdentity(r)),
+			time.Now().Add(-latency).Format("02/Jan/2006:15:04:05 -0700"),
+			combinedLogQuotedField(r.Method+" "+uri+" "+r.Proto),
+			status,
+			size,
+			combinedLogQuotedField(r.Referer()),
+			combinedLogQuotedField(r.UserAgent()),
+			combinedLogField(info.requestID),
+			combinedLogField(info.upstreamURL),
+			combinedLogField(info.commandType),
+			combinedLogField(info.cacheState),
+			int64(latency/time.Millisecond),
+		)
+		if _, err := io.WriteString(w, line); err != nil {
+			log.Printf("Cannot write an access log entry: %v", err)
+		}
+	}
+}
+
+// combinedLogQuotedField returns s as a quoted field of the Combined Log
+// Format without the quotes, which is "-" if s is empty. The quotes and the
+// control characters are escaped with backslashes as Apache does.
+func combinedLogQuotedField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+}
+
+// combinedLogField returns s as a field of the Combined Log Format, which is
+// "-" if s is empty. The spaces and the quotes are percent-encoded so that
+// the field stays a single token.
+func combinedLogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.NewReplacer(" ", "%20", `"`, "%22", "\n", "%0A", "\r", "%0D", "\t", "%09").Replace(s)
+}
+
+var (
+	// accessLogFiles are the rotatingFiles by path, shared among the
+	// HTTPHandlers that log to the same file so that they don't rotate
+	// it independently.
+	accessLogFiles   = map[string]*rotatingFile{}
+	accessLogFilesMu sync.Mutex
+)
+
+// accessLogFile returns the rotatingFile for config.AccessLogFile. The
+// rotation settings of the first config for a path apply to it.
+func accessLogFile(config *ServerConfig) *rotatingFile {
+	accessLogFilesMu.Lock()
+	defer accessLogFilesMu.Unlock()
+	if rf, ok := accessLogFiles[config.AccessLogFile]; ok {
+		return rf
+	}
+	rf := &rotatingFile{
+		path:       config.AccessLogFile,
+		maxBytes:   config.AccessLogMaxBytes,
+		maxAge:     config.AccessLogMaxAge,
+		maxBackups: config.AccessLogMaxBackups,
+	}
+	accessLogFiles[config.AccessLogFile] = rf
+	return rf
+}
+
+// closeAccessLogFile closes the rotatingFile for config.AccessLogFile if
+// it's open.
+func closeAccessLogFile(config *ServerConfig) error {
+	if config.AccessLogFile == "" {
+		return nil
+	}
+	accessLogFilesMu.Lock()
+	rf, ok := accessLogFiles[config.AccessLogFile]
+	accessLogFilesMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return rf.Close()
+}
+
+// rotatingFile is an io.Writer that appends to a file and rotates it by size
+// and age. The rotated files are renamed to path.1, path.2, and so on, with
+// path.1 being the newest. It's safe for concurrent use, and a single Write is
+// never split across files.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.size > 0 && (rf.maxBytes > 0 && rf.size+int64(len(p)) > rf.maxBytes || rf.maxAge > 0 && time.Since(rf.openedAt) > rf.maxAge) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the file. A later Write opens it again.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("cannot open the log file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot stat the log file: %v", err)
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return fmt.Errorf("cannot close the log file: %v", err)
+	}
+	rf.f = nil
+
+	if rf.maxBackups <= 0 {
+		if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove the log file: %v", err)
+		}
+		return rf.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot rotate the log file: %v", err)
+		}
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return fmt.Errorf("cannot rotate the log file: %v", err)
+	}
+	return rf.open()
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// AccessRule allows the matching clients to fetch the matching repositories.
+// A client matches if it matches with one of Identities, if any, and comes
+// from one of SourceRanges, if any.
+type AccessRule struct {
+	// Identities is a list of glob patterns, in the path.Match syntax, of
+	// the client identities that ClientIdentifier returns.
+	Identities []string
+
+	// SourceRanges is a list of the IP ranges of the clients.
+	SourceRanges []*net.IPNet
+
+	// Repos is a list of glob patterns, in the path.Match syntax, of the
+	// canonical upstream URLs.
+	Repos []string
+}
+
+// clientIdentity returns the identity of the client with ClientIdentifier,
+// or ClientIdentity if it's nil. The SSH clients are identified by
+// SSHServerConfig.PublicKeyAuthorizer, and the git:// clients are anonymous.
+func clientIdentity(config *ServerConfig, r *http.Request) string {
+	if s := streamSessionFromContext(r.Context()); s != nil {
+		return s.identity
+	}
+	if h := clusterHopFromContext(r.Context()); h != nil {
+		return h.identity
+	}
+	config.settingsMu.RLock()
+	identifier := config.ClientIdentifier
+	config.settingsMu.RUnlock()
+	if identifier == nil {
+		return ClientIdentity(r)
+	}
+	return identifier(r)
+}
+
+// isAllowedRepo returns true if AccessRules is empty, or one of them allows
+// the client to fetch the repository.
+func isAllowedRepo(config *ServerConfig, r *http.Request, u *url.URL) bool {
+	config.settingsMu.RLock()
+	rules := config.AccessRules
+	config.settingsMu.RUnlock()
+	if len(rules) == 0 {
+		return true
+	}
+	identity := clientIdentity(config, r)
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, rule := range rules {
+		if matchAccessRuleClient(rule, identity, ip) && matchAccessRuleRepo(rule, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAccessRuleClient(rule *AccessRule, identity string, ip net.IP) bool {
+	if len(rule.Identities) != 0 {
+		matched := false
+		for _, p := range rule.Identities {
+			if ok, _ := path.Match(p, identity); ok && identity != "" {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.SourceRanges) != 0 {
+		if ip == nil {
+			return false
+		}
+		for _, n := range rule.SourceRanges {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchAccessRuleRepo(rule *AccessRule, u *url.URL) bool {
+	for _, p := range rule.Repos {
+		if matchRepoPattern(p, u) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,627 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type adminServer struct {
+	config *ServerConfig
+}
+
+type adminRepoInfo struct {
+	Tenant               string    `json:"tenant,omitempty"`
+	UpstreamURL          string    `json:"upstream_url"`
+	LastUpdateTime       time.Time `json:"last_update_time"`
+	FetchFreshnessWindow string    `json:"fetch_freshness_window"`
+	DiskUsageBytes       int64     `json:"disk_usage_bytes"`
+	Opened               bool      `json:"opened"`
+	Draining             bool      `json:"draining,omitempty"`
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.AdminAuthorizer == nil {
+		writeAdminError(w, status.Error(codes.PermissionDenied, "admin endpoints are not enabled"))
+		return
+	}
+	if err := s.config.AdminAuthorizer(r); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/info":
+		s.infoHandler(w, r)
+	case "/admin/repos":
+		s.reposHandler(w, r)
+	case "/admin/repos/stats":
+		s.statsHandler(w, r)
+	case "/admin/repos/drain":
+		s.drainHandler(w, r)
+	case "/admin/repos/evict":
+		s.evictHandler(w, r)
+	case "/admin/repos/refresh":
+		s.refreshHandler(w, r)
+	case "/admin/reload":
+		s.reloadHandler(w, r)
+	case "/admin/rebalance":
+		s.rebalanceHandler(w, r)
+	case "/admin/repo-overrides":
+		s.repoOverridesHandler(w, r)
+	case "/admin/warm-repos":
+		s.warmReposHandler(w, r)
+	case "/admin/profile/next":
+		s.profileNextHandler(w, r)
+	case "/statusz":
+		s.statuszHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type adminRepoOverride struct {
+	Pattern              string `json:"pattern"`
+	FetchFreshnessWindow string `json:"fetch_freshness_window,omitempty"`
+	ObjectPool           string `json:"object_pool,omitempty"`
+}
+
+type adminServerInfo struct {
+	DNSCacheTTL string           `json:"dns_cache_ttl"`
+	DNSCache    []*dnsCacheEntry `json:"dns_cache"`
+}
+
+func (s *adminServer) infoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, &adminServerInfo{
+		DNSCacheTTL: s.config.DNSCacheTTL.String(),
+		DNSCache:    dnsCacheEntries(s.config),
+	})
+}
+
+func (s *adminServer) reposHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	repos := []*adminRepoInfo{}
+	if !isLocalDiskStore(s.config) {
+		usage, err := s.config.RepositoryStore.Usage()
+		if err != nil {
+			writeAdminError(w, status.Errorf(codes.Internal, "%v", err))
+			return
+		}
+		for _, u := range usage {
+			repos = append(repos, &adminRepoInfo{
+				Tenant:               u.Tenant,
+				UpstreamURL:          u.UpstreamURL.String(),
+				LastUpdateTime:       u.LastUpdateTime,
+				FetchFreshnessWindow: fetchFreshnessWindow(s.config, u.UpstreamURL).String(),
+				DiskUsageBytes:       u.Bytes,
+			})
+		}
+		writeRepoInfos(w, repos)
+		return
+	}
+	opened := map[string]bool{}
+	managedRepos.Range(func(key, value interface{}) bool {
+		m := value.(*managedRepository)
+		repos = append(repos, newAdminRepoInfo(m))
+		opened[m.localDiskPath] = true
+		return true
+	})
+	// Include the repositories that are cached on the disk but not opened
+	// since the server started.
+	cached, err := listCachedRepositories(s.config)
+	if err != nil {
+		writeAdminError(w, status.Errorf(codes.Internal, "%v", err))
+		return
+	}
+	for _, c := range cached {
+		if opened[c.localDiskPath] {
+			continue
+		}
+		repos = append(repos, &adminRepoInfo{
+			Tenant:               cachedRepositoryTenant(s.config, c),
+			UpstreamURL:          c.upstreamURL.String(),
+			LastUpdateTime:       lastFetchTime(c.localDiskPath),
+			FetchFreshnessWindow: fetchFreshnessWindow(s.config, c.upstreamURL).String(),
+			DiskUsageBytes:       diskUsage(c.localDiskPath),
+		})
+	}
+	writeRepoInfos(w, repos)
+}
+
+type adminRepoStats struct {
+	Tenant      string `json:"tenant,omitempty"`
+	UpstreamURL string `json:"upstream_url"`
+	cacheStats
+}
+
+type adminCacheStats struct {
+	Total        cacheStats        `json:"total"`
+	Repositories []*adminRepoStats `json:"repositories"`
+}
+
+// statsHandler shows the cache hits and misses of the repositories opened
+// since the server started, and their total.
+func (s *adminServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	resp := &adminCacheStats{Repositories: []*adminRepoStats{}}
+	managedRepos.Range(func(key, value interface{}) bool {
+		m := value.(*managedRepository)
+		st := &adminRepoStats{
+			Tenant:      m.tenant,
+			UpstreamURL: m.upstreamURL.String(),
+			cacheStats:  m.currentCacheStats(),
+		}
+		resp.Total.add(&st.cacheStats)
+		resp.Repositories = append(resp.Repositories, st)
+		return true
+	})
+	sort.Slice(resp.Repositories, func(i, j int) bool {
+		a, b := resp.Repositories[i], resp.Repositories[j]
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		return a.UpstreamURL < b.UpstreamURL
+	})
+	writeJSON(w, resp)
+}
+
+// refreshHandler fetches the repository from the upstream immediately. The
+// repository is cached if it's not yet.
+func (s *adminServer) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := s.canonicalURLParam(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" {
+		if err := validateTenant(tenant); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+	}
+	m, err := openManagedRepository(s.config, tenant, u)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if err := m.fetchUpstream(); err != nil {
+		writeAdminError(w, status.Errorf(codes.Unavailable, "cannot fetch the repository: %v", err))
+		return
+	}
+	writeJSON(w, newAdminRepoInfo(m))
+}
+
+// repoOverridesHandler shows the RepoOverrides on GET, and replaces them on
+// PUT. The replaced ones are effective until the next reload.
+func (s *adminServer) repoOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var entries []*adminRepoOverride
+		if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+			writeAdminError(w, status.Errorf(codes.InvalidArgument, "cannot parse the repository overrides: %v", err))
+			return
+		}
+		overrides := []*RepoOverride{}
+		for _, e := range entries {
+			o := &RepoOverride{Pattern: e.Pattern, ObjectPool: e.ObjectPool}
+			if e.FetchFreshnessWindow != "" {
+				d, err := time.ParseDuration(e.FetchFreshnessWindow)
+				if err != nil {
+					writeAdminError(w, status.Errorf(codes.InvalidArgument, "cannot parse the fetch freshness window of %q: %v", e.Pattern, err))
+					return
+				}
+				o.FetchFreshnessWindow = d
+			}
+			overrides = append(overrides, o)
+		}
+		if err := SetRepoOverrides(s.config, overrides); err != nil {
+			writeAdminError(w, status.Errorf(codes.InvalidArgument, "%v", err))
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.config.settingsMu.RLock()
+	overrides := s.config.RepoOverrides
+	s.config.settingsMu.RUnlock()
+	entries := []*adminRepoOverride{}
+	for _, o := range overrides {
+		e := &adminRepoOverride{Pattern: o.Pattern, ObjectPool: o.ObjectPool}
+		if o.FetchFreshnessWindow != 0 {
+			e.FetchFreshnessWindow = o.FetchFreshnessWindow.String()
+		}
+		entries = append(entries, e)
+	}
+	writeJSON(w, entries)
+}
+
+// warmReposHandler shows the WarmRepositories on GET, and replaces them on
+// PUT. The new list is warmed up in the background. The replaced ones are
+// effective until the next reload.
+func (s *adminServer) warmReposHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var urls []string
+		if err := json.NewDecoder(r.Body).Decode(&urls); err != nil {
+			writeAdminError(w, status.Errorf(codes.InvalidArgument, "cannot parse the warm repositories: %v", err))
+			return
+		}
+		if urls == nil {
+			urls = []string{}
+		}
+		if err := SetWarmRepositories(s.config, urls); err != nil {
+			writeAdminError(w, status.Errorf(codes.InvalidArgument, "%v", err))
+			return
+		}
+		go WarmUpRepositories(s.config)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.config.settingsMu.RLock()
+	urls := s.config.WarmRepositories
+	s.config.settingsMu.RUnlock()
+	if urls == nil {
+		urls = []string{}
+	}
+	writeJSON(w, urls)
+}
+
+// reloadHandler reloads the settings with SettingsReloader.
+func (s *adminServer) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config.SettingsReloader == nil {
+		writeAdminError(w, status.Error(codes.Unimplemented, "reloading the settings is not enabled"))
+		return
+	}
+	if err := s.config.SettingsReloader(); err != nil {
+		writeAdminError(w, status.Errorf(codes.FailedPrecondition, "cannot reload the settings: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// rebalanceHandler moves the cached repositories to the cache roots they
+// belong to. The removed_root parameters specify the roots no longer in use.
+// See RebalanceCacheShards.
+func (s *adminServer) rebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := RebalanceCacheShards(s.config, r.URL.Query()["removed_root"]); err != nil {
+		writeAdminError(w, status.Errorf(codes.Internal, "%v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+func (s *adminServer) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := s.canonicalURLParam(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	drained := drainRepositories(u)
+	if len(drained) == 0 {
+		writeAdminError(w, status.Errorf(codes.NotFound, "no managed repository for %s", u))
+		return
+	}
+	repos := []*adminRepoInfo{}
+	for _, m := range drained {
+		repos = append(repos, newAdminRepoInfo(m))
+	}
+	writeRepoInfos(w, repos)
+}
+
+// evictHandler evicts the cached repository of the tenant, or of all tenants
+// if the tenant parameter is not given. This includes the repositories that
+// are not opened since the server started, and the ones cached before
+// ForceUpstreamHTTPS is enabled. The opened repositories are drained so that
+// their in-flight requests can complete.
+func (s *adminServer) evictHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	rawURL := r.URL.Query().Get("url")
+	if rawURL == "" {
+		writeAdminError(w, status.Error(codes.InvalidArgument, "url parameter is required"))
+		return
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		writeAdminError(w, status.Errorf(codes.InvalidArgument, "cannot parse the URL: %v", err))
+		return
+	}
+	if u, err = canonicalUpstreamURL(s.config, u); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	tenants, hasTenant := r.URL.Query()["tenant"]
+	tenant := ""
+	if hasTenant {
+		tenant = tenants[0]
+		if tenant != "" {
+			if err := validateTenant(tenant); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+		}
+	}
+
+	repos := []*adminRepoInfo{}
+	if !isLocalDiskStore(s.config) {
+		store := repositoryStore(s.config)
+		usage, err := store.Usage()
+		if err != nil {
+			writeAdminError(w, status.Errorf(codes.Internal, "%v", err))
+			return
+		}
+		for _, ru := range usage {
+			if upgradeUpstreamScheme(s.config, ru.UpstreamURL).String() != u.String() || (hasTenant && ru.Tenant != tenant) {
+				continue
+			}
+			if err := store.Evict(ru.Tenant, ru.UpstreamURL); err != nil {
+				writeAdminError(w, status.Errorf(codes.Internal, "%v", err))
+				return
+			}
+			repos = append(repos, &adminRepoInfo{
+				Tenant:               ru.Tenant,
+				UpstreamURL:          ru.UpstreamURL.String(),
+				LastUpdateTime:       ru.LastUpdateTime,
+				FetchFreshnessWindow: fetchFreshnessWindow(s.config, ru.UpstreamURL).String(),
+				DiskUsageBytes:       ru.Bytes,
+			})
+		}
+	} else {
+		cached, err := listCachedRepositories(s.config)
+		if err != nil {
+			writeAdminError(w, status.Errorf(codes.Internal, "%v", err))
+			return
+		}
+		for _, c := range cached {
+			cachedTenant := cachedRepositoryTenant(s.config, c)
+			if upgradeUpstreamScheme(s.config, c.upstreamURL).String() != u.String() || (hasTenant && cachedTenant != tenant) {
+				continue
+			}
+			if v, ok := managedRepos.Load(c.localDiskPath); ok {
+				m := v.(*managedRepository)
+				m.drain()
+				repos = append(repos, newAdminRepoInfo(m))
+				continue
+			}
+			info := &adminRepoInfo{
+				Tenant:               cachedTenant,
+				UpstreamURL:          c.upstreamURL.String(),
+				LastUpdateTime:       lastFetchTime(c.localDiskPath),
+				FetchFreshnessWindow: fetchFreshnessWindow(s.config, c.upstreamURL).String(),
+				DiskUsageBytes:       diskUsage(c.localDiskPath),
+			}
+			if err := evictListedRepository(s.config, c); err != nil {
+				writeAdminError(w, status.Errorf(codes.Internal, "%v", err))
+				return
+			}
+			repos = append(repos, info)
+		}
+	}
+	if len(repos) == 0 {
+		writeAdminError(w, status.Errorf(codes.NotFound, "no cached repository for %s", u))
+		return
+	}
+	writeRepoInfos(w, repos)
+}
+
+func newAdminRepoInfo(m *managedRepository) *adminRepoInfo {
+	info := &adminRepoInfo{
+		Tenant:               m.tenant,
+		UpstreamURL:          m.upstreamURL.String(),
+		LastUpdateTime:       m.LastUpdateTime(),
+		FetchFreshnessWindow: fetchFreshnessWindow(m.config, m.upstreamURL).String(),
+		DiskUsageBytes:       diskUsage(m.localDiskPath),
+		Opened:               true,
+		Draining:             m.isDraining(),
+	}
+	if info.LastUpdateTime.IsZero() {
+		// Not fetched since the server started.
+		info.LastUpdateTime = lastFetchTime(m.localDiskPath)
+	}
+	return info
+}
+
+// cachedRepositoryTenant returns the tenant of a cached repository from its
+// path, root/[tenant]/host/path.
+func cachedRepositoryTenant(config *ServerConfig, c *cachedRepository) string {
+	rel, err := filepath.Rel(c.root, c.localDiskPath)
+	if err != nil {
+		return ""
+	}
+	first := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	if first == c.upstreamURL.Host {
+		return ""
+	}
+	return first
+}
+
+// lastFetchTime returns the time of the last upstream fetch of a cached
+// repository, including the ones before the server started.
+func lastFetchTime(localDiskPath string) time.Time {
+	fi, err := os.Stat(filepath.Join(localDiskPath, "FETCH_HEAD"))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// diskUsage returns the total size of the files under the directory.
+func diskUsage(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The files can be removed by gc while walking.
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func writeRepoInfos(w http.ResponseWriter, repos []*adminRepoInfo) {
+	sort.Slice(repos, func(i, j int) bool {
+		if repos[i].Tenant != repos[j].Tenant {
+			return repos[i].Tenant < repos[j].Tenant
+		}
+		return repos[i].UpstreamURL < repos[j].UpstreamURL
+	})
+	writeJSON(w, repos)
+}
+
+// profileNextHandler arms a CPU profile for the next fetch of a repository,
+// and returns the profile and the trace of its git-upload-pack once the fetch
+// is served.
+func (s *adminServer) profileNextHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := s.canonicalURLParam(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	p := &profileRequest{upstreamURL: u.String(), done: make(chan profileResult, 1)}
+	armedProfileMu.Lock()
+	if armedProfile != nil {
+		armed := armedProfile.upstreamURL
+		armedProfileMu.Unlock()
+		writeAdminError(w, status.Errorf(codes.AlreadyExists, "a profile is already armed for %s", armed))
+		return
+	}
+	armedProfile = p
+	armedProfileMu.Unlock()
+
+	select {
+	case res := <-p.done:
+		if res.err != nil {
+			writeAdminError(w, status.Errorf(codes.Internal, "cannot take a CPU profile: %v", res.err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="goblet-profile.zip"`)
+		writeProfileArchive(w, res)
+	case <-r.Context().Done():
+		armedProfileMu.Lock()
+		if armedProfile == p {
+			armedProfile = nil
+		}
+		armedProfileMu.Unlock()
+	}
+}
+
+// writeProfileArchive writes the profile and the trace in a zip archive.
+func writeProfileArchive(w io.Writer, res profileResult) error {
+	zw := zip.NewWriter(w)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"cpu.pprof", res.profile},
+		{"git-trace2-perf.txt", res.trace},
+	} {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (s *adminServer) canonicalURLParam(r *http.Request) (*url.URL, error) {
+	rawURL := r.URL.Query().Get("url")
+	if rawURL == "" {
+		return nil, status.Error(codes.InvalidArgument, "url parameter is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot parse the URL: %v", err)
+	}
+	return canonicalizeURL(s.config, u)
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	code := codes.Internal
+	message := err.Error()
+	if st, ok := status.FromError(err); ok {
+		code = st.Code()
+		message = st.Message()
+	}
+	http.Error(w, message, runtime.HTTPStatusFromCode(code))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
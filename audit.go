@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+// AuditEvent is a record of a protocol v2 command that a client ran against a
+// repository, such as a fetch, for AuditLogger.
+type AuditEvent struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id,omitempty"`
+	ClientIdentity string    `json:"client_identity,omitempty"`
+	RemoteIP       string    `json:"remote_ip,omitempty"`
+	Tenant         string    `json:"tenant,omitempty"`
+	Repo           string    `json:"repo"`
+	Command        string    `json:"command"`
+
+	// RefPrefixes are the ref-prefix arguments of ls-refs.
+	RefPrefixes []string `json:"ref_prefixes,omitempty"`
+
+	// Wants and WantRefs are the commits and the refs that a fetch
+	// requested. Wants includes the commits that WantRefs resolved to.
+	Wants    []string `json:"wants,omitempty"`
+	WantRefs []string `json:"want_refs,omitempty"`
+
+	CacheState  string `json:"cache_state,omitempty"`
+	BytesServed int64  `json:"bytes_served"`
+
+	// Error is the error that the command failed with, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// NewJSONAuditLogger returns an AuditLogger that writes the events in JSON,
+// one event per line. Each line is written with a single Write call.
+func NewJSONAuditLogger(w io.Writer) func(*AuditEvent) {
+	return func(e *AuditEvent) {
+		bs, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Cannot encode an audit log entry: %v", err)
+			return
+		}
+		if _, err := w.Write(append(bs, '\n')); err != nil {
+			log.Printf("Cannot write an audit log entry: %v", err)
+		}
+	}
+}
+
+// newAuditEvent returns the AuditEvent of the command, with the client
+// recorded in requestInfo.
+func newAuditEvent(ctx context.Context, tenant string, u *url.URL, command []*gitprotocolio.ProtocolV2RequestChunk) *AuditEvent {
+	info := requestInfoFromContext(ctx)
+	e := &AuditEvent{
+		Time:           time.Now(),
+		RequestID:      info.requestID,
+		ClientIdentity: info.clientIdentity,
+		RemoteIP:       info.remoteAddr,
+		Tenant:         tenant,
+		Repo:           u.String(),
+		Command:        command[0].Command,
+	}
+	for _, ch := range command {
+		if ch.Argument == nil {
+			continue
+		}
+		s := strings.TrimSpace(string(ch.Argument))
+		switch {
+		case strings.HasPrefix(s, "ref-prefix "):
+			e.RefPrefixes = append(e.RefPrefixes, strings.TrimPrefix(s, "ref-prefix "))
+		case strings.HasPrefix(s, "want "):
+			e.Wants = append(e.Wants, strings.TrimPrefix(s, "want "))
+		case strings.HasPrefix(s, "want-ref "):
+			e.WantRefs = append(e.WantRefs, strings.TrimPrefix(s, "want-ref "))
+		}
+	}
+	return e
+}
+
+// auditWriter counts the bytes written to the client for AuditEvent.
+type auditWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// auditErrorReporter sends the AuditEvent of the command to AuditLogger when
+// the command finishes.
+type auditErrorReporter struct {
+	gitProtocolErrorReporter
+	logger func(*AuditEvent)
+	event  *AuditEvent
+	w      *auditWriter
+	done   bool
+}
+
+func (r *auditErrorReporter) reportError(ctx context.Context, startTime time.Time, err error) {
+	r.gitProtocolErrorReporter.reportError(ctx, startTime, err)
+	if r.done {
+		return
+	}
+	r.done = true
+	r.event.CacheState = requestInfoFromContext(ctx).cacheState
+	r.event.BytesServed = r.w.n
+	if err != nil {
+		r.event.Error = err.Error()
+	}
+	r.logger(r.event)
+}
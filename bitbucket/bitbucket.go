@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bitbucket
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/google/goblet"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// CloudHost is the host of Bitbucket Cloud.
+	CloudHost = "bitbucket.org"
+
+	// cloudAccessTokenUser is the username for the repository, project,
+	// and workspace access tokens of Bitbucket Cloud.
+	cloudAccessTokenUser = "x-token-auth"
+)
+
+// NewPasswordTokenSource returns a TokenSource that authenticates as user with
+// password. This is an app password for Bitbucket Cloud, and a password or a
+// personal access token for Bitbucket Server.
+func NewPasswordTokenSource(user, password string) oauth2.TokenSource {
+	return oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: base64.StdEncoding.EncodeToString([]byte(user + ":" + password)),
+		TokenType:   "Basic",
+	})
+}
+
+// NewCloudAccessTokenSource returns a TokenSource that authenticates with a
+// repository, project, or workspace access token of Bitbucket Cloud.
+func NewCloudAccessTokenSource(token string) oauth2.TokenSource {
+	return NewPasswordTokenSource(cloudAccessTokenUser, token)
+}
+
+// NewServerAccessTokenSource returns a TokenSource that authenticates with an
+// HTTP access token of Bitbucket Server or Data Center.
+func NewServerAccessTokenSource(token string) oauth2.TokenSource {
+	return oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: token,
+		TokenType:   "Bearer",
+	})
+}
+
+// NewCloudURLCanonicalizer returns a URLCanonializer for the repositories on
+// Bitbucket Cloud. The canonical URLs are
+// https://bitbucket.org/<workspace>/<repo> in lower case, as Bitbucket Cloud
+// is case-insensitive for them.
+func NewCloudURLCanonicalizer() func(*url.URL) (*url.URL, error) {
+	return func(u *url.URL) (*url.URL, error) {
+		if !strings.EqualFold(u.Host, CloudHost) {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported host: %s", u.Host)
+		}
+		ss, err := goblet.SplitRepositoryPath(u.Path)
+		if err != nil || len(ss) != 2 {
+			return nil, status.Errorf(codes.InvalidArgument, "not a repository URL: %s", u)
+		}
+		return &url.URL{
+			Scheme: "https",
+			Host:   CloudHost,
+			Path:   "/" + strings.ToLower(strings.Join(ss, "/")),
+		}, nil
+	}
+}
+
+// NewServerURLCanonicalizer returns a URLCanonializer for the repositories on
+// the Bitbucket Server or Data Center at host. The canonical URLs are
+// https://<host>/scm/<project>/<repo> in lower case, as the project keys and
+// the repository slugs are case-insensitive. The personal repositories are
+// https://<host>/scm/~<user>/<repo>.
+func NewServerURLCanonicalizer(host string) func(*url.URL) (*url.URL, error) {
+	return func(u *url.URL) (*url.URL, error) {
+		if !strings.EqualFold(u.Host, host) {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported host: %s", u.Host)
+		}
+		ss, err := goblet.SplitRepositoryPath(u.Path)
+		if err != nil || len(ss) != 3 || ss[0] != "scm" {
+			return nil, status.Errorf(codes.InvalidArgument, "not a repository URL: %s", u)
+		}
+		return &url.URL{
+			Scheme: "https",
+			Host:   strings.ToLower(host),
+			Path:   "/" + strings.ToLower(strings.Join(ss, "/")),
+		}, nil
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+)
+
+// UpdateBlockedRepos replaces the BlockedRepos of the config and evicts the
+// cached repositories that are blocked by the new patterns. This is safe to
+// call while the server is running.
+func UpdateBlockedRepos(config *ServerConfig, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid blocked repository pattern %q: %v", p, err)
+		}
+	}
+	config.blockedReposMu.Lock()
+	config.BlockedRepos = append([]string{}, patterns...)
+	config.blockedReposMu.Unlock()
+	return EvictBlockedRepositories(config)
+}
+
+// UpdateAllowedRepos replaces the AllowedRepos of the config and evicts the
+// cached repositories that are not allowed by the new patterns. This is safe
+// to call while the server is running.
+func UpdateAllowedRepos(config *ServerConfig, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid allowed repository pattern %q: %v", p, err)
+		}
+	}
+	config.blockedReposMu.Lock()
+	config.AllowedRepos = append([]string{}, patterns...)
+	config.blockedReposMu.Unlock()
+	return EvictBlockedRepositories(config)
+}
+
+// EvictBlockedRepositories removes the cached repositories that are blocked
+// by BlockedRepos or not allowed by AllowedRepos from the cache roots.
+func EvictBlockedRepositories(config *ServerConfig) error {
+	defer StartEvictionPass()()
+
+	repos, err := listCachedRepositories(config)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if !isBlockedRepo(config, repo.upstreamURL) {
+			continue
+		}
+		if err := evictListedRepository(config, repo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBlockedRepo returns true if the canonical URL matches with BlockedRepos,
+// or AllowedRepos is set and the URL matches with none of them.
+func isBlockedRepo(config *ServerConfig, u *url.URL) bool {
+	config.blockedReposMu.RLock()
+	defer config.blockedReposMu.RUnlock()
+	for _, p := range config.BlockedRepos {
+		if matchRepoPattern(p, u) {
+			return true
+		}
+	}
+	if len(config.AllowedRepos) == 0 {
+		return false
+	}
+	for _, p := range config.AllowedRepos {
+		if matchRepoPattern(p, u) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// bundlePathSuffix is the path of the bundle of a repository on this
+	// server, relative to the repository URL.
+	bundlePathSuffix = "/info/goblet-bundle"
+
+	defaultBundleMaxAge = 24 * time.Hour
+)
+
+// bundleBaseURLKey is the context key of the URL of the repository on this
+// server that the bundle URIs are relative to.
+type bundleBaseURLKey struct{}
+
+// isBundleRequest returns true if the request is for the bundle of a
+// repository.
+func isBundleRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, bundlePathSuffix)
+}
+
+// bundleRepositoryURL returns the repository URL of a bundle URL.
+func bundleRepositoryURL(u *url.URL) *url.URL {
+	ret := *u
+	ret.Path = strings.TrimSuffix(ret.Path, bundlePathSuffix)
+	ret.RawPath = ""
+	ret.RawQuery = ""
+	return &ret
+}
+
+// bundleBaseURL returns the URL of the repository of the request on this
+// server, or an empty string for the requests of the SSH and the git://
+// clients.
+func bundleBaseURL(config *ServerConfig, r *http.Request) string {
+	if streamSessionFromContext(r.Context()) != nil {
+		return ""
+	}
+	p := TrimGitHTTPEndpoint(r.URL.Path)
+	if config.BundleBaseURL != "" {
+		return strings.TrimSuffix(config.BundleBaseURL, "/") + p
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: p}
+	return u.String()
+}
+
+func (r *managedRepository) bundlePath() string {
+	return filepath.Join(r.config.BundleRoot, r.tenant, r.upstreamURL.Host, r.upstreamURL.Path) + ".bundle"
+}
+
+func bundleMaxAge(config *ServerConfig) time.Duration {
+	if config.BundleMaxAge > 0 {
+		return config.BundleMaxAge
+	}
+	return defaultBundleMaxAge
+}
+
+// refreshBundle regenerates the bundle of the repository if it doesn't exist
+// or is older than BundleMaxAge. Only one runs at a time per repository.
+func (r *managedRepository) refreshBundle() (err error) {
+	if r.config.BundleRoot == "" {
+		return nil
+	}
+	if fi, err := os.Stat(r.bundlePath()); err == nil && time.Since(fi.ModTime()) < bundleMaxAge(r.config) {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&r.bundling, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&r.bundling, 0)
+
+	op := r.startOperation("CreateBundleURI")
+	defer func() {
+		op.Done(err)
+	}()
+	refs, err := r.listLocalRefs(op)
+	if err != nil {
+		return err
+	}
+	// The hidden refs must not be downloadable.
+	args := []string{"bundle", "create"}
+	var refNames []string
+	for refName := range refs {
+		if !isHiddenRef(r.config, refName) {
+			refNames = append(refNames, refName)
+		}
+	}
+	if len(refNames) == 0 {
+		// Git refuses to create an empty bundle.
+		return nil
+	}
+	sort.Strings(refNames)
+
+	p := r.bundlePath()
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	r.mu.RLock()
+	err = runGit(op, r.localDiskPath, append(append(args, f.Name()), refNames...)...)
+	r.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// handleBundleURICommand writes the bundle list of the bundle-uri command. The
+// list is empty if the bundle is not generated yet.
+func handleBundleURICommand(ctx context.Context, repo *managedRepository, w io.Writer) error {
+	if repo.config.BundleRoot == "" {
+		return writePacket(w, gitprotocolio.FlushPacket{})
+	}
+	base, _ := ctx.Value(bundleBaseURLKey{}).(string)
+	if _, err := os.Stat(repo.bundlePath()); err == nil && base != "" {
+		for _, line := range []string{
+			"bundle.version=1",
+			"bundle.mode=all",
+			"bundle.goblet.uri=" + base + bundlePathSuffix,
+		} {
+			if err := writePacket(w, gitprotocolio.BytesPacket(line+"\n")); err != nil {
+				return err
+			}
+		}
+	} else {
+		go repo.refreshBundle()
+	}
+	return writePacket(w, gitprotocolio.FlushPacket{})
+}
+
+// bundleHandler serves the bundle of a repository.
+func (s *httpProxyServer) bundleHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, tenant string) {
+	repo, err := openManagedRepository(s.config, tenant, bundleRepositoryURL(r.URL))
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	f, err := os.Open(repo.bundlePath())
+	if os.IsNotExist(err) {
+		reporter.reportError(status.Error(codes.NotFound, "the bundle is not generated yet"))
+		return
+	} else if err != nil {
+		reporter.reportError(status.Errorf(codes.Internal, "cannot open the bundle: %v", err))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.Internal, "cannot open the bundle: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
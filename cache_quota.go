@@ -0,0 +1,113 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.opencensus.io/stats"
+)
+
+// cachedRepositoryUsage is the disk usage of a cached repository.
+type cachedRepositoryUsage struct {
+	*cachedRepository
+	size     int64
+	lastUsed time.Time
+}
+
+// EnforceCacheQuota removes the least recently fetched repositories from the
+// cache roots until their size, including the object pools, is within
+// MaxCacheBytes, and repacks the rest so that their redundant packs and loose
+// objects don't take the space again. The object pools that no repository
+// borrows the objects from are removed. This does nothing if MaxCacheBytes is
+// zero.
+func EnforceCacheQuota(config *ServerConfig) error {
+	if config.MaxCacheBytes <= 0 {
+		return nil
+	}
+	repos, err := listCachedRepositories(config)
+	if err != nil {
+		return err
+	}
+	usages := make([]*cachedRepositoryUsage, 0, len(repos))
+	var total int64
+	for _, repo := range repos {
+		u := cachedRepositoryUsage{
+			cachedRepository: repo,
+			size:             diskUsage(repo.localDiskPath),
+			lastUsed:         lastUseTime(repo.localDiskPath),
+		}
+		usages = append(usages, &u)
+		total += u.size
+	}
+	poolSize, err := pruneObjectPools(config, repos)
+	if err != nil {
+		return err
+	}
+	total += poolSize
+	stats.Record(context.Background(), CacheBytes.M(total))
+	if total <= config.MaxCacheBytes {
+		return nil
+	}
+
+	defer StartEvictionPass()()
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].lastUsed.Before(usages[j].lastUsed)
+	})
+	for len(usages) != 0 && total > config.MaxCacheBytes {
+		for len(usages) != 0 && total > config.MaxCacheBytes {
+			if err := evictListedRepository(config, usages[0].cachedRepository); err != nil {
+				return err
+			}
+			stats.Record(context.Background(), CacheEvictionCount.M(1))
+			total -= usages[0].size
+			usages = usages[1:]
+		}
+		// An object pool is freed only after all of its members
+		// are evicted.
+		rest := make([]*cachedRepository, 0, len(usages))
+		for _, u := range usages {
+			rest = append(rest, u.cachedRepository)
+		}
+		newPoolSize, err := pruneObjectPools(config, rest)
+		if err != nil {
+			return err
+		}
+		total += newPoolSize - poolSize
+		poolSize = newPoolSize
+	}
+	for _, u := range usages {
+		if err := repackCachedRepository(u.localDiskPath); err != nil {
+			return err
+		}
+	}
+	stats.Record(context.Background(), CacheBytes.M(total))
+	return nil
+}
+
+// repackCachedRepository packs the objects of a cached repository into one
+// pack. If the repository is being fetched, this waits for the fetch to
+// finish.
+func repackCachedRepository(localDiskPath string) error {
+	if v, ok := managedRepos.Load(localDiskPath); ok {
+		m := v.(*managedRepository)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		defer m.invalidateSnapshot()
+	}
+	return runGit(noopOperation{}, localDiskPath, "repack", "-a", "-d", "-q")
+}
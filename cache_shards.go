@@ -0,0 +1,188 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// cacheRoots returns the directories that the cached repositories are spread
+// across.
+func cacheRoots(config *ServerConfig) []string {
+	return append([]string{config.LocalDiskCacheRoot}, config.CacheShardRoots...)
+}
+
+// cacheRoot returns the directory that the cached repository at the relative
+// path, <tenant>/<host>/<path>, belongs to. This uses rendezvous hashing so
+// that adding a root moves only the repositories that the new root takes, and
+// removing a root moves only the ones that it had.
+func cacheRoot(config *ServerConfig, rel string) string {
+	roots := cacheRoots(config)
+	best := roots[0]
+	var bestScore uint64
+	for i, root := range roots {
+		sum := sha256.Sum256([]byte(root + "\x00" + filepath.ToSlash(rel)))
+		if score := binary.BigEndian.Uint64(sum[:8]); i == 0 || score > bestScore {
+			best, bestScore = root, score
+		}
+	}
+	return best
+}
+
+// cachedRepositoryPath returns the path of the cached repository at the
+// relative path, <tenant>/<host>/<path>.
+func cachedRepositoryPath(config *ServerConfig, rel string) string {
+	return filepath.Join(cacheRoot(config, rel), rel)
+}
+
+// RebalanceCacheShards moves the cached repositories that are not in the
+// cache root they belong to, such as after CacheShardRoots is changed.
+// removedRoots are the roots no longer in use, and their repositories are
+// moved to the current roots. A repository is removed instead if it's already
+// cached in the right root. The requests for a repository wait for its move
+// to finish.
+func RebalanceCacheShards(config *ServerConfig, removedRoots []string) error {
+	repos, err := listCachedRepositories(config)
+	if err != nil {
+		return err
+	}
+	for _, root := range removedRoots {
+		rs, err := listCachedRepositoriesIn(root)
+		if err != nil {
+			return err
+		}
+		repos = append(repos, rs...)
+	}
+	for _, repo := range repos {
+		rel, err := filepath.Rel(repo.root, repo.localDiskPath)
+		if err != nil {
+			return err
+		}
+		to := cachedRepositoryPath(config, rel)
+		if to == repo.localDiskPath {
+			continue
+		}
+		if err := moveCachedRepository(config, repo, to); err != nil {
+			return fmt.Errorf("cannot move %s to %s: %v", repo.localDiskPath, to, err)
+		}
+	}
+	return nil
+}
+
+func moveCachedRepository(config *ServerConfig, repo *cachedRepository, to string) error {
+	// Hold the destination so that the requests don't create it while the
+	// repository is moved.
+	dst := getManagedRepo(to, cachedRepositoryTenant(config, repo), repo.upstreamURL, config)
+	dst.initMu.Lock()
+	defer dst.initMu.Unlock()
+	if config.CrossProcessLocking {
+		unlock, err := lockRepositoryFile(noopOperation{}, to)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if _, err := os.Stat(to); err == nil {
+		return evictCachedRepository(config, repo.localDiskPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if v, ok := managedRepos.Load(repo.localDiskPath); ok {
+		m := v.(*managedRepository)
+		m.initMu.Lock()
+		defer m.initMu.Unlock()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		managedRepos.Delete(repo.localDiskPath)
+	}
+	if config.CrossProcessLocking {
+		unlock, err := lockRepositoryFile(noopOperation{}, repo.localDiskPath)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0750); err != nil {
+		return err
+	}
+	if err := os.Rename(repo.localDiskPath, to); err == nil {
+		return nil
+	}
+
+	// The roots are usually on different devices. Copy the repository to a
+	// temporary directory next to the destination so that it appears
+	// atomically.
+	tmp, err := ioutil.TempDir(filepath.Dir(to), filepath.Base(to))
+	if err != nil {
+		return err
+	}
+	if err := copyDir(repo.localDiskPath, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, to); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.RemoveAll(repo.localDiskPath)
+}
+
+// copyDir copies the files under src to dst, which must exist.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
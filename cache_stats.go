@@ -0,0 +1,125 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaxRepositoryTagValues = 100
+
+	// otherRepositoryTagValue is the RepositoryKey value for the
+	// repositories over MaxRepositoryTagValues.
+	otherRepositoryTagValue = "other"
+)
+
+var (
+	// repositoryTagValues is the set of the upstream URLs that are used as
+	// RepositoryKey values.
+	repositoryTagValues   = map[string]bool{}
+	repositoryTagValuesMu sync.Mutex
+)
+
+// repositoryTagValue returns the RepositoryKey value for the upstream URL.
+// The URL is canonicalized without the credentials, the query, the trailing
+// slash, and the ".git" suffix, so that the variants of a repository share
+// a value. The first MaxRepositoryTagValues repositories are used as is, and
+// the others are aggregated as "other".
+func repositoryTagValue(config *ServerConfig, u *url.URL) string {
+	limit := config.MaxRepositoryTagValues
+	if limit == 0 {
+		limit = defaultMaxRepositoryTagValues
+	}
+
+	repositoryTagValuesMu.Lock()
+	defer repositoryTagValuesMu.Unlock()
+	s := (&url.URL{
+		Scheme: u.Scheme,
+		Host:   strings.ToLower(u.Host),
+		Path:   strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git"),
+	}).String()
+	if repositoryTagValues[s] {
+		return s
+	}
+	if len(repositoryTagValues) >= limit {
+		return otherRepositoryTagValue
+	}
+	repositoryTagValues[s] = true
+	return s
+}
+
+// cacheStats counts the commands served for a repository by their
+// CommandCacheStateKey value. The hits are served without querying the
+// upstream, including the ones served stale while the upstream is
+// unavailable. The stale hits query the upstream as the cache is not fresh, and
+// the cache turns out to be up to date. The misses wait for the upstream. The
+// bytes are the sizes of the fetch responses.
+type cacheStats struct {
+	Hits          int64 `json:"hits"`
+	StaleHits     int64 `json:"stale_hits"`
+	Misses        int64 `json:"misses"`
+	HitBytes      int64 `json:"hit_bytes"`
+	StaleHitBytes int64 `json:"stale_hit_bytes"`
+	MissBytes     int64 `json:"miss_bytes"`
+}
+
+func (s *cacheStats) add(o *cacheStats) {
+	s.Hits += o.Hits
+	s.StaleHits += o.StaleHits
+	s.Misses += o.Misses
+	s.HitBytes += o.HitBytes
+	s.StaleHitBytes += o.StaleHitBytes
+	s.MissBytes += o.MissBytes
+}
+
+// recordCacheStats counts a command served in the cache state with the
+// response of the size.
+func (r *managedRepository) recordCacheStats(state string, bytes int64) {
+	r.cacheStatsMu.Lock()
+	defer r.cacheStatsMu.Unlock()
+	switch state {
+	case "locally-served", "served-stale":
+		r.cacheStats.Hits++
+		r.cacheStats.HitBytes += bytes
+	case "revalidated":
+		r.cacheStats.StaleHits++
+		r.cacheStats.StaleHitBytes += bytes
+	case "queried-upstream":
+		r.cacheStats.Misses++
+		r.cacheStats.MissBytes += bytes
+	}
+}
+
+func (r *managedRepository) currentCacheStats() cacheStats {
+	r.cacheStatsMu.Lock()
+	defer r.cacheStatsMu.Unlock()
+	return r.cacheStats
+}
+
+// byteCountingWriter counts the bytes written to w.
+type byteCountingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *byteCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
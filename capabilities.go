@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"strings"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// coreCommandArguments are the command arguments that are always allowed.
+var coreCommandArguments = map[string]bool{
+	"want":       true,
+	"have":       true,
+	"done":       true,
+	"ref-prefix": true,
+}
+
+// fetchArgumentFeatures maps the fetch arguments to the fetch features that
+// allow them. The "shallow" feature covers all the shallow and the deepen
+// arguments, and "ref-in-want" covers "want-ref".
+var fetchArgumentFeatures = map[string]string{
+	"shallow":         "shallow",
+	"deepen":          "shallow",
+	"deepen-since":    "shallow",
+	"deepen-not":      "shallow",
+	"deepen-relative": "shallow",
+	"filter":          "filter",
+	"want-ref":        "ref-in-want",
+}
+
+// capabilityName returns the name of a capability or a command argument,
+// e.g. "agent" for "agent=git/2.x" and "filter" for "filter blob:none".
+func capabilityName(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, "= "); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+func isAllowedClientCapability(config *ServerConfig, name string) bool {
+	config.settingsMu.RLock()
+	defer config.settingsMu.RUnlock()
+	if config.AllowedClientCapabilities == nil {
+		return true
+	}
+	for _, c := range config.AllowedClientCapabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// filterClientCapabilities strips the capabilities that are not in
+// AllowedClientCapabilities from the commands, and rejects the commands with
+// such arguments.
+func filterClientCapabilities(config *ServerConfig, commands [][]*gitprotocolio.ProtocolV2RequestChunk) ([][]*gitprotocolio.ProtocolV2RequestChunk, error) {
+	config.settingsMu.RLock()
+	allowAll := config.AllowedClientCapabilities == nil
+	config.settingsMu.RUnlock()
+	if allowAll {
+		return commands, nil
+	}
+	ret := [][]*gitprotocolio.ProtocolV2RequestChunk{}
+	for _, command := range commands {
+		chunks := []*gitprotocolio.ProtocolV2RequestChunk{}
+		for _, c := range command {
+			if c.Capability != "" && !isAllowedClientCapability(config, capabilityName(c.Capability)) {
+				continue
+			}
+			if c.Argument != nil {
+				name := capabilityName(string(c.Argument))
+				allowedBy := name
+				if f, ok := fetchArgumentFeatures[name]; ok && command[0].Command == "fetch" {
+					allowedBy = f
+				}
+				if !coreCommandArguments[name] && !isAllowedClientCapability(config, allowedBy) {
+					return nil, status.Errorf(codes.InvalidArgument, "%s %s is not allowed", command[0].Command, name)
+				}
+			}
+			chunks = append(chunks, c)
+		}
+		ret = append(ret, chunks)
+	}
+	return ret, nil
+}
+
+// advertisedFetchFeatures returns the fetch features to advertise.
+func advertisedFetchFeatures(config *ServerConfig) string {
+	features := []string{}
+	for _, f := range []string{"filter", "shallow", "ref-in-want"} {
+		if isAllowedClientCapability(config, f) {
+			features = append(features, f)
+		}
+	}
+	if config.PackfileURIUploader != nil && isAllowedClientCapability(config, "packfile-uris") {
+		features = append(features, "packfile-uris")
+	}
+	if len(features) == 0 {
+		return "fetch"
+	}
+	return "fetch=" + strings.Join(features, " ")
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+)
+
+const (
+	// circuitWindow is the duration over which the error rate of an
+	// upstream host is measured.
+	circuitWindow = time.Minute
+
+	defaultCircuitMinRequests  = 5
+	defaultCircuitOpenDuration = 30 * time.Second
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreakers are the circuit breakers of the upstream hosts.
+type circuitBreakers struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func (c *circuitBreakers) get(host string) *circuitBreaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.breakers == nil {
+		c.breakers = map[string]*circuitBreaker{}
+	}
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &circuitBreaker{host: host}
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// circuitBreaker stops sending the operations to an upstream host while it's
+// down. The circuit opens when CircuitErrorRate of the operations in
+// circuitWindow fail transiently, and the operations fail fast while it's
+// open. After CircuitOpenDuration, the circuit is half-open, and a single
+// operation is let through to probe the host. The circuit closes if the probe
+// succeeds, and opens again otherwise.
+type circuitBreaker struct {
+	host string
+
+	mu          sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+// allow returns an error if the operation must not be sent to the upstream.
+// Call done with the result of an allowed operation.
+func (b *circuitBreaker) allow(config *ServerConfig) error {
+	if config.CircuitErrorRate <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		openDuration := config.CircuitOpenDuration
+		if openDuration <= 0 {
+			openDuration = defaultCircuitOpenDuration
+		}
+		if time.Since(b.openedAt) < openDuration {
+			return b.openError()
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return nil
+	case circuitHalfOpen:
+		if b.probing {
+			return b.openError()
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the result of an operation allowed by allow. failed is true if
+// the operation failed transiently.
+func (b *circuitBreaker) done(config *ServerConfig, failed bool) {
+	if config.CircuitErrorRate <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing = false
+		if failed {
+			b.open(now)
+			return
+		}
+		b.state = circuitClosed
+		b.windowStart, b.requests, b.failures = now, 0, 0
+		return
+	case circuitOpen:
+		// Allowed before the circuit opened.
+		return
+	}
+
+	if now.Sub(b.windowStart) > circuitWindow {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	minRequests := config.CircuitMinRequests
+	if minRequests <= 0 {
+		minRequests = defaultCircuitMinRequests
+	}
+	if b.requests >= minRequests && float64(b.failures) >= config.CircuitErrorRate*float64(b.requests) {
+		b.open(now)
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = circuitOpen
+	b.openedAt = now
+	stats.Record(context.Background(), UpstreamCircuitOpenCount.M(1))
+}
+
+// openError returns the error of the operations rejected while the circuit is
+// open. The clients are asked to retry later.
+func (b *circuitBreaker) openError() error {
+	return &saturationError{fmt.Sprintf("the upstream %s is unavailable", b.host), ErrorCategoryUpstreamUnavailable}
+}
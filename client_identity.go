@@ -0,0 +1,35 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/http"
+)
+
+// ClientIdentity returns the identity of the verified TLS client certificate
+// of the request, or an empty string if there's none. This is the first URI
+// SAN of the certificate, such as a SPIFFE ID, if any, or its subject
+// otherwise. Use this in RequestAuthorizer to authorize the clients by their
+// certificates.
+func ClientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(cert.URIs) != 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.String()
+}
@@ -0,0 +1,217 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// clusterVirtualNodes is the number of the points of a replica on the
+	// hash ring. The more points, the more even the repositories are
+	// spread over the replicas.
+	clusterVirtualNodes = 128
+
+	// clusterForwardedHeader marks the requests forwarded to the owner
+	// replica so that they are not forwarded again even if the replicas
+	// disagree on the owner, such as while the replicas are reconfigured.
+	clusterForwardedHeader = "Goblet-Cluster-Forwarded"
+
+	// clusterClientHeader carries the client of a forwarded request, and
+	// clusterSignatureHeader its signature with ClusterSecret.
+	clusterClientHeader    = "Goblet-Cluster-Client"
+	clusterSignatureHeader = "Goblet-Cluster-Signature"
+
+	// clusterClientMaxAge is how long a signed client is accepted after
+	// the request is forwarded.
+	clusterClientMaxAge = time.Minute
+)
+
+// clusterHopKey is the context key of the clusterHop of the requests
+// forwarded by another replica.
+type clusterHopKey struct{}
+
+// clusterHop is the client of a request forwarded by another replica, which
+// has authorized and rate-limited it.
+type clusterHop struct {
+	identity string
+}
+
+// clusterHopFromContext returns the clusterHop of the request, or nil if it's
+// not forwarded by another replica with a valid signature.
+func clusterHopFromContext(ctx context.Context) *clusterHop {
+	h, _ := ctx.Value(clusterHopKey{}).(*clusterHop)
+	return h
+}
+
+// hashRing is a consistent hash ring of the replicas. Adding or removing a
+// replica only moves the repositories owned by it.
+type hashRing struct {
+	points   []uint64
+	replicas map[uint64]string
+}
+
+func newHashRing(replicas []string) *hashRing {
+	r := &hashRing{replicas: map[uint64]string{}}
+	for _, replica := range replicas {
+		for i := 0; i < clusterVirtualNodes; i++ {
+			p := hashKey(replica + "#" + strconv.Itoa(i))
+			r.points = append(r.points, p)
+			r.replicas[p] = replica
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner returns the replica that owns the key, which is the first one on the
+// ring at or after the hash of the key.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.replicas[r.points[i]]
+}
+
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// clusterOwner returns the base URL of the replica that owns the canonical
+// upstream URL, or "" if it's this replica or the cluster mode is disabled.
+func clusterOwner(config *ServerConfig, u *url.URL) string {
+	if len(config.ClusterReplicas) == 0 {
+		return ""
+	}
+	config.clusterRingOnce.Do(func() {
+		config.clusterRing = newHashRing(config.ClusterReplicas)
+	})
+	owner := config.clusterRing.owner(u.String())
+	if owner == config.ClusterSelf {
+		return ""
+	}
+	return owner
+}
+
+// shouldForwardToOwner returns true if the request can be forwarded to the
+// owner replica. Without ClusterSecret, the owner authorizes the forwarded
+// requests again, and the ones of the SSH and the git:// clients, which have
+// no credentials it can check, are served by this replica.
+func shouldForwardToOwner(config *ServerConfig, r *http.Request) bool {
+	if r.Header.Get(clusterForwardedHeader) != "" {
+		return false
+	}
+	return config.ClusterSecret != "" || streamSessionFromContext(r.Context()) == nil
+}
+
+// forwardToOwner proxies the request to the owner replica. The request keeps
+// its Host and Authorization headers. With ClusterSecret, the client identity
+// and the remote address are signed so that the owner trusts them instead of
+// authorizing and rate-limiting the request again. Otherwise, the owner
+// authorizes it again.
+func forwardToOwner(config *ServerConfig, reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, owner string) {
+	target, err := url.Parse(owner)
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.Internal, "invalid cluster replica URL %q: %v", owner, err))
+		return
+	}
+	stats.Record(r.Context(), ClusterForwardCount.M(1))
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set(clusterForwardedHeader, "1")
+		req.Header.Del(clusterClientHeader)
+		req.Header.Del(clusterSignatureHeader)
+		if config.ClusterSecret != "" {
+			v := url.Values{}
+			v.Set("identity", clientIdentity(config, r))
+			v.Set("remote_addr", r.RemoteAddr)
+			v.Set("path", req.URL.Path)
+			v.Set("time", strconv.FormatInt(time.Now().Unix(), 10))
+			if streamSessionFromContext(r.Context()) != nil {
+				v.Set("stream", "1")
+			}
+			client := v.Encode()
+			req.Header.Set(clusterClientHeader, client)
+			req.Header.Set(clusterSignatureHeader, signClusterClient(config.ClusterSecret, client))
+		}
+	}
+	// Stream the packfiles rather than buffering them.
+	proxy.FlushInterval = 100 * time.Millisecond
+	proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) {
+		reporter.reportError(status.Errorf(codes.Unavailable, "cannot forward the request to the owner replica %s: %v", owner, err))
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+func signClusterClient(secret, client string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(client))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// acceptClusterHop returns the request with the client identity and the
+// remote address of the client if it's forwarded by another replica with a
+// valid signature. Otherwise, the request is returned as is, and it's
+// authorized as usual.
+func acceptClusterHop(config *ServerConfig, r *http.Request) *http.Request {
+	client := r.Header.Get(clusterClientHeader)
+	if config.ClusterSecret == "" || client == "" {
+		return r
+	}
+	if !hmac.Equal([]byte(r.Header.Get(clusterSignatureHeader)), []byte(signClusterClient(config.ClusterSecret, client))) {
+		return r
+	}
+	v, err := url.ParseQuery(client)
+	if err != nil || v.Get("path") != r.URL.Path {
+		return r
+	}
+	sec, err := strconv.ParseInt(v.Get("time"), 10, 64)
+	if err != nil {
+		return r
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > clusterClientMaxAge || age < -clusterClientMaxAge {
+		return r
+	}
+	ctx := context.WithValue(r.Context(), clusterHopKey{}, &clusterHop{identity: v.Get("identity")})
+	if v.Get("stream") != "" {
+		ctx = context.WithValue(ctx, streamSessionKey{}, &streamSession{identity: v.Get("identity")})
+	}
+	r = r.WithContext(ctx)
+	r.RemoteAddr = v.Get("remote_addr")
+	return r
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ColdStorage stores the repositories that are moved out of the local disk,
+// such as in a GCS or S3 bucket. A repository is stored as a Git bundle
+// of all its refs.
+type ColdStorage interface {
+	// Upload stores the content of r as name, replacing the existing
+	// one.
+	Upload(ctx context.Context, name string, r io.Reader) error
+
+	// Download returns the content stored as name. It returns a
+	// NotFound error if there's none.
+	Download(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// coldStorageName returns the name of the repository in ColdStorage.
+func coldStorageName(u *url.URL) string {
+	return path.Join(u.Host, u.Path) + ".bundle"
+}
+
+// MoveColdRepositories uploads the cached repositories that are not fetched
+// for ColdStorageAfter to ColdStorage, and removes them from the cache roots.
+// They are restored from ColdStorage when they are requested again. This
+// does nothing if ColdStorage is nil or ColdStorageAfter is zero.
+func MoveColdRepositories(config *ServerConfig) error {
+	if config.ColdStorage == nil || config.ColdStorageAfter <= 0 {
+		return nil
+	}
+	defer StartEvictionPass()()
+
+	repos, err := listCachedRepositories(config)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if time.Since(lastUseTime(repo.localDiskPath)) <= config.ColdStorageAfter {
+			continue
+		}
+		if err := uploadColdRepository(config, repo); err != nil {
+			return err
+		}
+		if err := evictListedRepository(config, repo); err != nil {
+			return err
+		}
+		stats.Record(context.Background(), ColdStorageUploadCount.M(1))
+	}
+	return nil
+}
+
+// uploadColdRepository uploads a bundle of the cached repository to
+// ColdStorage. If the repository is being fetched, this waits for the fetch
+// to finish.
+func uploadColdRepository(config *ServerConfig, repo *cachedRepository) error {
+	if v, ok := managedRepos.Load(repo.localDiskPath); ok {
+		m := v.(*managedRepository)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(runGitWithStdOut(noopOperation{}, pw, repo.localDiskPath, "bundle", "create", "-", "--all"))
+	}()
+	err := config.ColdStorage.Upload(context.Background(), coldStorageName(repo.upstreamURL), pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("cannot upload %s to the cold storage: %v", repo.upstreamURL, err)
+	}
+	return nil
+}
+
+// restoreFromColdStorage fetches the refs and the objects of the repository
+// from its bundle in ColdStorage. It returns false if there's none. The
+// caller must hold r.mu.
+func (r *managedRepository) restoreFromColdStorage(op RunningOperation) (bool, error) {
+	rc, err := r.config.ColdStorage.Download(context.Background(), coldStorageName(r.upstreamURL))
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	f, err := ioutil.TempFile(r.localDiskPath, "cold-bundle")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, rc)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot download the bundle: %v", err)
+	}
+	if err := runGit(op, r.localDiskPath, "fetch", "--progress", "-f", f.Name(), "refs/*:refs/*"); err != nil {
+		return false, err
+	}
+	stats.Record(context.Background(), ColdStorageRestoreCount.M(1))
+	return true, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// saturationError is returned when a concurrency limit is reached. The
+// clients are asked to retry with 503 and Retry-After if the response hasn't
+// started.
+type saturationError struct {
+	message  string
+	category ErrorCategory
+}
+
+func (e *saturationError) Error() string {
+	return e.message
+}
+
+func (e *saturationError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.message)
+}
+
+func isSaturated(err error) bool {
+	_, ok := err.(*saturationError)
+	return ok
+}
+
+// concurrencyLimiter limits the number of the operations running at the same
+// time. Unlike fetchScheduler, the operations over the limit are rejected
+// rather than queued so that they don't pile up under load. The lower
+// priority operations are rejected first, as priorityLimit describes.
+type concurrencyLimiter struct {
+	mu      sync.Mutex
+	running int
+}
+
+// tryAcquire counts a running operation of the priority, and returns a
+// function to call when it's done. It returns a saturationError with the
+// message if the operations running take all the slots the priority can
+// take. No limit if limit is zero.
+func (l *concurrencyLimiter) tryAcquire(limit int, p Priority, message string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit > 0 && l.running >= priorityLimit(limit, p) {
+		return nil, &saturationError{message, ErrorCategoryOverloaded}
+	}
+	l.running++
+	return l.release, nil
+}
+
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	l.running--
+	l.mu.Unlock()
+}
+
+// runUpstreamGit runs a git command fetching from the upstream in the cached
+// repository. It's rejected if MaxUpstreamFetches are running, and
+// aborted by Shutdown or UpstreamFetchTimeout. The transient upstream
+// failures are retried with UpstreamRetries. It fails in the Offline mode.
+func (r *managedRepository) runUpstreamGit(op RunningOperation, args ...string) error {
+	return r.runUpstreamGitContext(context.Background(), op, args...)
+}
+
+// runUpstreamGitContext is runUpstreamGit that stops the command when
+// clientCtx is done. It's not retried then. The callers must hold the
+// repository lock, as the lock files and the temporary files of a stopped
+// command are removed.
+func (r *managedRepository) runUpstreamGitContext(clientCtx context.Context, op RunningOperation, args ...string) error {
+	if r.config.Offline {
+		return errOffline
+	}
+	return r.retryUpstream("fetch", func() (bool, error) {
+		release, err := r.config.upstreamFetchSlots.tryAcquire(r.config.MaxUpstreamFetches, priorityFromContext(clientCtx), "too many upstream fetches")
+		if err != nil {
+			return false, err
+		}
+		defer release()
+		ctx, cancel := upstreamTimeoutContext(r.config.upstreamFetches.context(), r.config.UpstreamFetchTimeout)
+		defer cancel()
+		ctx, cancelWith := withCancelOf(ctx, clientCtx)
+		defer cancelWith()
+		out := &gitOutputRecorder{RunningOperation: op}
+		err = runGitContext(ctx, out, r.localDiskPath, args...)
+		if err != nil && ctx.Err() != nil {
+			// git may not have cleaned up if it's killed. The
+			// leftover lock files would fail the next fetches.
+			if rmErr := removeStaleGitLocks(r.localDiskPath); rmErr != nil {
+				op.Printf("cannot remove the git lock files of the stopped fetch: %v", rmErr)
+			}
+		}
+		if clientCtx.Err() != nil {
+			return false, status.Errorf(codes.Canceled, "the request is canceled: %v", clientCtx.Err())
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return true, categoryErrorf(ErrorCategoryUpstreamUnavailable, codes.DeadlineExceeded, "the upstream fetch did not finish in %v", r.config.UpstreamFetchTimeout)
+		}
+		if err != nil {
+			err = out.categorize(err)
+		}
+		return out.failedTransiently(), err
+	})
+}
+
+// responseStarted returns true if the response has been written, and it's
+// too late to respond with an HTTP error.
+func responseStarted(w http.ResponseWriter) bool {
+	mw, ok := w.(*monitoringWriter)
+	return !ok || mw.status != 0
+}
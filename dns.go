@@ -0,0 +1,140 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const dnsLookupTimeout = 10 * time.Second
+
+var (
+	// dnsCache is a cache of the resolved upstream hosts. This is used only
+	// when DNSCacheTTL is set.
+	dnsCache   = map[string]*dnsCacheEntry{}
+	dnsCacheMu sync.Mutex
+)
+
+type dnsCacheEntry struct {
+	Host       string    `json:"host"`
+	Addrs      []string  `json:"addrs"`
+	ResolvedAt time.Time `json:"resolved_at"`
+	Pinned     bool      `json:"pinned,omitempty"`
+}
+
+// resolveUpstreamHost returns the IP address to connect to for the host. It
+// returns an empty string if the host should be resolved by the OS resolver.
+func resolveUpstreamHost(ctx context.Context, config *ServerConfig, host string) (string, error) {
+	if ip, ok := config.UpstreamHostIPs[host]; ok {
+		return ip, nil
+	}
+	if config.DNSCacheTTL <= 0 || net.ParseIP(host) != nil {
+		return "", nil
+	}
+
+	dnsCacheMu.Lock()
+	e, ok := dnsCache[host]
+	dnsCacheMu.Unlock()
+	if ok && time.Since(e.ResolvedAt) < config.DNSCacheTTL {
+		return e.Addrs[0], nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if ok {
+			// Keep using the stale entry rather than failing the
+			// request.
+			return e.Addrs[0], nil
+		}
+		return "", fmt.Errorf("cannot resolve %s: %v", host, err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("cannot resolve %s: no addresses", host)
+	}
+	e = &dnsCacheEntry{Host: host, ResolvedAt: time.Now()}
+	for _, a := range addrs {
+		e.Addrs = append(e.Addrs, a.IP.String())
+	}
+	dnsCacheMu.Lock()
+	dnsCache[host] = e
+	dnsCacheMu.Unlock()
+	return e.Addrs[0], nil
+}
+
+// upstreamGitOptions returns the git options that make git connect to the
+// resolved address of the upstream. TLS SNI and the Host header still use the
+// hostname. This also applies DisableHTTP2 of UpstreamTransport, UpstreamTLS,
+// and the upstream proxy.
+func upstreamGitOptions(config *ServerConfig, u *url.URL) ([]string, error) {
+	opts := []string{}
+	if config.UpstreamTransport != nil && config.UpstreamTransport.DisableHTTP2 {
+		opts = append(opts, "-c", "http.version=HTTP/1.1")
+	}
+	if config.UpstreamTLS != nil {
+		opts = append(opts, config.UpstreamTLS.gitOptions()...)
+	}
+	proxy, err := upstreamProxy(config, u)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		// git-fetch runs without the environment variables of the
+		// server.
+		opts = append(opts, "-c", "http.proxy="+proxy.String())
+	}
+	ip, err := resolveUpstreamHost(context.Background(), config, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if ip == "" {
+		return opts, nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	if net.ParseIP(ip).To4() == nil {
+		ip = "[" + ip + "]"
+	}
+	return append(opts, "-c", fmt.Sprintf("http.curloptResolve=%s:%s:%s", u.Hostname(), port, ip)), nil
+}
+
+// dnsCacheEntries returns the pinned upstream hosts and the DNS cache entries.
+func dnsCacheEntries(config *ServerConfig) []*dnsCacheEntry {
+	entries := []*dnsCacheEntry{}
+	for host, ip := range config.UpstreamHostIPs {
+		entries = append(entries, &dnsCacheEntry{Host: host, Addrs: []string{ip}, Pinned: true})
+	}
+	dnsCacheMu.Lock()
+	for _, e := range dnsCache {
+		if _, ok := config.UpstreamHostIPs[e.Host]; !ok {
+			entries = append(entries, e)
+		}
+	}
+	dnsCacheMu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Host < entries[j].Host })
+	return entries
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"log"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// startRequest counts an in-flight request. It returns an error if the
+// repository is draining or has MaxRepoRequests in-flight requests,
+// and the request should not be served.
+func (r *managedRepository) startRequest() error {
+	r.drainMu.Lock()
+	defer r.drainMu.Unlock()
+	if r.draining {
+		return categoryErrorf(ErrorCategoryOverloaded, codes.Unavailable, "the repository is being drained")
+	}
+	if limit := r.config.MaxRepoRequests; limit > 0 && r.inflight >= limit {
+		return &saturationError{"too many requests for the repository", ErrorCategoryOverloaded}
+	}
+	r.inflight++
+	r.requests++
+	r.lastRequest = time.Now()
+	return nil
+}
+
+func (r *managedRepository) finishRequest() {
+	r.drainMu.Lock()
+	defer r.drainMu.Unlock()
+	r.inflight--
+	if r.inflight == 0 && r.drained != nil {
+		close(r.drained)
+		r.drained = nil
+	}
+}
+
+func (r *managedRepository) isDraining() bool {
+	r.drainMu.Lock()
+	defer r.drainMu.Unlock()
+	return r.draining
+}
+
+// drain stops accepting new requests, and evicts the repository once the
+// in-flight requests complete.
+func (r *managedRepository) drain() {
+	r.drainMu.Lock()
+	defer r.drainMu.Unlock()
+	if r.draining {
+		return
+	}
+	r.draining = true
+	drained := make(chan struct{})
+	if r.inflight == 0 {
+		close(drained)
+	} else {
+		r.drained = drained
+	}
+
+	go func() {
+		<-drained
+		if err := repositoryStore(r.config).Evict(r.tenant, r.upstreamURL); err != nil {
+			log.Printf("Cannot evict the drained repository %s: %v", r.localDiskPath, err)
+		}
+	}()
+}
+
+// drainRepositories drains the managed repositories of the upstream URL of
+// all tenants, and returns them.
+func drainRepositories(u *url.URL) []*managedRepository {
+	repos := []*managedRepository{}
+	managedRepos.Range(func(key, value interface{}) bool {
+		m := value.(*managedRepository)
+		if m.upstreamURL.String() == u.String() {
+			m.drain()
+			repos = append(repos, m)
+		}
+		return true
+	})
+	return repos
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// errorCategoryHeader is the response header that tells the clients
+	// the ErrorCategory of a failed request.
+	errorCategoryHeader = "X-Goblet-Error-Category"
+)
+
+// ErrorCategory is a kind of the request failures, so that the clients and
+// the dashboards can tell the failure modes apart. See ErrorCategoryOf.
+type ErrorCategory string
+
+const (
+	// ErrorCategoryUpstreamAuth is a failure to authenticate to the
+	// upstream, such as no credentials for it or a 401 or 403 response
+	// from it.
+	ErrorCategoryUpstreamAuth ErrorCategory = "upstream-auth"
+
+	// ErrorCategoryUpstreamUnavailable is a failure to reach the
+	// upstream, such as an error response, a timeout, or an open circuit
+	// breaker.
+	ErrorCategoryUpstreamUnavailable ErrorCategory = "upstream-unavailable"
+
+	// ErrorCategoryNotFound is a repository or objects that neither the
+	// upstream nor the cache has.
+	ErrorCategoryNotFound ErrorCategory = "not-found"
+
+	// ErrorCategoryLocalCorruption is a cached repository that cannot be
+	// read.
+	ErrorCategoryLocalCorruption ErrorCategory = "local-corruption"
+
+	// ErrorCategoryOverloaded is a request shed by a concurrency limit or
+	// a drain.
+	ErrorCategoryOverloaded ErrorCategory = "overloaded"
+)
+
+// errorCategoryHTTPStatus maps the categories to the HTTP status codes of the
+// responses. The errors without a category are mapped by their gRPC status
+// codes.
+var errorCategoryHTTPStatus = map[ErrorCategory]int{
+	ErrorCategoryUpstreamAuth:        http.StatusBadGateway,
+	ErrorCategoryUpstreamUnavailable: http.StatusBadGateway,
+	ErrorCategoryNotFound:            http.StatusNotFound,
+	ErrorCategoryLocalCorruption:     http.StatusInternalServerError,
+	ErrorCategoryOverloaded:          http.StatusServiceUnavailable,
+}
+
+// Error is an error of the request path with its category. It's sent to the
+// client with the gRPC status code and the message, as the errors made with
+// status.Errorf are.
+type Error struct {
+	Category ErrorCategory
+	Code     codes.Code
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e *Error) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Message)
+}
+
+// categoryErrorf returns an Error with the category and the code, formatting
+// the message as fmt.Sprintf does.
+func categoryErrorf(category ErrorCategory, code codes.Code, format string, a ...interface{}) error {
+	return &Error{Category: category, Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// ErrorCategoryOf returns the category of an error passed to ErrorReporter or
+// RequestHook.AfterRequest, or an empty string if the error has none, such as
+// an invalid request.
+func ErrorCategoryOf(err error) ErrorCategory {
+	switch e := err.(type) {
+	case *Error:
+		return e.Category
+	case *saturationError:
+		return e.category
+	}
+	return ""
+}
+
+// errorHTTPStatus returns the HTTP status code of the response for the error.
+func errorHTTPStatus(err error) int {
+	if s, ok := errorCategoryHTTPStatus[ErrorCategoryOf(err)]; ok {
+		return s
+	}
+	return runtime.HTTPStatusFromCode(status.Code(err))
+}
+
+// isServerError returns true if the error is not the client's fault, and it's
+// passed to ErrorReporter. The not-found and the overloaded errors are
+// expected, and not reported.
+func isServerError(err error) bool {
+	switch ErrorCategoryOf(err) {
+	case ErrorCategoryUpstreamAuth, ErrorCategoryUpstreamUnavailable, ErrorCategoryLocalCorruption:
+		return true
+	case ErrorCategoryNotFound, ErrorCategoryOverloaded:
+		return false
+	}
+	code := codes.Internal
+	if st, ok := status.FromError(err); ok {
+		code = st.Code()
+	}
+	return serverErrorCodes[code]
+}
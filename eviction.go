@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+)
+
+// shedRetryAfter is the Retry-After sent with the shed requests.
+const shedRetryAfter = 30 * time.Second
+
+// activeEvictionPasses is the number of the running eviction passes.
+var activeEvictionPasses int32
+
+// StartEvictionPass marks the start of a pass that removes cached repositories
+// to reclaim disk space. While a pass is running, the requests that need an
+// upstream fetch are shed if ShedDuringEviction is set. Call the returned
+// function when the pass completes.
+func StartEvictionPass() func() {
+	atomic.AddInt32(&activeEvictionPasses, 1)
+	return func() {
+		atomic.AddInt32(&activeEvictionPasses, -1)
+	}
+}
+
+func isEvictionActive() bool {
+	return atomic.LoadInt32(&activeEvictionPasses) > 0
+}
+
+// shouldShed returns true if the fetch commands cannot be served from the
+// cache while an eviction pass is running.
+func shouldShed(config *ServerConfig, repo *managedRepository, commands [][]*gitprotocolio.ProtocolV2RequestChunk) bool {
+	if !config.ShedDuringEviction || !isEvictionActive() {
+		return false
+	}
+	for _, command := range commands {
+		if command[0].Command != "fetch" {
+			continue
+		}
+		wantHashes, wantRefs, err := parseFetchWants(command)
+		if err != nil {
+			// Let the command handler report the error.
+			return false
+		}
+		if hasAllWants, err := repo.hasAllWants(wantHashes, wantRefs); err != nil || !hasAllWants {
+			return true
+		}
+	}
+	return false
+}
+
+// writeShedResponse responds with 503 Service Unavailable. This is not
+// reported to ErrorReporter as it's an expected consequence of an eviction or
+// a drain.
+func writeShedResponse(w http.ResponseWriter, r *http.Request, message string) {
+	writeCategorizedShedResponse(w, r, ErrorCategoryOverloaded, message)
+}
+
+// writeCategorizedShedResponse is writeShedResponse for a request shed for
+// another category than ErrorCategoryOverloaded, such as an open circuit
+// breaker.
+func writeCategorizedShedResponse(w http.ResponseWriter, r *http.Request, category ErrorCategory, message string) {
+	stats.RecordWithTags(
+		r.Context(),
+		[]tag.Mutator{tag.Insert(CommandCanonicalStatusKey, codes.Unavailable.String()), tag.Insert(ErrorCategoryKey, string(category))},
+		InboundCommandCount.M(1),
+		ShedRequestCount.M(1),
+	)
+	w.Header().Set(errorCategoryHeader, string(category))
+	w.Header().Set("Retry-After", strconv.Itoa(int(shedRetryAfter/time.Second)))
+	http.Error(w, message, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/gitprotocolio"
+	"go.opencensus.io/stats"
+)
+
+var (
+	// fetchFlights are the in-flight fetch responses that the identical
+	// fetch commands share. The keys are from fetchFlightKey.
+	fetchFlights   = map[string]*fetchFlight{}
+	fetchFlightsMu sync.Mutex
+)
+
+// fetchFlight is a fetch response being generated into a temporary file. The
+// readers stream the file from the beginning as it grows, so the commands
+// that join late get the same bytes.
+type fetchFlight struct {
+	key string
+	f   *os.File
+	// cancel stops the generation when all the readers leave before it's
+	// done.
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int64
+	done bool
+	err  error
+	// readers is the number of the commands reading the file. The file is
+	// closed when the last one leaves, and the generation is stopped if
+	// it's not done.
+	readers int
+}
+
+// fetchFlightKey returns the key of the fetch command. The capabilities and
+// the arguments are sorted so that the commands that differ only in their
+// order share the response. The agent and the session ID are ignored as they
+// don't change the response.
+func fetchFlightKey(localDiskPath string, command []*gitprotocolio.ProtocolV2RequestChunk) string {
+	capabilities := []string{}
+	arguments := []string{}
+	for _, ch := range command {
+		switch {
+		case ch.Capability != "":
+			c := strings.TrimSpace(ch.Capability)
+			if strings.HasPrefix(c, "agent=") || strings.HasPrefix(c, "session-id=") {
+				continue
+			}
+			capabilities = append(capabilities, c)
+		case ch.Argument != nil:
+			arguments = append(arguments, strings.TrimSpace(string(ch.Argument)))
+		}
+	}
+	sort.Strings(capabilities)
+	sort.Strings(arguments)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", localDiskPath, strings.Join(capabilities, "\n"), strings.Join(arguments, "\n"))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// serveFetchCoalesced serves the fetch command with the response being
+// generated for an identical command if there's one. Otherwise, this starts
+// generating the response so that the identical commands that come while
+// it's generated share it.
+func (r *managedRepository) serveFetchCoalesced(command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	key := fetchFlightKey(r.localDiskPath, command)
+	fetchFlightsMu.Lock()
+	fl, ok := fetchFlights[key]
+	if ok {
+		fl.mu.Lock()
+		fl.readers++
+		fl.mu.Unlock()
+		fetchFlightsMu.Unlock()
+		stats.Record(context.Background(), CoalescedFetchCount.M(1))
+		return fl.copyTo(w)
+	}
+	f, err := ioutil.TempFile("", "goblet-fetch-")
+	if err != nil {
+		fetchFlightsMu.Unlock()
+		return err
+	}
+	// Only the open file is used.
+	os.Remove(f.Name())
+	ctx, cancel := context.WithCancel(context.Background())
+	fl = &fetchFlight{key: key, f: f, cancel: cancel, readers: 1}
+	fl.cond = sync.NewCond(&fl.mu)
+	fetchFlights[key] = fl
+	fetchFlightsMu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := r.serveUploadPack(ctx, command, fl)
+		fetchFlightsMu.Lock()
+		if fetchFlights[key] == fl {
+			delete(fetchFlights, key)
+		}
+		fetchFlightsMu.Unlock()
+		fl.mu.Lock()
+		fl.done = true
+		fl.err = err
+		fl.cond.Broadcast()
+		if fl.readers == 0 {
+			fl.f.Close()
+		}
+		fl.mu.Unlock()
+	}()
+	return fl.copyTo(w)
+}
+
+// Write appends the response bytes to the file.
+func (fl *fetchFlight) Write(p []byte) (int, error) {
+	n, err := fl.f.Write(p)
+	fl.mu.Lock()
+	fl.size += int64(n)
+	fl.cond.Broadcast()
+	fl.mu.Unlock()
+	return n, err
+}
+
+// copyTo writes the response to w as it's generated, and returns the error
+// of the generation.
+func (fl *fetchFlight) copyTo(w io.Writer) error {
+	defer func() {
+		fetchFlightsMu.Lock()
+		defer fetchFlightsMu.Unlock()
+		fl.mu.Lock()
+		defer fl.mu.Unlock()
+		fl.readers--
+		if fl.readers != 0 {
+			return
+		}
+		if fl.done {
+			fl.f.Close()
+			return
+		}
+		// Nobody reads the response. Stop generating it, and let the
+		// next identical command start a new one.
+		if fetchFlights[fl.key] == fl {
+			delete(fetchFlights, fl.key)
+		}
+		fl.cancel()
+	}()
+
+	buf := make([]byte, 32*1024)
+	var off int64
+	for {
+		fl.mu.Lock()
+		for off == fl.size && !fl.done {
+			fl.cond.Wait()
+		}
+		size, done, err := fl.size, fl.done, fl.err
+		fl.mu.Unlock()
+		if off == size && done {
+			return err
+		}
+		for off < size {
+			n := int64(len(buf))
+			if size-off < n {
+				n = size - off
+			}
+			if _, err := fl.f.ReadAt(buf[:n], off); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			off += n
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultFetchLockTTL is the TTL of the fetch locks in FetchStateStore
+	// if UpstreamFetchTimeout is zero. The lock of a replica that dies
+	// while fetching expires after this.
+	defaultFetchLockTTL = 10 * time.Minute
+
+	// fetchStatePollInterval is the interval of checking if the replica
+	// holding the fetch lock has finished.
+	fetchStatePollInterval = time.Second
+)
+
+// FetchStateStore shares the fetch state of the repositories between the
+// replicas that share the cache roots, such as on a network filesystem with
+// RemoteFilesystemMode, so that only one of them fetches a repository from
+// the upstream at a time and the others see the result as fresh. The
+// repositories are identified by their canonical upstream URLs.
+type FetchStateStore interface {
+	// LastFetchTime returns the time the repository was last fetched
+	// from the upstream by any replica, or the zero time if unknown.
+	LastFetchTime(ctx context.Context, repo string) (time.Time, error)
+
+	// SetLastFetchTime records the time the repository was fetched.
+	SetLastFetchTime(ctx context.Context, repo string, t time.Time) error
+
+	// TryLockFetch acquires the lock of fetching the repository from the
+	// upstream for ttl. It returns false if another replica holds it.
+	// Call release to release the lock.
+	TryLockFetch(ctx context.Context, repo string, ttl time.Duration) (release func(), acquired bool, err error)
+}
+
+// sharedLastFetchTime returns the LastFetchTime in FetchStateStore, or the
+// zero time if it's not available.
+func (r *managedRepository) sharedLastFetchTime() time.Time {
+	if r.config.FetchStateStore == nil {
+		return time.Time{}
+	}
+	t, err := r.config.FetchStateStore.LastFetchTime(context.Background(), r.upstreamURL.String())
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// lockSharedFetch acquires the fetch lock in FetchStateStore. If another
+// replica holds it, this waits until the lock is released, and returns
+// fetched true if the other replica has finished a fetch in the meantime. If
+// the store fails, the repository is fetched without the lock.
+func (r *managedRepository) lockSharedFetch(op RunningOperation) (release func(), fetched bool, err error) {
+	store := r.config.FetchStateStore
+	repo := r.upstreamURL.String()
+	ttl := r.config.UpstreamFetchTimeout
+	if ttl <= 0 {
+		ttl = defaultFetchLockTTL
+	}
+	ctx := r.config.upstreamFetches.context()
+	var lastFetch time.Time
+	waiting := false
+	for {
+		release, acquired, err := store.TryLockFetch(ctx, repo, ttl)
+		if err != nil {
+			op.Printf("cannot lock the fetch, fetching without the lock: %v", err)
+			return func() {}, false, nil
+		}
+		t, err := store.LastFetchTime(ctx, repo)
+		if waiting && err == nil && t.After(lastFetch) {
+			if acquired {
+				release()
+			}
+			stats.Record(context.Background(), SharedFetchCount.M(1))
+			return nil, true, nil
+		}
+		if acquired {
+			return release, false, nil
+		}
+		setOperationState(op, "waiting for another replica to release the shared fetch lock")
+		if err == nil {
+			lastFetch = t
+			waiting = true
+		}
+		select {
+		case <-time.After(fetchStatePollInterval):
+		case <-ctx.Done():
+			return nil, false, status.Error(codes.Unavailable, "the server is shutting down")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// retainedRefPrefix is the namespace of the refs that keep the old
+	// values of force-pushed refs. Refs under refs/goblet/ are hidden from
+	// the clients.
+	retainedRefPrefix = "refs/goblet/retained/"
+
+	defaultForcePushGracePeriod = 10 * time.Minute
+)
+
+// ForcePushPolicy specifies how the non-fast-forward updates of the upstream
+// refs are handled.
+type ForcePushPolicy int
+
+const (
+	// ForcePushServeImmediately serves the new ref values right after the
+	// fetch. The objects only reachable from the old values become
+	// unreachable.
+	ForcePushServeImmediately ForcePushPolicy = iota
+
+	// ForcePushKeepOldObjects serves the new ref values right after the
+	// fetch, but keeps the old values reachable for ForcePushGracePeriod.
+	// This prevents the clients that negotiated against the old values
+	// from failing if the cache is garbage-collected in the meantime.
+	ForcePushKeepOldObjects
+)
+
+// listLocalRefs returns the refs of the local repository except the ones
+// used by goblet itself.
+func (r *managedRepository) listLocalRefs(op RunningOperation) (map[string]string, error) {
+	out := new(bytes.Buffer)
+	if err := runGitWithStdOut(op, out, r.localDiskPath, "for-each-ref", "--format=%(objectname) %(refname)"); err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		ss := strings.SplitN(line, " ", 2)
+		if len(ss) != 2 || strings.HasPrefix(ss[1], "refs/goblet/") {
+			continue
+		}
+		refs[ss[1]] = ss[0]
+	}
+	return refs, nil
+}
+
+// retainForcePushedRefs keeps the old values of the refs that are not
+// fast-forwarded, and removes the retained refs older than the grace period.
+func (r *managedRepository) retainForcePushedRefs(op RunningOperation, oldRefs map[string]string) error {
+	newRefs, err := r.listLocalRefs(op)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	updates := new(bytes.Buffer)
+	for refName, oldHash := range oldRefs {
+		newHash, ok := newRefs[refName]
+		if ok && newHash == oldHash {
+			continue
+		}
+		if ok && runGit(noopOperation{}, r.localDiskPath, "merge-base", "--is-ancestor", oldHash, newHash) == nil {
+			continue
+		}
+		fmt.Fprintf(updates, "create %s%d/%s %s\n", retainedRefPrefix, now.Unix(), strings.TrimPrefix(refName, "refs/"), oldHash)
+	}
+
+	gracePeriod := r.config.ForcePushGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = defaultForcePushGracePeriod
+	}
+	retained := new(bytes.Buffer)
+	if err := runGitWithStdOut(op, retained, r.localDiskPath, "for-each-ref", "--format=%(refname)", retainedRefPrefix); err != nil {
+		return err
+	}
+	for _, refName := range strings.Split(retained.String(), "\n") {
+		ss := strings.SplitN(strings.TrimPrefix(refName, retainedRefPrefix), "/", 2)
+		ts, err := strconv.ParseInt(ss[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if now.Sub(time.Unix(ts, 0)) > gracePeriod {
+			fmt.Fprintf(updates, "delete %s\n", refName)
+		}
+	}
+
+	if updates.Len() == 0 {
+		return nil
+	}
+	return runGitWithStdIn(op, updates, r.localDiskPath, "update-ref", "--stdin")
+}
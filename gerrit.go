@@ -0,0 +1,166 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// GerritChangeRefPolicy specifies how the Gerrit change refs
+// (refs/changes/*) are cached and served.
+type GerritChangeRefPolicy int
+
+const (
+	// GerritChangeRefsAdvertise caches and advertises the change refs as
+	// any other refs.
+	GerritChangeRefsAdvertise GerritChangeRefPolicy = iota
+
+	// GerritChangeRefsHide neither caches nor serves the change refs.
+	GerritChangeRefsHide
+
+	// GerritChangeRefsFetchOnDemand doesn't cache or advertise the change
+	// refs by default. A change ref is fetched into the cache and
+	// advertised only when a client asks for it explicitly with a
+	// ref-prefix under refs/changes/, such as `git fetch origin
+	// refs/changes/34/1234/1`.
+	GerritChangeRefsFetchOnDemand
+)
+
+const gerritChangeRefPrefix = "refs/changes/"
+
+func isGerritChangeRef(refName string) bool {
+	return strings.HasPrefix(refName, gerritChangeRefPrefix)
+}
+
+// upstreamFetchRefspecs returns the refspecs of the upstream fetch. If nil,
+// the refspec of the remote is used.
+func upstreamFetchRefspecs(config *ServerConfig) []string {
+	if config.GerritChangeRefPolicy == GerritChangeRefsAdvertise {
+		return nil
+	}
+	// Negative refspecs need Git 2.29 or later.
+	return []string{"+refs/*:refs/*", "^" + gerritChangeRefPrefix + "*"}
+}
+
+// requestsChangeRefs returns true if the ls-refs command explicitly asks for
+// the change refs that are fetched on demand.
+func requestsChangeRefs(config *ServerConfig, command []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	return config.GerritChangeRefPolicy == GerritChangeRefsFetchOnDemand && len(changeRefPrefixes(command)) != 0
+}
+
+func changeRefPrefixes(command []*gitprotocolio.ProtocolV2RequestChunk) []string {
+	prefixes := []string{}
+	for _, ch := range command {
+		if ch.Argument == nil {
+			continue
+		}
+		s := strings.TrimSpace(string(ch.Argument))
+		if strings.HasPrefix(s, "ref-prefix ") {
+			if prefix := strings.TrimPrefix(s, "ref-prefix "); isGerritChangeRef(prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// filterChangeRefs removes the change refs that are not explicitly asked for
+// from an ls-refs response if they are fetched on demand.
+func filterChangeRefs(config *ServerConfig, command []*gitprotocolio.ProtocolV2RequestChunk, chunks []*gitprotocolio.ProtocolV2ResponseChunk) []*gitprotocolio.ProtocolV2ResponseChunk {
+	if config.GerritChangeRefPolicy != GerritChangeRefsFetchOnDemand {
+		return chunks
+	}
+	prefixes := changeRefPrefixes(command)
+	ret := []*gitprotocolio.ProtocolV2ResponseChunk{}
+	for _, ch := range chunks {
+		if ch.Response != nil {
+			ss := strings.Split(strings.TrimSpace(string(ch.Response)), " ")
+			if len(ss) >= 2 && isGerritChangeRef(ss[1]) && !hasAnyPrefix(ss[1], prefixes) {
+				continue
+			}
+		}
+		ret = append(ret, ch)
+	}
+	return ret
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchChangeRefs fetches the change refs in the ls-refs response that are
+// not up-to-date in the cache.
+func (r *managedRepository) fetchChangeRefs(refs map[string]plumbing.Hash) (err error) {
+	refspecs := []string{}
+	g, err := git.PlainOpen(r.localDiskPath)
+	if err != nil {
+		return fmt.Errorf("cannot open the local cached repository: %v", err)
+	}
+	for refName, hash := range refs {
+		if !isGerritChangeRef(refName) {
+			continue
+		}
+		if ref, err := g.Reference(plumbing.ReferenceName(refName), true); err == nil && ref.Hash() == hash {
+			continue
+		}
+		refspecs = append(refspecs, "+"+refName+":"+refName)
+	}
+	if len(refspecs) == 0 {
+		return nil
+	}
+
+	op := r.startOperation("FetchChangeRefs")
+	defer func() {
+		op.Done(err)
+	}()
+	finish, err := r.config.upstreamFetches.start()
+	if err != nil {
+		return err
+	}
+	defer finish()
+	gitOptions, err := upstreamGitOptions(r.config, r.upstreamURL)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "%v", err)
+	}
+	t, err := upstreamToken(r.config, r.upstreamURL)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+	}
+
+	startTime := time.Now()
+	unlock, err := r.lock(op)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer r.invalidateSnapshot()
+	args := append(gitOptions, "-c", "http.extraHeader=Authorization: "+authorizationHeader(t), "fetch", "--progress", "-f", "-n", "origin")
+	err = r.runUpstreamGit(op, append(args, refspecs...)...)
+	r.logStats("fetch-change-refs", startTime, err)
+	return err
+}
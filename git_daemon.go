@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultGitDaemonPort is the port of the git:// protocol.
+	DefaultGitDaemonPort = 9418
+
+	// gitDaemonRequestTimeout is the time to wait for the initial request
+	// of a git:// client.
+	gitDaemonRequestTimeout = 30 * time.Second
+)
+
+// ServeGitDaemon serves git-upload-pack with the git daemon protocol
+// (git://) on the listener. Like ServeSSH, each request is handled by
+// handler, which is usually the one HTTPHandler returns.
+//
+// The protocol has no authentication. The clients are anonymous, and
+// RequestAuthorizer is not called for them. AccessRules can still restrict
+// them by SourceRanges. Pushes are rejected. The repository path is the host
+// and the path of the upstream URL, such as
+// git://goblet.example.com/github.com/google/goblet.git. Only the protocol v2
+// is supported. This returns when the listener is closed.
+func ServeGitDaemon(l net.Listener, handler http.Handler) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveGitDaemonConn(conn, handler)
+	}
+}
+
+func serveGitDaemonConn(conn net.Conn, handler http.Handler) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(gitDaemonRequestTimeout))
+	line, err := readPktLine(r)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	u, v2, err := parseGitDaemonRequest(line)
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	if !v2 {
+		writeError(conn, fmt.Errorf("accepts only Git protocol v2"))
+		return
+	}
+	ctx := context.WithValue(context.Background(), streamSessionKey{}, &streamSession{})
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{r, conn}
+	if err := serveUploadPackStream(ctx, conn.RemoteAddr().String(), u, rw, handler); err != nil {
+		writeError(conn, err)
+	}
+}
+
+// readPktLine reads one pkt-line and returns its payload.
+func readPktLine(r *bufio.Reader) ([]byte, error) {
+	var lenBytes [4]byte
+	if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(string(lenBytes[:]), 16, 16)
+	if err != nil || n < 4 {
+		return nil, fmt.Errorf("invalid pkt-line length %q", lenBytes)
+	}
+	bs := make([]byte, n-4)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// parseGitDaemonRequest parses the initial request of a git:// client, such as
+// "git-upload-pack /github.com/google/goblet.git\x00host=goblet\x00\x00version=2\x00".
+// It returns the upstream URL and whether the client requests the protocol v2.
+func parseGitDaemonRequest(line []byte) (*url.URL, bool, error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	ss := strings.Split(string(line), "\x00")
+	if !strings.HasPrefix(ss[0], "git-upload-pack ") {
+		return nil, false, fmt.Errorf("only git-upload-pack is supported")
+	}
+	u, err := parseRepositoryPath(strings.TrimPrefix(ss[0], "git-upload-pack "))
+	if err != nil {
+		return nil, false, err
+	}
+	v2 := false
+	// The extra parameters follow the host parameter after an empty one.
+	for _, p := range ss[1:] {
+		if p == "version=2" {
+			v2 = true
+		}
+	}
+	return u, v2, nil
+}
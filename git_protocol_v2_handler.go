@@ -17,12 +17,14 @@ package goblet
 import (
 	"context"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/gitprotocolio"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"gopkg.in/src-d/go-git.v4/plumbing"
@@ -39,31 +41,96 @@ type gitProtocolErrorReporter interface {
 func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, repo *managedRepository, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) bool {
 	startTime := time.Now()
 	var err error
-	ctx, err = tag.New(ctx, tag.Upsert(CommandTypeKey, command[0].Command))
+	mutators := []tag.Mutator{tag.Upsert(CommandTypeKey, command[0].Command)}
+	if repo.config.RepositoryMetricTag {
+		mutators = append(mutators, tag.Upsert(RepositoryKey, repositoryTagValue(repo.config, repo.upstreamURL)))
+	}
+	ctx, err = tag.New(ctx, mutators...)
 	if err != nil {
 		reporter.reportError(ctx, startTime, err)
 		return false
 	}
 
+	ctx, span := trace.StartSpan(ctx, "goblet."+command[0].Command)
+	defer span.End()
+	reporter = &tracingErrorReporter{reporter, span}
+	var auditEvent *AuditEvent
+	if repo.config.AuditLogger != nil {
+		aw := &auditWriter{w: w}
+		w = aw
+		auditEvent = newAuditEvent(ctx, repo.tenant, repo.upstreamURL, command)
+		reporter = &auditErrorReporter{gitProtocolErrorReporter: reporter, logger: repo.config.AuditLogger, event: auditEvent, w: aw}
+	}
+
 	cacheState := "locally-served"
 	ctx, err = tag.New(ctx, tag.Upsert(CommandCacheStateKey, cacheState))
 	if err != nil {
 		reporter.reportError(ctx, startTime, err)
 		return false
 	}
+	span.AddAttributes(trace.StringAttribute("goblet.upstream_url", repo.upstreamURL.String()))
+	requestInfoFromContext(ctx).commandType = command[0].Command
+	if err := repo.checkCachedOffline(); err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
 	switch command[0].Command {
 	case "ls-refs":
+		headOnly := isHeadOnlyLsRefs(command)
+		ctx, err = tag.New(ctx, tag.Upsert(HeadOnlyKey, strconv.FormatBool(headOnly)))
+		if err != nil {
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
+		changeRefs := requestsChangeRefs(repo.config, command)
+		if repo.config.Offline || !changeRefs && (repo.isFresh() || headOnly && repo.isHeadFresh()) {
+			recordCacheState(ctx, span, "locally-served")
+			if err := serveFetchLocalTraced(ctx, repo, command, w); err != nil {
+				reporter.reportError(ctx, startTime, err)
+				return false
+			}
+			if headOnly {
+				stats.Record(ctx, HeadOnlyRequestCount.M(1))
+			}
+			repo.recordCacheStats("locally-served", 0)
+			reporter.reportError(ctx, startTime, nil)
+			return true
+		}
+
 		ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upstream"))
 		if err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
 
-		resp, err := repo.lsRefsUpstream(command)
+		recordCacheState(ctx, span, "queried-upstream")
+		_, upstreamSpan := trace.StartSpan(ctx, "goblet.lsRefsUpstream", trace.WithSpanKind(trace.SpanKindClient))
+		resp, err := repo.lsRefsUpstream(ctx, command)
+		upstreamSpan.End()
+		if !changeRefs && repo.canServeStale(ctx, err) {
+			// The upstream is unavailable. Serve the cached refs
+			// rather than failing.
+			ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "served-stale"))
+			if err != nil {
+				reporter.reportError(ctx, startTime, err)
+				return false
+			}
+			recordCacheState(ctx, span, "served-stale")
+			recordServedStale(ctx)
+			if err := serveFetchLocalTraced(ctx, repo, command, w); err != nil {
+				reporter.reportError(ctx, startTime, err)
+				return false
+			}
+			repo.recordCacheStats("served-stale", 0)
+			reporter.reportError(ctx, startTime, nil)
+			return true
+		}
 		if err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
+		resp = filterChangeRefs(repo.config, command, filterHiddenRefs(repo.config, resp))
+		repo.syncHead(resp)
 
 		refs, err := parseLsRefsResponse(resp)
 		if err != nil {
@@ -71,57 +138,150 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 			return false
 		}
 
+		if changeRefs {
+			if err := repo.fetchChangeRefs(refs); err != nil {
+				reporter.reportError(ctx, startTime, err)
+				return false
+			}
+		}
+
+		cacheState = "queried-upstream"
 		if hasUpdate, err := repo.hasAnyUpdate(refs); err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		} else if hasUpdate {
 			go repo.fetchUpstream()
+		} else if !changeRefs {
+			// The cache is up to date even though it's not fresh.
+			cacheState = "revalidated"
+			ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, cacheState))
+			if err != nil {
+				reporter.reportError(ctx, startTime, err)
+				return false
+			}
+			recordCacheState(ctx, span, cacheState)
 		}
 
 		writeResp(w, resp)
+		if headOnly {
+			stats.Record(ctx, HeadOnlyRequestCount.M(1))
+		}
+		repo.recordCacheStats(cacheState, 0)
+		reporter.reportError(ctx, startTime, nil)
+		return true
+
+	case "bundle-uri":
+		if err := handleBundleURICommand(ctx, repo, w); err != nil {
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
 		reporter.reportError(ctx, startTime, nil)
 		return true
 
 	case "fetch":
+		packfileStarted := false
 		wantHashes, wantRefs, err := parseFetchWants(command)
 		if err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
+		var resolvedRefs map[string]plumbing.Hash
+		if len(wantRefs) != 0 {
+			// The want-refs are served as the wants of the hashes
+			// they point to.
+			if resolvedRefs, err = repo.resolveWantRefs(ctx, wantRefs); err != nil {
+				reporter.reportError(ctx, startTime, err)
+				return false
+			}
+			command = replaceWantRefs(command, resolvedRefs)
+			for _, refName := range wantRefs {
+				wantHashes = append(wantHashes, resolvedRefs[refName])
+				if auditEvent != nil {
+					auditEvent.Wants = append(auditEvent.Wants, resolvedRefs[refName].String())
+				}
+			}
+		}
 
-		if hasAllWants, err := repo.hasAllWants(wantHashes, wantRefs); err != nil {
+		if hasAllWants, err := repo.hasAllWants(wantHashes, nil); err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		} else if !hasAllWants {
-			ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upsteam"))
+			cacheState = "queried-upstream"
+			ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, cacheState))
 			if err != nil {
 				reporter.reportError(ctx, startTime, err)
 				return false
 			}
 
+			recordCacheState(ctx, span, cacheState)
+			_, waitSpan := trace.StartSpan(ctx, "goblet.waitForUpstreamFetch")
+			defer waitSpan.End()
 			fetchStartTime := time.Now()
-			fetchDone := make(chan error, 1)
-			go func() {
-				fetchDone <- repo.fetchUpstream()
-			}()
+			// The fetch is shared with the other clients waiting for
+			// the repository. It continues after this returns, unless
+			// all the clients waiting for it go away.
+			fetch, joined, leaveFetch := repo.joinUpstreamFetch(ctx)
+			defer func() { leaveFetch(false) }()
 			timer := time.NewTimer(checkFrequency)
+			var keepalive <-chan time.Time
+			// The wanted-refs section precedes the packfile
+			// section. The want-refs are already replaced in the
+			// command.
+			if repo.config.ClientKeepaliveInterval > 0 && len(wantRefs) == 0 && canSendKeepalive(command) {
+				ticker := time.NewTicker(repo.config.ClientKeepaliveInterval)
+				defer ticker.Stop()
+				keepalive = ticker.C
+			}
+			noProgress := hasFetchArgument(command, "no-progress")
 		LOOP:
 			for {
 				select {
+				case <-keepalive:
+					if !packfileStarted {
+						// Start the packfile section so that the
+						// keepalives can be sent as sideband
+						// packets.
+						if err := writePacket(w, gitprotocolio.BytesPacket("packfile\n")); err != nil {
+							leaveFetch(true)
+							reporter.reportError(ctx, startTime, status.Errorf(codes.Canceled, "client IO error"))
+							return false
+						}
+						packfileStarted = true
+						reporter = &sidebandErrorReporter{reporter, w}
+					}
+					if err := writeKeepalive(w, noProgress, time.Since(fetchStartTime)); err != nil {
+						leaveFetch(true)
+						reporter.reportError(ctx, startTime, status.Errorf(codes.Canceled, "client IO error"))
+						return false
+					}
 				case <-ctx.Done():
+					leaveFetch(true)
 					reporter.reportError(ctx, startTime, ctx.Err())
 					return false
-				case err := <-fetchDone:
-					if hasAllWants, checkErr := repo.hasAllWants(wantHashes, wantRefs); checkErr != nil {
+				case <-fetch.done:
+					err := fetch.err
+					if hasAllWants, checkErr := repo.hasAllWants(wantHashes, nil); checkErr != nil {
 						reporter.reportError(ctx, startTime, checkErr)
 						return false
 					} else if !hasAllWants {
+						if joined && err == nil {
+							// The fetch started before this
+							// request. Wait for a new one that
+							// has the objects pushed since then.
+							leaveFetch(false)
+							fetch, _, leaveFetch = repo.joinUpstreamFetch(ctx)
+							joined = false
+							continue
+						}
+						if err == nil {
+							err = categoryErrorf(ErrorCategoryNotFound, codes.NotFound, "the upstream doesn't have the wanted objects or refs")
+						}
 						reporter.reportError(ctx, startTime, err)
 						return false
 					}
 					break LOOP
 				case <-timer.C:
-					if hasAllWants, err := repo.hasAllWants(wantHashes, wantRefs); err != nil {
+					if hasAllWants, err := repo.hasAllWants(wantHashes, nil); err != nil {
 						reporter.reportError(ctx, startTime, err)
 						return false
 					} else if hasAllWants {
@@ -131,12 +291,38 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 				}
 			}
 			stats.Record(ctx, UpstreamFetchWaitingTime.M(int64(time.Now().Sub(fetchStartTime)/time.Millisecond)))
+			waitSpan.End()
+		} else {
+			recordCacheState(ctx, span, "locally-served")
+		}
+
+		if err := repo.ensureHistory(command); err != nil {
+			reporter.reportError(ctx, startTime, err)
+			return false
 		}
 
-		if err := repo.serveFetchLocal(command, w); err != nil {
+		if err := repo.checkWantsVisible(wantHashes, wantRefs); err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
+
+		served := &byteCountingWriter{w: w}
+		var out io.Writer = served
+		if packfileStarted {
+			out = &packfileHeaderStripper{w: served}
+		} else if offloaded, section, ok := repo.offloadBasePack(command); ok {
+			stats.Record(ctx, PackfileURIOffloadCount.M(1))
+			command = offloaded
+			out = &sectionInserter{w: out, section: section}
+		}
+		if len(wantRefs) != 0 {
+			out = &sectionInserter{w: out, section: wantedRefsSection(wantRefs, resolvedRefs)}
+		}
+		if err := serveFetchLocalTraced(ctx, repo, command, out); err != nil {
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
+		repo.recordCacheStats(cacheState, served.n)
 		reporter.reportError(ctx, startTime, nil)
 		return true
 	}
@@ -183,3 +369,61 @@ func parseFetchWants(chunks []*gitprotocolio.ProtocolV2RequestChunk) ([]plumbing
 	}
 	return hashes, refs, nil
 }
+
+// canSendKeepalive returns true if the fetch response consists of only the
+// packfile section. The other sections such as shallow-info precede the
+// packfile section, and they cannot be sent before the local upload-pack
+// runs.
+func canSendKeepalive(chunks []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	done := false
+	for _, ch := range chunks {
+		if ch.Argument == nil {
+			continue
+		}
+		s := strings.TrimSpace(string(ch.Argument))
+		switch {
+		case s == "done":
+			done = true
+		case strings.HasPrefix(s, "want-ref "), strings.HasPrefix(s, "shallow "), strings.HasPrefix(s, "deepen"), strings.HasPrefix(s, "packfile-uris "):
+			return false
+		}
+	}
+	return done
+}
+
+func hasFetchArgument(chunks []*gitprotocolio.ProtocolV2RequestChunk, arg string) bool {
+	for _, ch := range chunks {
+		if ch.Argument != nil && strings.TrimSpace(string(ch.Argument)) == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// recordCacheState records the cache state of the command to its span and
+// the request log.
+func recordCacheState(ctx context.Context, span *trace.Span, state string) {
+	span.AddAttributes(trace.StringAttribute("goblet.cache_state", state))
+	requestInfoFromContext(ctx).cacheState = state
+}
+
+// serveFetchLocalTraced runs serveFetchLocal in a span.
+func serveFetchLocalTraced(ctx context.Context, repo *managedRepository, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	_, span := trace.StartSpan(ctx, "goblet.uploadPack")
+	defer span.End()
+	return repo.serveFetchLocal(ctx, command, w)
+}
+
+// sidebandErrorReporter sends the error as a sideband error packet. This is
+// used after the packfile section is started.
+type sidebandErrorReporter struct {
+	gitProtocolErrorReporter
+	w io.Writer
+}
+
+func (r *sidebandErrorReporter) reportError(ctx context.Context, startTime time.Time, err error) {
+	if err != nil {
+		writePacket(r.w, gitprotocolio.SideBandErrorPacket(err.Error()))
+	}
+	r.gitProtocolErrorReporter.reportError(ctx, startTime, err)
+}
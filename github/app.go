@@ -0,0 +1,184 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package github
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/goblet"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultAPIURL is the REST API endpoint of github.com.
+	DefaultAPIURL = "https://api.github.com"
+
+	// appJWTLifetime is the lifetime of the JWTs that authenticate as the
+	// app. GitHub accepts up to 10 minutes.
+	appJWTLifetime = 9 * time.Minute
+)
+
+// AppConfig specifies a GitHub App installation.
+type AppConfig struct {
+	// AppID is the ID of the GitHub App.
+	AppID int64
+
+	// InstallationID is the ID of the installation of the app on the
+	// organization or the user that owns the repositories.
+	InstallationID int64
+
+	// PrivateKeyPEM is the private key of the app in the PEM format, as
+	// downloaded from the app settings.
+	PrivateKeyPEM []byte
+
+	// APIURL is the REST API endpoint. It defaults to DefaultAPIURL. For
+	// GitHub Enterprise Server, this is https://<host>/api/v3.
+	APIURL string
+}
+
+// NewAppTokenSource returns a TokenSource that authenticates as the GitHub App
+// installation. The installation access tokens are minted when needed and
+// reused until they expire in an hour. The tokens are of the "Basic" type so
+// that they can be used for the Git HTTP requests.
+func NewAppTokenSource(config *AppConfig) (oauth2.TokenSource, error) {
+	block, _ := pem.Decode(config.PrivateKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("cannot find a PEM block in the GitHub App private key")
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = k.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("the GitHub App private key is not an RSA key")
+		}
+	} else {
+		return nil, fmt.Errorf("cannot parse the GitHub App private key: %v", err)
+	}
+	apiURL := config.APIURL
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	return oauth2.ReuseTokenSource(nil, &appTokenSource{
+		appID:          config.AppID,
+		installationID: config.InstallationID,
+		key:            key,
+		apiURL:         strings.TrimSuffix(apiURL, "/"),
+	}), nil
+}
+
+type appTokenSource struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	apiURL         string
+}
+
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	jwt, err := s.appJWT(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/app/installations/%d/access_tokens", s.apiURL, s.installationID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create a GitHub App installation access token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("cannot create a GitHub App installation access token: %s %s", resp.Status, bs)
+	}
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("cannot parse the GitHub App installation access token: %v", err)
+	}
+	return &oauth2.Token{
+		// GitHub accepts the installation access tokens as the password
+		// of the basic authentication for Git.
+		AccessToken: base64.StdEncoding.EncodeToString([]byte("x-access-token:" + body.Token)),
+		TokenType:   "Basic",
+		Expiry:      body.ExpiresAt,
+	}, nil
+}
+
+// appJWT returns a JWT that authenticates as the app.
+func (s *appTokenSource) appJWT(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		// Backdate for the clock skew.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": fmt.Sprint(s.appID),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("cannot sign the GitHub App JWT: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// NewURLCanonicalizer returns a URLCanonializer for the repositories on host,
+// such as "github.com". The canonical URLs are
+// https://<host>/<owner>/<repo> in lower case, as GitHub is case-insensitive
+// for them.
+func NewURLCanonicalizer(host string) func(*url.URL) (*url.URL, error) {
+	return func(u *url.URL) (*url.URL, error) {
+		if !strings.EqualFold(u.Host, host) {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported host: %s", u.Host)
+		}
+		ss, err := goblet.SplitRepositoryPath(u.Path)
+		if err != nil || len(ss) != 2 {
+			return nil, status.Errorf(codes.InvalidArgument, "not a repository URL: %s", u)
+		}
+		return &url.URL{
+			Scheme: "https",
+			Host:   strings.ToLower(host),
+			Path:   "/" + strings.ToLower(strings.Join(ss, "/")),
+		}, nil
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitlab
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/google/goblet"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// personalAccessTokenUser is the username for the personal, project,
+	// and group access tokens. GitLab accepts any non-empty username for
+	// them.
+	personalAccessTokenUser = "oauth2"
+
+	// jobTokenUser is the username for the CI/CD job tokens.
+	jobTokenUser = "gitlab-ci-token"
+)
+
+// NewPersonalAccessTokenSource returns a TokenSource that authenticates with a
+// personal, project, or group access token. The token needs the read_repository
+// scope.
+func NewPersonalAccessTokenSource(token string) oauth2.TokenSource {
+	return basicTokenSource(personalAccessTokenUser, token)
+}
+
+// NewJobTokenSource returns a TokenSource that authenticates with a CI/CD job
+// token, such as $CI_JOB_TOKEN. The job tokens expire when the job finishes,
+// so this is for the servers that run within a job.
+func NewJobTokenSource(token string) oauth2.TokenSource {
+	return basicTokenSource(jobTokenUser, token)
+}
+
+// basicTokenSource returns a TokenSource of the "Basic" type, as GitLab takes
+// the tokens as the password of the basic authentication for Git.
+func basicTokenSource(user, token string) oauth2.TokenSource {
+	return oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: base64.StdEncoding.EncodeToString([]byte(user + ":" + token)),
+		TokenType:   "Basic",
+	})
+}
+
+// NewURLCanonicalizer returns a URLCanonializer for the repositories on host,
+// such as "gitlab.example.com". The canonical URLs are
+// https://<host>/<namespace>/<project> in lower case, as GitLab is
+// case-insensitive for them. The namespace can have subgroups. The web UI
+// paths after "/-/" are dropped. The http:// URLs are kept as is for the
+// instances without TLS.
+func NewURLCanonicalizer(host string) func(*url.URL) (*url.URL, error) {
+	return func(u *url.URL) (*url.URL, error) {
+		if !strings.EqualFold(u.Host, host) {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported host: %s", u.Host)
+		}
+		p := u.Path
+		if i := strings.Index(p, "/-/"); i >= 0 {
+			p = p[:i]
+		}
+		ss, err := goblet.SplitRepositoryPath(p)
+		if err != nil || len(ss) < 2 {
+			return nil, status.Errorf(codes.InvalidArgument, "not a repository URL: %s", u)
+		}
+		scheme := "https"
+		if u.Scheme == "http" {
+			scheme = "http"
+		}
+		return &url.URL{
+			Scheme: scheme,
+			Host:   strings.ToLower(host),
+			Path:   "/" + strings.ToLower(strings.Join(ss, "/")),
+		}, nil
+	}
+}
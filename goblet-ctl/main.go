@@ -0,0 +1,285 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// goblet-ctl operates a goblet server through its admin endpoints.
+//
+//	goblet-ctl [flags] list
+//	goblet-ctl [flags] evict <repo URL>
+//	goblet-ctl [flags] prefetch <repo URL>
+//	goblet-ctl [flags] stats
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	scopeCloudPlatform = "https://www.googleapis.com/auth/cloud-platform"
+	scopeUserInfoEmail = "https://www.googleapis.com/auth/userinfo.email"
+)
+
+var (
+	adminURL   = flag.String("admin_url", "http://localhost:8081", "URL of the goblet admin endpoints")
+	token      = flag.String("token", "", "Bearer token sent to the admin endpoints. The application default credentials are used if empty")
+	tenant     = flag.String("tenant", "", "Tenant of the repository for prefetch and evict. evict evicts the repository of all tenants if empty")
+	jsonOutput = flag.Bool("json", false, "Print the responses in JSON as-is")
+	timeout    = flag.Duration("timeout", 10*time.Minute, "Timeout of a command")
+)
+
+type repoInfo struct {
+	Tenant               string    `json:"tenant,omitempty"`
+	UpstreamURL          string    `json:"upstream_url"`
+	LastUpdateTime       time.Time `json:"last_update_time"`
+	FetchFreshnessWindow string    `json:"fetch_freshness_window"`
+	DiskUsageBytes       int64     `json:"disk_usage_bytes"`
+	Opened               bool      `json:"opened"`
+	Draining             bool      `json:"draining,omitempty"`
+}
+
+type cacheStats struct {
+	Hits          int64 `json:"hits"`
+	StaleHits     int64 `json:"stale_hits"`
+	Misses        int64 `json:"misses"`
+	HitBytes      int64 `json:"hit_bytes"`
+	StaleHitBytes int64 `json:"stale_hit_bytes"`
+	MissBytes     int64 `json:"miss_bytes"`
+}
+
+type repoStats struct {
+	Tenant      string `json:"tenant,omitempty"`
+	UpstreamURL string `json:"upstream_url"`
+	cacheStats
+}
+
+type serverStats struct {
+	Total        cacheStats   `json:"total"`
+	Repositories []*repoStats `json:"repositories"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] list|evict <repo URL>|prefetch <repo URL>|stats\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	err := run(os.Stdout, flag.Args())
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// errUsage is returned by run if the arguments are not a command.
+var errUsage = errors.New("unknown command")
+
+// run runs the command of args, and writes its output to w.
+func run(w io.Writer, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		return list(w)
+	case len(args) == 2 && (args[0] == "evict" || args[0] == "prefetch"):
+		params := url.Values{}
+		if *tenant != "" {
+			params.Set("tenant", *tenant)
+		}
+		path := "/admin/repos/refresh"
+		if args[0] == "evict" {
+			path = "/admin/repos/evict"
+		}
+		return repoCommand(w, path, args[1], params)
+	case len(args) == 1 && args[0] == "stats":
+		return stats(w)
+	}
+	return errUsage
+}
+
+func list(w io.Writer) error {
+	bs, err := call("GET", "/admin/repos", nil)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		w.Write(bs)
+		return nil
+	}
+	var repos []*repoInfo
+	if err := json.Unmarshal(bs, &repos); err != nil {
+		return fmt.Errorf("cannot parse the response: %v", err)
+	}
+	printRepos(w, repos)
+	return nil
+}
+
+// repoCommand runs an admin command for a repository. evict drains the opened
+// repositories so that their in-flight requests can complete before they're
+// removed.
+func repoCommand(w io.Writer, path, repo string, params url.Values) error {
+	params.Set("url", repo)
+	bs, err := call("POST", path, params)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		w.Write(bs)
+		return nil
+	}
+	var repos []*repoInfo
+	if bytes.HasPrefix(bytes.TrimSpace(bs), []byte("[")) {
+		err = json.Unmarshal(bs, &repos)
+	} else {
+		r := &repoInfo{}
+		err = json.Unmarshal(bs, r)
+		repos = append(repos, r)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse the response: %v", err)
+	}
+	printRepos(w, repos)
+	return nil
+}
+
+// stats shows the cache hits and misses counted since the server started.
+func stats(w io.Writer) error {
+	bs, err := call("GET", "/admin/repos/stats", nil)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		w.Write(bs)
+		return nil
+	}
+	st := &serverStats{}
+	if err := json.Unmarshal(bs, st); err != nil {
+		return fmt.Errorf("cannot parse the response: %v", err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TENANT\tURL\tHITS\tSTALE HITS\tMISSES\tHIT RATIO\tSERVED")
+	for _, r := range st.Repositories {
+		printStats(tw, r.Tenant, r.UpstreamURL, &r.cacheStats)
+	}
+	printStats(tw, "", "(total)", &st.Total)
+	return tw.Flush()
+}
+
+func printStats(w io.Writer, tenant, upstreamURL string, st *cacheStats) {
+	if tenant == "" {
+		tenant = "-"
+	}
+	ratio := "-"
+	if n := st.Hits + st.StaleHits + st.Misses; n != 0 {
+		ratio = fmt.Sprintf("%.1f%%", float64(st.Hits+st.StaleHits)*100/float64(n))
+	}
+	fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", tenant, upstreamURL, st.Hits, st.StaleHits, st.Misses, ratio, formatBytes(st.HitBytes+st.StaleHitBytes+st.MissBytes))
+}
+
+func printRepos(out io.Writer, repos []*repoInfo) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tURL\tLAST FETCH\tDISK\tSTATE")
+	for _, r := range repos {
+		tenant := r.Tenant
+		if tenant == "" {
+			tenant = "-"
+		}
+		lastFetch := "never"
+		if !r.LastUpdateTime.IsZero() {
+			lastFetch = r.LastUpdateTime.Format(time.RFC3339)
+		}
+		state := "on disk"
+		if r.Draining {
+			state = "draining"
+		} else if r.Opened {
+			state = "opened"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", tenant, r.UpstreamURL, lastFetch, formatBytes(r.DiskUsageBytes), state)
+	}
+	w.Flush()
+}
+
+func call(method, path string, params url.Values) ([]byte, error) {
+	u := strings.TrimSuffix(*adminURL, "/") + path
+	if len(params) != 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	t, err := tokenSource().Token()
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain an access token: %v", err)
+	}
+	t.SetAuthHeader(req)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(bs)))
+	}
+	return bs, nil
+}
+
+func tokenSource() oauth2.TokenSource {
+	if *token != "" {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: *token})
+	}
+	ts, err := google.DefaultTokenSource(context.Background(), scopeCloudPlatform, scopeUserInfoEmail)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot initialize the OAuth2 token source: %v\n", err)
+		os.Exit(1)
+	}
+	return ts
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
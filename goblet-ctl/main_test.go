@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestCommands(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+	})
+	defer ts.Close()
+	admin := httptest.NewServer(goblet.AdminHandler(ts.ServerConfig))
+	defer admin.Close()
+	defer func(oldURL, oldToken string) { *adminURL, *token = oldURL, oldToken }(*adminURL, *token)
+	*adminURL = admin.URL
+	*token = goblettest.ValidClientAuthToken
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	repoURL := strings.TrimSuffix(ts.ProxyServerURL, "/")
+	upstreamURL := strings.TrimSuffix(ts.UpstreamServerURL, "/")
+
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		tenant string
+		want   []string
+	}{
+		{name: "prefetch", args: []string{"prefetch", repoURL}, want: []string{upstreamURL, "opened"}},
+		{name: "list", args: []string{"list"}, want: []string{upstreamURL, "opened"}},
+		{name: "stats", args: []string{"stats"}, want: []string{"HIT RATIO", "(total)"}},
+		{name: "evict another tenant", args: []string{"evict", repoURL}, tenant: "other", want: nil},
+		{name: "evict", args: []string{"evict", repoURL}, want: []string{upstreamURL, "draining"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func(old string) { *tenant = old }(*tenant)
+			*tenant = tc.tenant
+
+			out := new(bytes.Buffer)
+			err := run(out, tc.args)
+			if tc.want == nil {
+				if err == nil || !strings.Contains(err.Error(), "404") {
+					t.Errorf("got %v, want a not found error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.want {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("got %q, want %q in the output", out.String(), s)
+				}
+			}
+		})
+	}
+
+	// The drained repository is evicted in the background.
+	for i := 0; ; i++ {
+		out := new(bytes.Buffer)
+		if err := run(out, []string{"list"}); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), upstreamURL) {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("got %q, want the evicted repository not to be listed", out.String())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := run(new(bytes.Buffer), []string{"evict"}); err != errUsage {
+		t.Errorf("got %v, want %v", err, errUsage)
+	}
+}
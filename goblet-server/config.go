@@ -0,0 +1,693 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/goblet"
+	bitbuckethook "github.com/google/goblet/bitbucket"
+	githubhook "github.com/google/goblet/github"
+	gitlabhook "github.com/google/goblet/gitlab"
+	googlehook "github.com/google/goblet/google"
+	"github.com/google/goblet/oidc"
+	"github.com/google/goblet/redis"
+	"github.com/google/goblet/secrets"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"gopkg.in/yaml.v2"
+)
+
+// reloadMu serializes the reloads from SIGHUP and the admin endpoint.
+var reloadMu sync.Mutex
+
+// readConfigFile reads a YAML file that maps the flag names to the values.
+//
+// A list is joined with commas, and a mapping is converted to comma-separated
+// key=value pairs, so that they can be written in the format the
+// corresponding flag takes. For example,
+//
+//	cache_root: /var/cache/goblet
+//	fetch_freshness_window: 1m
+//	hidden_refs:
+//	  - refs/heads/internal
+//	upstream_host_ips:
+//	  github.com: 140.82.112.3
+func readConfigFile(path string) (map[string]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the config file: %v", err)
+	}
+	m := map[string]interface{}{}
+	if err := yaml.UnmarshalStrict(bs, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse the config file %s: %v", path, err)
+	}
+	values := map[string]string{}
+	for name, v := range m {
+		s, err := configValueString(v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %s in the config file %s: %v", name, path, err)
+		}
+		values[name] = s
+	}
+	return values, nil
+}
+
+func configValueString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		ss := []string{}
+		for _, e := range v {
+			s, err := configScalarString(e)
+			if err != nil {
+				return "", err
+			}
+			ss = append(ss, s)
+		}
+		return strings.Join(ss, ","), nil
+	case map[interface{}]interface{}:
+		ss := []string{}
+		for k, e := range v {
+			ks, err := configScalarString(k)
+			if err != nil {
+				return "", err
+			}
+			es, err := configScalarString(e)
+			if err != nil {
+				return "", err
+			}
+			ss = append(ss, ks+"="+es)
+		}
+		sort.Strings(ss)
+		return strings.Join(ss, ","), nil
+	}
+	return configScalarString(v)
+}
+
+func configScalarString(v interface{}) (string, error) {
+	switch v.(type) {
+	case []interface{}, map[interface{}]interface{}:
+		return "", fmt.Errorf("nested value %v is not supported", v)
+	}
+	return fmt.Sprint(v), nil
+}
+
+// applyConfigFile sets the flags from the config file. The flags specified on
+// the command line take precedence over the config file, and the other flags
+// not in the config file are reset to their defaults so that a setting
+// removed from the file is reverted on a reload.
+func applyConfigFile(fs *flag.FlagSet, path string, commandLineFlags map[string]bool) error {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for name := range values {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %s in the config file %s", name, path)
+		}
+	}
+	var setErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if setErr != nil || f.Name == "config" || commandLineFlags[f.Name] {
+			return
+		}
+		value, ok := values[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			setErr = fmt.Errorf("cannot set %s from the config file %s: %v", f.Name, path, err)
+		}
+	})
+	return setErr
+}
+
+// cacheRoots returns the directories of -cache_root.
+func cacheRoots() []string {
+	return strings.Split(*cacheRoot, ",")
+}
+
+// newServerConfig creates a ServerConfig from the flags. The loggers and the
+// reporters are not set.
+func newServerConfig(ts oauth2.TokenSource, googleAuthorizer func(*http.Request) error) (*goblet.ServerConfig, error) {
+	authorizer, identifier, err := newRequestAuthorizer(googleAuthorizer)
+	if err != nil {
+		return nil, err
+	}
+	config := &goblet.ServerConfig{
+		LocalDiskCacheRoot:       cacheRoots()[0],
+		CacheShardRoots:          cacheRoots()[1:],
+		CrossProcessLocking:      *crossProcessLocking,
+		LFSCacheRoot:             *lfsCacheRoot,
+		LFSCacheMaxBytes:         *lfsCacheMaxBytes,
+		PackCacheRoot:            *packCacheRoot,
+		PackCacheMaxBytes:        *packCacheMaxBytes,
+		BundleRoot:               *bundleRoot,
+		BundleMaxAge:             *bundleMaxAge,
+		BundleBaseURL:            *bundleBaseURL,
+		PackfileURIMinBytes:      *packfileURIMinBytes,
+		PackfileURIMaxAge:        *packfileURIMaxAge,
+		URLCanonializer:          googlehook.CanonicalizeURL,
+		RequestAuthorizer:        authorizer,
+		ClientIdentifier:         identifier,
+		ClientRateLimit:          *clientRateLimit,
+		ClientRateBurst:          *clientRateBurst,
+		TokenSource:              ts,
+		AccessLogFile:            *accessLogFile,
+		AccessLogFormat:          *accessLogFormat,
+		AccessLogMaxBytes:        *accessLogMaxBytes,
+		AccessLogMaxAge:          *accessLogMaxAge,
+		AccessLogMaxBackups:      *accessLogMaxBackups,
+		FetchFreshnessWindow:     *fetchFreshnessWindow,
+		HeadOnlyCacheTTL:         *headOnlyCacheTTL,
+		NegativeCacheTTL:         *negativeCacheTTL,
+		PackServeTimeout:         *packServeTimeout,
+		RequestTimeout:           *requestTimeout,
+		CloneTimeout:             *cloneTimeout,
+		UpstreamLsRefsTimeout:    *upstreamLsRefsTimeout,
+		UpstreamFetchTimeout:     *upstreamFetchTimeout,
+		RetryPackServe:           *retryPackServe,
+		CoalesceFetches:          *coalesceFetches,
+		DNSCacheTTL:              *dnsCacheTTL,
+		UpstreamProxy:            *upstreamProxy,
+		UpstreamRetries:          *upstreamRetries,
+		UpstreamRetryBackoff:     *upstreamRetryBackoff,
+		UpstreamRetryBudget:      *upstreamRetryBudget,
+		CircuitErrorRate:         *circuitErrorRate,
+		CircuitMinRequests:       *circuitMinRequests,
+		CircuitOpenDuration:      *circuitOpenDuration,
+		ServeStaleOnFailure:      *serveStaleOnFailure,
+		Offline:                  *offline,
+		ShedDuringEviction:       *shedDuringEviction,
+		MaxCacheBytes:            *maxCacheSize,
+		IdleRepositoryTTL:        *idleRepositoryTTL,
+		HotRepositoryCount:       *hotRepositories,
+		MaintenanceInterval:      *maintenanceInterval,
+		MaxConcurrentMaintenance: *maxConcurrentMaintenance,
+		MaxNegotiationRounds:     *maxNegotiationRounds,
+		MaxRequestBytes:          *maxRequestBytes,
+		RequestMemoryBudget:      *requestMemoryBudget,
+		MaxUpstreamFetches:       *maxUpstreamFetches,
+		MaxUploadPacks:           *maxUploadPacks,
+		MaxRepoRequests:          *maxRepoRequests,
+		ForceUpstreamHTTPS:       *forceUpstreamHTTPS,
+		MaxConcurrentFetches:     *maxConcurrentFetches,
+		ShedLowPriority:          *shedLowPriority,
+		RepositoryMetricTag:      *repositoryMetricTag,
+		MaxRepositoryTagValues:   *maxRepositoryTagValues,
+	}
+	if *highPriorityClients != "" {
+		config.HighPriorityClients = strings.Split(*highPriorityClients, ",")
+	}
+	if *plaintextUpstreamHosts != "" {
+		config.PlaintextUpstreamHosts = strings.Split(*plaintextUpstreamHosts, ",")
+	}
+	if *upstreamNoProxy != "" {
+		config.UpstreamNoProxy = strings.Split(*upstreamNoProxy, ",")
+	}
+	if *clusterReplicas != "" {
+		config.ClusterReplicas = strings.Split(*clusterReplicas, ",")
+		config.ClusterSelf = *clusterSelf
+		found := false
+		for _, replica := range config.ClusterReplicas {
+			found = found || replica == *clusterSelf
+		}
+		if !found {
+			return nil, fmt.Errorf("-cluster_self %q is not in -cluster_replicas", *clusterSelf)
+		}
+	}
+	if *fetchStateRedisAddr != "" {
+		config.FetchStateStore = redis.NewFetchStateStore(*fetchStateRedisAddr)
+	}
+	if *readinessCanaryURL != "" {
+		u, err := url.Parse(*readinessCanaryURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse -readiness_canary_url: %v", err)
+		}
+		config.ReadinessCanaryURL = u
+	}
+	if *peerURL != "" {
+		config.PeerURL = newPeerURL(*peerURL)
+	}
+	if *accessLogFormat != "json" && *accessLogFormat != "combined" {
+		return nil, fmt.Errorf("unknown -access_log_format %q", *accessLogFormat)
+	}
+	if *allowedClientCapabilities != "" {
+		config.AllowedClientCapabilities = strings.Split(*allowedClientCapabilities, ",")
+	}
+	// The credentials for GitHub, GitLab, and Bitbucket are used only for
+	// their hosts, and the Google ones for the others.
+	providers := []goblet.UpstreamCredentialProvider{}
+	canonicalizers := []func(*url.URL) (*url.URL, error){}
+	secretsConfig := &secrets.Config{
+		GoogleTokenSource: ts,
+		VaultAddr:         *vaultAddr,
+		VaultTokenFile:    *vaultTokenFile,
+	}
+	if *githubAppID != 0 {
+		fetch, err := secretFetcher(secretsConfig, *githubAppPrivateKeyFile, *githubAppPrivateKeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the GitHub App private key: %v", err)
+		}
+		pem, err := fetch()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the GitHub App private key: %v", err)
+		}
+		ts, err := githubhook.NewAppTokenSource(&githubhook.AppConfig{
+			AppID:          *githubAppID,
+			InstallationID: *githubAppInstallationID,
+			PrivateKeyPEM:  []byte(pem),
+			APIURL:         *githubAPIURL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, goblet.NewTokenSourceCredentialProvider(*githubHost, ts))
+		canonicalizers = append(canonicalizers, githubhook.NewURLCanonicalizer(*githubHost))
+	}
+	if *webhookSecretFile != "" || *webhookSecretSecret != "" {
+		fetch, err := secretFetcher(secretsConfig, *webhookSecretFile, *webhookSecretSecret)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the webhook secret: %v", err)
+		}
+		secret, err := fetch()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the webhook secret: %v", err)
+		}
+		config.WebhookSecret = secret
+		config.WebhookGerritURL = *gerritURL
+	}
+	if *clusterSecretFile != "" || *clusterSecretSecret != "" {
+		fetch, err := secretFetcher(secretsConfig, *clusterSecretFile, *clusterSecretSecret)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the cluster secret: %v", err)
+		}
+		secret, err := fetch()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the cluster secret: %v", err)
+		}
+		config.ClusterSecret = secret
+	}
+	if *gitlabTokenFile != "" || *gitlabTokenSecret != "" {
+		var newTokenSource func(string) oauth2.TokenSource
+		switch *gitlabTokenKind {
+		case "personal":
+			newTokenSource = gitlabhook.NewPersonalAccessTokenSource
+		case "job":
+			newTokenSource = gitlabhook.NewJobTokenSource
+		default:
+			return nil, fmt.Errorf("unknown -gitlab_token_kind %q", *gitlabTokenKind)
+		}
+		ts, err := secretTokenSource(secretsConfig, *gitlabTokenFile, *gitlabTokenSecret, newTokenSource)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the GitLab token: %v", err)
+		}
+		providers = append(providers, goblet.NewTokenSourceCredentialProvider(*gitlabHost, ts))
+		canonicalizers = append(canonicalizers, gitlabhook.NewURLCanonicalizer(*gitlabHost))
+	}
+	if *bitbucketTokenFile != "" || *bitbucketTokenSecret != "" {
+		var newTokenSource func(string) oauth2.TokenSource
+		switch {
+		case *bitbucketUsername != "":
+			newTokenSource = func(password string) oauth2.TokenSource {
+				return bitbuckethook.NewPasswordTokenSource(*bitbucketUsername, password)
+			}
+		case *bitbucketServerHost != "":
+			newTokenSource = bitbuckethook.NewServerAccessTokenSource
+		default:
+			newTokenSource = bitbuckethook.NewCloudAccessTokenSource
+		}
+		ts, err := secretTokenSource(secretsConfig, *bitbucketTokenFile, *bitbucketTokenSecret, newTokenSource)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the Bitbucket token: %v", err)
+		}
+		if *bitbucketServerHost != "" {
+			providers = append(providers, goblet.NewTokenSourceCredentialProvider(*bitbucketServerHost, ts))
+			canonicalizers = append(canonicalizers, bitbuckethook.NewServerURLCanonicalizer(*bitbucketServerHost))
+		} else {
+			providers = append(providers, goblet.NewTokenSourceCredentialProvider(bitbuckethook.CloudHost, ts))
+			canonicalizers = append(canonicalizers, bitbuckethook.NewCloudURLCanonicalizer())
+		}
+	}
+	switch {
+	case *urlRewriteRulesFile != "":
+		rules, err := readURLRewriteRules(*urlRewriteRulesFile, secretsConfig)
+		if err != nil {
+			return nil, err
+		}
+		if config.URLCanonializer, err = goblet.NewRuleURLCanonicalizer(rules); err != nil {
+			return nil, err
+		}
+		// The tokens of the rules take precedence over the ones of the
+		// hosts.
+		providers = append([]goblet.UpstreamCredentialProvider{goblet.NewRuleCredentialProvider(rules)}, providers...)
+	case len(canonicalizers) > 1:
+		return nil, fmt.Errorf("-url_rewrite_rules_file is required to serve more than one of GitHub, GitLab, and Bitbucket")
+	case len(canonicalizers) == 1:
+		config.URLCanonializer = canonicalizers[0]
+	}
+	if len(providers) != 0 {
+		config.UpstreamCredentialProvider = goblet.ChainUpstreamCredentialProviders(providers...)
+	}
+	if *accessRulesFile != "" {
+		if config.AccessRules, err = readAccessRules(*accessRulesFile); err != nil {
+			return nil, err
+		}
+	}
+	switch *pushPolicy {
+	case "reject":
+		config.PushPolicy = goblet.PushReject
+	case "server-credentials":
+		config.PushPolicy = goblet.PushWithServerCredentials
+	case "client-credentials":
+		config.PushPolicy = goblet.PushWithClientCredentials
+	default:
+		return nil, fmt.Errorf("unknown -push_policy %q", *pushPolicy)
+	}
+	if config.GerritChangeRefPolicy, err = googlehook.ParseGerritChangeRefPolicy(*gerritChangeRefs); err != nil {
+		return nil, err
+	}
+	if *hiddenRefs != "" {
+		config.HiddenRefs = strings.Split(*hiddenRefs, ",")
+	}
+	if *tenantHeader != "" {
+		header := *tenantHeader
+		config.TenantExtractor = func(r *http.Request) string {
+			return r.Header.Get(header)
+		}
+	}
+	config.UpstreamTransport = &goblet.UpstreamTransport{
+		MaxIdleConns:        *upstreamMaxIdleConns,
+		MaxIdleConnsPerHost: *upstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:     *upstreamMaxConnsPerHost,
+		IdleConnTimeout:     *upstreamIdleConnTimeout,
+		KeepAlive:           *upstreamKeepAlive,
+		DisableHTTP2:        *upstreamDisableHTTP2,
+	}
+	if config.UpstreamTLS, err = newUpstreamTLS(); err != nil {
+		return nil, err
+	}
+	if *upstreamHostIPs != "" {
+		config.UpstreamHostIPs = map[string]string{}
+		for _, pair := range strings.Split(*upstreamHostIPs, ",") {
+			ss := strings.SplitN(pair, "=", 2)
+			if len(ss) != 2 || net.ParseIP(ss[1]) == nil {
+				return nil, fmt.Errorf("cannot parse %q as host=ip", pair)
+			}
+			config.UpstreamHostIPs[ss[0]] = ss[1]
+		}
+	}
+	if *rejectShallowCache && *deepenShallowCache {
+		return nil, fmt.Errorf("-reject_shallow_cache and -deepen_shallow_cache cannot be set together")
+	}
+	if *rejectShallowCache {
+		config.ShallowCachePolicy = goblet.ShallowCacheReject
+	}
+	if *deepenShallowCache {
+		config.ShallowCachePolicy = goblet.ShallowCacheDeepen
+	}
+	if *keepForcePushedObjects > 0 {
+		config.ForcePushPolicy = goblet.ForcePushKeepOldObjects
+		config.ForcePushGracePeriod = *keepForcePushedObjects
+	}
+	if *fetchFreshnessOverrides != "" {
+		for _, pair := range strings.Split(*fetchFreshnessOverrides, ",") {
+			ss := strings.SplitN(pair, "=", 2)
+			if len(ss) != 2 {
+				return nil, fmt.Errorf("cannot parse %q as pattern=duration", pair)
+			}
+			d, err := time.ParseDuration(ss[1])
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %q as pattern=duration: %v", pair, err)
+			}
+			config.RepoOverrides = append(config.RepoOverrides, &goblet.RepoOverride{
+				Pattern:              ss[0],
+				FetchFreshnessWindow: d,
+			})
+		}
+	}
+	if *warmRepositories != "" {
+		config.WarmRepositories = strings.Split(*warmRepositories, ",")
+	}
+	if *objectPools != "" {
+		for _, pair := range strings.Split(*objectPools, ",") {
+			ss := strings.SplitN(pair, "=", 2)
+			if len(ss) != 2 || ss[1] == "" || strings.ContainsAny(ss[1], `/\`) {
+				return nil, fmt.Errorf("cannot parse %q as pattern=name", pair)
+			}
+			config.RepoOverrides = append(config.RepoOverrides, &goblet.RepoOverride{
+				Pattern:    ss[0],
+				ObjectPool: ss[1],
+			})
+		}
+	}
+	return config, nil
+}
+
+// readAccessRules reads a YAML list of the access rules. For example,
+//
+//	# Team A's builders can fetch only Team A's repositories.
+//	- identities: ["spiffe://example.com/team-a/*"]
+//	  source_ranges: ["10.0.0.0/8"]
+//	  repos: ["github.com/team-a/*"]
+func readAccessRules(path string) ([]*goblet.AccessRule, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the access rules: %v", err)
+	}
+	var entries []struct {
+		Identities   []string `yaml:"identities"`
+		SourceRanges []string `yaml:"source_ranges"`
+		Repos        []string `yaml:"repos"`
+	}
+	if err := yaml.UnmarshalStrict(bs, &entries); err != nil {
+		return nil, fmt.Errorf("cannot parse the access rules %s: %v", path, err)
+	}
+	rules := []*goblet.AccessRule{}
+	for _, e := range entries {
+		rule := &goblet.AccessRule{Identities: e.Identities, Repos: e.Repos}
+		for _, cidr := range e.SourceRanges {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %q in the access rules %s as CIDR: %v", cidr, path, err)
+			}
+			rule.SourceRanges = append(rule.SourceRanges, n)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// secretFetcher returns the Fetcher of the secret in the file or the secret
+// reference. Only one of them can be specified.
+func secretFetcher(config *secrets.Config, file, ref string) (secrets.Fetcher, error) {
+	if file != "" && ref != "" {
+		return nil, fmt.Errorf("both a file and a secret reference are specified")
+	}
+	if file != "" {
+		ref = "file:" + file
+	}
+	return config.Fetcher(ref)
+}
+
+// secretTokenSource returns a TokenSource of the secret in the file or the
+// secret reference that is refetched every -secret_refresh_interval.
+func secretTokenSource(config *secrets.Config, file, ref string, newTokenSource func(string) oauth2.TokenSource) (oauth2.TokenSource, error) {
+	fetch, err := secretFetcher(config, file, ref)
+	if err != nil {
+		return nil, err
+	}
+	return secrets.NewRotatingTokenSource(fetch, *secretRefreshInterval, newTokenSource)
+}
+
+// newPeerURL returns a PeerURL that replaces $host and $path in the template
+// with the ones of the upstream URL. For example,
+// "https://goblet-us.example.com/$host$path" maps
+// https://go.googlesource.com/net to
+// https://goblet-us.example.com/go.googlesource.com/net.
+func newPeerURL(template string) func(*url.URL) (*url.URL, error) {
+	return func(u *url.URL) (*url.URL, error) {
+		return url.Parse(os.Expand(template, func(name string) string {
+			switch name {
+			case "host":
+				return u.Host
+			case "path":
+				return u.Path
+			}
+			return "$" + name
+		}))
+	}
+}
+
+// readURLRewriteRules reads a YAML list of the URL rewrite rules. A rule can
+// have a token, in a file or a secret reference, that its upstream URLs are
+// fetched with. The token is sent as the password of the basic
+// authentication if a username is set, and as a bearer token otherwise. For
+// example,
+//
+//	# Serve git.example.com/<repo> from upstream.example.com.
+//	- match: git\.example\.com/(.+?)(\.git)?
+//	  upstream: https://upstream.example.com/$1
+//	# Serve /github/<owner>/<repo> from GitHub and /gob/<host>/<repo> from
+//	# googlesource.com with the server credentials.
+//	- match: '[^/]+/github/(.+?)(\.git)?'
+//	  upstream: https://github.com/$1
+//	  username: x-access-token
+//	  token_file: /etc/goblet/github-token
+//	- match: '[^/]+/gob/([^/]+)/(.+?)(\.git)?'
+//	  upstream: https://$1.googlesource.com/$2
+func readURLRewriteRules(path string, secretsConfig *secrets.Config) ([]*goblet.URLRewriteRule, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the URL rewrite rules: %v", err)
+	}
+	var entries []struct {
+		Match       string `yaml:"match"`
+		Upstream    string `yaml:"upstream"`
+		Username    string `yaml:"username"`
+		TokenFile   string `yaml:"token_file"`
+		TokenSecret string `yaml:"token_secret"`
+	}
+	if err := yaml.UnmarshalStrict(bs, &entries); err != nil {
+		return nil, fmt.Errorf("cannot parse the URL rewrite rules %s: %v", path, err)
+	}
+	rules := []*goblet.URLRewriteRule{}
+	for _, e := range entries {
+		if e.Match == "" || e.Upstream == "" {
+			return nil, fmt.Errorf("a URL rewrite rule in %s has no match or upstream", path)
+		}
+		rule := &goblet.URLRewriteRule{Pattern: e.Match, Upstream: e.Upstream}
+		if e.TokenFile != "" || e.TokenSecret != "" {
+			username := e.Username
+			ts, err := secretTokenSource(secretsConfig, e.TokenFile, e.TokenSecret, func(token string) oauth2.TokenSource {
+				if username == "" {
+					return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token, TokenType: "Bearer"})
+				}
+				return oauth2.StaticTokenSource(&oauth2.Token{
+					AccessToken: base64.StdEncoding.EncodeToString([]byte(username + ":" + token)),
+					TokenType:   "Basic",
+				})
+			})
+			if err != nil {
+				return nil, fmt.Errorf("cannot read the token of the URL rewrite rule %q: %v", e.Match, err)
+			}
+			rule.TokenSource = ts
+		} else if e.Username != "" {
+			return nil, fmt.Errorf("the URL rewrite rule %q has a username but no token", e.Match)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// newRequestAuthorizer returns the authorizer of the Git requests and the
+// identifier of the clients. This is the OpenID Connect one with
+// -oidc_issuer, which identifies the clients by the subjects of their tokens,
+// and googleAuthorizer otherwise, with which the clients are identified by
+// their TLS client certificates.
+func newRequestAuthorizer(googleAuthorizer func(*http.Request) error) (func(*http.Request) error, func(*http.Request) string, error) {
+	if *oidcIssuer == "" {
+		return googleAuthorizer, nil, nil
+	}
+	if *oidcAudience == "" {
+		return nil, nil, fmt.Errorf("-oidc_audience is required with -oidc_issuer")
+	}
+	v, err := oidc.NewVerifier(*oidcIssuer, *oidcAudience)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v.Authorize, v.Subject, nil
+}
+
+// reloadSettings applies the config file to the flags again, and updates the
+// settings of the config that can be changed while the server is running,
+// including the OAuth2 credentials and the blocked repositories.
+func reloadSettings(config *goblet.ServerConfig, commandLineFlags map[string]bool) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if *configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, *configFile, commandLineFlags); err != nil {
+			return err
+		}
+	}
+	ts, err := google.DefaultTokenSource(context.Background(), scopeCloudPlatform, scopeUserInfoEmail)
+	if err != nil {
+		return fmt.Errorf("cannot initialize the OAuth2 token source: %v", err)
+	}
+	authorizer, err := googlehook.NewRequestAuthorizer(ts)
+	if err != nil {
+		return fmt.Errorf("cannot create a request authorizer: %v", err)
+	}
+	newConfig, err := newServerConfig(ts, authorizer)
+	if err != nil {
+		return err
+	}
+	if err := goblet.UpdateSettings(config, newConfig); err != nil {
+		return err
+	}
+	log.Printf("Reloaded the settings")
+
+	if sshAuthorizedKeys != nil {
+		if err := sshAuthorizedKeys.reload(); err != nil {
+			return err
+		}
+		log.Printf("Reloaded the SSH authorized keys")
+	}
+
+	if tlsCertificates != nil {
+		if err := tlsCertificates.reload(); err != nil {
+			return err
+		}
+		log.Printf("Reloaded the TLS certificate")
+	}
+
+	if *blockedReposFile != "" {
+		patterns, err := readRepoPatterns(*blockedReposFile)
+		if err != nil {
+			return err
+		}
+		if err := goblet.UpdateBlockedRepos(config, patterns); err != nil {
+			return fmt.Errorf("cannot update the blocked repositories: %v", err)
+		}
+		log.Printf("Reloaded %d blocked repository patterns", len(patterns))
+	}
+	if *allowedReposFile != "" {
+		patterns, err := readRepoPatterns(*allowedReposFile)
+		if err != nil {
+			return err
+		}
+		if err := goblet.UpdateAllowedRepos(config, patterns); err != nil {
+			return fmt.Errorf("cannot update the allowed repositories: %v", err)
+		}
+		log.Printf("Reloaded %d allowed repository patterns", len(patterns))
+	}
+	return nil
+}
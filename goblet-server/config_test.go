@@ -0,0 +1,193 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "goblet_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "goblet.yaml")
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestReadConfigFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "scalars",
+			content: "cache_root: /var/cache/goblet\nfetch_freshness_window: 1m\nmax_upload_packs: 8\nforce_upstream_https: true\n",
+			want: map[string]string{
+				"cache_root":             "/var/cache/goblet",
+				"fetch_freshness_window": "1m",
+				"max_upload_packs":       "8",
+				"force_upstream_https":   "true",
+			},
+		},
+		{
+			name:    "list",
+			content: "hidden_refs:\n  - refs/heads/internal\n  - refs/heads/secret\n",
+			want:    map[string]string{"hidden_refs": "refs/heads/internal,refs/heads/secret"},
+		},
+		{
+			name:    "mapping",
+			content: "upstream_host_ips:\n  github.com: 140.82.112.3\n  gitlab.com: 172.65.251.78\n",
+			want:    map[string]string{"upstream_host_ips": "github.com=140.82.112.3,gitlab.com=172.65.251.78"},
+		},
+		{
+			name:    "empty value",
+			content: "hidden_refs:\n",
+			want:    map[string]string{"hidden_refs": ""},
+		},
+		{
+			name:    "nested list",
+			content: "hidden_refs:\n  - [refs/heads/internal]\n",
+			wantErr: "nested value",
+		},
+		{
+			name:    "duplicate setting",
+			content: "cache_root: /a\ncache_root: /b\n",
+			wantErr: "cannot parse the config file",
+		},
+		{
+			name:    "not a mapping",
+			content: "- cache_root\n",
+			wantErr: "cannot parse the config file",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := writeConfigFile(t, tc.content)
+			defer os.RemoveAll(filepath.Dir(p))
+
+			got, err := readConfigFile(p)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got %v, want an error with %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := readConfigFile(filepath.Join(os.TempDir(), "goblet_missing.yaml")); err == nil || !strings.Contains(err.Error(), "cannot read the config file") {
+		t.Errorf("got %v, want an error for the missing file", err)
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		commandLine []string
+		content     string
+		want        map[string]string
+		wantErr     string
+	}{
+		{
+			name:    "file",
+			content: "cache_root: /var/cache/goblet\nmax_upload_packs: 8\n",
+			want:    map[string]string{"cache_root": "/var/cache/goblet", "max_upload_packs": "8", "fetch_freshness_window": "0s"},
+		},
+		{
+			name:        "command line takes precedence",
+			commandLine: []string{"-cache_root=/tmp/goblet", "-max_upload_packs=0"},
+			content:     "cache_root: /var/cache/goblet\nmax_upload_packs: 8\nfetch_freshness_window: 1m\n",
+			want:        map[string]string{"cache_root": "/tmp/goblet", "max_upload_packs": "0", "fetch_freshness_window": "1m0s"},
+		},
+		{
+			name:    "removed setting is reverted",
+			content: "cache_root: /var/cache/goblet\n",
+			want:    map[string]string{"cache_root": "/var/cache/goblet", "max_upload_packs": "4", "fetch_freshness_window": "0s"},
+		},
+		{
+			name:    "unknown setting",
+			content: "cache_rot: /var/cache/goblet\n",
+			wantErr: "unknown setting cache_rot",
+		},
+		{
+			name:    "config in the config file",
+			content: "config: /etc/goblet.yaml\n",
+			wantErr: "unknown setting config",
+		},
+		{
+			name:    "invalid value",
+			content: "max_upload_packs: many\n",
+			wantErr: "cannot set max_upload_packs",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("goblet-server", flag.ContinueOnError)
+			fs.String("config", "", "")
+			fs.String("cache_root", "", "")
+			fs.Int("max_upload_packs", 4, "")
+			fs.Duration("fetch_freshness_window", 0, "")
+			if err := fs.Parse(tc.commandLine); err != nil {
+				t.Fatal(err)
+			}
+			commandLineFlags := map[string]bool{}
+			fs.Visit(func(f *flag.Flag) {
+				commandLineFlags[f.Name] = true
+			})
+			// A value set by the previous load of the file.
+			if !commandLineFlags["max_upload_packs"] {
+				fs.Set("max_upload_packs", "16")
+			}
+
+			p := writeConfigFile(t, tc.content)
+			defer os.RemoveAll(filepath.Dir(p))
+
+			err := applyConfigFile(fs, p, commandLineFlags)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got %v, want an error with %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for name := range tc.want {
+				got[name] = fs.Lookup(name).Value.String()
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -19,23 +19,33 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/errorreporting"
 	"cloud.google.com/go/logging"
 	"cloud.google.com/go/storage"
 	"contrib.go.opencensus.io/exporter/stackdriver"
+	"contrib.go.opencensus.io/exporter/stackdriver/monitoredresource"
 	"github.com/google/goblet"
+	githubhook "github.com/google/goblet/github"
 	googlehook "github.com/google/goblet/google"
 	"github.com/google/uuid"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/oauth2/google"
+	pubsub "google.golang.org/api/pubsub/v1"
 
 	logpb "google.golang.org/genproto/googleapis/logging/v2"
 )
@@ -46,15 +56,227 @@ const (
 )
 
 var (
+	configFile = flag.String("config", "", "YAML file that maps the flag names to the values. The flags on the command line take precedence. Reloaded on SIGHUP")
+
 	port      = flag.Int("port", 8080, "port to listen to")
-	cacheRoot = flag.String("cache_root", "", "Root directory of cached repositories")
+	cacheRoot = flag.String("cache_root", "", "Comma-separated root directories of cached repositories. The repositories are spread across them")
+
+	rebalanceCacheShards = flag.Bool("rebalance_cache_shards", false, "Move the cached repositories to the -cache_root they belong to at startup, such as after a root is added")
+	removedCacheRoots    = flag.String("removed_cache_roots", "", "Comma-separated cache roots no longer in use. Their repositories are moved to -cache_root with -rebalance_cache_shards")
+
+	lfsCacheRoot     = flag.String("lfs_cache_root", "", "Root directory of the cached Git LFS objects. The Git LFS downloads are served through the cache if this is set")
+	lfsCacheMaxBytes = flag.Int64("lfs_cache_max_bytes", 0, "Size of the Git LFS object cache above which the least recently used objects are evicted. No limit if zero")
+
+	packCacheRoot     = flag.String("pack_cache_root", "", "Root directory of the cached pack responses. The responses of the clones are cached and served for the identical clones if this is set")
+	packCacheMaxBytes = flag.Int64("pack_cache_max_bytes", 0, "Size of the pack response cache above which the least recently used responses are evicted. No limit if zero")
+
+	bundleRoot    = flag.String("bundle_root", "", "Root directory of the Git bundles of the cached repositories. The bundles are advertised with the bundle-uri capability if this is set")
+	bundleMaxAge  = flag.Duration("bundle_max_age", 24*time.Hour, "Age of a bundle after which it's regenerated")
+	bundleBaseURL = flag.String("bundle_base_url", "", "URL the clients reach this server at, such as https://goblet.example.com, that the advertised bundle URIs are relative to. If empty, the scheme and the host of each request are used")
+
+	tlsCert = flag.String("tls_cert", "", "PEM file of the TLS certificate chain. The server and the admin endpoints are served with HTTPS if this and -tls_key are set. Reloaded on SIGHUP")
+	tlsKey  = flag.String("tls_key", "", "PEM file of the TLS private key")
+
+	githubAppID               = flag.Int64("github_app_id", 0, "ID of the GitHub App that the repositories on -github_host are fetched as. Unless -url_rewrite_rules_file is set, they are served instead of the googlesource.com ones")
+	githubAppInstallationID   = flag.Int64("github_app_installation_id", 0, "ID of the installation of the GitHub App")
+	githubAppPrivateKeyFile   = flag.String("github_app_private_key_file", "", "PEM file of the private key of the GitHub App. Reloaded on SIGHUP")
+	githubAppPrivateKeySecret = flag.String("github_app_private_key_secret", "", "Secret reference of the private key of the GitHub App, instead of -github_app_private_key_file: gcp-secret-manager:<secret version name> or vault:<path>#<field>")
+	githubHost                = flag.String("github_host", "github.com", "Hostname of the GitHub repositories with -github_app_id")
+	githubAPIURL              = flag.String("github_api_url", githubhook.DefaultAPIURL, "REST API endpoint of GitHub with -github_app_id, such as https://<host>/api/v3 for GitHub Enterprise Server")
+
+	gitlabTokenFile   = flag.String("gitlab_token_file", "", "File of the GitLab token that the repositories on -gitlab_host are fetched with. Unless -url_rewrite_rules_file is set, they are served instead of the googlesource.com ones. Reloaded on SIGHUP")
+	gitlabTokenSecret = flag.String("gitlab_token_secret", "", "Secret reference of the GitLab token, instead of -gitlab_token_file: gcp-secret-manager:<secret version name> or vault:<path>#<field>")
+	gitlabTokenKind   = flag.String("gitlab_token_kind", "personal", "Kind of the token in -gitlab_token_file: personal (a personal, project, or group access token) or job (a CI/CD job token)")
+	gitlabHost        = flag.String("gitlab_host", "gitlab.com", "Hostname of the GitLab repositories with -gitlab_token_file")
+
+	bitbucketTokenFile   = flag.String("bitbucket_token_file", "", "File of the Bitbucket token that the repositories on Bitbucket Cloud, or on -bitbucket_server_host if set, are fetched with. Unless -url_rewrite_rules_file is set, they are served instead of the googlesource.com ones. Reloaded on SIGHUP")
+	bitbucketTokenSecret = flag.String("bitbucket_token_secret", "", "Secret reference of the Bitbucket token, instead of -bitbucket_token_file: gcp-secret-manager:<secret version name> or vault:<path>#<field>")
+	bitbucketUsername    = flag.String("bitbucket_username", "", "Username for -bitbucket_token_file. If set, the token is an app password or a password. Otherwise, it's an access token")
+	bitbucketServerHost  = flag.String("bitbucket_server_host", "", "Hostname of the Bitbucket Server or Data Center with -bitbucket_token_file. Bitbucket Cloud if empty")
+
+	webhookSecretFile   = flag.String("webhook_secret_file", "", "File of the secret of the push webhooks of GitHub, GitLab, and Gerrit. If set, the webhooks are received at /webhook and the pushed repositories are refreshed immediately. Reloaded on SIGHUP")
+	webhookSecretSecret = flag.String("webhook_secret_secret", "", "Secret reference of the webhook secret, instead of -webhook_secret_file: gcp-secret-manager:<secret version name> or vault:<path>#<field>")
+	gerritURL           = flag.String("gerrit_url", "", "URL of the Gerrit server that sends the ref-updated events to /webhook or to -pubsub_subscription, such as https://gerrit.example.com")
+	pubsubSubscription  = flag.String("pubsub_subscription", "", "Cloud Pub/Sub subscription of the Gerrit events of -gerrit_url, such as the ones published by the events-gcloud-pubsub plugin: projects/<project>/subscriptions/<name>. If set, the updated repositories are refreshed immediately")
+
+	vaultAddr             = flag.String("vault_addr", os.Getenv("VAULT_ADDR"), "Address of the Vault server for the vault: secret references")
+	vaultTokenFile        = flag.String("vault_token_file", "", "File of the Vault token for the vault: secret references, such as the sink of Vault Agent. Read for every fetch of a secret")
+	secretRefreshInterval = flag.Duration("secret_refresh_interval", 5*time.Minute, "Interval of refetching the upstream tokens from the files and the secret stores so that the rotated ones are used")
+
+	oidcIssuer   = flag.String("oidc_issuer", "", "OpenID Connect issuer URL. If set, the Git requests are authorized with the JWTs issued by it instead of the Google OAuth2 access tokens. The admin endpoints still use the Google ones")
+	oidcAudience = flag.String("oidc_audience", "", "Audience that the JWTs must be issued for with -oidc_issuer")
+
+	accessRulesFile = flag.String("access_rules_file", "", "YAML file of the rules that allow the clients to fetch the repositories. The clients are identified by the subjects of their tokens with -oidc_issuer, and by their TLS client certificates otherwise. All repositories are allowed if empty. Reloaded on SIGHUP")
+
+	clientRateLimit = flag.Float64("client_rate_limit", 0, "Sustained rate, in requests per second, that a client can make. The clients are identified as with -access_rules_file, or by their IP addresses if anonymous. The requests over it get 429. No limit if zero")
+	clientRateBurst = flag.Int("client_rate_burst", 0, "Number of requests that a client can make at once with -client_rate_limit. Defaults to -client_rate_limit rounded up if zero")
+
+	sshPort               = flag.Int("ssh_port", 0, "Port to serve git-upload-pack over SSH. The repositories are ssh://<host>:<port>/<upstream host>/<upstream path>. Disabled if zero")
+	sshHostKeyFiles       = flag.String("ssh_host_key_files", "", "Comma-separated private key files of the SSH host keys")
+	sshAuthorizedKeysFile = flag.String("ssh_authorized_keys_file", "", "OpenSSH authorized_keys file of the SSH clients. The comment of a key is the client identity for -access_rules_file. Reloaded on SIGHUP")
+
+	gitDaemonPort = flag.Int("git_daemon_port", 0, "Port to serve anonymous read-only git:// access, usually 9418. The repositories are git://<host>:<port>/<upstream host>/<upstream path>. The clients are not authenticated, so use this only on the trusted networks. Disabled if zero")
+
+	tlsClientCA = flag.String("tls_client_ca", "", "PEM file of the CA certificates that the TLS client certificates are verified with. The clients must present a certificate if this is set. Needs -tls_cert; the ACME challenges of -acme_hosts don't present a client certificate")
+
+	acmeHosts        = flag.String("acme_hosts", "", "Comma-separated hostnames to obtain the TLS certificates for from the ACME server, such as Let's Encrypt, instead of -tls_cert. The server must be reachable at port 443 of the hostnames")
+	acmeCacheDir     = flag.String("acme_cache_dir", "", "Directory to store the ACME account key and the certificates. Defaults to .acme under the first -cache_root")
+	acmeEmail        = flag.String("acme_email", "", "Contact email address of the ACME account")
+	acmeDirectoryURL = flag.String("acme_directory_url", autocert.DefaultACMEDirectory, "Directory URL of the ACME server")
+
+	drainTimeout = flag.Duration("drain_timeout", 30*time.Second, "Duration to wait for the in-flight requests and the upstream fetches on SIGTERM before aborting them")
 
 	stackdriverProject      = flag.String("stackdriver_project", "", "GCP project ID used for the Stackdriver integration")
 	stackdriverLoggingLogID = flag.String("stackdriver_logging_log_id", "", "Stackdriver logging Log ID")
+	stackdriverMetrics      = flag.Bool("stackdriver_metrics", true, "Export the metrics to Cloud Monitoring of -stackdriver_project. The monitored resource is detected on GCE and GKE")
+	stackdriverMetricPrefix = flag.String("stackdriver_metric_prefix", "", "Prefix of the metric types exported with -stackdriver_metrics. Defaults to custom.googleapis.com/opencensus/ if empty")
+	stackdriverTrace        = flag.Bool("stackdriver_trace", false, "Export the traces to Cloud Trace of -stackdriver_project, sampled with -trace_sampling_probability")
 
 	backupBucketName   = flag.String("backup_bucket_name", "", "Name of the GCS bucket for backed-up repositories")
 	backupManifestName = flag.String("backup_manifest_name", "", "Name of the backup manifest")
 
+	packfileURIBucketName = flag.String("packfile_uri_bucket_name", "", "Name of the GCS bucket the base packs are uploaded to. The initial clones of the clients that support packfile-uris download the base packs from the bucket if this is set")
+	packfileURIBaseURL    = flag.String("packfile_uri_base_url", "", "URL of the CDN in front of the packfile URI bucket. The objects are downloaded from storage.googleapis.com if empty")
+	packfileURIMinBytes   = flag.Int64("packfile_uri_min_bytes", 64<<20, "Size of a base pack below which it's served by this server rather than uploaded")
+	packfileURIMaxAge     = flag.Duration("packfile_uri_max_age", 24*time.Hour, "Age of a base pack after which it's regenerated")
+
+	blockedReposFile = flag.String("blocked_repos_file", "", "File with glob patterns of the blocked repository URLs, one per line. Reloaded on SIGHUP")
+	allowedReposFile = flag.String("allowed_repos_file", "", "File with glob patterns of the repository URLs, one per line, such as github.com/ours/*. If set, only the matching repositories are served. Reloaded on SIGHUP")
+
+	fetchFreshnessWindow    = flag.Duration("fetch_freshness_window", 0, "Duration after an upstream fetch during which ls-refs is served from the cache")
+	fetchFreshnessOverrides = flag.String("fetch_freshness_overrides", "", "Comma-separated pattern=duration pairs that override -fetch_freshness_window per repository")
+	objectPools             = flag.String("object_pools", "", "Comma-separated pattern=name pairs of the object pools. The repositories matching with the patterns of the same name, such as the forks of a project, share their objects")
+
+	keepForcePushedObjects = flag.Duration("keep_force_pushed_objects", 0, "Duration to keep the objects of force-pushed refs reachable. Disabled if zero")
+
+	dnsCacheTTL     = flag.Duration("dns_cache_ttl", 0, "Duration to cache the resolved upstream hostnames. Uses the OS resolver on every connection if zero")
+	upstreamHostIPs = flag.String("upstream_host_ips", "", "Comma-separated host=ip pairs that pin the upstream hostnames to the IP addresses")
+
+	upstreamProxy   = flag.String("upstream_proxy", "", "URL of the HTTP, HTTPS, or SOCKS5 proxy of the connections to the upstream, including the ones of git-fetch, such as http://proxy.example.com:3128. Uses HTTPS_PROXY, HTTP_PROXY, and NO_PROXY if empty")
+	upstreamNoProxy = flag.String("upstream_no_proxy", "", "Comma-separated upstream hosts connected without -upstream_proxy in the NO_PROXY syntax, such as .example.com,10.0.0.0/8")
+
+	upstreamCAFile        = flag.String("upstream_ca_file", "", "PEM file of the root CA certificates that the upstream certificates are verified with, instead of the system ones")
+	upstreamTLSMinVersion = flag.String("upstream_tls_min_version", "", "Minimum TLS version of the connections to the upstream: 1.0, 1.1, 1.2, or 1.3")
+	upstreamClientCert    = flag.String("upstream_client_cert", "", "PEM file of the TLS client certificate presented to the upstream")
+	upstreamClientKey     = flag.String("upstream_client_key", "", "PEM file of the private key of -upstream_client_cert")
+
+	upstreamMaxIdleConns        = flag.Int("upstream_max_idle_conns", 0, "Maximum number of idle connections to the upstream kept for reuse. Defaults to 100 if zero")
+	upstreamMaxIdleConnsPerHost = flag.Int("upstream_max_idle_conns_per_host", 0, "Maximum number of idle connections to an upstream host kept for reuse. Defaults to -upstream_max_idle_conns if zero")
+	upstreamMaxConnsPerHost     = flag.Int("upstream_max_conns_per_host", 0, "Maximum number of connections to an upstream host. Unlimited if zero")
+	upstreamIdleConnTimeout     = flag.Duration("upstream_idle_conn_timeout", 0, "Duration to keep an idle connection to the upstream. Defaults to 90s if zero")
+	upstreamKeepAlive           = flag.Duration("upstream_keep_alive", 0, "Interval of the TCP keep-alive probes of the connections to the upstream. Defaults to 30s if zero")
+	upstreamDisableHTTP2        = flag.Bool("upstream_disable_http2", false, "Use HTTP/1.1 for the upstream even if it supports HTTP/2")
+
+	upstreamRetries      = flag.Int("upstream_retries", 0, "Number of times to retry the upstream fetches and ls-refs that fail transiently, such as with 5xx responses, reset connections, and timeouts. No retries if zero")
+	upstreamRetryBackoff = flag.Duration("upstream_retry_backoff", 0, "Initial wait before retrying with -upstream_retries. It's jittered and doubles on every retry up to 30s. Defaults to 1s if zero")
+	upstreamRetryBudget  = flag.Float64("upstream_retry_budget", 0, "Maximum ratio of the retries to the upstream operations with -upstream_retries. Defaults to 0.1 if zero")
+
+	circuitErrorRate    = flag.Float64("circuit_error_rate", 0, "Ratio of the upstream operations failing transiently in a minute at which the upstream host is considered down. The operations then fail fast with 503, and the cached refs are served, until a probe succeeds. Disabled if zero")
+	circuitMinRequests  = flag.Int("circuit_min_requests", 0, "Number of the upstream operations in a minute needed for -circuit_error_rate. Defaults to 5 if zero")
+	circuitOpenDuration = flag.Duration("circuit_open_duration", 0, "Duration to fail fast with -circuit_error_rate before probing the upstream host again. Defaults to 30s if zero")
+
+	offline             = flag.Bool("offline", false, "Serve strictly from the pre-seeded cache without contacting the upstream. The repositories that are not cached are not found")
+	peerURL             = flag.String("peer_url", "", "URL of the repositories on a peer goblet instance that the uncached repositories are fetched from before the upstream, with $host and $path replaced with the ones of the upstream URL, such as https://goblet-us.example.com/$host$path. The upstream credentials are sent to the peer")
+	serveStaleOnFailure = flag.Bool("serve_stale_on_upstream_failure", false, "Serve the cached refs of a repository when the upstream fails, instead of failing the request. The responses have the Goblet-Served-Stale header")
+
+	clusterReplicas = flag.String("cluster_replicas", "", "Comma-separated base URLs of the goblet replicas that share the repositories by consistent hashing, such as http://goblet-0.goblet:8080,http://goblet-1.goblet:8080. The fetches of the repositories owned by other replicas are forwarded to them. Requires -cluster_self")
+	clusterSelf     = flag.String("cluster_self", "", "Base URL of this replica in -cluster_replicas")
+
+	clusterSecretFile   = flag.String("cluster_secret_file", "", "File of the secret shared by the replicas in -cluster_replicas to sign the clients of the forwarded requests. Without it, the owner replica authorizes the forwarded requests again, and the SSH and git:// requests are not forwarded")
+	clusterSecretSecret = flag.String("cluster_secret_secret", "", "Secret reference of the cluster secret, instead of -cluster_secret_file: gcp-secret-manager:<secret version name> or vault:<path>#<field>")
+
+	crossProcessLocking = flag.Bool("cross_process_locking", false, "Lock the cached repositories with flock(2) while they are written, so that multiple goblet processes can share the cache root on a network filesystem such as NFS. The git lock files left by a process that died are removed")
+	fetchStateRedisAddr = flag.String("fetch_state_redis_addr", "", "Address of the Redis server, such as redis.example.com:6379, that shares the last fetch times and the fetch locks of the repositories between the replicas sharing the cache root on a network filesystem, so that one replica fetches a repository at a time")
+
+	shedDuringEviction = flag.Bool("shed_during_eviction", false, "Respond with 503 to the fetches that need an upstream fetch while the cache is being evicted")
+
+	maxCacheSize         = flag.Int64("max_cache_size", 0, "Size in bytes of the cache root above which the least recently fetched repositories are evicted and the rest are repacked. No limit if zero")
+	idleRepositoryTTL    = flag.Duration("idle_repository_ttl", 0, "Duration after which the cached repositories that are not fetched are evicted. Never evicted if zero")
+	cacheCleanupInterval = flag.Duration("cache_cleanup_interval", 10*time.Minute, "Interval of evicting the idle repositories and checking the cache size against -max_cache_size")
+
+	coldStorageBucketName = flag.String("cold_storage_bucket_name", "", "Name of the GCS bucket that the repositories not fetched for -cold_storage_after are moved to. They are restored from the bucket when requested again")
+	coldStorageAfter      = flag.Duration("cold_storage_after", 0, "Duration after which the cached repositories that are not fetched are moved to -cold_storage_bucket_name. Never moved if zero")
+
+	maintenanceInterval      = flag.Duration("maintenance_interval", 0, "Interval at which the refs and the objects of each cached repository are repacked. No maintenance if zero")
+	maxConcurrentMaintenance = flag.Int("max_concurrent_maintenance", 1, "Number of the repositories maintained at a time")
+
+	warmRepositories = flag.String("warm_repositories", "", "Comma-separated URLs of the repositories fetched at startup and every -warm_up_interval, so that they're cached before they're requested")
+	warmUpInterval   = flag.Duration("warm_up_interval", time.Hour, "Interval of fetching -warm_repositories. They're fetched only at startup if zero")
+
+	hotRepositories    = flag.Int("hot_repositories", 0, "Number of the most requested repositories fetched every -hot_refresh_interval, so that their requests are served from a fresh cache within -fetch_freshness_window. None if zero")
+	hotRefreshInterval = flag.Duration("hot_refresh_interval", time.Minute, "Interval of fetching the -hot_repositories most requested repositories")
+
+	tenantHeader = flag.String("tenant_header", "", "HTTP header that specifies the tenant. The cache is partitioned by tenant if set")
+
+	selfTest = flag.Bool("selftest", false, "Fetch a temporary repository through an in-process server, report the result, and exit")
+
+	maxNegotiationRounds = flag.Int("max_negotiation_rounds", 0, "Maximum number of fetch requests in a negotiation. The clients behind the same NAT fetching the same commits with the same identity count as one negotiation. Unlimited if zero")
+	maxRequestBytes      = flag.Int64("max_request_bytes", 0, "Maximum size of an upload-pack request in bytes. Defaults to 32 MiB if zero, unlimited if negative")
+	requestMemoryBudget  = flag.Int64("request_memory_budget", 0, "Size of the data that a request holds in memory before spilling to temporary files under the cache root. No limit if zero")
+
+	maxUpstreamFetches = flag.Int("max_upstream_fetches", 0, "Maximum number of git-fetch processes fetching from the upstream at the same time. The requests over it get 503, the lower priorities first. Unlimited if zero")
+	maxUploadPacks     = flag.Int("max_upload_packs", 0, "Maximum number of git-upload-pack processes serving the clients at the same time. The requests over it get 503, the lower priorities first. Unlimited if zero")
+	maxRepoRequests    = flag.Int("max_repo_requests", 0, "Maximum number of in-flight requests of a repository. The requests over it get 503. Unlimited if zero")
+
+	gerritChangeRefs = flag.String("gerrit_change_refs", "advertise", "How the Gerrit change refs are served: advertise, hide, or fetch-on-demand")
+
+	pushPolicy = flag.String("push_policy", "reject", "How the pushes are handled: reject, server-credentials (forward them to the upstream with the server's credentials), or client-credentials (forward them with the client's Authorization header)")
+
+	hiddenRefs = flag.String("hidden_refs", "", "Comma-separated ref prefixes that are not served, such as refs/heads/internal")
+
+	forceUpstreamHTTPS     = flag.Bool("force_upstream_https", false, "Fetch from the upstream with HTTPS even if the URL is http://. The hosts without HTTPS must be in -plaintext_upstream_hosts, as there is no fallback to plain HTTP")
+	plaintextUpstreamHosts = flag.String("plaintext_upstream_hosts", "", "Comma-separated glob patterns of the upstream hostnames that can be fetched with plain HTTP with -force_upstream_https")
+	urlRewriteRulesFile    = flag.String("url_rewrite_rules_file", "", "YAML file of the rules that rewrite the request URLs to the upstream URLs. If set, the repositories that match with a rule are served instead of the googlesource.com ones. This is required to serve more than one of GitHub, GitLab, and Bitbucket. A rule can have the token that its upstream repositories are fetched with")
+
+	headOnlyCacheTTL = flag.Duration("head_only_cache_ttl", 0, "Duration that HEAD-only ls-refs commands are served from the cache")
+	negativeCacheTTL = flag.Duration("negative_cache_ttl", 0, "Duration that the upstream 401, 403, and 404 responses are cached per repository")
+
+	packServeTimeout = flag.Duration("pack_serve_timeout", 0, "Maximum duration of generating a pack from the cache, until the pack data starts streaming to the client. No timeout if zero")
+	retryPackServe   = flag.Bool("retry_pack_serve", false, "Retry a pack generation that failed on the server side once with the settings that use less memory")
+	coalesceFetches  = flag.Bool("coalesce_fetches", false, "Share the pack generated for a fetch with the identical fetches that come while it's generated, such as the CI shards cloning the same commit")
+
+	requestTimeout = flag.Duration("request_timeout", 0, "Maximum duration of handling a Git request, including the wait for the upstream fetch. No timeout if zero")
+	cloneTimeout   = flag.Duration("clone_timeout", 0, "Maximum duration of handling a clone, a fetch without haves, instead of -request_timeout")
+
+	upstreamLsRefsTimeout = flag.Duration("upstream_ls_refs_timeout", time.Minute, "Maximum duration of an ls-refs request to the upstream. No timeout if zero")
+	upstreamFetchTimeout  = flag.Duration("upstream_fetch_timeout", time.Hour, "Maximum duration of a git-fetch from the upstream. It's killed when it exceeds this. No timeout if zero")
+
+	rejectShallowCache = flag.Bool("reject_shallow_cache", false, "Reject the requests that need more history than a shallow cached repository has, instead of fetching the rest of the history")
+	deepenShallowCache = flag.Bool("deepen_shallow_cache", false, "Fetch only the history that the shallow fetches need into a shallow cached repository, instead of the rest of the history")
+
+	maxConcurrentFetches = flag.Int("max_concurrent_fetches", 0, "Maximum number of fetch requests processed at the same time. The others wait in the order of the Goblet-Priority header. Unlimited if zero")
+	highPriorityClients  = flag.String("high_priority_clients", "", "Comma-separated glob patterns of the client identities, such as the TLS client certificate identities, the OIDC subjects, or the SSH identities, that can request the high priority")
+	shedLowPriority      = flag.Bool("shed_low_priority", false, "Shed the low priority fetch requests instead of queueing them when -max_concurrent_fetches is reached")
+
+	allowedClientCapabilities = flag.String("allowed_client_capabilities", "", "Comma-separated protocol v2 capabilities and command arguments that the clients can use. All are allowed if empty")
+
+	adminPort   = flag.Int("admin_port", 0, "port to serve the admin endpoints. Disabled if zero")
+	adminEmails = flag.String("admin_emails", "", "Comma-separated Google accounts that can use the admin endpoints, such as the operators' accounts. Required with -admin_port. The clients of the proxy cannot use the admin endpoints unless they're listed")
+
+	readinessCanaryURL = flag.String("readiness_canary_url", "", "Upstream URL of a repository, such as https://github.com/google/goblet, that the readiness probe at /readyz runs ls-refs against. The probe checks only the cache roots if empty")
+
+	otlpTracesEndpoint       = flag.String("otlp_traces_endpoint", "", "OTLP/HTTP endpoint that the traces are exported to, such as http://localhost:4318/v1/traces. Disabled if empty")
+	otlpMetricsEndpoint      = flag.String("otlp_metrics_endpoint", "", "OTLP/HTTP endpoint that the metrics are exported to every minute, such as http://localhost:4318/v1/metrics. The metrics are named after the OpenCensus views. Disabled if empty")
+	otlpHeaders              = flag.String("otlp_headers", "", "Comma-separated key=value headers sent to -otlp_traces_endpoint and -otlp_metrics_endpoint")
+	traceSamplingProbability = flag.Float64("trace_sampling_probability", 0.01, "Probability that a request is traced")
+
+	repositoryMetricTag    = flag.Bool("repository_metric_tag", false, "Tag the inbound and outbound command metrics with the canonical upstream URL of the repository")
+	maxRepositoryTagValues = flag.Int("max_repository_tag_values", 0, "Maximum number of repositories tagged with -repository_metric_tag. The others are tagged as \"other\". Defaults to 100 if zero")
+
+	metricsPort = flag.Int("metrics_port", 0, "port to serve the metrics in the Prometheus format at /metrics. Disabled if zero")
+
+	debugPort = flag.Int("debug_port", 0, "port to serve net/http/pprof at /debug/pprof/, expvar at /debug/vars, and the operations in flight with the goroutine dump at /debug/operations. Listens on localhost only. Disabled if zero")
+
+	requestLogFormat = flag.String("request_log_format", "text", "Format of the request logs written to stderr: text, json, or combined (the Combined Log Format of Apache with the goblet fields at the end). Ignored with -stackdriver_logging_log_id")
+
+	accessLogFile       = flag.String("access_log_file", "", "File that the requests are logged to in -access_log_format")
+	accessLogFormat     = flag.String("access_log_format", "json", "Format of -access_log_file: json or combined (the Combined Log Format of Apache with the goblet fields at the end)")
+	accessLogMaxBytes   = flag.Int64("access_log_max_bytes", 100*1024*1024, "Size of the access log file that triggers a rotation")
+	accessLogMaxAge     = flag.Duration("access_log_max_age", 24*time.Hour, "Age of the access log file that triggers a rotation")
+	accessLogMaxBackups = flag.Int("access_log_max_backups", 7, "Number of the rotated access log files to keep")
+
+	auditLogFile = flag.String("audit_log_file", "", "File that the commands of the clients are appended to in JSON for auditing: the client identity and IP address, the repository, the requested refs and commits, and the bytes served. The file is never rotated or truncated")
+
 	latencyDistributionAggregation = view.Distribution(
 		100,
 		200,
@@ -81,28 +303,35 @@ var (
 		{
 			Name:        "github.com/google/goblet/inbound-command-count",
 			Description: "Inbound command count",
-			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.CommandCanonicalStatusKey, goblet.CommandCacheStateKey},
+			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.CommandCanonicalStatusKey, goblet.CommandCacheStateKey, goblet.TenantKey, goblet.HeadOnlyKey},
 			Measure:     goblet.InboundCommandCount,
 			Aggregation: view.Count(),
 		},
 		{
 			Name:        "github.com/google/goblet/inbound-command-latency",
 			Description: "Inbound command latency",
-			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.CommandCanonicalStatusKey, goblet.CommandCacheStateKey},
+			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.CommandCanonicalStatusKey, goblet.CommandCacheStateKey, goblet.TenantKey},
 			Measure:     goblet.InboundCommandProcessingTime,
 			Aggregation: latencyDistributionAggregation,
 		},
+		{
+			Name:        "github.com/google/goblet/inbound-command-error-count",
+			Description: "Inbound command count by the error category, which is empty for the successful commands",
+			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.ErrorCategoryKey, goblet.TenantKey},
+			Measure:     goblet.InboundCommandCount,
+			Aggregation: view.Count(),
+		},
 		{
 			Name:        "github.com/google/goblet/outbound-command-count",
 			Description: "Outbound command count",
-			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.CommandCanonicalStatusKey},
+			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.CommandCanonicalStatusKey, goblet.TenantKey},
 			Measure:     goblet.OutboundCommandCount,
 			Aggregation: view.Count(),
 		},
 		{
 			Name:        "github.com/google/goblet/outbound-command-latency",
 			Description: "Outbound command latency",
-			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.CommandCanonicalStatusKey},
+			TagKeys:     []tag.Key{goblet.CommandTypeKey, goblet.CommandCanonicalStatusKey, goblet.TenantKey},
 			Measure:     goblet.OutboundCommandProcessingTime,
 			Aggregation: latencyDistributionAggregation,
 		},
@@ -112,11 +341,233 @@ var (
 			Measure:     goblet.UpstreamFetchWaitingTime,
 			Aggregation: latencyDistributionAggregation,
 		},
+		{
+			Name:        "github.com/google/goblet/blocked-request-count",
+			Description: "Request count for blocked repositories",
+			Measure:     goblet.BlockedRequestCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/aborted-negotiation-count",
+			Description: "Fetch negotiation count aborted by the round limit",
+			Measure:     goblet.AbortedNegotiationCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/pack-serve-retry-count",
+			Description: "Retried pack generation count",
+			Measure:     goblet.PackServeRetryCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/pack-serve-kill-count",
+			Description: "Pack generation count killed by the timeout",
+			Measure:     goblet.PackServeKillCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/coalesced-fetch-count",
+			Description: "Fetch command count served with the pack generated for an identical fetch",
+			Measure:     goblet.CoalescedFetchCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/request-spill-count",
+			Description: "Request count that spilled the data over the memory budget to disk",
+			Measure:     goblet.RequestSpillCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/head-only-request-count",
+			Description: "HEAD-only ls-refs command count",
+			TagKeys:     []tag.Key{goblet.CommandCacheStateKey},
+			Measure:     goblet.HeadOnlyRequestCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/pack-cache-hit-count",
+			Description: "Pack response cache hit count",
+			Measure:     goblet.PackCacheHitCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/pack-cache-miss-count",
+			Description: "Pack response cache miss count",
+			Measure:     goblet.PackCacheMissCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/pack-cache-eviction-count",
+			Description: "Pack response cache eviction count",
+			Measure:     goblet.PackCacheEvictionCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/pack-cache-bytes",
+			Description: "Size of the pack response cache",
+			Measure:     goblet.PackCacheBytes,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "github.com/google/goblet/lfs-cache-hit-count",
+			Description: "LFS object cache hit count",
+			Measure:     goblet.LFSCacheHitCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/lfs-cache-miss-count",
+			Description: "LFS object cache miss count",
+			Measure:     goblet.LFSCacheMissCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/lfs-cache-eviction-count",
+			Description: "LFS object cache eviction count",
+			Measure:     goblet.LFSCacheEvictionCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/lfs-cache-bytes",
+			Description: "Size of the LFS object cache",
+			Measure:     goblet.LFSCacheBytes,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "github.com/google/goblet/packfile-uri-offload-count",
+			Description: "Fetch count offloaded to packfile URIs",
+			Measure:     goblet.PackfileURIOffloadCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/shed-request-count",
+			Description: "Request count shed during an eviction or a drain, or because of the low priority",
+			Measure:     goblet.ShedRequestCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/upstream-conn-count",
+			Description: "Connection count used for the upstream requests, by whether it's reused",
+			TagKeys:     []tag.Key{goblet.ConnReusedKey},
+			Measure:     goblet.UpstreamConnCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/throttled-request-count",
+			Description: "Request count rejected by the per-client rate limit",
+			Measure:     goblet.ThrottledRequestCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/upstream-retry-count",
+			Description: "Upstream operation count retried after a transient failure, by the command type",
+			TagKeys:     []tag.Key{goblet.CommandTypeKey},
+			Measure:     goblet.UpstreamRetryCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/upstream-circuit-open-count",
+			Description: "Count of the upstream circuit breakers opened",
+			Measure:     goblet.UpstreamCircuitOpenCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/cluster-forward-count",
+			Description: "Request count forwarded to the owner replica of the repository",
+			Measure:     goblet.ClusterForwardCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/shared-fetch-count",
+			Description: "Upstream fetch count skipped as another replica fetched the repository",
+			Measure:     goblet.SharedFetchCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/stale-lock-recovery-count",
+			Description: "Repository lock count taken over from a process that died while holding it",
+			Measure:     goblet.StaleLockRecoveryCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/stale-serve-count",
+			Description: "Command count served from the cache because the upstream failed, by the command type",
+			TagKeys:     []tag.Key{goblet.CommandTypeKey},
+			Measure:     goblet.StaleServeCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/cache-eviction-count",
+			Description: "Cached repository count evicted to keep the cache within the quota",
+			Measure:     goblet.CacheEvictionCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/cold-storage-upload-count",
+			Description: "Cached repository count moved to the cold storage",
+			Measure:     goblet.ColdStorageUploadCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/cold-storage-restore-count",
+			Description: "Repository count restored from the cold storage",
+			Measure:     goblet.ColdStorageRestoreCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/idle-eviction-count",
+			Description: "Cached repository count evicted as they are idle",
+			Measure:     goblet.IdleEvictionCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/negative-cache-hit-count",
+			Description: "Request count failed with a cached upstream error",
+			Measure:     goblet.NegativeCacheHitCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/maintenance-count",
+			Description: "Repository maintenance count",
+			Measure:     goblet.MaintenanceCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/maintenance-processing-time",
+			Description: "Repository maintenance processing time",
+			Measure:     goblet.MaintenanceProcessingTime,
+			Aggregation: latencyDistributionAggregation,
+		},
+		{
+			Name:        "github.com/google/goblet/cache-bytes",
+			Description: "Size of the cached repositories",
+			Measure:     goblet.CacheBytes,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "github.com/google/goblet/fetch-queue-depth",
+			Description: "Number of fetch requests waiting for the concurrency limit",
+			TagKeys:     []tag.Key{goblet.PriorityKey},
+			Measure:     goblet.FetchQueueDepth,
+			Aggregation: view.LastValue(),
+		},
 	}
 )
 
 func main() {
 	flag.Parse()
+	commandLineFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	if *configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, *configFile, commandLineFlags); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *selfTest {
+		os.Exit(runSelfTest())
+	}
 
 	ts, err := google.DefaultTokenSource(context.Background(), scopeCloudPlatform, scopeUserInfoEmail)
 	if err != nil {
@@ -126,23 +577,67 @@ func main() {
 	if err != nil {
 		log.Fatalf("Cannot create a request authorizer: %v", err)
 	}
+	if *repositoryMetricTag {
+		for _, v := range views {
+			switch v.Measure {
+			case goblet.InboundCommandCount, goblet.InboundCommandProcessingTime, goblet.OutboundCommandCount, goblet.OutboundCommandProcessingTime:
+				v.TagKeys = append(v.TagKeys, goblet.RepositoryKey)
+			}
+		}
+	}
 	if err := view.Register(views...); err != nil {
 		log.Fatal(err)
 	}
 
+	otlpHeader := http.Header{}
+	if *otlpHeaders != "" {
+		for _, pair := range strings.Split(*otlpHeaders, ",") {
+			ss := strings.SplitN(pair, "=", 2)
+			if len(ss) != 2 {
+				log.Fatalf("Cannot parse %q as key=value", pair)
+			}
+			otlpHeader.Add(ss[0], ss[1])
+		}
+	}
+	var otlpExporter *goblet.OTLPTraceExporter
+	if *otlpTracesEndpoint != "" {
+		otlpExporter = goblet.NewOTLPTraceExporter(*otlpTracesEndpoint, otlpHeader, "goblet")
+		trace.RegisterExporter(otlpExporter)
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(*traceSamplingProbability)})
+	}
+	var otlpMetricExporter *goblet.OTLPMetricExporter
+	if *otlpMetricsEndpoint != "" {
+		otlpMetricExporter = goblet.NewOTLPMetricExporter(*otlpMetricsEndpoint, otlpHeader, "goblet")
+		view.RegisterExporter(otlpMetricExporter)
+	}
+
 	var er func(*http.Request, error)
 	var rl func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
 		dump, err := httputil.DumpRequest(r, false)
 		if err != nil {
 			return
 		}
+		if identity := goblet.ClientIdentity(r); identity != "" {
+			log.Printf("%q %d reqsize: %d, respsize %d, latency: %v, client: %s", dump, status, requestSize, responseSize, latency, identity)
+			return
+		}
 		log.Printf("%q %d reqsize: %d, respsize %d, latency: %v", dump, status, requestSize, responseSize, latency)
 	}
+	switch *requestLogFormat {
+	case "text":
+	case "json":
+		rl = goblet.NewJSONRequestLogger(os.Stderr)
+	case "combined":
+		rl = goblet.NewCombinedRequestLogger(os.Stderr)
+	default:
+		log.Fatalf("Unknown request log format: %q", *requestLogFormat)
+	}
 	var lrol func(string, *url.URL) goblet.RunningOperation = func(action string, u *url.URL) goblet.RunningOperation {
 		log.Printf("Starting %s for %s", action, u.String())
 		return &logBasedOperation{action, u}
 	}
 	var backupLogger *log.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	var sdExporter *stackdriver.Exporter
 	if *stackdriverProject != "" {
 		// Error reporter
 		ec, err := errorreporting.NewClient(context.Background(), *stackdriverProject, errorreporting.Config{
@@ -161,7 +656,7 @@ func main() {
 				Req:   r,
 				Error: err,
 			})
-			log.Printf("Error while processing a request: %v", err)
+			log.Printf("Error while processing request %s: %v", goblet.RequestID(r), err)
 		}
 
 		if *stackdriverLoggingLogID != "" {
@@ -178,7 +673,12 @@ func main() {
 			// Request logger
 			sdLogger := lc.Logger(*stackdriverLoggingLogID)
 			rl = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+				labels := map[string]string{"request_id": goblet.RequestID(r)}
+				if identity := goblet.ClientIdentity(r); identity != "" {
+					labels["client_identity"] = identity
+				}
 				sdLogger.Log(logging.Entry{
+					Labels: labels,
 					HTTPRequest: &logging.HTTPRequest{
 						Request:      r,
 						RequestSize:  requestSize,
@@ -214,27 +714,84 @@ func main() {
 			backupLogger = sdLogger.StandardLogger(logging.Warning)
 		}
 
-		// OpenCensus view exporters.
-		exporter, err := stackdriver.NewExporter(stackdriver.Options{
-			ProjectID: *stackdriverProject,
-		})
+		// OpenCensus view and trace exporters.
+		if *stackdriverMetrics || *stackdriverTrace {
+			sdExporter, err = stackdriver.NewExporter(stackdriver.Options{
+				ProjectID:         *stackdriverProject,
+				MetricPrefix:      *stackdriverMetricPrefix,
+				MonitoredResource: monitoredresource.Autodetect(),
+				OnError: func(err error) {
+					log.Printf("Cannot export to Stackdriver: %v", err)
+				},
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *stackdriverMetrics {
+			if err = sdExporter.StartMetricsExporter(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *stackdriverTrace {
+			trace.RegisterExporter(sdExporter)
+			trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(*traceSamplingProbability)})
+		}
+	} else if *stackdriverTrace {
+		log.Fatal("-stackdriver_trace needs -stackdriver_project")
+	}
+
+	tlsConfig, err := newServerTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := newServerConfig(ts, authorizer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *adminPort != 0 {
+		if *adminEmails == "" {
+			log.Fatal("-admin_port needs -admin_emails")
+		}
+		config.AdminAuthorizer, err = googlehook.NewAdminAuthorizer(ts, strings.Split(*adminEmails, ","))
+		if err != nil {
+			log.Fatalf("Cannot create an admin authorizer: %v", err)
+		}
+	}
+	config.ErrorReporter = er
+	config.RequestLogger = rl
+	config.LongRunningOperationLogger = lrol
+	if *auditLogFile != "" {
+		f, err := os.OpenFile(*auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			log.Fatalf("Cannot open the audit log file: %v", err)
+		}
+		config.AuditLogger = goblet.NewJSONAuditLogger(f)
+	}
+	config.SettingsReloader = func() error {
+		return reloadSettings(config, commandLineFlags)
+	}
+
+	if *blockedReposFile != "" {
+		patterns, err := readRepoPatterns(*blockedReposFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err = exporter.StartMetricsExporter(); err != nil {
+		if err := goblet.UpdateBlockedRepos(config, patterns); err != nil {
 			log.Fatal(err)
 		}
 	}
-
-	config := &goblet.ServerConfig{
-		LocalDiskCacheRoot:         *cacheRoot,
-		URLCanonializer:            googlehook.CanonicalizeURL,
-		RequestAuthorizer:          authorizer,
-		TokenSource:                ts,
-		ErrorReporter:              er,
-		RequestLogger:              rl,
-		LongRunningOperationLogger: lrol,
+	if *allowedReposFile != "" {
+		patterns, err := readRepoPatterns(*allowedReposFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := goblet.UpdateAllowedRepos(config, patterns); err != nil {
+			log.Fatal(err)
+		}
 	}
+	go reloadSettingsOnSIGHUP(config)
 
 	if *backupBucketName != "" && *backupManifestName != "" {
 		gsClient, err := storage.NewClient(context.Background())
@@ -244,13 +801,203 @@ func main() {
 
 		googlehook.RunBackupProcess(config, gsClient.Bucket(*backupBucketName), *backupManifestName, backupLogger)
 	}
+	if *packfileURIBucketName != "" {
+		gsClient, err := storage.NewClient(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		config.PackfileURIUploader = googlehook.NewPackfileURIUploader(gsClient.Bucket(*packfileURIBucketName), *packfileURIBaseURL)
+	}
+	if *pubsubSubscription != "" {
+		if *gerritURL == "" {
+			log.Fatal("-pubsub_subscription requires -gerrit_url")
+		}
+		svc, err := pubsub.NewService(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		googlehook.RunPubSubRefresher(config, svc, *pubsubSubscription, *gerritURL, log.New(os.Stderr, "", log.LstdFlags))
+	}
 
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+	if *coldStorageBucketName != "" {
+		gsClient, err := storage.NewClient(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.ColdStorage = googlehook.NewColdStorage(gsClient.Bucket(*coldStorageBucketName))
+		config.ColdStorageAfter = *coldStorageAfter
+	}
+	srv, err := goblet.NewServer(
+		goblet.WithServerConfig(config),
+		goblet.WithCacheCleanupInterval(*cacheCleanupInterval),
+		goblet.WithWarmUpInterval(*warmUpInterval),
+		goblet.WithHotRefreshInterval(*hotRefreshInterval),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *rebalanceCacheShards {
+		go func() {
+			var removed []string
+			if *removedCacheRoots != "" {
+				removed = strings.Split(*removedCacheRoots, ",")
+			}
+			if err := goblet.RebalanceCacheShards(config, removed); err != nil {
+				log.Printf("Cannot rebalance the cache roots: %v", err)
+			}
+		}()
+	}
+
+	// Not http.DefaultServeMux, as net/http/pprof registers the debug
+	// endpoints to it.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		io.WriteString(w, "ok\n")
 	})
-	http.Handle("/", goblet.HTTPHandler(config))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	mux.Handle("/readyz", goblet.ReadinessHandler(config))
+	if *adminPort != 0 {
+		go func() {
+			adminServer := &http.Server{
+				Addr:    fmt.Sprintf(":%d", *adminPort),
+				Handler: goblet.AdminHandler(config),
+			}
+			log.Fatal(listenAndServe(adminServer, tlsConfig))
+		}()
+	}
+
+	if *metricsPort != 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", goblet.PrometheusHandler(views))
+		go func() {
+			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), metricsMux))
+		}()
+	}
+
+	if *debugPort != 0 {
+		go func() {
+			log.Fatal(http.ListenAndServe(fmt.Sprintf("localhost:%d", *debugPort), newDebugHandler(config)))
+		}()
+	}
+
+	mux.Handle("/", srv)
+	if *webhookSecretFile != "" || *webhookSecretSecret != "" {
+		mux.Handle("/webhook", goblet.WebhookHandler(config))
+	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", *port), Handler: mux}
+	go func() {
+		if err := listenAndServe(server, tlsConfig); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	var sshListener net.Listener
+	if *sshPort != 0 {
+		if *sshHostKeyFiles == "" || *sshAuthorizedKeysFile == "" {
+			log.Fatal("-ssh_port needs -ssh_host_key_files and -ssh_authorized_keys_file")
+		}
+		hostKeys, err := readSSHHostKeys(*sshHostKeyFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if sshAuthorizedKeys, err = newAuthorizedKeysLoader(*sshAuthorizedKeysFile); err != nil {
+			log.Fatal(err)
+		}
+		if sshListener, err = net.Listen("tcp", fmt.Sprintf(":%d", *sshPort)); err != nil {
+			log.Fatal(err)
+		}
+		go goblet.ServeSSH(sshListener, srv, &goblet.SSHServerConfig{
+			HostKeys:            hostKeys,
+			PublicKeyAuthorizer: sshAuthorizedKeys.authorize,
+		})
+	}
+
+	var gitDaemonListener net.Listener
+	if *gitDaemonPort != 0 {
+		var err error
+		if gitDaemonListener, err = net.Listen("tcp", fmt.Sprintf(":%d", *gitDaemonPort)); err != nil {
+			log.Fatal(err)
+		}
+		go goblet.ServeGitDaemon(gitDaemonListener, srv)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	<-ch
+	if sshListener != nil {
+		sshListener.Close()
+	}
+	if gitDaemonListener != nil {
+		gitDaemonListener.Close()
+	}
+	shutdown(server, srv)
+	if otlpExporter != nil {
+		trace.UnregisterExporter(otlpExporter)
+		if err := otlpExporter.Close(); err != nil {
+			log.Printf("Cannot export the traces: %v", err)
+		}
+	}
+	if otlpMetricExporter != nil {
+		view.UnregisterExporter(otlpMetricExporter)
+		if err := otlpMetricExporter.Close(); err != nil {
+			log.Printf("Cannot export the metrics: %v", err)
+		}
+	}
+	if sdExporter != nil {
+		if *stackdriverMetrics {
+			sdExporter.StopMetricsExporter()
+		}
+		sdExporter.Flush()
+	}
+}
+
+// shutdown stops accepting new requests, and waits for the in-flight requests
+// and the upstream fetches for -drain_timeout. The ones still running after
+// that are aborted.
+func shutdown(server *http.Server, srv *goblet.Server) {
+	log.Printf("Shutting down. Waiting for the in-flight requests for %v", *drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Closing the connections of the unfinished requests: %v", err)
+		server.Close()
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Aborted the unfinished upstream fetches: %v", err)
+	}
+	log.Printf("Shut down")
+}
+
+func readRepoPatterns(path string) ([]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the repository patterns: %v", err)
+	}
+	patterns := []string{}
+	for _, line := range strings.Split(string(bs), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+func reloadSettingsOnSIGHUP(config *goblet.ServerConfig) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := config.SettingsReloader(); err != nil {
+			log.Printf("Cannot reload the settings: %v", err)
+		}
+	}
 }
 
 type LongRunningOperation struct {
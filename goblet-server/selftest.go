@@ -0,0 +1,244 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/goblet"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const selfTestToken = "goblet-selftest"
+
+// runSelfTest runs an in-process goblet with a temporary upstream repository
+// and cache, and checks that a repository can be fetched through it. It
+// prints the result of each step and returns the exit code.
+func runSelfTest() int {
+	env := &selfTestEnv{}
+	defer env.close()
+	var hash string
+
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"config", checkCacheRoot},
+		{"git", func() error {
+			out, err := exec.Command("git", "--version").CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("cannot run git: %v", err)
+			}
+			fmt.Printf("  %s", out)
+			return nil
+		}},
+		{"upstream", func() error {
+			var err error
+			hash, err = env.startUpstream()
+			return err
+		}},
+		{"fetch", func() error {
+			if err := env.startProxy(); err != nil {
+				return err
+			}
+			_, err := env.git(env.clientDir, "-c", "http.extraHeader=Authorization: Bearer "+selfTestToken, "fetch", env.proxyURL+"/repo")
+			return err
+		}},
+		{"verify", func() error {
+			got, err := env.git(env.clientDir, "rev-parse", "FETCH_HEAD")
+			if err != nil {
+				return err
+			}
+			if got != hash {
+				return fmt.Errorf("fetched %s, want %s", got, hash)
+			}
+			_, err = env.git(env.clientDir, "fsck", "--strict")
+			return err
+		}},
+	}
+	for _, step := range steps {
+		if err := step.fn(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", step.name, err)
+			return 1
+		}
+		fmt.Printf("PASS %s\n", step.name)
+	}
+	return 0
+}
+
+// selfTestEnv is a temporary upstream served by git-http-backend, a goblet
+// with a cache under the first -cache_root, and a client repository.
+type selfTestEnv struct {
+	dir         string
+	upstreamDir string
+	clientDir   string
+	upstream    *http.Server
+	upstreamURL *url.URL
+	proxy       *http.Server
+	proxyURL    string
+}
+
+// startUpstream creates the upstream repository with a commit and serves it.
+// It returns the hash of the commit.
+func (e *selfTestEnv) startUpstream() (string, error) {
+	var err error
+	if e.dir, err = ioutil.TempDir(cacheRoots()[0], "goblet_selftest"); err != nil {
+		return "", err
+	}
+	e.upstreamDir = filepath.Join(e.dir, "upstream")
+	e.clientDir = filepath.Join(e.dir, "client")
+	for _, dir := range []string{e.upstreamDir, e.clientDir} {
+		if err := os.Mkdir(dir, 0750); err != nil {
+			return "", err
+		}
+	}
+	if _, err := e.git(e.upstreamDir, "init", "--bare", "repo.git"); err != nil {
+		return "", err
+	}
+	if _, err := e.git(e.clientDir, "init"); err != nil {
+		return "", err
+	}
+	tree, err := e.git(e.clientDir, "hash-object", "-t", "tree", "-w", "--stdin")
+	if err != nil {
+		return "", err
+	}
+	hash, err := e.git(e.clientDir, "-c", "user.name=goblet", "-c", "user.email=goblet@localhost", "commit-tree", "-m", "goblet self-test", tree)
+	if err != nil {
+		return "", err
+	}
+	if _, err := e.git(e.clientDir, "push", "--quiet", filepath.Join(e.upstreamDir, "repo.git"), hash+":refs/heads/master"); err != nil {
+		return "", err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	e.upstream = &http.Server{Handler: http.HandlerFunc(e.serveUpstream)}
+	go e.upstream.Serve(l)
+	e.upstreamURL = &url.URL{Scheme: "http", Host: l.Addr().String()}
+	return hash, nil
+}
+
+func (e *selfTestEnv) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	h := &cgi.Handler{
+		Path: "git",
+		Dir:  e.upstreamDir,
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + e.upstreamDir,
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+		Args:   []string{"http-backend"},
+		Stderr: os.Stderr,
+	}
+	if p, err := exec.LookPath("git"); err == nil {
+		h.Path = p
+	}
+	if p := r.Header.Get("Git-Protocol"); p != "" {
+		h.Env = append(h.Env, "GIT_PROTOCOL="+p)
+	}
+	h.ServeHTTP(w, r)
+}
+
+// startProxy serves a goblet that fetches the repositories from the upstream.
+func (e *selfTestEnv) startProxy() error {
+	cache := filepath.Join(e.dir, "cache")
+	if err := os.Mkdir(cache, 0750); err != nil {
+		return err
+	}
+	config := &goblet.ServerConfig{
+		LocalDiskCacheRoot: cache,
+		URLCanonializer: func(u *url.URL) (*url.URL, error) {
+			ret := *e.upstreamURL
+			ret.Path = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(u.Path, "/info/refs"), "/git-upload-pack"), ".git") + ".git"
+			return &ret, nil
+		},
+		RequestAuthorizer: func(r *http.Request) error {
+			if r.Header.Get("Authorization") != "Bearer "+selfTestToken {
+				return status.Error(codes.Unauthenticated, "not the self-test token")
+			}
+			return nil
+		},
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: selfTestToken}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	e.proxy = &http.Server{Handler: goblet.HTTPHandler(config)}
+	go e.proxy.Serve(l)
+	e.proxyURL = "http://" + l.Addr().String()
+	return nil
+}
+
+// git runs git in dir, and returns the trimmed output.
+func (e *selfTestEnv) git(dir string, arg ...string) (string, error) {
+	cmd := exec.Command("git", arg...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "HOME="+e.dir)
+	bs, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v\n%s", strings.Join(arg, " "), err, bs)
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
+
+func (e *selfTestEnv) close() {
+	if e.proxy != nil {
+		e.proxy.Close()
+	}
+	if e.upstream != nil {
+		e.upstream.Close()
+	}
+	if e.dir != "" {
+		os.RemoveAll(e.dir)
+	}
+}
+
+// checkCacheRoot checks that each -cache_root is a writable directory.
+func checkCacheRoot() error {
+	if *cacheRoot == "" {
+		return fmt.Errorf("-cache_root is not specified")
+	}
+	for _, root := range cacheRoots() {
+		fi, err := os.Stat(root)
+		if err != nil {
+			return fmt.Errorf("cannot access the cache root: %v", err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("the cache root %s is not a directory", root)
+		}
+		f, err := ioutil.TempFile(root, "goblet_selftest")
+		if err != nil {
+			return fmt.Errorf("the cache root %s is not writable: %v", root, err)
+		}
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goblet_selftest_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name      string
+		cacheRoot string
+		want      int
+	}{
+		{name: "writable cache root", cacheRoot: dir, want: 0},
+		{name: "missing cache root", cacheRoot: filepath.Join(dir, "missing"), want: 1},
+		{name: "no cache root", cacheRoot: "", want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func(old string) { *cacheRoot = old }(*cacheRoot)
+			*cacheRoot = tc.cacheRoot
+
+			if got := runSelfTest(); got != tc.want {
+				t.Errorf("got exit code %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 0 {
+		t.Errorf("the self-test left %d files in the cache root", len(fis))
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshAuthorizedKeys is set if -ssh_port is specified.
+var sshAuthorizedKeys *authorizedKeysLoader
+
+// authorizedKeysLoader authorizes the SSH clients with the keys of
+// -ssh_authorized_keys_file. It's reloaded with the settings.
+type authorizedKeysLoader struct {
+	path string
+
+	mu sync.RWMutex
+	// identities maps the keys in the wire format to the client
+	// identities.
+	identities map[string]string
+}
+
+func newAuthorizedKeysLoader(path string) (*authorizedKeysLoader, error) {
+	l := &authorizedKeysLoader{path: path}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reload reads the authorized keys file in the OpenSSH format. The comment of
+// a key is the identity of the client, and the SHA256 fingerprint is used if
+// there's no comment.
+func (l *authorizedKeysLoader) reload() error {
+	bs, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("cannot read the SSH authorized keys: %v", err)
+	}
+	identities := map[string]string{}
+	for len(strings.TrimSpace(string(bs))) != 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(bs)
+		if err != nil {
+			return fmt.Errorf("cannot parse the SSH authorized keys %s: %v", l.path, err)
+		}
+		if comment == "" {
+			comment = ssh.FingerprintSHA256(key)
+		}
+		identities[string(key.Marshal())] = comment
+		bs = rest
+	}
+	l.mu.Lock()
+	l.identities = identities
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *authorizedKeysLoader) authorize(user string, key ssh.PublicKey) (string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	identity, ok := l.identities[string(key.Marshal())]
+	if !ok {
+		return "", fmt.Errorf("unknown public key for %s", user)
+	}
+	return identity, nil
+}
+
+// readSSHHostKeys reads the comma-separated private key files.
+func readSSHHostKeys(files string) ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+	for _, f := range strings.Split(files, ",") {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the SSH host key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(bs)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the SSH host key %s: %v", f, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
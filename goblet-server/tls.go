@@ -0,0 +1,184 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/goblet"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsCertificates is set if -tls_cert and -tls_key are specified.
+var tlsCertificates *certificateLoader
+
+// certificateLoader serves the certificate of -tls_cert and -tls_key. It's
+// reloaded with the settings so that a renewed certificate is used without a
+// restart.
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertificateLoader(certFile, keyFile string) (*certificateLoader, error) {
+	l := &certificateLoader{certFile: certFile, keyFile: keyFile}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *certificateLoader) reload() error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load the TLS certificate: %v", err)
+	}
+	l.mu.Lock()
+	l.cert = &cert
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cert, nil
+}
+
+func (l *certificateLoader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: l.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// newACMEManager returns an autocert.Manager that obtains and renews the
+// certificates of -acme_hosts. The certificates are obtained with the
+// TLS-ALPN-01 challenge on the first TLS handshake for each hostname.
+func newACMEManager() *autocert.Manager {
+	dir := *acmeCacheDir
+	if dir == "" {
+		dir = filepath.Join(cacheRoots()[0], ".acme")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(strings.Split(*acmeHosts, ",")...),
+		Email:      *acmeEmail,
+		Client:     &acme.Client{DirectoryURL: *acmeDirectoryURL},
+	}
+}
+
+// newServerTLSConfig returns the TLS config of the server from the flags, or
+// nil to serve plain HTTP.
+func newServerTLSConfig() (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		if *acmeHosts != "" {
+			return nil, fmt.Errorf("-tls_cert and -acme_hosts cannot be used together")
+		}
+		var err error
+		if tlsCertificates, err = newCertificateLoader(*tlsCert, *tlsKey); err != nil {
+			return nil, err
+		}
+		tlsConfig = tlsCertificates.tlsConfig()
+	} else if *acmeHosts != "" {
+		tlsConfig = newACMEManager().TLSConfig()
+	}
+	if *tlsClientCA != "" {
+		if *acmeHosts != "" {
+			// The ACME server connects for the TLS-ALPN-01
+			// challenges without a client certificate.
+			return nil, fmt.Errorf("-tls_client_ca and -acme_hosts cannot be used together")
+		}
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("-tls_client_ca needs -tls_cert")
+		}
+		if err := requireClientCertificates(tlsConfig, *tlsClientCA); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// requireClientCertificates makes the server require the client certificates
+// signed by the CAs in caFile. The identities of the certificates are
+// available with goblet.ClientIdentity.
+func requireClientCertificates(tlsConfig *tls.Config, caFile string) error {
+	bs, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the client CA certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return fmt.Errorf("no certificate is found in %s", caFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// listenAndServe serves HTTPS if tlsConfig is not nil, and plain HTTP
+// otherwise.
+func listenAndServe(server *http.Server, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = tlsConfig
+	return server.ListenAndServeTLS("", "")
+}
+
+// tlsVersions maps the -upstream_tls_min_version values to the TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newUpstreamTLS returns the UpstreamTLS of the flags, or nil if none of them
+// is set. The files are loaded to report the errors upfront.
+func newUpstreamTLS() (*goblet.UpstreamTLS, error) {
+	if *upstreamCAFile == "" && *upstreamTLSMinVersion == "" && *upstreamClientCert == "" && *upstreamClientKey == "" {
+		return nil, nil
+	}
+	t := &goblet.UpstreamTLS{
+		CAFile:   *upstreamCAFile,
+		CertFile: *upstreamClientCert,
+		KeyFile:  *upstreamClientKey,
+	}
+	if *upstreamTLSMinVersion != "" {
+		v, ok := tlsVersions[*upstreamTLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown -upstream_tls_min_version %q", *upstreamTLSMinVersion)
+		}
+		t.MinVersion = v
+	}
+	if _, err := t.ClientConfig(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCertificate writes a self-signed certificate and its key to
+// dir, and returns their paths.
+func writeSelfSignedCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goblet-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goblet_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSignedCertificate(t, dir)
+	emptyFile := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		cert, key      string
+		clientCA       string
+		acmeHosts      string
+		wantNil        bool
+		wantClientAuth tls.ClientAuthType
+		wantErr        string
+	}{
+		{name: "plain HTTP", wantNil: true},
+		{name: "certificate", cert: certFile, key: keyFile, wantClientAuth: tls.NoClientCert},
+		{name: "client certificates", cert: certFile, key: keyFile, clientCA: certFile, wantClientAuth: tls.RequireAndVerifyClientCert},
+		{name: "no client CA certificate", cert: certFile, key: keyFile, clientCA: emptyFile, wantErr: "no certificate is found"},
+		{name: "client certificates without a certificate", clientCA: certFile, wantErr: "-tls_client_ca needs -tls_cert"},
+		{name: "client certificates with ACME", clientCA: certFile, acmeHosts: "goblet.example.com", wantErr: "-tls_client_ca and -acme_hosts cannot be used together"},
+		{name: "certificate with ACME", cert: certFile, key: keyFile, acmeHosts: "goblet.example.com", wantErr: "-tls_cert and -acme_hosts cannot be used together"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func(cert, key, clientCA, hosts string) {
+				*tlsCert, *tlsKey, *tlsClientCA, *acmeHosts = cert, key, clientCA, hosts
+				tlsCertificates = nil
+			}(*tlsCert, *tlsKey, *tlsClientCA, *acmeHosts)
+			*tlsCert, *tlsKey, *tlsClientCA, *acmeHosts = tc.cert, tc.key, tc.clientCA, tc.acmeHosts
+
+			got, err := newServerTLSConfig()
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got %v, want an error with %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantNil {
+				if got != nil {
+					t.Errorf("got a TLS config, want plain HTTP")
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("got plain HTTP, want a TLS config")
+			}
+			if got.ClientAuth != tc.wantClientAuth {
+				t.Errorf("got the client auth %v, want %v", got.ClientAuth, tc.wantClientAuth)
+			}
+		})
+	}
+}
@@ -15,9 +15,11 @@
 package goblet
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"go.opencensus.io/stats"
@@ -31,13 +33,42 @@ var (
 	CommandTypeKey = tag.MustNewKey("github.com/google/goblet/command-type")
 
 	// CommandCacheStateKey indicates whether the command response is cached
-	// or not ("locally-served", "queried-upstream").
+	// or not ("locally-served", "revalidated", "queried-upstream",
+	// "served-stale"). The revalidated commands query the upstream as the
+	// cache is not fresh, and find the cache up to date. The served-stale
+	// commands are served from the cache as the upstream is unavailable.
 	CommandCacheStateKey = tag.MustNewKey("github.com/google/goblet/command-cache-state")
 
 	// CommandCanonicalStatusKey indicates whether the command is succeeded
 	// or not ("OK", "Unauthenticated").
 	CommandCanonicalStatusKey = tag.MustNewKey("github.com/google/goblet/command-status")
 
+	// ErrorCategoryKey indicates the category of a failed command
+	// ("upstream-auth", "upstream-unavailable", "not-found",
+	// "local-corruption", "overloaded"). See ErrorCategory.
+	ErrorCategoryKey = tag.MustNewKey("github.com/google/goblet/error-category")
+
+	// TenantKey indicates the tenant of the request. This is set only when
+	// TenantExtractor is set.
+	TenantKey = tag.MustNewKey("github.com/google/goblet/tenant")
+
+	// RepositoryKey indicates the canonical upstream URL of the repository
+	// of the command. This is set only when RepositoryMetricTag is true.
+	// See MaxRepositoryTagValues.
+	RepositoryKey = tag.MustNewKey("github.com/google/goblet/repository")
+
+	// PriorityKey indicates the priority of the request ("low", "normal",
+	// "high").
+	PriorityKey = tag.MustNewKey("github.com/google/goblet/priority")
+
+	// HeadOnlyKey indicates whether an ls-refs command asks only for HEAD
+	// ("true", "false"). This is not set for the other commands.
+	HeadOnlyKey = tag.MustNewKey("github.com/google/goblet/head-only")
+
+	// ConnReusedKey indicates whether a request to the upstream reused a
+	// connection ("true", "false").
+	ConnReusedKey = tag.MustNewKey("github.com/google/goblet/conn-reused")
+
 	// InboundCommandProcessingTime is a processing time of the inbound
 	// commands.
 	InboundCommandProcessingTime = stats.Int64("github.com/google/goblet/inbound-command-processing-time", "processing time of inbound commands", stats.UnitMilliseconds)
@@ -55,22 +86,753 @@ var (
 
 	// OutboundCommandCount is a count of outbound commands.
 	OutboundCommandCount = stats.Int64("github.com/google/goblet/outbound-command-count", "number of outbound commands", stats.UnitDimensionless)
+
+	// BlockedRequestCount is a count of requests for blocked repositories.
+	BlockedRequestCount = stats.Int64("github.com/google/goblet/blocked-request-count", "number of requests for blocked repositories", stats.UnitDimensionless)
+
+	// AbortedNegotiationCount is a count of fetch negotiations aborted by
+	// MaxNegotiationRounds.
+	AbortedNegotiationCount = stats.Int64("github.com/google/goblet/aborted-negotiation-count", "number of aborted fetch negotiations", stats.UnitDimensionless)
+
+	// PackServeRetryCount is a count of the pack generations retried with
+	// RetryPackServe.
+	PackServeRetryCount = stats.Int64("github.com/google/goblet/pack-serve-retry-count", "number of retried pack generations", stats.UnitDimensionless)
+
+	// PackServeKillCount is a count of the pack generations killed by
+	// PackServeTimeout.
+	PackServeKillCount = stats.Int64("github.com/google/goblet/pack-serve-kill-count", "number of killed pack generations", stats.UnitDimensionless)
+
+	// HeadOnlyRequestCount is a count of ls-refs commands that ask only
+	// for HEAD.
+	HeadOnlyRequestCount = stats.Int64("github.com/google/goblet/head-only-request-count", "number of HEAD-only ls-refs commands", stats.UnitDimensionless)
+
+	// CoalescedFetchCount is a count of the fetch commands served with the
+	// response generated for an identical command. See CoalesceFetches.
+	CoalescedFetchCount = stats.Int64("github.com/google/goblet/coalesced-fetch-count", "number of coalesced fetch commands", stats.UnitDimensionless)
+
+	// RequestSpillCount is a count of the requests that spilled the data
+	// over RequestMemoryBudget to disk.
+	RequestSpillCount = stats.Int64("github.com/google/goblet/request-spill-count", "number of requests spilled to disk", stats.UnitDimensionless)
+
+	// PackCacheHitCount and PackCacheMissCount are counts of the fetch
+	// responses served from and not found in the pack response cache.
+	PackCacheHitCount  = stats.Int64("github.com/google/goblet/pack-cache-hit-count", "number of pack response cache hits", stats.UnitDimensionless)
+	PackCacheMissCount = stats.Int64("github.com/google/goblet/pack-cache-miss-count", "number of pack response cache misses", stats.UnitDimensionless)
+
+	// PackCacheEvictionCount is a count of the responses evicted from the
+	// pack response cache.
+	PackCacheEvictionCount = stats.Int64("github.com/google/goblet/pack-cache-eviction-count", "number of pack response cache evictions", stats.UnitDimensionless)
+
+	// PackCacheBytes is the size of the responses in the pack response
+	// cache.
+	PackCacheBytes = stats.Int64("github.com/google/goblet/pack-cache-bytes", "size of the pack response cache", stats.UnitBytes)
+
+	// LFSCacheHitCount and LFSCacheMissCount are counts of the Git LFS
+	// object requests served from and not found in the LFS object cache.
+	LFSCacheHitCount  = stats.Int64("github.com/google/goblet/lfs-cache-hit-count", "number of LFS object cache hits", stats.UnitDimensionless)
+	LFSCacheMissCount = stats.Int64("github.com/google/goblet/lfs-cache-miss-count", "number of LFS object cache misses", stats.UnitDimensionless)
+
+	// LFSCacheEvictionCount is a count of the objects evicted from the
+	// LFS object cache.
+	LFSCacheEvictionCount = stats.Int64("github.com/google/goblet/lfs-cache-eviction-count", "number of LFS object cache evictions", stats.UnitDimensionless)
+
+	// LFSCacheBytes is the size of the objects in the LFS object cache.
+	LFSCacheBytes = stats.Int64("github.com/google/goblet/lfs-cache-bytes", "size of the LFS object cache", stats.UnitBytes)
+
+	// PackfileURIOffloadCount is a count of the fetches whose base pack is
+	// downloaded from the packfile URI.
+	PackfileURIOffloadCount = stats.Int64("github.com/google/goblet/packfile-uri-offload-count", "number of fetches offloaded to packfile URIs", stats.UnitDimensionless)
+
+	// ShedRequestCount is a count of requests shed during an eviction or
+	// a drain, or because of their low priority or a concurrency limit.
+	ShedRequestCount = stats.Int64("github.com/google/goblet/shed-request-count", "number of shed requests", stats.UnitDimensionless)
+
+	// UpstreamConnCount is a count of the connections that the requests
+	// to the upstream got, either new or reused. See ConnReusedKey.
+	UpstreamConnCount = stats.Int64("github.com/google/goblet/upstream-conn-count", "number of connections used for the upstream requests", stats.UnitDimensionless)
+
+	// ThrottledRequestCount is a count of requests rejected by
+	// ClientRateLimit.
+	ThrottledRequestCount = stats.Int64("github.com/google/goblet/throttled-request-count", "number of throttled requests", stats.UnitDimensionless)
+
+	// UpstreamRetryCount is a count of the upstream operations retried
+	// with UpstreamRetries. See CommandTypeKey.
+	UpstreamRetryCount = stats.Int64("github.com/google/goblet/upstream-retry-count", "number of retried upstream operations", stats.UnitDimensionless)
+
+	// UpstreamCircuitOpenCount is a count of the circuit breakers of the
+	// upstream hosts opened. See CircuitErrorRate.
+	UpstreamCircuitOpenCount = stats.Int64("github.com/google/goblet/upstream-circuit-open-count", "number of opened upstream circuit breakers", stats.UnitDimensionless)
+
+	// StaleServeCount is a count of the commands served from the cache
+	// because the upstream was unavailable. See ServeStaleOnFailure.
+	StaleServeCount = stats.Int64("github.com/google/goblet/stale-serve-count", "number of commands served stale", stats.UnitDimensionless)
+
+	// ClusterForwardCount is a count of the requests forwarded to the
+	// owner replica of the repository. See ClusterReplicas.
+	ClusterForwardCount = stats.Int64("github.com/google/goblet/cluster-forward-count", "number of requests forwarded to the owner replica", stats.UnitDimensionless)
+
+	// SharedFetchCount is a count of the upstream fetches skipped as
+	// another replica fetched the repository. See FetchStateStore.
+	SharedFetchCount = stats.Int64("github.com/google/goblet/shared-fetch-count", "number of upstream fetches done by another replica", stats.UnitDimensionless)
+
+	// StaleLockRecoveryCount is a count of the repository locks taken
+	// over from a process that died while holding them. See
+	// CrossProcessLocking.
+	StaleLockRecoveryCount = stats.Int64("github.com/google/goblet/stale-lock-recovery-count", "number of repository locks recovered from a died process", stats.UnitDimensionless)
+
+	// CacheEvictionCount is a count of the repositories evicted to keep
+	// the cache within MaxCacheBytes.
+	CacheEvictionCount = stats.Int64("github.com/google/goblet/cache-eviction-count", "number of cached repository evictions", stats.UnitDimensionless)
+
+	// IdleEvictionCount is a count of the repositories evicted as they
+	// are not fetched for IdleRepositoryTTL.
+	IdleEvictionCount = stats.Int64("github.com/google/goblet/idle-eviction-count", "number of idle cached repository evictions", stats.UnitDimensionless)
+
+	// ColdStorageUploadCount is a count of the repositories moved to
+	// ColdStorage, and ColdStorageRestoreCount is a count of the ones
+	// restored from it.
+	ColdStorageUploadCount  = stats.Int64("github.com/google/goblet/cold-storage-upload-count", "number of repositories moved to the cold storage", stats.UnitDimensionless)
+	ColdStorageRestoreCount = stats.Int64("github.com/google/goblet/cold-storage-restore-count", "number of repositories restored from the cold storage", stats.UnitDimensionless)
+
+	// MaintenanceCount is a count of the repository maintenances, and
+	// MaintenanceProcessingTime is their processing time.
+	MaintenanceCount          = stats.Int64("github.com/google/goblet/maintenance-count", "number of repository maintenances", stats.UnitDimensionless)
+	MaintenanceProcessingTime = stats.Int64("github.com/google/goblet/maintenance-processing-time", "processing time of repository maintenances", stats.UnitMilliseconds)
+
+	// NegativeCacheHitCount is a count of the requests that failed with a
+	// remembered upstream error. See NegativeCacheTTL.
+	NegativeCacheHitCount = stats.Int64("github.com/google/goblet/negative-cache-hit-count", "number of requests failed with a cached upstream error", stats.UnitDimensionless)
+
+	// CacheBytes is the size of the cached repositories.
+	CacheBytes = stats.Int64("github.com/google/goblet/cache-bytes", "size of the cached repositories", stats.UnitBytes)
+
+	// FetchQueueDepth is the number of the fetch requests waiting for
+	// MaxConcurrentFetches.
+	FetchQueueDepth = stats.Int64("github.com/google/goblet/fetch-queue-depth", "number of waiting fetch requests", stats.UnitDimensionless)
 )
 
 type ServerConfig struct {
 	LocalDiskCacheRoot string
 
+	// CacheShardRoots are the directories, typically on separate disks,
+	// that the cached repositories are spread across in addition to
+	// LocalDiskCacheRoot. A repository is placed by the hash of its
+	// tenant and URL. Use RebalanceCacheShards to move the cached
+	// repositories after the roots are changed. The object pools are
+	// kept in LocalDiskCacheRoot.
+	CacheShardRoots []string
+
+	// RepositoryStore stores the cached repositories in place of the
+	// local disk, such as on a shared filesystem or an object storage.
+	// The repositories of a store other than NewLocalDiskStore are served
+	// with the basic caching only: the commands are served from the store
+	// after fetching the repository once it gets older than
+	// FetchFreshnessWindow. HiddenRefs, GerritChangeRefPolicy,
+	// AuditLogger, MaxRepoRequests, MaxNegotiationRounds, the fetch
+	// priorities, and AllowedClientCapabilities still apply to them. The
+	// drains of AdminHandler and ShedDuringEviction don't. If nil, the
+	// repositories are cached under LocalDiskCacheRoot and
+	// CacheShardRoots.
+	RepositoryStore RepositoryStore
+
+	// The settings that UpdateSettings changes are guarded by settingsMu.
+	settingsMu sync.RWMutex
+
 	URLCanonializer func(*url.URL) (*url.URL, error)
 
 	RequestAuthorizer func(*http.Request) error
 
+	// AdminAuthorizer authorizes the requests to AdminHandler. The admin
+	// endpoints are disabled if this is nil.
+	AdminAuthorizer func(*http.Request) error
+
+	// SettingsReloader is called by POST /admin/reload to reload the
+	// settings, typically with UpdateSettings. The endpoint is disabled
+	// if this is nil.
+	SettingsReloader func() error
+
+	// TokenSource provides the credentials for the upstream. The token is
+	// sent in the Authorization header with its type, which is "Bearer"
+	// by default.
 	TokenSource oauth2.TokenSource
 
+	// UpstreamCredentialProvider provides the credentials for each
+	// upstream repository. TokenSource is used for the repositories that
+	// it has no credentials for. This allows fetching from the upstreams
+	// that take different credentials.
+	UpstreamCredentialProvider UpstreamCredentialProvider
+
+	// ErrorReporter receives the errors that are not the clients' fault,
+	// such as the upstream failures and the corrupted caches. Use
+	// ErrorCategoryOf to tell them apart. The errors are logged if nil.
 	ErrorReporter func(*http.Request, error)
 
 	RequestLogger func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
 
 	LongRunningOperationLogger func(string, *url.URL) RunningOperation
+
+	// RemoteFilesystemMode minimizes the filesystem round-trips on the
+	// serving path. The refs and the pack indexes of a cached repository
+	// are kept in memory until the next upstream fetch, and fetched
+	// objects are kept in packs instead of loose objects. Use this when
+	// LocalDiskCacheRoot is on a high-latency filesystem such as NFS.
+	RemoteFilesystemMode bool
+
+	// CrossProcessLocking locks the cached repositories with flock(2)
+	// while they are written, so that multiple goblet processes can share
+	// the cache roots, such as on NFS. A lock held by a process that died
+	// is released by the kernel or the NFS server, and the git lock files
+	// that the process left are removed.
+	CrossProcessLocking bool
+
+	// ClientKeepaliveInterval is the interval of the keepalive packets sent
+	// to the client while it's waiting for an upstream fetch. This keeps
+	// the connection alive through load balancers that drop idle
+	// connections. Zero disables the keepalive.
+	ClientKeepaliveInterval time.Duration
+
+	// BlockedRepos is a list of glob patterns, in the path.Match syntax,
+	// of the canonical upstream URLs that are neither fetched nor served.
+	// Use UpdateBlockedRepos to change this while the server is running.
+	BlockedRepos   []string
+	blockedReposMu sync.RWMutex
+
+	// AllowedRepos is a list of glob patterns in the same syntax. If set,
+	// only the repositories that match with one of them and none of
+	// BlockedRepos are fetched and served. The patterns are matched
+	// against the URL with and without the scheme, such as
+	// "github.com/ours/*". Use UpdateAllowedRepos to change this while the
+	// server is running.
+	AllowedRepos []string
+
+	// AccessRules restricts the repositories that the clients can fetch.
+	// A request is rejected unless one of the rules allows it. All
+	// repositories are allowed if this is empty.
+	AccessRules []*AccessRule
+
+	// ClientIdentifier returns the identity of the client that
+	// AccessRules match with, such as the subject of its token. It
+	// defaults to ClientIdentity.
+	ClientIdentifier func(*http.Request) string
+
+	// ClientRateLimit is the sustained rate, in requests per second, that
+	// a client can make. ClientRateBurst is the number of the requests it
+	// can make at once, and defaults to ClientRateLimit rounded up. The
+	// clients are identified by ClientIdentifier, or by their IP addresses
+	// if they are anonymous. The requests over the limit are rejected
+	// with 429 and Retry-After. No limit if zero.
+	ClientRateLimit float64
+	ClientRateBurst int
+
+	// AccessLogFile is a path of the file that the requests are logged to
+	// in JSON, one request per line, in addition to RequestLogger. The
+	// file is rotated when it exceeds AccessLogMaxBytes or gets older than
+	// AccessLogMaxAge, and AccessLogMaxBackups rotated files are kept.
+	// Zero values disable the respective rotation conditions. If
+	// AccessLogFormat is "combined", the requests are logged in the
+	// Combined Log Format instead. See NewCombinedRequestLogger. The
+	// HTTPHandlers logging to the same file share one writer, which
+	// Shutdown closes.
+	AccessLogFile       string
+	AccessLogFormat     string
+	AccessLogMaxBytes   int64
+	AccessLogMaxAge     time.Duration
+	AccessLogMaxBackups int
+
+	// RequestHooks are called before and after the requests that
+	// HTTPHandler serves, such as for the custom authorization, quotas,
+	// and tagging. See RequestHook.
+	RequestHooks []RequestHook
+
+	// AuditLogger receives an AuditEvent for each protocol v2 command that
+	// the clients run, recording who fetched which refs and commits of
+	// which repository and how many bytes were served. Use
+	// NewJSONAuditLogger to write them to an append-only file. Not
+	// recorded if nil.
+	AuditLogger func(*AuditEvent)
+
+	// FetchFreshnessWindow is the duration after an upstream fetch during
+	// which ls-refs is served from the local cache without querying the
+	// upstream. Zero means that the upstream is always queried.
+	FetchFreshnessWindow time.Duration
+
+	// MaxConcurrentFetches is the maximum number of the fetch requests
+	// processed at the same time. The other requests wait in the order of
+	// their Goblet-Priority header ("low", "normal", or "high"). Unlimited
+	// if zero.
+	MaxConcurrentFetches int
+
+	// HighPriorityClients is a list of glob patterns, in the path.Match
+	// syntax, of the client identities that can claim the high priority.
+	// The clients are identified by ClientIdentifier, or by the SSH keys.
+	HighPriorityClients []string
+
+	// HighPriorityAuthorizer authorizes the other requests that claim the
+	// high priority. The claims of the clients not in HighPriorityClients
+	// are ignored if this is nil or returns an error.
+	HighPriorityAuthorizer func(*http.Request) error
+
+	// ShedLowPriority sheds the low priority fetch requests with 503
+	// instead of queueing them when MaxConcurrentFetches is reached.
+	ShedLowPriority bool
+
+	// HeadOnlyCacheTTL is the duration that the ls-refs commands asking
+	// only for HEAD are served from the local cache after the upstream
+	// HEAD is observed. Zero means that the upstream is always queried.
+	// A command is HEAD-only if all of its ref-prefix arguments are
+	// expansions of "HEAD", as `git fetch origin HEAD` sends. Note that
+	// `git ls-remote --symref origin HEAD` of Git 2.32 and later doesn't
+	// send ref prefixes. Its command is the same as the one listing all
+	// refs, so it always gets the full advertisement, and it's not served
+	// with this TTL. See HeadOnlyKey.
+	HeadOnlyCacheTTL time.Duration
+
+	// NegativeCacheTTL is the duration that the upstream's 401, 403, and
+	// 404 responses to ls-refs are remembered per repository. The
+	// requests for the repository fail with the remembered error without
+	// querying the upstream until it expires, so that the clients
+	// retrying a missing repository don't flood the upstream. Zero
+	// disables the cache.
+	NegativeCacheTTL time.Duration
+
+	// PackServeTimeout is the maximum duration of git-upload-pack
+	// generating the response of a command from the local cache, until it
+	// starts sending the pack data. It's killed with git-pack-objects when
+	// it exceeds this. The pack data is streamed without a timeout, so
+	// that the long clones to slow clients aren't killed. Zero means no
+	// timeout.
+	PackServeTimeout time.Duration
+
+	// RequestTimeout is the maximum duration of handling an upload-pack
+	// request, including the wait for the upstream fetch. The request
+	// fails with DeadlineExceeded when it exceeds this, and the running
+	// git-upload-pack is stopped. CloneTimeout is the maximum duration of
+	// the requests fetching without haves, which can take much longer.
+	// It defaults to RequestTimeout if zero. No deadline if zero.
+	RequestTimeout time.Duration
+	CloneTimeout   time.Duration
+
+	// RetryPackServe makes goblet retry a failed git-upload-pack once with
+	// the settings that use less memory, such as a single thread and a
+	// smaller delta window. Only the server-side failures are retried,
+	// such as PackServeTimeout and the process being killed, and not the
+	// errors of the request that git-upload-pack reports to the client.
+	// The response is buffered until the pack data starts, and a failure
+	// after that is not retried.
+	RetryPackServe bool
+
+	// CoalesceFetches makes the identical fetch commands that come while
+	// the response for one of them is generated share the response,
+	// instead of running git-upload-pack for each. The response is
+	// spooled to a temporary file, and each client reads it at its own
+	// pace from the beginning.
+	CoalesceFetches bool
+
+	// ForcePushPolicy specifies how the non-fast-forward updates of the
+	// upstream refs are handled. ForcePushGracePeriod is the duration that
+	// the old values are kept with ForcePushKeepOldObjects. It defaults
+	// to 10 minutes.
+	ForcePushPolicy      ForcePushPolicy
+	ForcePushGracePeriod time.Duration
+
+	// DNSCacheTTL makes goblet resolve the upstream hostnames by itself
+	// and cache the results for the duration. If zero, the upstream
+	// hostnames are resolved by the OS resolver on every connection.
+	DNSCacheTTL time.Duration
+
+	// UpstreamHostIPs pins the upstream hostnames to the IP addresses.
+	// This takes precedence over DNSCacheTTL.
+	UpstreamHostIPs map[string]string
+
+	// UpstreamTransport tunes the connection pool of the requests to the
+	// upstream. http.DefaultTransport is used if this is nil and the
+	// upstream hostnames are resolved by the OS resolver.
+	UpstreamTransport *UpstreamTransport
+
+	// UpstreamRetries is the number of times that the upstream fetches
+	// and ls-refs are retried when they fail transiently, such as with 5xx
+	// responses, reset connections, and timeouts. No retries if zero. The
+	// first retry waits for about UpstreamRetryBackoff, 1 second by
+	// default, and the wait doubles on every retry up to 30 seconds.
+	// UpstreamRetryBudget is the ratio of the retries to the upstream
+	// operations, 0.1 by default, so that the retries don't pile up when
+	// the upstream is down.
+	UpstreamRetries      int
+	UpstreamRetryBackoff time.Duration
+	UpstreamRetryBudget  float64
+
+	upstreamRetries retryBudget
+
+	// UpstreamLsRefsTimeout is the maximum duration of an ls-refs request
+	// to the upstream. UpstreamFetchTimeout is the maximum duration of a
+	// git-fetch from the upstream, and it's killed when it exceeds this.
+	// The timed out operations are retried with UpstreamRetries. No
+	// timeout if zero.
+	UpstreamLsRefsTimeout time.Duration
+	UpstreamFetchTimeout  time.Duration
+
+	// CircuitErrorRate is the ratio of the upstream operations failing
+	// transiently in a minute at which the circuit breaker of the
+	// upstream host opens. While it's open, the operations fail fast
+	// with 503 and Retry-After, and the ls-refs of the cached
+	// repositories are served from the cache. Disabled if zero.
+	// CircuitMinRequests is the number of the operations in a minute
+	// needed to open the circuit, 5 by default. CircuitOpenDuration is
+	// the duration after which an operation is let through to probe the
+	// upstream, 30 seconds by default. The circuit closes if the probe
+	// succeeds.
+	CircuitErrorRate    float64
+	CircuitMinRequests  int
+	CircuitOpenDuration time.Duration
+
+	upstreamCircuits circuitBreakers
+
+	// ServeStaleOnFailure makes the ls-refs and the want-ref resolution
+	// of the cached repositories served from the cache when the upstream
+	// fails, instead of failing the request. Such responses have the
+	// Goblet-Served-Stale header and are counted in StaleServeCount. The
+	// fetches of the objects that aren't cached still fail. The upstream
+	// errors that tell the repository is gone or inaccessible, such as
+	// 404 and 403, are not hidden.
+	ServeStaleOnFailure bool
+
+	// Offline makes goblet serve strictly from the cache and never contact
+	// the upstream, such as in an air-gapped network with a pre-seeded
+	// cache. The cached repositories are served as fresh, and the
+	// requests for the repositories that are not cached fail with
+	// NotFound. The requests that need the upstream, such as the fetches
+	// of the objects that are not cached, pushes, and LFS downloads, fail
+	// with FailedPrecondition.
+	Offline bool
+
+	// PeerURL returns the URL of the repository on a peer goblet
+	// instance, such as the one in the region closest to the upstream.
+	// The repositories that are not cached are fetched from the peer
+	// first, and then from the upstream, which only sends what the peer
+	// doesn't have. The upstream is fetched from as usual if the peer
+	// fails. No peer if nil. PeerTokenSource provides the credentials for
+	// the peer, and the upstream credentials are used if nil.
+	PeerURL         func(upstreamURL *url.URL) (*url.URL, error)
+	PeerTokenSource oauth2.TokenSource
+
+	// ClusterReplicas are the base URLs of the goblet replicas that share
+	// the repositories, such as http://goblet-0.goblet:8080, and
+	// ClusterSelf is the one of this replica. The replicas agree on the
+	// owner of each repository by consistent hashing of the canonical
+	// URLs, and the others forward the git-upload-pack requests to the
+	// owner so that each repository is cached only by its owner. All
+	// replicas must have the same ClusterReplicas. Disabled if empty.
+	ClusterReplicas []string
+	ClusterSelf     string
+
+	// ClusterSecret is the secret shared by the replicas to sign the
+	// client identity and the remote address of the forwarded requests.
+	// The owner trusts the signed ones instead of authorizing and
+	// rate-limiting the requests again, so that the clients authorized
+	// by their TLS client certificates and the SSH and the git:// clients
+	// can be forwarded. Without it, the owner authorizes the forwarded
+	// requests with their Authorization headers, and the requests of the
+	// SSH and the git:// clients are not forwarded.
+	ClusterSecret string
+
+	clusterRingOnce sync.Once
+	clusterRing     *hashRing
+
+	// FetchStateStore shares the last fetch times and the fetch locks of
+	// the repositories between the replicas that share the cache roots,
+	// so that only one of them fetches a repository at a time. Not
+	// shared if nil.
+	FetchStateStore FetchStateStore
+
+	// UpstreamTLS configures the TLS connections to the upstream, such as
+	// the root CA certificates and the client certificate. The system
+	// root CA certificates are used if nil.
+	UpstreamTLS *UpstreamTLS
+
+	// UpstreamProxy is the URL of the proxy that the connections to the
+	// upstream, including the ones of git-fetch, go through, such as
+	// http://proxy.example.com:3128 or socks5://proxy.example.com:1080.
+	// UpstreamNoProxy is a list of the upstream hosts connected directly
+	// in the NO_PROXY syntax, such as .example.com and 10.0.0.0/8. If
+	// UpstreamProxy is empty, the HTTPS_PROXY, HTTP_PROXY, and NO_PROXY
+	// environment variables are used.
+	UpstreamProxy   string
+	UpstreamNoProxy []string
+
+	upstreamProxyOnce sync.Once
+	upstreamProxyFunc func(*url.URL) (*url.URL, error)
+
+	upstreamClientOnce sync.Once
+	upstreamClient     *http.Client
+
+	upstreamFetches upstreamFetchTracker
+	operations      operationTracker
+
+	// ReadinessCanaryURL is the upstream URL of a repository that
+	// ReadinessHandler runs ls-refs against to check the connectivity to
+	// the upstream. Only the cache roots are checked if nil.
+	ReadinessCanaryURL *url.URL
+
+	readinessMu        sync.Mutex
+	readinessCheckTime time.Time
+	readinessCanaryErr error
+
+	// MaxUpstreamFetches is the maximum number of the git-fetch processes
+	// fetching from the upstream at the same time. MaxUploadPacks is the
+	// maximum number of the git-upload-pack processes serving the clients
+	// at the same time. MaxRepoRequests is the maximum number of the
+	// in-flight requests of a repository. Unlike MaxConcurrentFetches,
+	// the requests over the limits are not queued but rejected with 503
+	// and Retry-After. The upstream fetches and the git-upload-pack
+	// processes of the normal priority requests can take three quarters
+	// of the slots, and the low priority ones half of them, so that the
+	// high priority requests are rejected last. Unlimited if zero.
+	MaxUpstreamFetches int
+	MaxUploadPacks     int
+	MaxRepoRequests    int
+
+	upstreamFetchSlots concurrencyLimiter
+	uploadPackSlots    concurrencyLimiter
+
+	// ShedDuringEviction makes the server respond with 503 Service
+	// Unavailable to the fetches that cannot be served from the cache
+	// while an eviction pass is running. The cache hits are still
+	// served. See StartEvictionPass.
+	ShedDuringEviction bool
+
+	// MaxCacheBytes is the total size of the cache roots above which the
+	// least recently fetched repositories are evicted by
+	// EnforceCacheQuota. No limit if zero.
+	MaxCacheBytes int64
+
+	// IdleRepositoryTTL is the duration after which the repositories that
+	// are not fetched are evicted by EvictIdleRepositories. Never evicted
+	// if zero.
+	IdleRepositoryTTL time.Duration
+
+	// ColdStorage stores the repositories that are not fetched for
+	// ColdStorageAfter, such as in a bucket, so that only the hot ones are
+	// kept on the local disk. MoveColdRepositories moves them, and they
+	// are restored on the next request before fetching from the
+	// upstream. Disabled if nil or zero.
+	ColdStorage      ColdStorage
+	ColdStorageAfter time.Duration
+
+	// HotRepositoryCount is the number of the most requested repositories
+	// that RefreshHotRepositories fetches ahead of the requests. None if
+	// zero.
+	HotRepositoryCount int
+
+	// MaintenanceInterval is the interval at which RunMaintenancePass
+	// packs the refs and the objects of each cached repository. A
+	// repository is also maintained right after its initial fetch so
+	// that the clones are served with its bitmap index. No maintenance
+	// if zero. MaxConcurrentMaintenance is the number of the
+	// repositories maintained at a time. It defaults to 1.
+	MaintenanceInterval      time.Duration
+	MaxConcurrentMaintenance int
+
+	// MaxNegotiationRounds is the maximum number of fetch requests in a
+	// negotiation. A negotiation is identified by the client IP, the
+	// client identity, the repository, and the wants, and it's aborted
+	// when it exceeds the limit. The clients behind the same NAT fetching
+	// the same commits with the same identity, such as the CI shards,
+	// count as one negotiation. No limit if zero or negative.
+	MaxNegotiationRounds int
+
+	// MaxRequestBytes is the size limit of an upload-pack request, after
+	// it's ungzipped. The requests are read upfront, and the larger ones
+	// are rejected with ResourceExhausted. It defaults to 32 MiB. A
+	// negative value disables the limit.
+	MaxRequestBytes int64
+
+	// RequestMemoryBudget is the size of the data that a request holds in
+	// memory, such as the upload-pack request of a negotiation with many
+	// haves and the response held for RetryPackServe. The data over the
+	// budget is spilled to temporary files under LocalDiskCacheRoot. No
+	// limit if zero.
+	RequestMemoryBudget int64
+
+	// ForceUpstreamHTTPS makes goblet fetch from the upstream with HTTPS
+	// even if the canonical URL is http://. The clients can keep using
+	// the http:// URL. There is no fallback to plain HTTP, which a network
+	// attacker could force, so the fetches from the hosts that don't
+	// support HTTPS fail. PlaintextUpstreamHosts is a list of glob
+	// patterns, in the path.Match syntax, of the upstream hostnames that
+	// are still fetched with plain HTTP, such as the ones without HTTPS.
+	ForceUpstreamHTTPS     bool
+	PlaintextUpstreamHosts []string
+
+	// AllowedClientCapabilities is a list of the protocol v2 capabilities
+	// and command arguments, such as "agent", "ofs-delta", and "filter",
+	// that the clients can use. The request capabilities not in the list
+	// are stripped, and the commands with arguments not in the list are
+	// rejected. "want", "have", "done", and "ref-prefix" are always
+	// allowed. "shallow" allows the deepen fetch arguments, such as
+	// "deepen" and "deepen-since", as well, and "ref-in-want" allows
+	// "want-ref". The bundle-uri capability is advertised only if
+	// "bundle-uri" is allowed. If nil, all are allowed.
+	AllowedClientCapabilities []string
+
+	// ShallowCachePolicy specifies how a shallow cached repository serves
+	// the requests that need more history than it has. By default, the
+	// rest of the history is fetched from the upstream.
+	ShallowCachePolicy ShallowCachePolicy
+
+	// GerritChangeRefPolicy specifies how the Gerrit change refs
+	// (refs/changes/*) are cached and served. By default, they are cached
+	// and advertised as any other refs.
+	GerritChangeRefPolicy GerritChangeRefPolicy
+
+	// PushPolicy specifies how the pushes are handled. By default, they
+	// are rejected.
+	PushPolicy PushPolicy
+
+	// LFSCacheRoot is the directory of the Git LFS object cache. If set,
+	// the Git LFS batch API of the repositories, such as
+	// <repository URL>/info/lfs/objects/batch, is served for downloads.
+	// The batch requests are forwarded to the upstream, and the objects
+	// are downloaded through this server and cached. The objects are
+	// stored once for all the repositories and the tenants, as they're
+	// addressed by their SHA-256 hashes, but an object is served only
+	// for the repositories whose upstream batch API returns it.
+	LFSCacheRoot string
+
+	// LFSCacheMaxBytes is the maximum size of the LFS object cache. The
+	// least recently used objects are evicted when it's exceeded. No
+	// limit if zero.
+	LFSCacheMaxBytes int64
+
+	// PackCacheRoot is the directory of the pack response cache. If set,
+	// the responses of the fetch commands without haves, such as the
+	// clones and the shallow clones, are stored in the cache, and the
+	// identical commands are served from it until the repository is
+	// fetched from the upstream.
+	PackCacheRoot string
+
+	// PackCacheMaxBytes is the maximum size of the pack response cache.
+	// The least recently used responses are evicted when it's exceeded.
+	// No limit if zero.
+	PackCacheMaxBytes int64
+
+	// BundleRoot is the directory of the Git bundles of the cached
+	// repositories. If set, a bundle of each repository is generated
+	// after it's fetched from the upstream, served at
+	// <repository URL>/info/goblet-bundle, and advertised with the
+	// bundle-uri capability so that the clients can bootstrap a clone
+	// from it and fetch only the rest with git-upload-pack.
+	BundleRoot string
+
+	// BundleMaxAge is how long a bundle is used before it's regenerated.
+	// 24 hours if zero.
+	BundleMaxAge time.Duration
+
+	// BundleBaseURL is the URL the clients reach this server at, such as
+	// "https://goblet.example.com", that the advertised bundle URIs are
+	// relative to. Set this if the server is behind a proxy or a load
+	// balancer. If empty, the scheme and the host of the request are
+	// used. The bundle URIs are not advertised to the SSH and the git://
+	// clients.
+	BundleBaseURL string
+
+	// PackfileURIUploader uploads a pack to a storage, such as a GCS
+	// bucket behind a CDN, and returns the URI the clients can download
+	// it from. name is a path unique to the repository and the pack. If
+	// set, a base pack of each repository is generated after it's
+	// fetched from the upstream and uploaded, and the initial clones of
+	// the clients that support the packfile-uris capability download it
+	// from the URI instead of this server.
+	PackfileURIUploader func(ctx context.Context, name string, pack io.Reader) (string, error)
+
+	// PackfileURIMinBytes is the size of a base pack below which it's
+	// served by this server rather than uploaded.
+	PackfileURIMinBytes int64
+
+	// PackfileURIMaxAge is how long a base pack is used before it's
+	// regenerated. 24 hours if zero.
+	PackfileURIMaxAge time.Duration
+
+	// HiddenRefs is a list of ref prefixes, such as
+	// "refs/heads/internal", that are not served. A ref is hidden if its
+	// name is a prefix or starts with a prefix followed by "/". Hidden
+	// refs are not advertised, and the objects reachable only from them
+	// cannot be fetched even by SHA-1.
+	HiddenRefs []string
+
+	// TenantExtractor returns the tenant of the request. If set, the
+	// cache is partitioned by tenant: a repository is stored at
+	// <cache root>/<tenant>/<host>/<path>, and the in-memory state
+	// of the repository, such as the last update time and the ref
+	// snapshot, is kept per tenant. Each tenant fetches from the upstream
+	// separately, and a request is served only from its tenant's cache.
+	//
+	// A tenant must match [A-Za-z0-9][A-Za-z0-9._-]{0,63}. The requests
+	// without a tenant are rejected. The server-wide settings, such as
+	// BlockedRepos and the DNS cache, are shared among the tenants, and
+	// the repositories with a tenant are not listed by
+	// ListManagedRepositories.
+	TenantExtractor func(*http.Request) string
+
+	// MaxTenantTagValues is the maximum number of distinct TenantKey
+	// values. The tenants seen after the limit is reached are recorded as
+	// "other", and the invalid tenants as "(invalid)". It defaults to 100.
+	MaxTenantTagValues int
+
+	// RepositoryMetricTag tags the command measures with RepositoryKey, so
+	// that the command counts, latencies, and cache states can be broken
+	// down per repository.
+	RepositoryMetricTag bool
+
+	// MaxRepositoryTagValues is the maximum number of distinct
+	// RepositoryKey values. The repositories seen after the limit is
+	// reached are recorded as "other". It defaults to 100.
+	MaxRepositoryTagValues int
+
+	// RepoOverrides overrides the settings above per repository. If
+	// multiple overrides match with a repository, the most specific one,
+	// the one with the most non-wildcard characters in the pattern, wins.
+	// They can be replaced at runtime with SetRepoOverrides.
+	RepoOverrides []*RepoOverride
+
+	// WarmRepositories are the URLs of the repositories that
+	// WarmUpRepositories fetches ahead of the requests, so that the first
+	// clone of the day doesn't wait for the upstream. The URLs are
+	// canonicalized with URLCanonializer as the request URLs are, and the
+	// repositories are cached in the default tenant. They can be replaced
+	// at runtime with SetWarmRepositories.
+	WarmRepositories []string
+
+	// WebhookSecret is the secret shared with the senders of the webhooks
+	// to WebhookHandler. The webhooks are rejected if this is empty.
+	// WebhookGerritURL is the URL of the Gerrit server that sends its
+	// events to WebhookHandler, such as https://gerrit.example.com, as
+	// the events don't have it.
+	WebhookSecret    string
+	WebhookGerritURL string
+}
+
+// RepoOverride overrides the ServerConfig settings for the repositories that
+// match with Pattern.
+type RepoOverride struct {
+	// Pattern is a glob pattern, in the path.Match syntax, of the
+	// canonical upstream URLs. It's matched against the URL with and
+	// without the scheme.
+	Pattern string
+
+	// FetchFreshnessWindow overrides ServerConfig.FetchFreshnessWindow if
+	// non-zero.
+	FetchFreshnessWindow time.Duration
+
+	// ObjectPool is the name of the object store shared by the
+	// repositories, such as the forks of a project, so that their common
+	// history is stored once. The repositories borrow the objects of the
+	// pool with Git alternates, and RunMaintenancePass moves their
+	// objects to the pool. The pooled repositories don't have bitmap
+	// indexes. This applies to the repositories cached after it's set.
+	// A client can fetch the objects of any repository in the pool by
+	// their hashes, so share a pool only among the repositories
+	// readable by the same clients.
+	ObjectPool string
 }
 
 type RunningOperation interface {
@@ -90,17 +852,107 @@ type ManagedRepository interface {
 }
 
 func HTTPHandler(config *ServerConfig) http.Handler {
-	return &httpProxyServer{config}
+	s := &httpProxyServer{config: config}
+	if config.AccessLogFile != "" {
+		f := accessLogFile(config)
+		if config.AccessLogFormat == "combined" {
+			s.accessLogger = NewCombinedRequestLogger(f)
+		} else {
+			s.accessLogger = NewJSONRequestLogger(f)
+		}
+	}
+	return s
+}
+
+// AdminHandler returns an http.Handler for the administrative endpoints.
+// This should be served separately from HTTPHandler.
+//
+//	GET /admin/info
+//		Shows the server state, such as the upstream DNS cache, in JSON.
+//	GET /admin/repos
+//		Lists the cached repositories in JSON, with their last fetch
+//		time and disk usage. This includes the repositories that are on
+//		the disk but not opened since the server started. With a
+//		RepositoryStore other than the local disk, lists the
+//		repositories by RepositoryStore.Usage.
+//	GET /admin/repos/stats
+//		Shows the numbers of the cache hits, the stale hits, and the
+//		misses, and the bytes of the fetch responses served for each of
+//		them, per repository and in total in JSON. The counts start
+//		when the server starts. See CommandCacheStateKey.
+//	POST /admin/repos/drain?url=...
+//		Stops serving the repository with 503 Service Unavailable, and
+//		evicts it once the in-flight requests complete. A new request
+//		after the eviction fetches the repository again; use
+//		BlockedRepos to keep rejecting it.
+//	POST /admin/repos/evict?url=...[&tenant=...]
+//		Evicts the cached repository of the tenant, or of all tenants
+//		if tenant is not given, and shows the evicted ones in JSON.
+//		Unlike drain, this includes the repositories that are not
+//		opened since the server started. The opened ones are drained
+//		first.
+//	POST /admin/repos/refresh?url=...[&tenant=...]
+//		Fetches the repository from the upstream immediately, and shows
+//		it in JSON. The repository is cached if it's not yet.
+//	POST /admin/reload
+//		Reloads the settings with SettingsReloader.
+//	GET, PUT /admin/repo-overrides
+//		Shows or replaces the RepoOverrides in JSON.
+//	GET, PUT /admin/warm-repos
+//		Shows or replaces the WarmRepositories in JSON. The new list is
+//		warmed up in the background.
+//	POST /admin/rebalance[?removed_root=...]
+//		Moves the cached repositories to the cache roots they belong
+//		to. See RebalanceCacheShards.
+//	POST /admin/profile/next?url=...
+//		Takes a CPU profile while the next fetch of the repository is
+//		served, and returns a zip archive of the profile in the pprof
+//		format, cpu.pprof, and the GIT_TRACE2_PERF trace of the
+//		git-upload-pack and git-pack-objects of the fetch,
+//		git-trace2-perf.txt. The packing time is mostly spent in these
+//		processes, which the CPU profile doesn't see. The trace is empty
+//		if the fetch doesn't run git-upload-pack, such as when it's
+//		served from PackCacheRoot or coalesced with CoalesceFetches.
+//		The CPU profile covers the whole process, including the other
+//		requests served in the meantime. The samples of the fetches
+//		are labeled with goblet_repo and goblet_request (the
+//		X-Request-Id), so use "go tool pprof -tagfocus
+//		goblet_request=<id>" to scope it to the fetch. Only one
+//		profile can be armed at a time. As the Go runtime takes one CPU
+//		profile at a time, this fails while /debug/pprof/profile of the
+//		debug port is running, and that fails while this is taken.
+//	GET /statusz[?format=json]
+//		Shows the long-running operations in flight, such as the
+//		upstream fetches, with their elapsed time and their progress
+//		messages, in HTML or JSON.
+func AdminHandler(config *ServerConfig) http.Handler {
+	return &adminServer{config}
+}
+
+// WebhookHandler returns an http.Handler that receives the webhooks of the
+// pushes to the upstream and refreshes the cached repositories immediately,
+// so that the clients see the new commits without waiting for
+// FetchFreshnessWindow. This takes the push and the tag push events of GitHub
+// and GitLab, and the ref-updated events of the webhooks plugin of Gerrit. The
+// payloads are validated with WebhookSecret: the signature in
+// X-Hub-Signature-256 for GitHub, X-Gitlab-Token for GitLab, and the token
+// query parameter for Gerrit.
+func WebhookHandler(config *ServerConfig) http.Handler {
+	return &webhookServer{config}
 }
 
 func OpenManagedRepository(config *ServerConfig, u *url.URL) (ManagedRepository, error) {
-	return openManagedRepository(config, u)
+	return openManagedRepository(config, "", u)
 }
 
+// ListManagedRepositories calls fn for each managed repository without a
+// tenant.
 func ListManagedRepositories(fn func(ManagedRepository)) {
 	managedRepos.Range(func(key, value interface{}) bool {
 		m := value.(*managedRepository)
-		fn(m)
+		if m.tenant == "" {
+			fn(m)
+		}
 		return true
 	})
 }
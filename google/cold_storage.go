@@ -0,0 +1,56 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package google
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/goblet"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NewColdStorage returns a ColdStorage that stores the repositories in the
+// GCS bucket.
+func NewColdStorage(bh *storage.BucketHandle) goblet.ColdStorage {
+	return &coldStorage{bh}
+}
+
+type coldStorage struct {
+	bh *storage.BucketHandle
+}
+
+func (s *coldStorage) Upload(ctx context.Context, name string, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The object is committed only if the writer is closed without the
+	// context canceled.
+	w := s.bh.Object(name).NewWriter(ctx)
+	w.ContentType = "application/x-git-bundle"
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (s *coldStorage) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := s.bh.Object(name).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, status.Errorf(codes.NotFound, "%s is not in the cold storage", name)
+	}
+	return rc, err
+}
@@ -22,6 +22,7 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/google/goblet"
 	"golang.org/x/oauth2"
 	oauth2cli "google.golang.org/api/oauth2/v2"
 	"google.golang.org/api/option"
@@ -71,19 +72,42 @@ func NewRequestAuthorizer(ts oauth2.TokenSource) (func(*http.Request) error, err
 		return nil, fmt.Errorf("cannot obtain the server's service account email")
 	}
 
-	email := ti.Email
+	return newEmailAuthorizer(oauth2Service, map[string]bool{ti.Email: true}), nil
+}
+
+// NewAdminAuthorizer returns an authorizer of the admin endpoints that
+// allows only the OAuth2 access tokens of the given Google accounts, such as
+// the operators' accounts. Unlike NewRequestAuthorizer, this doesn't allow
+// the server's service account unless it's listed, so that the clients of
+// the proxy cannot use the admin endpoints.
+func NewAdminAuthorizer(ts oauth2.TokenSource, emails []string) (func(*http.Request) error, error) {
+	if len(emails) == 0 {
+		return nil, fmt.Errorf("no admin accounts")
+	}
+	oauth2Service, err := oauth2cli.NewService(context.Background(), option.WithTokenSource(ts))
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize the OAuth2 service: %v", err)
+	}
+	m := map[string]bool{}
+	for _, email := range emails {
+		m[email] = true
+	}
+	return newEmailAuthorizer(oauth2Service, m), nil
+}
+
+func newEmailAuthorizer(oauth2Service *oauth2cli.Service, emails map[string]bool) func(*http.Request) error {
 	return func(r *http.Request) error {
 		if h := r.Header.Get("Authorization"); h != "" {
-			return authorizeAuthzHeader(oauth2Service, email, h)
+			return authorizeAuthzHeader(oauth2Service, emails, h)
 		}
 		if c, err := r.Cookie("o"); err == nil {
-			return authorizeCookie(oauth2Service, email, c.Value)
+			return authorizeCookie(oauth2Service, emails, c.Value)
 		}
 		return status.Error(codes.Unauthenticated, "no auth token")
-	}, nil
+	}
 }
 
-func authorizeAuthzHeader(oauth2Service *oauth2cli.Service, email, authorizationHeader string) error {
+func authorizeAuthzHeader(oauth2Service *oauth2cli.Service, emails map[string]bool, authorizationHeader string) error {
 	accessToken := ""
 	if strings.HasPrefix(authorizationHeader, "Bearer ") {
 		accessToken = strings.TrimPrefix(authorizationHeader, "Bearer ")
@@ -101,17 +125,17 @@ func authorizeAuthzHeader(oauth2Service *oauth2cli.Service, email, authorization
 	} else {
 		return status.Error(codes.Unauthenticated, "no bearer token")
 	}
-	return authorizeAccessToken(oauth2Service, email, accessToken)
+	return authorizeAccessToken(oauth2Service, emails, accessToken)
 }
 
-func authorizeCookie(oauth2Service *oauth2cli.Service, email, oCookie string) error {
+func authorizeCookie(oauth2Service *oauth2cli.Service, emails map[string]bool, oCookie string) error {
 	if strings.ContainsRune(oCookie, '=') {
 		oCookie = strings.SplitN(oCookie, "=", 2)[1]
 	}
-	return authorizeAccessToken(oauth2Service, email, oCookie)
+	return authorizeAccessToken(oauth2Service, emails, oCookie)
 }
 
-func authorizeAccessToken(oauth2Service *oauth2cli.Service, email, accessToken string) error {
+func authorizeAccessToken(oauth2Service *oauth2cli.Service, emails map[string]bool, accessToken string) error {
 	c := oauth2Service.Tokeninfo()
 	c.AccessToken(accessToken)
 	ti, err := c.Do()
@@ -127,7 +151,7 @@ func authorizeAccessToken(oauth2Service *oauth2cli.Service, email, accessToken s
 		return status.Errorf(codes.Unauthenticated, "access token doesn't have %s", scopeUserInfoEmail)
 	}
 
-	if ti.Email != email {
+	if !emails[ti.Email] {
 		// Do not send the server's service account email so that a
 		// stranger cannot know the server's service account. The proxy
 		// server should be running in a private network, but this is
@@ -167,6 +191,21 @@ func CanonicalizeURL(u *url.URL) (*url.URL, error) {
 	return &ret, nil
 }
 
+// ParseGerritChangeRefPolicy parses the name of a GerritChangeRefPolicy:
+// "advertise", "hide", or "fetch-on-demand". The googlesource.com hosts run
+// Gerrit, and their refs/changes/* often outnumber the branches by far.
+func ParseGerritChangeRefPolicy(s string) (goblet.GerritChangeRefPolicy, error) {
+	switch s {
+	case "advertise":
+		return goblet.GerritChangeRefsAdvertise, nil
+	case "hide":
+		return goblet.GerritChangeRefsHide, nil
+	case "fetch-on-demand":
+		return goblet.GerritChangeRefsFetchOnDemand, nil
+	}
+	return goblet.GerritChangeRefsAdvertise, fmt.Errorf("unknown Gerrit change ref policy: %q", s)
+}
+
 func scopeCheck(scopes string) (bool, bool) {
 	hasCloudPlatform := false
 	hasUserInfoEmail := false
@@ -0,0 +1,45 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package google
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// NewPackfileURIUploader returns a PackfileURIUploader that uploads the packs
+// to the GCS bucket. The packs are downloaded from baseURL, such as a CDN in
+// front of the bucket, or from storage.googleapis.com if it's empty.
+func NewPackfileURIUploader(bh *storage.BucketHandle, baseURL string) func(context.Context, string, io.Reader) (string, error) {
+	return func(ctx context.Context, name string, pack io.Reader) (string, error) {
+		obj := bh.Object(name)
+		w := obj.NewWriter(ctx)
+		w.ContentType = "application/x-git-packfile"
+		if _, err := io.Copy(w, pack); err != nil {
+			w.Close()
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		if baseURL == "" {
+			return "https://storage.googleapis.com/" + obj.BucketName() + "/" + name, nil
+		}
+		return strings.TrimSuffix(baseURL, "/") + "/" + name, nil
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package google
+
+import (
+	"encoding/base64"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/google/goblet"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	pubsubMaxMessages = 100
+
+	pubsubRetryInterval = 10 * time.Second
+)
+
+// RunPubSubRefresher pulls the Gerrit events from the Pub/Sub subscription,
+// such as the ones published by the events-gcloud-pubsub plugin, and
+// refreshes the cached repositories updated by the ref-updated events. The
+// subscription is the full name, projects/<project>/subscriptions/<name>.
+// gerritURL is the URL of the Gerrit server, such as
+// https://gerrit.example.com. The messages that cannot be parsed are logged
+// and acknowledged so that they're not redelivered.
+func RunPubSubRefresher(config *goblet.ServerConfig, svc *pubsub.Service, subscription, gerritURL string, logger *log.Logger) {
+	go func() {
+		for {
+			if err := pullGerritEvents(config, svc, subscription, gerritURL, logger); err != nil {
+				logger.Printf("Cannot pull the events from %s: %v", subscription, err)
+				time.Sleep(pubsubRetryInterval)
+			}
+		}
+	}()
+}
+
+func pullGerritEvents(config *goblet.ServerConfig, svc *pubsub.Service, subscription, gerritURL string, logger *log.Logger) error {
+	resp, err := svc.Projects.Subscriptions.Pull(subscription, &pubsub.PullRequest{MaxMessages: pubsubMaxMessages}).Do()
+	if err != nil {
+		return err
+	}
+	if len(resp.ReceivedMessages) == 0 {
+		return nil
+	}
+
+	ackIDs := []string{}
+	// A push often updates multiple refs of a repository.
+	refreshed := map[string]bool{}
+	for _, m := range resp.ReceivedMessages {
+		ackIDs = append(ackIDs, m.AckId)
+		if m.Message == nil {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(m.Message.Data)
+		if err != nil {
+			logger.Printf("Cannot decode the message %s: %v", m.Message.MessageId, err)
+			continue
+		}
+		rawURL, err := goblet.GerritEventRepositoryURL(gerritURL, data)
+		if err != nil {
+			logger.Printf("Cannot parse the message %s: %v", m.Message.MessageId, err)
+			continue
+		}
+		if rawURL == "" || refreshed[rawURL] {
+			continue
+		}
+		refreshed[rawURL] = true
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			logger.Printf("Cannot parse %s as a URL: %v", rawURL, err)
+			continue
+		}
+		if err := goblet.RefreshRepositories(config, u); err != nil {
+			logger.Printf("Cannot refresh %s: %v", rawURL, err)
+		}
+	}
+	_, err = svc.Projects.Subscriptions.Acknowledge(subscription, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Do()
+	return err
+}
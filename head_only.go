@@ -0,0 +1,116 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// headRefPrefixes is the set of the ref prefixes that Git expands "HEAD" to.
+var headRefPrefixes = map[string]bool{
+	"HEAD":                   true,
+	"refs/HEAD":              true,
+	"refs/tags/HEAD":         true,
+	"refs/heads/HEAD":        true,
+	"refs/remotes/HEAD":      true,
+	"refs/remotes/HEAD/HEAD": true,
+}
+
+// isHeadOnlyLsRefs returns true if the ls-refs command asks only for HEAD, as
+// `git fetch origin HEAD` and `git ls-remote origin HEAD` before Git 2.32 do.
+// `git ls-remote` of Git 2.32 and later sends no ref prefixes and matches the
+// patterns on the client, so its command cannot be told apart from the one
+// listing all refs, and it's not HEAD-only.
+func isHeadOnlyLsRefs(command []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	hasPrefix := false
+	for _, c := range command {
+		if !bytes.HasPrefix(c.Argument, []byte("ref-prefix ")) {
+			continue
+		}
+		if !headRefPrefixes[strings.TrimSpace(strings.TrimPrefix(string(c.Argument), "ref-prefix "))] {
+			return false
+		}
+		hasPrefix = true
+	}
+	return hasPrefix
+}
+
+// isHeadFresh returns true if the upstream HEAD is observed within
+// HeadOnlyCacheTTL and the local HEAD points to the same commit.
+func (r *managedRepository) isHeadFresh() bool {
+	r.config.settingsMu.RLock()
+	ttl := r.config.HeadOnlyCacheTTL
+	r.config.settingsMu.RUnlock()
+	if ttl <= 0 {
+		return false
+	}
+	r.headMu.Lock()
+	fresh := !r.headSyncTime.IsZero() && time.Since(r.headSyncTime) < ttl
+	headHash := r.headHash
+	r.headMu.Unlock()
+	if !fresh {
+		return false
+	}
+
+	// The target ref might not be fetched yet.
+	g, err := git.PlainOpen(r.localDiskPath)
+	if err != nil {
+		return false
+	}
+	ref, err := g.Reference(plumbing.HEAD, true)
+	return err == nil && ref.Hash() == headHash
+}
+
+// syncHead updates the local HEAD symref to the upstream's if the ls-refs
+// response contains it. git-fetch doesn't update HEAD of a mirror.
+func (r *managedRepository) syncHead(chunks []*gitprotocolio.ProtocolV2ResponseChunk) {
+	target := ""
+	var hash plumbing.Hash
+	for _, ch := range chunks {
+		if ch.Response == nil {
+			continue
+		}
+		ss := strings.Split(strings.TrimSpace(string(ch.Response)), " ")
+		if len(ss) < 2 || ss[1] != "HEAD" {
+			continue
+		}
+		for _, attr := range ss[2:] {
+			if strings.HasPrefix(attr, "symref-target:") {
+				target = strings.TrimPrefix(attr, "symref-target:")
+				hash = plumbing.NewHash(ss[0])
+			}
+		}
+	}
+	if target == "" {
+		return
+	}
+
+	r.headMu.Lock()
+	defer r.headMu.Unlock()
+	if target != r.headTarget {
+		if err := runGit(noopOperation{}, r.localDiskPath, "symbolic-ref", "HEAD", target); err != nil {
+			return
+		}
+		r.headTarget = target
+	}
+	r.headHash = hash
+	r.headSyncTime = time.Now()
+}
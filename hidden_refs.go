@@ -0,0 +1,278 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// isHiddenRef returns true if the ref is hidden by HiddenRefs or
+// GerritChangeRefPolicy.
+func isHiddenRef(config *ServerConfig, refName string) bool {
+	if config.GerritChangeRefPolicy == GerritChangeRefsHide && isGerritChangeRef(refName) {
+		return true
+	}
+	config.settingsMu.RLock()
+	defer config.settingsMu.RUnlock()
+	for _, prefix := range config.HiddenRefs {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if refName == prefix || strings.HasPrefix(refName, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasHiddenRefs(config *ServerConfig) bool {
+	config.settingsMu.RLock()
+	defer config.settingsMu.RUnlock()
+	return len(config.HiddenRefs) != 0 || config.GerritChangeRefPolicy == GerritChangeRefsHide
+}
+
+// filterHiddenRefs removes the hidden refs, and the symrefs pointing to them,
+// from an ls-refs response.
+func filterHiddenRefs(config *ServerConfig, chunks []*gitprotocolio.ProtocolV2ResponseChunk) []*gitprotocolio.ProtocolV2ResponseChunk {
+	if !hasHiddenRefs(config) {
+		return chunks
+	}
+	ret := []*gitprotocolio.ProtocolV2ResponseChunk{}
+	for _, ch := range chunks {
+		if ch.Response != nil && isHiddenRefLine(config, string(ch.Response)) {
+			continue
+		}
+		ret = append(ret, ch)
+	}
+	return ret
+}
+
+func isHiddenRefLine(config *ServerConfig, line string) bool {
+	ss := strings.Split(strings.TrimSpace(line), " ")
+	if len(ss) < 2 {
+		return false
+	}
+	if isHiddenRef(config, ss[1]) {
+		return true
+	}
+	for _, attr := range ss[2:] {
+		if strings.HasPrefix(attr, "symref-target:") && isHiddenRef(config, strings.TrimPrefix(attr, "symref-target:")) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadPackHideRefsOptions returns the git options that hide the refs from
+// git-upload-pack's advertisement.
+func uploadPackHideRefsOptions(config *ServerConfig) []string {
+	opts := []string{"-c", "uploadpack.hideRefs=refs/goblet/"}
+	config.settingsMu.RLock()
+	for _, prefix := range config.HiddenRefs {
+		opts = append(opts, "-c", "uploadpack.hideRefs="+strings.TrimSuffix(prefix, "/"))
+	}
+	config.settingsMu.RUnlock()
+	if config.GerritChangeRefPolicy != GerritChangeRefsAdvertise {
+		opts = append(opts, "-c", "uploadpack.hideRefs="+strings.TrimSuffix(gerritChangeRefPrefix, "/"))
+	}
+	return opts
+}
+
+// checkWantsVisible returns an error if any of the wanted objects is not
+// reachable from the visible refs. Git serves any object by SHA-1 with
+// protocol v2, and hiding a ref from the advertisement is not enough to make
+// the objects only reachable from it unavailable.
+func (r *managedRepository) checkWantsVisible(hashes []plumbing.Hash, refs []string) error {
+	if !hasHiddenRefs(r.config) {
+		return nil
+	}
+	for _, refName := range refs {
+		if isHiddenRef(r.config, refName) {
+			return status.Errorf(codes.PermissionDenied, "not our ref %s", refName)
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	out := new(bytes.Buffer)
+	if err := runGitWithStdOut(noopOperation{}, out, r.localDiskPath, "for-each-ref", "--format=%(objectname) %(refname)"); err != nil {
+		return err
+	}
+	revs := new(bytes.Buffer)
+	for _, hash := range hashes {
+		fmt.Fprintln(revs, hash.String())
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		ss := strings.SplitN(line, " ", 2)
+		if len(ss) != 2 {
+			continue
+		}
+		refName := ss[1]
+		if strings.HasPrefix(refName, retainedRefPrefix) {
+			// Retained refs are visible if their original refs are.
+			parts := strings.SplitN(strings.TrimPrefix(refName, retainedRefPrefix), "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			refName = "refs/" + parts[1]
+		} else if strings.HasPrefix(refName, "refs/goblet/") {
+			continue
+		}
+		if !isHiddenRef(r.config, refName) {
+			fmt.Fprintln(revs, "^"+ss[0])
+		}
+	}
+
+	// rev-list lists the objects reachable from the wants but not from the
+	// visible refs. Any output means that a want is not visible.
+	w := &countingWriter{}
+	if err := runGitWithStdInOut(noopOperation{}, revs, w, r.localDiskPath, "rev-list", "--objects", "--stdin"); err != nil {
+		return status.Errorf(codes.Internal, "cannot check the reachability of the wants: %v", err)
+	}
+	if w.n > 0 {
+		return status.Error(codes.PermissionDenied, "a wanted object is not reachable from the advertised refs")
+	}
+	return nil
+}
+
+// checkStoredWantsVisible is checkWantsVisible for the repositories of a
+// RepositoryStore other than the local disk. The store only serves the Git
+// protocol, so this asks it for a pack of the wants with the visible refs as
+// the haves. The pack has objects only if a want is not reachable from the
+// visible refs.
+func checkStoredWantsVisible(ctx context.Context, config *ServerConfig, repo StoredRepository, hashes []plumbing.Hash, refs []string) error {
+	if !hasHiddenRefs(config) {
+		return nil
+	}
+	for _, refName := range refs {
+		if isHiddenRef(config, refName) {
+			return status.Errorf(codes.PermissionDenied, "not our ref %s", refName)
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	lsRefs, err := storedLsRefs(ctx, repo, []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{EndCapability: true},
+		{EndArgument: true},
+	})
+	if err != nil {
+		return err
+	}
+	visible, err := parseLsRefsResponse(lsRefs)
+	if err != nil {
+		return err
+	}
+	command := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("no-progress\n")},
+	}
+	for _, hash := range hashes {
+		command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("want " + hash.String() + "\n")})
+	}
+	for refName, hash := range visible {
+		if refName == "HEAD" || strings.HasPrefix(refName, "refs/goblet/") || isHiddenRef(config, refName) {
+			continue
+		}
+		command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("have " + hash.String() + "\n")})
+	}
+	command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("done\n")}, &gitprotocolio.ProtocolV2RequestChunk{EndArgument: true})
+
+	c := &packObjectCounter{}
+	if err := repo.ServeUploadPack(ctx, command, c); !c.counted {
+		if err == nil {
+			err = errors.New("no pack in the response")
+		}
+		return status.Errorf(codes.Internal, "cannot check the reachability of the wants: %v", err)
+	}
+	if c.count > 0 {
+		return status.Error(codes.PermissionDenied, "a wanted object is not reachable from the advertised refs")
+	}
+	return nil
+}
+
+// errPackCounted stops an upload-pack response once packObjectCounter reads
+// the pack header.
+var errPackCounted = errors.New("the pack objects are counted")
+
+// packObjectCounter reads the number of the objects in the pack header of an
+// upload-pack response, and discards the response.
+type packObjectCounter struct {
+	// pending is the incomplete pkt-line at the end of the read response.
+	pending    []byte
+	inPackfile bool
+	header     []byte
+	counted    bool
+	count      uint32
+}
+
+func (c *packObjectCounter) Write(p []byte) (int, error) {
+	if c.counted {
+		return 0, errPackCounted
+	}
+	bs := append(c.pending, p...)
+	scanned := 0
+	for scanned+4 <= len(bs) && !c.counted {
+		var l [2]byte
+		if _, err := hex.Decode(l[:], bs[scanned:scanned+4]); err != nil {
+			return 0, fmt.Errorf("invalid pkt-line length %q", bs[scanned:scanned+4])
+		}
+		n := int(l[0])<<8 | int(l[1])
+		if n < 4 {
+			// Special packets.
+			scanned += 4
+			continue
+		}
+		if scanned+n > len(bs) {
+			break
+		}
+		payload := bs[scanned+4 : scanned+n]
+		scanned += n
+		if !c.inPackfile {
+			c.inPackfile = string(payload) == "packfile\n"
+		} else if len(payload) > 0 && payload[0] == 1 {
+			c.header = append(c.header, payload[1:]...)
+			// "PACK", the version, and the number of the objects.
+			if len(c.header) >= 12 {
+				c.count = binary.BigEndian.Uint32(c.header[8:12])
+				c.counted = true
+			}
+		}
+	}
+	c.pending = append([]byte(nil), bs[scanned:]...)
+	return len(p), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
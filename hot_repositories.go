@@ -0,0 +1,66 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RefreshHotRepositories fetches the HotRepositoryCount most requested
+// repositories from the upstream, so that their requests are served from a
+// fresh cache within FetchFreshnessWindow instead of waiting for the
+// upstream. The request counts are halved after every pass so that the
+// recent requests weigh more. A failure of a repository doesn't stop the
+// others, and the first error is returned. This does nothing if
+// HotRepositoryCount is zero.
+func RefreshHotRepositories(config *ServerConfig) error {
+	if config.HotRepositoryCount <= 0 {
+		return nil
+	}
+
+	type hotRepository struct {
+		m        *managedRepository
+		requests int64
+	}
+	hot := []hotRepository{}
+	managedRepos.Range(func(key, value interface{}) bool {
+		m := value.(*managedRepository)
+		if m.config != config {
+			return true
+		}
+		m.drainMu.Lock()
+		requests := m.requests
+		m.requests /= 2
+		draining := m.draining
+		m.drainMu.Unlock()
+		if requests > 0 && !draining {
+			hot = append(hot, hotRepository{m, requests})
+		}
+		return true
+	})
+	sort.Slice(hot, func(i, j int) bool { return hot[i].requests > hot[j].requests })
+	if len(hot) > config.HotRepositoryCount {
+		hot = hot[:config.HotRepositoryCount]
+	}
+
+	var firstErr error
+	for _, h := range hot {
+		if err := h.m.fetchUpstream(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("cannot refresh %s: %v", h.m.upstreamURL, err)
+		}
+	}
+	return firstErr
+}
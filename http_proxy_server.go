@@ -16,52 +16,140 @@ package goblet
 
 import (
 	"compress/gzip"
+	"context"
 	"io"
+	"log"
 	"net/http"
+	"runtime/pprof"
 	"strings"
+	"time"
 
 	"github.com/google/gitprotocolio"
+	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type httpProxyServer struct {
-	config *ServerConfig
+	config       *ServerConfig
+	accessLogger func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
+	negotiations negotiationTracker
+	fetches      fetchScheduler
+	lfsObjects   lfsObjectCache
+	clientRates  clientRateLimiter
+	// storedRequests counts the in-flight requests of the repositories of
+	// a RepositoryStore other than the local disk.
+	storedRequests storedRequestCounter
 }
 
 func (s *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w, logCloser := logHTTPRequest(s.config, w, r)
+	r = acceptClusterHop(s.config, r)
+	r, span := startInboundSpan(r)
+	defer span.End()
+	r = withRequestInfo(r)
+	span.AddAttributes(trace.StringAttribute("goblet.request_id", withRequestID(w, r)))
+	w, logCloser := logHTTPRequest(s.config, s.accessLogger, w, r)
 	defer logCloser()
 	reporter := &httpErrorReporter{config: s.config, req: r, w: w}
 
-	ctx, err := tag.New(r.Context(), tag.Insert(CommandTypeKey, "not-a-command"))
+	tenant := ""
+	var tenantErr error
+	mutators := []tag.Mutator{tag.Insert(CommandTypeKey, "not-a-command")}
+	if s.config.TenantExtractor != nil {
+		// Validate the tenant before it takes one of the
+		// MaxTenantTagValues.
+		tenant = s.config.TenantExtractor(r)
+		tagValue := invalidTenantTagValue
+		if tenantErr = validateTenant(tenant); tenantErr == nil {
+			tagValue = tenantTagValue(s.config, tenant)
+		}
+		mutators = append(mutators, tag.Insert(TenantKey, tagValue))
+	}
+	ctx, err := tag.New(r.Context(), mutators...)
 	if err != nil {
 		reporter.reportError(err)
 		return
 	}
 	r = r.WithContext(ctx)
+	reporter.req = r
 
 	// Technically, this server is an HTTP proxy, and it should use
 	// Proxy-Authorization / Proxy-Authenticate. However, existing
 	// authentication mechanism around Git is not compatible with proxy
 	// authorization. We use normal authentication mechanism here.
-	if err := s.config.RequestAuthorizer(r); err != nil {
-		reporter.reportError(err)
+	//
+	// The pushes are not checked when they are forwarded with the
+	// client's credentials. They are authorized by the upstream.
+	push := s.config.PushPolicy != PushReject && isPushRequest(r)
+	lfs := s.config.LFSCacheRoot != "" && isLFSRequest(r)
+	bundle := s.config.BundleRoot != "" && isBundleRequest(r)
+	if !push || s.config.PushPolicy != PushWithClientCredentials {
+		if err := authorizeRequest(s.config, r); err != nil {
+			reporter.reportError(err)
+			return
+		}
+	}
+	if tenantErr != nil {
+		reporter.reportError(tenantErr)
 		return
 	}
-	if proto := r.Header.Get("Git-Protocol"); proto != "version=2" {
+	if ok, retryAfter := s.clientRates.allow(s.config, r); !ok {
+		writeThrottledResponse(w, r, retryAfter)
+		return
+	}
+	// The pushes, the LFS API, and the bundle downloads don't support
+	// protocol v2.
+	if proto := r.Header.Get("Git-Protocol"); proto != "version=2" && !push && !lfs && !bundle {
 		reporter.reportError(status.Error(codes.InvalidArgument, "accepts only Git protocol v2"))
 		return
 	}
+	repoURL := r.URL
+	if lfs {
+		repoURL = lfsRepositoryURL(r.URL)
+	} else if bundle {
+		repoURL = bundleRepositoryURL(r.URL)
+	}
+	u, err := canonicalizeURL(s.config, repoURL)
+	if err == nil {
+		requestInfoFromContext(ctx).upstreamURL = u.String()
+		if isBlockedRepo(s.config, u) {
+			stats.Record(ctx, BlockedRequestCount.M(1))
+			reporter.reportError(status.Error(codes.PermissionDenied, "the repository is blocked"))
+			return
+		}
+		if !isAllowedRepo(s.config, r, u) {
+			reporter.reportError(status.Error(codes.PermissionDenied, "the client is not allowed to fetch the repository"))
+			return
+		}
+	} else {
+		u = nil
+	}
+	if r, err = runBeforeRequestHooks(s.config, w, r, u); err != nil {
+		reporter.reportError(err)
+		return
+	}
+	if u != nil && strings.HasSuffix(r.URL.Path, "/git-upload-pack") && shouldForwardToOwner(s.config, r) {
+		if owner := clusterOwner(s.config, u); owner != "" {
+			forwardToOwner(s.config, reporter, w, r, owner)
+			return
+		}
+	}
 
 	switch {
+	case push:
+		s.receivePackHandler(reporter, w, r, tenant)
+	case lfs:
+		s.lfsHandler(reporter, w, r, tenant)
+	case bundle:
+		s.bundleHandler(reporter, w, r, tenant)
 	case strings.HasSuffix(r.URL.Path, "/info/refs"):
 		s.infoRefsHandler(reporter, w, r)
 	case strings.HasSuffix(r.URL.Path, "/git-receive-pack"):
 		reporter.reportError(status.Error(codes.Unimplemented, "git-receive-pack not supported"))
 	case strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
-		s.uploadPackHandler(reporter, w, r)
+		s.uploadPackHandler(reporter, w, r, tenant, requestPriority(s.config, r))
 	}
 }
 
@@ -75,11 +163,16 @@ func (s *httpProxyServer) infoRefsHandler(reporter *httpErrorReporter, w http.Re
 	rs := []*gitprotocolio.InfoRefsResponseChunk{
 		{ProtocolVersion: 2},
 		{Capabilities: []string{"ls-refs"}},
-		// See managed_repositories.go for not having ref-in-want.
-		{Capabilities: []string{"fetch=filter shallow"}},
-		{Capabilities: []string{"server-option"}},
-		{EndOfRequest: true},
+		{Capabilities: []string{advertisedFetchFeatures(s.config)}},
 	}
+	if isAllowedClientCapability(s.config, "server-option") {
+		rs = append(rs, &gitprotocolio.InfoRefsResponseChunk{Capabilities: []string{"server-option"}})
+	}
+	// The SSH and the git:// clients may not reach this server over HTTP.
+	if s.config.BundleRoot != "" && isAllowedClientCapability(s.config, "bundle-uri") && streamSessionFromContext(r.Context()) == nil {
+		rs = append(rs, &gitprotocolio.InfoRefsResponseChunk{Capabilities: []string{"bundle-uri"}})
+	}
+	rs = append(rs, &gitprotocolio.InfoRefsResponseChunk{EndOfRequest: true})
 	for _, pkt := range rs {
 		if err := writePacket(w, pkt); err != nil {
 			// Client-side IO error. Treat this as Canceled.
@@ -89,10 +182,16 @@ func (s *httpProxyServer) infoRefsHandler(reporter *httpErrorReporter, w http.Re
 	}
 }
 
-func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, tenant string, priority Priority) {
 	// /git-upload-pack doesn't recognize text/plain error. Send an error
 	// with ErrorPacket.
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
+	info := requestInfoFromContext(r.Context())
+	info.header = w.Header()
+	if s.config.AuditLogger != nil {
+		info.clientIdentity = clientIdentity(s.config, r)
+		info.remoteAddr = r.RemoteAddr
+	}
 	if r.Header.Get("Content-Encoding") == "gzip" {
 		var err error
 		if r.Body, err = gzip.NewReader(r.Body); err != nil {
@@ -106,27 +205,131 @@ func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.
 	// We need to compromise and either drain the entire request first or
 	// buffer the entire response.
 	//
-	// Because this server supports only ls-refs and fetch commands, valid
-	// protocol V2 requests are relatively small in practice compared to the
-	// response. A request with many wants and haves can be large, but
+	// Because this server supports only ls-refs, fetch, and bundle-uri
+	// commands, valid protocol V2 requests are relatively small in practice
+	// compared to the response. A request with many wants and haves can be large, but
 	// practically there's a limit on the number of haves a client would
 	// send. Compared to that the fetch response can contain a packfile, and
-	// this can easily get large. Read the entire request upfront.
-	commands, err := parseAllCommands(r.Body)
+	// this can easily get large. Read the entire request upfront, up to
+	// MaxRequestBytes so that a request, or a gzip bomb, cannot exhaust the
+	// memory. The response is streamed to the client as it's generated.
+	body := newRequestSizeLimiter(s.config, r.Body)
+	commands, err := parseAllCommands(body)
+	if body.exceeded() {
+		err = body.err()
+	}
 	if err != nil {
 		reporter.reportError(err)
 		return
 	}
+	if commands, err = filterClientCapabilities(s.config, commands); err != nil {
+		reporter.reportError(err)
+		return
+	}
+	var out io.Writer = w
+	if timeout := inboundTimeout(s.config, commands); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+		out = &deadlineWriter{w: w, ctx: ctx}
+	}
 
-	repo, err := openManagedRepository(s.config, r.URL)
+	stored, err := openStoredRepository(s.config, tenant, r.URL)
 	if err != nil {
+		if s.config.Offline {
+			// Show the client that the repository is not cached,
+			// as checkCachedOffline does for the cached ones.
+			gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
+			gitReporter.reportError(r.Context(), time.Now(), err)
+			return
+		}
 		reporter.reportError(err)
 		return
 	}
+	// The limits, the hidden refs, and the audit logs apply to the
+	// repositories of any RepositoryStore. The drains and the shedding
+	// during the evictions apply only to the local disk.
+	if repo, ok := stored.(*managedRepository); ok {
+		if err := repo.startRequest(); err != nil {
+			writeShedResponse(w, r, status.Convert(err).Message()+"; retry later")
+			return
+		}
+		defer repo.finishRequest()
+
+		if shouldShed(s.config, repo, commands) {
+			writeShedResponse(w, r, "the cache is reclaiming disk space; retry later")
+			return
+		}
+	} else {
+		finish, err := s.storedRequests.start(s.config, tenant, stored.UpstreamURL())
+		if err != nil {
+			writeShedResponse(w, r, status.Convert(err).Message()+"; retry later")
+			return
+		}
+		defer finish()
+	}
+
+	for _, command := range commands {
+		if command[0].Command == "fetch" {
+			release, err := s.fetches.acquire(r.Context(), s.config, priority)
+			if err == errLowPriorityShed {
+				writeShedResponse(w, r, "the server is busy; retry later")
+				return
+			} else if err != nil {
+				reporter.reportError(err)
+				return
+			}
+			defer release()
+			ctx, stopProfile := startArmedProfile(r.Context(), stored.UpstreamURL())
+			defer stopProfile()
+			r = r.WithContext(ctx)
+			break
+		}
+	}
 
+	r = r.WithContext(withPriority(context.WithValue(r.Context(), bundleBaseURLKey{}, bundleBaseURL(s.config, r)), priority))
+	// Label the samples of the request so that they can be picked from
+	// the CPU profiles of the whole process.
+	pprof.Do(r.Context(), fetchProfileLabels(r.Context(), stored.UpstreamURL()), func(ctx context.Context) {
+		s.serveCommands(w, r.WithContext(ctx), tenant, stored, commands, out)
+	})
+}
+
+// serveCommands serves the protocol v2 commands of the request from the
+// repository.
+func (s *httpProxyServer) serveCommands(w http.ResponseWriter, r *http.Request, tenant string, stored StoredRepository, commands [][]*gitprotocolio.ProtocolV2RequestChunk, out io.Writer) {
 	gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
+	handle := func(command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) bool {
+		if repo, ok := stored.(*managedRepository); ok {
+			return handleV2Command(r.Context(), gitReporter, repo, command, w)
+		}
+		return handleStoredV2Command(r.Context(), s.config, gitReporter, tenant, stored, command, w)
+	}
 	for _, command := range commands {
-		if !handleV2Command(r.Context(), gitReporter, repo, command, w) {
+		if command[0].Command != "fetch" {
+			if !handle(command, out) {
+				return
+			}
+			continue
+		}
+
+		key := negotiationSessionKey(r, tenant, stored.UpstreamURL(), command)
+		if err := s.negotiations.startRound(s.config, key); err != nil {
+			stats.Record(r.Context(), AbortedNegotiationCount.M(1))
+			if s.config.ErrorReporter != nil {
+				s.config.ErrorReporter(r, err)
+			} else {
+				log.Printf("Aborted a negotiation for %s: %v", stored.UpstreamURL(), err)
+			}
+			gitReporter.reportError(r.Context(), time.Now(), err)
+			return
+		}
+		d := &packfileDetector{w: out}
+		ok := handle(command, d)
+		if d.found || hasFetchArgument(command, "done") {
+			s.negotiations.endSession(key)
+		}
+		if !ok {
 			return
 		}
 	}
@@ -151,6 +354,7 @@ func parseAllCommands(r io.Reader) ([][]*gitprotocolio.ProtocolV2RequestChunk, e
 		switch chunks[0].Command {
 		case "ls-refs":
 		case "fetch":
+		case "bundle-uri":
 			// Do nothing.
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "unrecognized command: %v", chunks[0])
@@ -0,0 +1,67 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+)
+
+// EvictIdleRepositories removes the cached repositories that are not fetched
+// for IdleRepositoryTTL from the cache roots, and the object pools that the
+// rest don't borrow the objects from. This does nothing if IdleRepositoryTTL
+// is zero.
+func EvictIdleRepositories(config *ServerConfig) error {
+	if config.IdleRepositoryTTL <= 0 {
+		return nil
+	}
+	defer StartEvictionPass()()
+
+	repos, err := listCachedRepositories(config)
+	if err != nil {
+		return err
+	}
+	var rest []*cachedRepository
+	for _, repo := range repos {
+		if time.Since(lastUseTime(repo.localDiskPath)) <= config.IdleRepositoryTTL {
+			rest = append(rest, repo)
+			continue
+		}
+		if err := evictListedRepository(config, repo); err != nil {
+			return err
+		}
+		stats.Record(context.Background(), IdleEvictionCount.M(1))
+	}
+	_, err = pruneObjectPools(config, rest)
+	return err
+}
+
+// lastUseTime returns the time a cached repository was last requested by a
+// client. For the repositories not requested since the server started, this
+// is the time of the last upstream fetch.
+func lastUseTime(localDiskPath string) time.Time {
+	t := lastFetchTime(localDiskPath)
+	if v, ok := managedRepos.Load(localDiskPath); ok {
+		m := v.(*managedRepository)
+		m.drainMu.Lock()
+		if m.lastRequest.After(t) {
+			t = m.lastRequest
+		}
+		m.drainMu.Unlock()
+	}
+	return t
+}
@@ -15,11 +15,18 @@
 package goblet
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/google/gitprotocolio"
 )
 
+var (
+	packfileSectionHeader = gitprotocolio.BytesPacket("packfile\n").EncodeToPktLine()
+)
+
 func writePacket(w io.Writer, p gitprotocolio.Packet) error {
 	_, err := w.Write(p.EncodeToPktLine())
 	return err
@@ -38,6 +45,42 @@ func writeError(w io.Writer, err error) error {
 	return writePacket(w, gitprotocolio.ErrorPacket(err.Error()))
 }
 
+// writeKeepalive sends a sideband packet to keep the connection alive. If the
+// client doesn't want the progress, an empty packet is sent to the main
+// stream as git-upload-pack does.
+func writeKeepalive(w io.Writer, noProgress bool, elapsed time.Duration) error {
+	if noProgress {
+		return writePacket(w, gitprotocolio.SideBandMainPacket(nil))
+	}
+	return writePacket(w, gitprotocolio.SideBandReportPacket(fmt.Sprintf("Waiting for the upstream fetch (%ds)\r", elapsed/time.Second)))
+}
+
+// packfileHeaderStripper drops the packfile section header from the
+// upload-pack output. This is used when the header is already sent to the
+// client.
+type packfileHeaderStripper struct {
+	w    io.Writer
+	buf  []byte
+	done bool
+}
+
+func (s *packfileHeaderStripper) Write(p []byte) (int, error) {
+	if s.done {
+		return s.w.Write(p)
+	}
+	s.buf = append(s.buf, p...)
+	if len(s.buf) < len(packfileSectionHeader) {
+		return len(p), nil
+	}
+	s.done = true
+	rest := bytes.TrimPrefix(s.buf, packfileSectionHeader)
+	s.buf = nil
+	if _, err := s.w.Write(rest); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 func copyRequestChunk(c *gitprotocolio.ProtocolV2RequestChunk) *gitprotocolio.ProtocolV2RequestChunk {
 	r := *c
 	if r.Argument != nil {
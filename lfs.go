@@ -0,0 +1,474 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	lfsMediaType = "application/vnd.git-lfs+json"
+
+	// lfsDefaultActionLifetime is how long an upstream download action is
+	// used if the upstream doesn't specify its expiry.
+	lfsDefaultActionLifetime = time.Hour
+)
+
+var lfsOIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// isLFSRequest returns true if the request is for the Git LFS API of a
+// repository, such as /github.com/google/goblet.git/info/lfs/objects/batch.
+func isLFSRequest(r *http.Request) bool {
+	return strings.Contains(r.URL.Path, "/info/lfs/")
+}
+
+// lfsRepositoryURL returns the repository URL of a Git LFS API URL.
+func lfsRepositoryURL(u *url.URL) *url.URL {
+	ret := *u
+	ret.Path = ret.Path[:strings.Index(ret.Path, "/info/lfs/")]
+	ret.RawPath = ""
+	ret.RawQuery = ""
+	return &ret
+}
+
+// lfsUpstreamBatchURL returns the batch API URL of the upstream repository.
+// As the Git LFS client does, ".git" is added to the repository URL if it
+// doesn't have one.
+func lfsUpstreamBatchURL(u *url.URL) string {
+	ret := *u
+	if !strings.HasSuffix(ret.Path, ".git") {
+		ret.Path += ".git"
+	}
+	ret.Path += "/info/lfs/objects/batch"
+	return ret.String()
+}
+
+type lfsObject struct {
+	OID           string                `json:"oid"`
+	Size          int64                 `json:"size"`
+	Authenticated bool                  `json:"authenticated,omitempty"`
+	Actions       map[string]*lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError       `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers,omitempty"`
+	Ref       interface{}  `json:"ref,omitempty"`
+	Objects   []*lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string       `json:"transfer,omitempty"`
+	Objects  []*lfsObject `json:"objects"`
+}
+
+// lfsObjectCache holds the Git LFS objects under LFSCacheRoot, and the
+// upstream download actions of the objects that are not cached yet. The
+// objects are shared by the repositories and the tenants, so an object is
+// served only to the repositories whose upstream batch API has returned it
+// recently (grants).
+type lfsObjectCache struct {
+	mu        sync.Mutex
+	actions   map[string]*lfsPendingDownload
+	grants    map[lfsGrant]time.Time
+	downloads map[string]*lfsDownload
+	evictMu   sync.Mutex
+}
+
+// lfsGrant is an object that the upstream batch API has returned for the
+// repository of the tenant.
+type lfsGrant struct {
+	tenant      string
+	upstreamURL string
+	oid         string
+}
+
+type lfsPendingDownload struct {
+	action *lfsAction
+	size   int64
+	expiry time.Time
+}
+
+type lfsDownload struct {
+	done chan struct{}
+	err  error
+}
+
+func (c *lfsObjectCache) objectPath(config *ServerConfig, oid string) string {
+	return filepath.Join(config.LFSCacheRoot, "objects", oid[0:2], oid[2:4], oid)
+}
+
+// addAction records the download action that the upstream batch API of the
+// repository has returned, and grants the object to the repository until the
+// action expires.
+func (c *lfsObjectCache) addAction(tenant string, u *url.URL, oid string, size int64, action *lfsAction) {
+	now := time.Now()
+	expiry := now.Add(lfsDefaultActionLifetime)
+	if !action.ExpiresAt.IsZero() {
+		expiry = action.ExpiresAt
+	} else if action.ExpiresIn > 0 {
+		expiry = now.Add(time.Duration(action.ExpiresIn) * time.Second)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.actions == nil {
+		c.actions = map[string]*lfsPendingDownload{}
+		c.grants = map[lfsGrant]time.Time{}
+	}
+	for k, p := range c.actions {
+		if p.expiry.Before(now) {
+			delete(c.actions, k)
+		}
+	}
+	for k, e := range c.grants {
+		if e.Before(now) {
+			delete(c.grants, k)
+		}
+	}
+	c.actions[oid] = &lfsPendingDownload{action: action, size: size, expiry: expiry}
+	c.grants[lfsGrant{tenant, u.String(), oid}] = expiry
+}
+
+// isGranted returns true if the upstream batch API of the repository has
+// returned the object, and its action has not expired.
+func (c *lfsObjectCache) isGranted(tenant string, u *url.URL, oid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiry, ok := c.grants[lfsGrant{tenant, u.String(), oid}]
+	return ok && time.Now().Before(expiry)
+}
+
+// open returns the cached object. If the object is not cached, it's
+// downloaded from the upstream with the action that the batch API returned.
+func (c *lfsObjectCache) open(ctx context.Context, config *ServerConfig, oid string) (*os.File, error) {
+	p := c.objectPath(config, oid)
+	if f, err := os.Open(p); err == nil {
+		stats.Record(ctx, LFSCacheHitCount.M(1))
+		// The modification time is the last access time for the
+		// eviction.
+		now := time.Now()
+		os.Chtimes(p, now, now)
+		return f, nil
+	}
+	stats.Record(ctx, LFSCacheMissCount.M(1))
+
+	c.mu.Lock()
+	d, ok := c.downloads[oid]
+	if !ok {
+		pending, ok := c.actions[oid]
+		if !ok || pending.expiry.Before(time.Now()) {
+			c.mu.Unlock()
+			return nil, status.Errorf(codes.NotFound, "unknown LFS object %s; request it with the batch API first", oid)
+		}
+		if c.downloads == nil {
+			c.downloads = map[string]*lfsDownload{}
+		}
+		d = &lfsDownload{done: make(chan struct{})}
+		c.downloads[oid] = d
+		go func() {
+			d.err = c.download(config, oid, pending)
+			if d.err == nil {
+				c.evict(ctx, config, p)
+			}
+			c.mu.Lock()
+			delete(c.downloads, oid)
+			if d.err == nil {
+				delete(c.actions, oid)
+			}
+			c.mu.Unlock()
+			close(d.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return os.Open(p)
+}
+
+func (c *lfsObjectCache) download(config *ServerConfig, oid string, pending *lfsPendingDownload) error {
+	req, err := http.NewRequest("GET", pending.action.Href, nil)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
+	}
+	for k, v := range pending.action.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := upstreamHTTPClient(config).Do(req)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "cannot download the LFS object %s: %v", oid, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status.Errorf(codes.Unavailable, "cannot download the LFS object %s: %s", oid, resp.Status)
+	}
+
+	tmpDir := filepath.Join(config.LFSCacheRoot, "tmp")
+	if err := os.MkdirAll(tmpDir, 0750); err != nil {
+		return status.Errorf(codes.Internal, "cannot create a temporary directory: %v", err)
+	}
+	f, err := ioutil.TempFile(tmpDir, oid)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot create a temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "cannot download the LFS object %s: %v", oid, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != oid {
+		return status.Errorf(codes.DataLoss, "the LFS object %s has a wrong hash %s", oid, got)
+	}
+	if pending.size != 0 && n != pending.size {
+		return status.Errorf(codes.DataLoss, "the LFS object %s has %d bytes, want %d", oid, n, pending.size)
+	}
+
+	p := c.objectPath(config, oid)
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return status.Errorf(codes.Internal, "cannot create a directory: %v", err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return status.Errorf(codes.Internal, "cannot store the LFS object %s: %v", oid, err)
+	}
+	return nil
+}
+
+// evict removes the least recently used objects until the total size is at
+// most LFSCacheMaxBytes. The object at keep, which has just been downloaded,
+// is not removed.
+func (c *lfsObjectCache) evict(ctx context.Context, config *ServerConfig, keep string) {
+	c.evictMu.Lock()
+	defer c.evictMu.Unlock()
+
+	total, err := evictLeastRecentlyUsedFiles(filepath.Join(config.LFSCacheRoot, "objects"), config.LFSCacheMaxBytes, keep, func() {
+		stats.Record(ctx, LFSCacheEvictionCount.M(1))
+	})
+	if err != nil {
+		log.Printf("Cannot list the LFS objects: %v", err)
+		return
+	}
+	stats.Record(ctx, LFSCacheBytes.M(total))
+}
+
+// lfsHandler serves the Git LFS API. Only the downloads are supported. The
+// batch API returns the download actions that point to this server, and the
+// objects are downloaded from the upstream on their first request. The
+// upstream batch API is asked even for the cached objects, so that an object
+// cached for one repository is not served for another that doesn't have it.
+func (s *httpProxyServer) lfsHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, tenant string) {
+	u, err := canonicalizeURL(s.config, lfsRepositoryURL(r.URL))
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	rest := r.URL.Path[strings.Index(r.URL.Path, "/info/lfs/")+len("/info/lfs/"):]
+	switch {
+	case rest == "objects/batch" && r.Method == "POST":
+		s.lfsBatchHandler(reporter, w, r, tenant, u)
+	case strings.HasPrefix(rest, "objects/") && r.Method == "GET":
+		s.lfsObjectHandler(reporter, w, r, tenant, u, strings.TrimPrefix(rest, "objects/"))
+	default:
+		reporter.reportError(status.Error(codes.Unimplemented, "only the LFS downloads are supported"))
+	}
+}
+
+func (s *httpProxyServer) lfsBatchHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, tenant string, u *url.URL) {
+	var batch lfsBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		reporter.reportError(status.Errorf(codes.InvalidArgument, "cannot parse the LFS batch request: %v", err))
+		return
+	}
+	if batch.Operation != "download" {
+		reporter.reportError(status.Error(codes.Unimplemented, "only the LFS downloads are supported"))
+		return
+	}
+	if len(batch.Transfers) != 0 {
+		basic := false
+		for _, t := range batch.Transfers {
+			basic = basic || t == "basic"
+		}
+		if !basic {
+			reporter.reportError(status.Error(codes.InvalidArgument, "only the basic LFS transfer is supported"))
+			return
+		}
+	}
+
+	var objects []*lfsObject
+	for _, o := range batch.Objects {
+		if !lfsOIDPattern.MatchString(o.OID) {
+			reporter.reportError(status.Errorf(codes.InvalidArgument, "invalid LFS object ID %q", o.OID))
+			return
+		}
+		objects = append(objects, &lfsObject{OID: o.OID, Size: o.Size})
+	}
+	upstreamObjects := map[string]*lfsObject{}
+	if len(objects) != 0 {
+		resp, err := s.lfsUpstreamBatch(r.Context(), u, &lfsBatchRequest{
+			Operation: "download",
+			Transfers: []string{"basic"},
+			Ref:       batch.Ref,
+			Objects:   objects,
+		})
+		if err != nil {
+			reporter.reportError(err)
+			return
+		}
+		for _, o := range resp.Objects {
+			upstreamObjects[o.OID] = o
+		}
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	objectURL := url.URL{Scheme: scheme, Host: r.Host, Path: strings.TrimSuffix(r.URL.Path, "batch")}
+	header := map[string]string{}
+	if v := r.Header.Get("Authorization"); v != "" {
+		// The objects are requested with the same credentials.
+		header["Authorization"] = v
+	}
+	ret := &lfsBatchResponse{Transfer: "basic"}
+	for _, o := range batch.Objects {
+		obj := &lfsObject{OID: o.OID, Size: o.Size}
+		uo, ok := upstreamObjects[o.OID]
+		if !ok {
+			obj.Error = &lfsObjectError{Code: http.StatusNotFound, Message: "the upstream doesn't return the object"}
+			ret.Objects = append(ret.Objects, obj)
+			continue
+		}
+		if uo.Error != nil {
+			obj.Error = uo.Error
+			ret.Objects = append(ret.Objects, obj)
+			continue
+		}
+		action := uo.Actions["download"]
+		if action == nil {
+			obj.Error = &lfsObjectError{Code: http.StatusNotFound, Message: "the upstream has no download action"}
+			ret.Objects = append(ret.Objects, obj)
+			continue
+		}
+		s.lfsObjects.addAction(tenant, u, o.OID, o.Size, action)
+		href := objectURL
+		href.Path += o.OID
+		obj.Actions = map[string]*lfsAction{"download": {Href: href.String(), Header: header}}
+		ret.Objects = append(ret.Objects, obj)
+	}
+	w.Header().Set("Content-Type", lfsMediaType)
+	json.NewEncoder(w).Encode(ret)
+}
+
+func (s *httpProxyServer) lfsUpstreamBatch(ctx context.Context, u *url.URL, batch *lfsBatchRequest) (*lfsBatchResponse, error) {
+	bs, err := json.Marshal(batch)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot construct the LFS batch request: %v", err)
+	}
+	req, err := http.NewRequest("POST", lfsUpstreamBatchURL(u), bytes.NewReader(bs))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	t, err := upstreamToken(s.config, u)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+	}
+	t.SetAuthHeader(req)
+
+	resp, err := upstreamHTTPClient(s.config).Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot send a request to the upstream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errMessage, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, status.Errorf(codes.Unavailable, "the upstream LFS batch API returned %s: %s", resp.Status, strings.TrimSpace(string(errMessage)))
+	}
+	var ret lfsBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot parse the upstream LFS batch response: %v", err)
+	}
+	if ret.Transfer != "" && ret.Transfer != "basic" {
+		return nil, status.Errorf(codes.Unavailable, "the upstream chose an unsupported LFS transfer %q", ret.Transfer)
+	}
+	return &ret, nil
+}
+
+func (s *httpProxyServer) lfsObjectHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, tenant string, u *url.URL, oid string) {
+	if !lfsOIDPattern.MatchString(oid) {
+		reporter.reportError(status.Errorf(codes.InvalidArgument, "invalid LFS object ID %q", oid))
+		return
+	}
+	if !s.lfsObjects.isGranted(tenant, u, oid) {
+		reporter.reportError(status.Errorf(codes.NotFound, "unknown LFS object %s; request it with the batch API first", oid))
+		return
+	}
+	f, err := s.lfsObjects.open(r.Context(), s.config, oid)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, f)
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+)
+
+// maintenanceMarker is the file in a cached repository whose modification time
+// is the time of the last maintenance.
+const maintenanceMarker = "goblet-last-maintenance"
+
+// RunMaintenancePass runs the maintenance of the cached repositories that are
+// not maintained for MaintenanceInterval. The refs are packed, the objects are
+// repacked into one pack with a bitmap index so that upload-pack doesn't need
+// to look up the loose objects and many packs, and the unreachable objects
+// older than two weeks, such as the ones of force-pushed refs, are pruned as
+// git-gc does. The incremental commit-graph files written by the upstream
+// fetches are merged into one. At most
+// MaxConcurrentMaintenance repositories are maintained at a time. This does
+// nothing if MaintenanceInterval is zero.
+func RunMaintenancePass(config *ServerConfig) error {
+	if config.MaintenanceInterval <= 0 {
+		return nil
+	}
+	repos, err := listCachedRepositories(config)
+	if err != nil {
+		return err
+	}
+	concurrency := config.MaxConcurrentMaintenance
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
+	for _, repo := range repos {
+		if !needsMaintenance(config, repo.localDiskPath) {
+			continue
+		}
+		m := getManagedRepo(repo.localDiskPath, cachedRepositoryTenant(config, repo), repo.upstreamURL, config)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := m.runMaintenance(); err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func needsMaintenance(config *ServerConfig, localDiskPath string) bool {
+	fi, err := os.Stat(filepath.Join(localDiskPath, maintenanceMarker))
+	if err != nil {
+		return true
+	}
+	return time.Since(fi.ModTime()) >= config.MaintenanceInterval
+}
+
+// runMaintenance packs the refs and the objects of the repository. The
+// upstream fetches wait for this to finish, while the requests are still
+// served from the repository.
+func (r *managedRepository) runMaintenance() (err error) {
+	if r.isDraining() {
+		return nil
+	}
+	op := r.startOperation("Maintenance")
+	defer func() {
+		op.Done(err)
+	}()
+	startTime := time.Now()
+
+	setOperationState(op, "waiting for the repository lock")
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	setOperationState(op, "holding the repository read lock")
+	if r.config.CrossProcessLocking {
+		unlockFile, err := lockRepositoryFile(op, r.localDiskPath)
+		if err != nil {
+			return err
+		}
+		defer unlockFile()
+	}
+	defer r.invalidateSnapshot()
+	repack := []string{"repack", "-a", "-d", "-q", "--write-bitmap-index"}
+	if pool := r.objectPool(); pool != "" {
+		// Move the objects to the pool, and drop them from the
+		// repository. The bitmap index cannot be written without the
+		// objects.
+		if err := r.shareObjects(op, pool); err != nil {
+			return err
+		}
+		repack = []string{"repack", "-a", "-d", "-q", "-l"}
+	}
+	for _, args := range [][]string{
+		{"pack-refs", "--all", "--prune"},
+		repack,
+		{"prune-packed", "-q"},
+		{"prune", "--expire=2.weeks.ago"},
+		{"commit-graph", "write", "--reachable", "--split=replace"},
+	} {
+		if err := runGit(op, r.localDiskPath, args...); err != nil {
+			return err
+		}
+	}
+	stats.Record(context.Background(),
+		MaintenanceCount.M(1),
+		MaintenanceProcessingTime.M(int64(time.Since(startTime)/time.Millisecond)),
+	)
+	marker := filepath.Join(r.localDiskPath, maintenanceMarker)
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(marker, now, now)
+}
@@ -28,11 +28,13 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/gitprotocolio"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -40,6 +42,13 @@ import (
 	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
+const (
+	// remoteFilesystemMaxPacks is the number of packs that a cached
+	// repository can have in RemoteFilesystemMode before they're
+	// consolidated into one.
+	remoteFilesystemMaxPacks = 8
+)
+
 var (
 	gitBinary string
 	// *managedRepository map keyed by a cached repository path.
@@ -54,9 +63,10 @@ func init() {
 	}
 }
 
-func getManagedRepo(localDiskPath string, u *url.URL, config *ServerConfig) *managedRepository {
+func getManagedRepo(localDiskPath string, tenant string, u *url.URL, config *ServerConfig) *managedRepository {
 	newM := &managedRepository{
 		localDiskPath: localDiskPath,
+		tenant:        tenant,
 		upstreamURL:   u,
 		config:        config,
 	}
@@ -69,22 +79,79 @@ func getManagedRepo(localDiskPath string, u *url.URL, config *ServerConfig) *man
 	return ret
 }
 
-func openManagedRepository(config *ServerConfig, u *url.URL) (*managedRepository, error) {
+func openManagedRepository(config *ServerConfig, tenant string, u *url.URL) (*managedRepository, error) {
+	u, err := canonicalUpstreamURL(config, u)
+	if err != nil {
+		return nil, err
+	}
+	return openCanonicalManagedRepository(config, tenant, u)
+}
+
+// canonicalUpstreamURL canonicalizes the URL of a request to the upstream URL
+// of the repository. An error is returned if the repository is blocked.
+func canonicalUpstreamURL(config *ServerConfig, u *url.URL) (*url.URL, error) {
+	u, err := canonicalizeURL(config, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if isBlockedRepo(config, u) {
+		return nil, status.Errorf(codes.PermissionDenied, "the repository is blocked: %s", u)
+	}
+	return upgradeUpstreamScheme(config, u), nil
+}
+
+// canonicalizeURL canonicalizes the URL with URLCanonializer, and rejects the
+// canonical URLs whose host or path has a "." or ".." element. Such a URL
+// resolves to a cache directory of another repository, or outside the cache
+// root, and doesn't match BlockedRepos and AccessRules as the repository it
+// resolves to.
+func canonicalizeURL(config *ServerConfig, u *url.URL) (*url.URL, error) {
 	u, err := config.URLCanonializer(u)
 	if err != nil {
 		return nil, err
 	}
+	if u.Host == "." || u.Host == ".." || strings.ContainsAny(u.Host, `/\`) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid repository host: %q", u.Host)
+	}
+	if _, err := SplitRepositoryPath(u.Path); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
 
-	localDiskPath := filepath.Join(config.LocalDiskCacheRoot, u.Host, u.Path)
+func openCanonicalManagedRepository(config *ServerConfig, tenant string, u *url.URL) (*managedRepository, error) {
+	localDiskPath := cachedRepositoryPath(config, filepath.Join(tenant, u.Host, u.Path))
+	if config.Offline {
+		// Nothing can be fetched into a new repository. Don't leave an
+		// empty one in the cache.
+		if _, err := os.Stat(localDiskPath); os.IsNotExist(err) {
+			return nil, errNotCachedOffline(u)
+		}
+	}
 
-	m := getManagedRepo(localDiskPath, u, config)
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m := getManagedRepo(localDiskPath, tenant, u, config)
+	// Do not take m.mu here. It's held during the upstream fetch, and the
+	// requests should be able to proceed while it's running.
+	m.initMu.Lock()
+	defer m.initMu.Unlock()
+	if config.CrossProcessLocking && !m.originChecked {
+		// Wait for another process that might be creating the
+		// repository.
+		unlock, err := lockRepositoryFile(noopOperation{}, localDiskPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "%v", err)
+		}
+		defer unlock()
+	}
 
 	if _, err := os.Stat(localDiskPath); err != nil {
 		if !os.IsNotExist(err) {
 			return nil, status.Errorf(codes.Internal, "error while initializing local Git repoitory: %v", err)
 		}
+		if config.Offline {
+			return nil, errNotCachedOffline(u)
+		}
 
 		if err := os.MkdirAll(localDiskPath, 0750); err != nil {
 			return nil, status.Errorf(codes.Internal, "cannot create a cache dir: %v", err)
@@ -99,21 +166,117 @@ func openManagedRepository(config *ServerConfig, u *url.URL) (*managedRepository
 		// It seems there's a bug in libcurl and HTTP/2 doens't work.
 		runGit(op, localDiskPath, "config", "http.version", "HTTP/1.1")
 		runGit(op, localDiskPath, "remote", "add", "--mirror=fetch", "origin", u.String())
+		if err := joinObjectPool(config, tenant, localDiskPath, u); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot join the object pool: %v", err)
+		}
+	} else if !m.originChecked {
+		// The repository might be created with a different scheme.
+		if err := runGit(noopOperation{}, localDiskPath, "remote", "set-url", "origin", u.String()); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot update the upstream URL: %v", err)
+		}
 	}
+	m.originChecked = true
 
 	return m, nil
 }
 
-func logStats(command string, startTime time.Time, err error) {
+// cachedRepository is a repository found in the cache directory. root is the
+// cache root that it's found in.
+type cachedRepository struct {
+	root          string
+	localDiskPath string
+	upstreamURL   *url.URL
+}
+
+// listCachedRepositories finds the cached repositories under the cache roots.
+// This includes the repositories that are not opened since the server
+// started.
+func listCachedRepositories(config *ServerConfig) ([]*cachedRepository, error) {
+	repos := []*cachedRepository{}
+	for _, root := range cacheRoots(config) {
+		rs, err := listCachedRepositoriesIn(root)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, rs...)
+	}
+	return repos, nil
+}
+
+func listCachedRepositoriesIn(root string) ([]*cachedRepository, error) {
+	repos := []*cachedRepository{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(p, "HEAD")); err != nil {
+			return nil
+		}
+		g, err := git.PlainOpen(p)
+		if err != nil {
+			return nil
+		}
+		cfg, err := g.Config()
+		if err != nil {
+			return filepath.SkipDir
+		}
+		if remote, ok := cfg.Remotes["origin"]; ok && len(remote.URLs) != 0 {
+			if u, err := url.Parse(remote.URLs[0]); err == nil {
+				repos = append(repos, &cachedRepository{root: root, localDiskPath: p, upstreamURL: u})
+			}
+		}
+		return filepath.SkipDir
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot list the cached repositories: %v", err)
+	}
+	return repos, nil
+}
+
+// evictCachedRepository removes a cached repository. If the repository is
+// being fetched, this waits for the fetch to finish.
+func evictCachedRepository(config *ServerConfig, localDiskPath string) error {
+	if v, ok := managedRepos.Load(localDiskPath); ok {
+		m := v.(*managedRepository)
+		m.initMu.Lock()
+		defer m.initMu.Unlock()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		managedRepos.Delete(localDiskPath)
+	}
+	if config.CrossProcessLocking {
+		unlock, err := lockRepositoryFile(noopOperation{}, localDiskPath)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := os.RemoveAll(localDiskPath); err != nil {
+		return fmt.Errorf("cannot remove the cached repository: %v", err)
+	}
+	return nil
+}
+
+func (r *managedRepository) logStats(command string, startTime time.Time, err error) {
 	code := codes.Unavailable
 	if st, ok := status.FromError(err); ok {
 		code = st.Code()
 	}
+	mutators := []tag.Mutator{
+		tag.Insert(CommandTypeKey, command),
+		tag.Insert(CommandCanonicalStatusKey, code.String()),
+	}
+	if r.config.TenantExtractor != nil {
+		mutators = append(mutators, tag.Insert(TenantKey, tenantTagValue(r.config, r.tenant)))
+	}
+	if r.config.RepositoryMetricTag {
+		mutators = append(mutators, tag.Insert(RepositoryKey, repositoryTagValue(r.config, r.upstreamURL)))
+	}
 	stats.RecordWithTags(context.Background(),
-		[]tag.Mutator{
-			tag.Insert(CommandTypeKey, command),
-			tag.Insert(CommandCanonicalStatusKey, code.String()),
-		},
+		mutators,
 		OutboundCommandCount.M(1),
 		OutboundCommandProcessingTime.M(int64(time.Now().Sub(startTime)/time.Millisecond)),
 	)
@@ -121,43 +284,134 @@ func logStats(command string, startTime time.Time, err error) {
 
 type managedRepository struct {
 	localDiskPath string
+	tenant        string
 	lastUpdate    time.Time
 	upstreamURL   *url.URL
 	config        *ServerConfig
 	mu            sync.RWMutex
+	initMu        sync.Mutex
+
+	// originChecked is true once the origin URL of the repository on disk
+	// is checked to match with upstreamURL. Guarded by initMu.
+	originChecked bool
+
+	// lastUpdateMu guards lastUpdate. This is separate from mu so that
+	// lastUpdate can be read while a fetch is running.
+	lastUpdateMu sync.Mutex
+
+	// snapshot is an in-memory view of the refs and the pack indexes used
+	// in RemoteFilesystemMode. This is dropped after the repository is
+	// updated.
+	snapshotMu sync.Mutex
+	snapshot   *repositorySnapshot
+
+	// headTarget and headHash are the upstream HEAD symref target and its
+	// value observed at headSyncTime.
+	headMu       sync.Mutex
+	headTarget   string
+	headHash     plumbing.Hash
+	headSyncTime time.Time
+
+	// inflight is the number of the requests being served. Once draining
+	// is set, no new request is accepted, and drained is closed when
+	// inflight reaches zero. lastRequest is the time the last request was
+	// accepted. requests is the number of the requests accepted, halved
+	// by every RefreshHotRepositories.
+	drainMu     sync.Mutex
+	inflight    int
+	draining    bool
+	drained     chan struct{}
+	lastRequest time.Time
+	requests    int64
+
+	// bundling is 1 while the bundle is generated. Accessed atomically.
+	bundling int32
+
+	// basePack is the pack offloaded with PackfileURIUploader, and
+	// offloading is 1 while it's generated. offloading is accessed
+	// atomically.
+	basePackMu sync.Mutex
+	basePack   *offloadedPack
+	offloading int32
+
+	// negativeErr is the upstream error returned without querying the
+	// upstream until negativeExpiry. See NegativeCacheTTL.
+	negativeMu     sync.Mutex
+	negativeErr    error
+	negativeExpiry time.Time
+
+	cacheStatsMu sync.Mutex
+	cacheStats   cacheStats
+
+	// waitedFetch is the upstream fetch that the clients are waiting for.
+	// See joinUpstreamFetch.
+	waitedFetchMu sync.Mutex
+	waitedFetch   *waitedFetch
 }
 
-func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
-	req, err := http.NewRequest("POST", r.upstreamURL.String()+"/git-upload-pack", newGitRequest(command))
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
+// lsRefsUpstream sends the ls-refs command to the upstream. It's canceled
+// with ctx.
+func (r *managedRepository) lsRefsUpstream(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+	if r.config.Offline {
+		return nil, errOffline
 	}
-	t, err := r.config.TokenSource.Token()
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+	if err := r.cachedUpstreamError(); err != nil {
+		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
-	req.Header.Add("Accept", "application/x-git-upload-pack-result")
-	req.Header.Add("Git-Protocol", "version=2")
-	t.SetAuthHeader(req)
-
-	startTime := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	logStats("ls-refs", startTime, err)
+	t, err := upstreamToken(r.config, r.upstreamURL)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot send a request to the upstream: %v", err)
+		return nil, categoryErrorf(ErrorCategoryUpstreamAuth, codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		errMessage := ""
-		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
-			bs, err := ioutil.ReadAll(resp.Body)
-			if err == nil {
-				errMessage = string(bs)
+
+	var resp *http.Response
+	cancel := func() {}
+	defer func() { cancel() }()
+	err = r.retryUpstream("ls-refs", func() (bool, error) {
+		cancel()
+		attemptCtx, c := upstreamTimeoutContext(ctx, r.config.UpstreamLsRefsTimeout)
+		cancel = c
+		req, err := http.NewRequest("POST", r.upstreamURL.String()+"/git-upload-pack", newGitRequest(command))
+		if err != nil {
+			return false, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
+		}
+		req = req.WithContext(attemptCtx)
+		req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
+		req.Header.Add("Accept", "application/x-git-upload-pack-result")
+		req.Header.Add("Git-Protocol", "version=2")
+		t.SetAuthHeader(req)
+
+		startTime := time.Now()
+		resp, err = upstreamHTTPClient(r.config).Do(req)
+		r.logStats("ls-refs", startTime, err)
+		if err != nil && ctx.Err() != nil {
+			// The client request is canceled or timed out. The
+			// upstream is not at fault.
+			return false, status.Errorf(codes.Canceled, "the request is canceled: %v", ctx.Err())
+		}
+		if attemptCtx.Err() == context.DeadlineExceeded {
+			return true, categoryErrorf(ErrorCategoryUpstreamUnavailable, codes.DeadlineExceeded, "the upstream did not respond in %v", r.config.UpstreamLsRefsTimeout)
+		}
+		if err != nil {
+			return true, categoryErrorf(ErrorCategoryUpstreamUnavailable, codes.Internal, "cannot send a request to the upstream: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			errMessage := ""
+			if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+				bs, err := ioutil.ReadAll(resp.Body)
+				if err == nil {
+					errMessage = string(bs)
+				}
 			}
+			return resp.StatusCode >= 500, r.upstreamResponseError(resp.StatusCode, errMessage)
 		}
-		return nil, fmt.Errorf("got a non-OK response from the upstream: %v %s", resp.StatusCode, errMessage)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
+	r.clearUpstreamError()
 
 	chunks := []*gitprotocolio.ProtocolV2ResponseChunk{}
 	v2Resp := gitprotocolio.NewProtocolV2Response(resp.Body)
@@ -170,11 +424,33 @@ func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2Re
 	return chunks, nil
 }
 
-func (r *managedRepository) fetchUpstream() (err error) {
+func (r *managedRepository) fetchUpstream() error {
+	return r.fetchUpstreamContext(context.Background())
+}
+
+// fetchUpstreamContext is fetchUpstream that stops the upstream fetch when
+// clientCtx is done, such as when the client waiting for the fetch goes
+// away.
+func (r *managedRepository) fetchUpstreamContext(clientCtx context.Context) (err error) {
 	op := r.startOperation("FetchUpstream")
 	defer func() {
 		op.Done(err)
+		if err == nil {
+			go r.refreshBundle()
+			go r.refreshBasePack()
+		}
 	}()
+	if err := r.cachedUpstreamError(); err != nil {
+		return err
+	}
+	if r.config.Offline {
+		return errOffline
+	}
+	finish, err := r.config.upstreamFetches.start()
+	if err != nil {
+		return err
+	}
+	defer finish()
 
 	// Because of
 	// https://public-inbox.org/git/20190915211802.207715-1-masayasuzuki@google.com/T/#t,
@@ -182,60 +458,213 @@ func (r *managedRepository) fetchUpstream() (err error) {
 	// reference (== an empty repo).
 	g, err := git.PlainOpen(r.localDiskPath)
 	if err != nil {
-		return fmt.Errorf("cannot open the local cached repository: %v", err)
+		return categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "cannot open the local cached repository: %v", err)
 	}
 	splitGitFetch := false
 	if _, err := g.Reference("HEAD", true); err == plumbing.ErrReferenceNotFound {
 		splitGitFetch = true
 	}
+	if splitGitFetch && r.config.MaintenanceInterval > 0 {
+		// Write the bitmap index right after the initial fetch so that
+		// the clones don't wait for the next maintenance pass to be
+		// served efficiently.
+		defer func() {
+			if err == nil {
+				go r.runMaintenance()
+			}
+		}()
+	}
+
+	gitOptions, err := upstreamGitOptions(r.config, r.upstreamURL)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "%v", err)
+	}
+	if r.config.RemoteFilesystemMode {
+		// Keep the fetched objects in a pack so that the object lookups
+		// don't need to stat loose objects.
+		gitOptions = append(gitOptions, "-c", "fetch.unpackLimit=1")
+	}
+	// Keep the commit-graph up to date so that the negotiations and the
+	// pack generation don't need to parse the commits one by one.
+	gitOptions = append(gitOptions, "-c", "fetch.writeCommitGraph=true")
+
+	// The upstream fetches run in the background, and they are traced
+	// separately from the requests.
+	ctx, span := trace.StartSpan(context.Background(), "goblet.fetchUpstream")
+	span.AddAttributes(trace.StringAttribute("goblet.upstream_url", r.upstreamURL.String()))
+	defer span.End()
 
 	var t *oauth2.Token
 	startTime := time.Now()
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	if r.config.FetchStateStore != nil {
+		release, fetched, err := r.lockSharedFetch(op)
+		if err != nil {
+			return err
+		}
+		if fetched {
+			// Another replica has fetched the repository into the
+			// shared cache.
+			r.invalidateSnapshot()
+			return nil
+		}
+		defer release()
+	}
+	_, lockSpan := trace.StartSpan(ctx, "goblet.fetchUpstream.waitForLock")
+	unlock, err := r.lock(op)
+	lockSpan.End()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := clientCtx.Err(); err != nil {
+		// The client went away while waiting for the lock.
+		return status.Errorf(codes.Canceled, "the request is canceled: %v", err)
+	}
+	defer r.invalidateSnapshot()
+
+	var oldRefs map[string]string
+	if r.config.ForcePushPolicy == ForcePushKeepOldObjects {
+		if oldRefs, err = r.listLocalRefs(op); err != nil {
+			return err
+		}
+	}
+	// Another fetch may have filled the repository while this one waited
+	// for the lock.
+	splitGitFetch = splitGitFetch && !r.hasCachedRefs()
+	if splitGitFetch && r.config.ColdStorage != nil {
+		if restored, err := r.restoreFromColdStorage(op); err != nil {
+			op.Printf("cannot restore from the cold storage, fetching from the upstream: %v", err)
+		} else if restored {
+			splitGitFetch = false
+		}
+	}
+	if splitGitFetch && r.config.PeerURL != nil {
+		if err := r.fetchFromPeer(op); err != nil {
+			op.Printf("cannot fetch from the peer, fetching from the upstream: %v", err)
+		} else {
+			splitGitFetch = false
+		}
+	}
 	if splitGitFetch {
 		// Fetch heads and changes first.
-		t, err = r.config.TokenSource.Token()
+		t, err = upstreamToken(r.config, r.upstreamURL)
 		if err != nil {
-			err = status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+			err = categoryErrorf(ErrorCategoryUpstreamAuth, codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
 			return err
 		}
-		err = runGit(op, r.localDiskPath, "-c", "http.extraHeader=Authorization: Bearer "+t.AccessToken, "fetch", "--progress", "-f", "-n", "origin", "refs/heads/*:refs/heads/*", "refs/changes/*:refs/changes/*")
+		refspecs := []string{"refs/heads/*:refs/heads/*"}
+		if r.config.GerritChangeRefPolicy == GerritChangeRefsAdvertise {
+			refspecs = append(refspecs, "refs/changes/*:refs/changes/*")
+		}
+		err = r.runUpstreamGitContext(clientCtx, op, append(append(gitOptions, "-c", "http.extraHeader=Authorization: "+authorizationHeader(t), "fetch", "--progress", "-f", "-n", "origin"), refspecs...)...)
 	}
 	if err == nil {
-		t, err = r.config.TokenSource.Token()
+		t, err = upstreamToken(r.config, r.upstreamURL)
 		if err != nil {
-			err = status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+			err = categoryErrorf(ErrorCategoryUpstreamAuth, codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
 			return err
 		}
-		err = runGit(op, r.localDiskPath, "-c", "http.extraHeader=Authorization: Bearer "+t.AccessToken, "fetch", "--progress", "-f", "origin")
+		err = r.runUpstreamGitContext(clientCtx, op, append(append(gitOptions, "-c", "http.extraHeader=Authorization: "+authorizationHeader(t), "fetch", "--progress", "-f", "origin"), upstreamFetchRefspecs(r.config)...)...)
+	}
+	r.logStats("fetch", startTime, err)
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(codes.Unavailable), Message: err.Error()})
 	}
-	logStats("fetch", startTime, err)
 	if err == nil {
+		r.lastUpdateMu.Lock()
 		r.lastUpdate = startTime
+		r.lastUpdateMu.Unlock()
+		if r.config.FetchStateStore != nil {
+			if err := r.config.FetchStateStore.SetLastFetchTime(context.Background(), r.upstreamURL.String(), startTime); err != nil {
+				op.Printf("cannot record the fetch time: %v", err)
+			}
+		}
+		if oldRefs != nil {
+			if err := r.retainForcePushedRefs(op, oldRefs); err != nil {
+				op.Printf("cannot retain the force-pushed refs: %v", err)
+			}
+		}
+		if r.config.RemoteFilesystemMode {
+			r.consolidatePacks(op)
+		}
 	}
 	return err
 }
 
+// consolidatePacks repacks the objects into one pack if there are too many
+// packs. Failures are not fatal as the repository is still usable.
+func (r *managedRepository) consolidatePacks(op RunningOperation) {
+	fis, err := ioutil.ReadDir(filepath.Join(r.localDiskPath, "objects", "pack"))
+	if err != nil {
+		op.Printf("cannot list the packs: %v", err)
+		return
+	}
+	packs := 0
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".pack") {
+			packs++
+		}
+	}
+	if packs <= remoteFilesystemMaxPacks {
+		return
+	}
+	if err := runGit(op, r.localDiskPath, "repack", "-a", "-d", "-q"); err != nil {
+		op.Printf("cannot consolidate the packs: %v", err)
+	}
+}
+
 func (r *managedRepository) UpstreamURL() *url.URL {
 	u := *r.upstreamURL
 	return &u
 }
 
 func (r *managedRepository) LastUpdateTime() time.Time {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	r.lastUpdateMu.Lock()
+	defer r.lastUpdateMu.Unlock()
 	return r.lastUpdate
 }
 
+// hasCachedRefs returns true if the repository has been fetched from the
+// upstream.
+func (r *managedRepository) hasCachedRefs() bool {
+	g, err := git.PlainOpen(r.localDiskPath)
+	if err != nil {
+		return false
+	}
+	_, err = g.Reference("HEAD", true)
+	return err == nil
+}
+
+// isFresh returns true if the repository is fetched from the upstream within
+// the effective FetchFreshnessWindow by this or, with FetchStateStore,
+// another replica. The cache is always fresh in the Offline mode.
+func (r *managedRepository) isFresh() bool {
+	if r.config.Offline {
+		return true
+	}
+	window := fetchFreshnessWindow(r.config, r.upstreamURL)
+	if window <= 0 {
+		return false
+	}
+	lastUpdate := r.LastUpdateTime()
+	if t := r.sharedLastFetchTime(); t.After(lastUpdate) {
+		lastUpdate = t
+	}
+	return !lastUpdate.IsZero() && time.Since(lastUpdate) < window
+}
+
 func (r *managedRepository) RecoverFromBundle(bundlePath string) (err error) {
 	op := r.startOperation("ReadBundle")
 	defer func() {
 		op.Done(err)
 	}()
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	unlock, err := r.lock(op)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer r.invalidateSnapshot()
 	err = runGit(op, r.localDiskPath, "fetch", "--progress", "-f", bundlePath, "refs/*:refs/*")
 	return
 }
@@ -250,16 +679,30 @@ func (r *managedRepository) WriteBundle(w io.Writer) (err error) {
 }
 
 func (r *managedRepository) hasAnyUpdate(refs map[string]plumbing.Hash) (bool, error) {
+	if r.config.RemoteFilesystemMode {
+		hasUpdate := false
+		err := r.withSnapshot(func(s *repositorySnapshot) error {
+			for refName, hash := range refs {
+				if h, ok := s.refs[refName]; !ok || h != hash {
+					hasUpdate = true
+					return nil
+				}
+			}
+			return nil
+		})
+		return hasUpdate, err
+	}
+
 	g, err := git.PlainOpen(r.localDiskPath)
 	if err != nil {
-		return false, fmt.Errorf("cannot open the local cached repository: %v", err)
+		return false, categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "cannot open the local cached repository: %v", err)
 	}
 	for refName, hash := range refs {
 		ref, err := g.Reference(plumbing.ReferenceName(refName), true)
 		if err == plumbing.ErrReferenceNotFound {
 			return true, nil
 		} else if err != nil {
-			return false, fmt.Errorf("cannot open the reference: %v", err)
+			return false, categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "cannot open the reference: %v", err)
 		}
 		if ref.Hash() != hash {
 			return true, nil
@@ -269,16 +712,38 @@ func (r *managedRepository) hasAnyUpdate(refs map[string]plumbing.Hash) (bool, e
 }
 
 func (r *managedRepository) hasAllWants(hashes []plumbing.Hash, refs []string) (bool, error) {
+	if r.config.RemoteFilesystemMode {
+		hasAll := true
+		err := r.withSnapshot(func(s *repositorySnapshot) error {
+			for _, hash := range hashes {
+				if _, err := s.repo.Object(plumbing.AnyObject, hash); err == plumbing.ErrObjectNotFound {
+					hasAll = false
+					return nil
+				} else if err != nil {
+					return categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "error while looking up an object for want check: %v", err)
+				}
+			}
+			for _, refName := range refs {
+				if _, ok := s.refs[refName]; !ok {
+					hasAll = false
+					return nil
+				}
+			}
+			return nil
+		})
+		return hasAll, err
+	}
+
 	g, err := git.PlainOpen(r.localDiskPath)
 	if err != nil {
-		return false, fmt.Errorf("cannot open the local cached repository: %v", err)
+		return false, categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "cannot open the local cached repository: %v", err)
 	}
 
 	for _, hash := range hashes {
 		if _, err := g.Object(plumbing.AnyObject, hash); err == plumbing.ErrObjectNotFound {
 			return false, nil
 		} else if err != nil {
-			return false, fmt.Errorf("error while looking up an object for want check: %v", err)
+			return false, categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "error while looking up an object for want check: %v", err)
 		}
 	}
 
@@ -286,39 +751,127 @@ func (r *managedRepository) hasAllWants(hashes []plumbing.Hash, refs []string) (
 		if _, err := g.Reference(plumbing.ReferenceName(refName), true); err == plumbing.ErrReferenceNotFound {
 			return false, nil
 		} else if err != nil {
-			return false, fmt.Errorf("error while looking up a reference for want check: %v", err)
+			return false, categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "error while looking up a reference for want check: %v", err)
 		}
 	}
 
 	return true, nil
 }
 
-func (r *managedRepository) serveFetchLocal(command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
-	// If fetch-upstream is running, it's possible that Git returns
-	// incomplete set of objects when the refs being fetched is updated and
-	// it uses ref-in-want.
-	cmd := exec.Command(gitBinary, "upload-pack", "--stateless-rpc", r.localDiskPath)
-	cmd.Env = []string{"GIT_PROTOCOL=version=2"}
-	cmd.Dir = r.localDiskPath
-	cmd.Stdin = newGitRequest(command)
-	cmd.Stdout = w
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// withSnapshot calls fn with the in-memory snapshot of the repository. If fn
+// fails, it's retried once with a new snapshot as the packs might have been
+// rewritten since the snapshot was taken.
+func (r *managedRepository) withSnapshot(fn func(*repositorySnapshot) error) error {
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	if r.snapshot == nil {
+		s, err := openRepositorySnapshot(r.localDiskPath)
+		if err != nil {
+			return err
+		}
+		r.snapshot = s
+	}
+	err := fn(r.snapshot)
+	if err == nil {
+		return nil
+	}
+	s, openErr := openRepositorySnapshot(r.localDiskPath)
+	if openErr != nil {
+		r.snapshot = nil
+		return err
+	}
+	r.snapshot = s
+	return fn(s)
+}
+
+func (r *managedRepository) invalidateSnapshot() {
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+	r.snapshot = nil
 }
 
 func (r *managedRepository) startOperation(op string) RunningOperation {
+	var o RunningOperation = noopOperation{}
 	if r.config.LongRunningOperationLogger != nil {
-		return r.config.LongRunningOperationLogger(op, r.upstreamURL)
+		o = r.config.LongRunningOperationLogger(op, r.upstreamURL)
 	}
-	return noopOperation{}
+	return r.config.operations.start(op, r.upstreamURL, o)
 }
 
 func runGit(op RunningOperation, gitDir string, arg ...string) error {
+	return runGitContext(context.Background(), op, gitDir, arg...)
+}
+
+// gitTerminationGracePeriod is how long a git command has to exit after
+// SIGTERM before it's killed with SIGKILL.
+const gitTerminationGracePeriod = 10 * time.Second
+
+// runGitContext is runGit that stops the command when ctx is done. The
+// command gets SIGTERM first so that git can remove its lock files and
+// temporary files, and SIGKILL if it doesn't exit in
+// gitTerminationGracePeriod.
+func runGitContext(ctx context.Context, op RunningOperation, gitDir string, arg ...string) error {
 	cmd := exec.Command(gitBinary, arg...)
 	cmd.Env = []string{}
 	cmd.Dir = gitDir
 	cmd.Stderr = &operationWriter{op}
 	cmd.Stdout = &operationWriter{op}
+	if ctx.Done() == nil {
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run a git command: %v", err)
+		}
+		return nil
+	}
+
+	// Run in a new process group so that the helpers, such as
+	// git-remote-https, are killed together, and so that they don't get
+	// the signals sent to the server's process group.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run a git command: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+			select {
+			case <-time.After(gitTerminationGracePeriod):
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			case <-exited:
+			}
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+	if err != nil {
+		return fmt.Errorf("failed to run a git command: %v", err)
+	}
+	return nil
+}
+
+func runGitWithStdIn(op RunningOperation, r io.Reader, gitDir string, arg ...string) error {
+	cmd := exec.Command(gitBinary, arg...)
+	cmd.Env = []string{}
+	cmd.Dir = gitDir
+	cmd.Stdin = r
+	cmd.Stdout = &operationWriter{op}
+	cmd.Stderr = &operationWriter{op}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run a git command: %v", err)
+	}
+	return nil
+}
+
+func runGitWithStdInOut(op RunningOperation, r io.Reader, w io.Writer, gitDir string, arg ...string) error {
+	cmd := exec.Command(gitBinary, arg...)
+	cmd.Env = []string{}
+	cmd.Dir = gitDir
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = &operationWriter{op}
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to run a git command: %v", err)
 	}
@@ -345,6 +898,41 @@ func newGitRequest(command []*gitprotocolio.ProtocolV2RequestChunk) io.Reader {
 	return b
 }
 
+type repositorySnapshot struct {
+	repo *git.Repository
+	refs map[string]plumbing.Hash
+}
+
+func openRepositorySnapshot(localDiskPath string) (*repositorySnapshot, error) {
+	g, err := git.PlainOpen(localDiskPath)
+	if err != nil {
+		return nil, categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "cannot open the local cached repository: %v", err)
+	}
+	iter, err := g.References()
+	if err != nil {
+		return nil, categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "cannot list the references: %v", err)
+	}
+	refs := map[string]plumbing.Hash{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs[ref.Name().String()] = ref.Hash()
+			return nil
+		}
+		resolved, err := g.Reference(ref.Name(), true)
+		if err == plumbing.ErrReferenceNotFound {
+			return nil
+		} else if err != nil {
+			return categoryErrorf(ErrorCategoryLocalCorruption, codes.Internal, "cannot resolve the reference: %v", err)
+		}
+		refs[ref.Name().String()] = resolved.Hash()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &repositorySnapshot{repo: g, refs: refs}, nil
+}
+
 type noopOperation struct{}
 
 func (noopOperation) Printf(string, ...interface{}) {}
@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+)
+
+// upstreamErrorCodes maps the upstream responses that are cached with
+// NegativeCacheTTL to the codes returned to the clients. The upstream
+// authentication failures are not the clients' fault, and they are not asked
+// for credentials.
+var upstreamErrorCodes = map[int]codes.Code{
+	http.StatusUnauthorized: codes.PermissionDenied,
+	http.StatusForbidden:    codes.PermissionDenied,
+	http.StatusNotFound:     codes.NotFound,
+}
+
+// upstreamErrorCategories maps the upstream responses in upstreamErrorCodes to
+// their ErrorCategory. The other responses are ErrorCategoryUpstreamUnavailable.
+var upstreamErrorCategories = map[int]ErrorCategory{
+	http.StatusUnauthorized: ErrorCategoryUpstreamAuth,
+	http.StatusForbidden:    ErrorCategoryUpstreamAuth,
+	http.StatusNotFound:     ErrorCategoryNotFound,
+}
+
+// upstreamResponseError returns the error for a non-OK upstream response, and
+// remembers it for NegativeCacheTTL if the repository is missing or not
+// accessible.
+func (r *managedRepository) upstreamResponseError(statusCode int, message string) error {
+	code, ok := upstreamErrorCodes[statusCode]
+	if !ok {
+		return categoryErrorf(ErrorCategoryUpstreamUnavailable, codes.Internal, "got a non-OK response from the upstream: %v %s", statusCode, message)
+	}
+	err := categoryErrorf(upstreamErrorCategories[statusCode], code, "got a non-OK response from the upstream: %v %s", statusCode, message)
+
+	r.config.settingsMu.RLock()
+	ttl := r.config.NegativeCacheTTL
+	r.config.settingsMu.RUnlock()
+	if ttl > 0 {
+		r.negativeMu.Lock()
+		r.negativeErr = err
+		r.negativeExpiry = time.Now().Add(ttl)
+		r.negativeMu.Unlock()
+	}
+	return err
+}
+
+// cachedUpstreamError returns the upstream error remembered by
+// upstreamResponseError, or nil if there's none or it has expired.
+func (r *managedRepository) cachedUpstreamError() error {
+	r.negativeMu.Lock()
+	defer r.negativeMu.Unlock()
+	if r.negativeErr == nil {
+		return nil
+	}
+	if time.Now().After(r.negativeExpiry) {
+		r.negativeErr = nil
+		return nil
+	}
+	stats.Record(context.Background(), NegativeCacheHitCount.M(1))
+	return r.negativeErr
+}
+
+// clearUpstreamError forgets the remembered upstream error, as the upstream
+// has responded successfully.
+func (r *managedRepository) clearUpstreamError() {
+	r.negativeMu.Lock()
+	r.negativeErr = nil
+	r.negativeMu.Unlock()
+}
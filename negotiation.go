@@ -0,0 +1,140 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// negotiationSessionTimeout is the idle time after which a negotiation
+// session is forgotten.
+const negotiationSessionTimeout = 5 * time.Minute
+
+// negotiationTracker counts the fetch requests of the logical negotiation
+// sessions. With the stateless RPC, every negotiation round is a separate
+// HTTP request. A session is identified by the client IP, the client
+// identity, the repository, and the set of wants, and ends when the client
+// sends "done" or the server sends a packfile.
+type negotiationTracker struct {
+	mu        sync.Mutex
+	sessions  map[string]*negotiationSession
+	lastPrune time.Time
+}
+
+type negotiationSession struct {
+	rounds   int
+	lastSeen time.Time
+}
+
+func negotiationSessionKey(r *http.Request, tenant string, u *url.URL, command []*gitprotocolio.ProtocolV2RequestChunk) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	wants := []string{}
+	for _, c := range command {
+		if bytes.HasPrefix(c.Argument, []byte("want ")) || bytes.HasPrefix(c.Argument, []byte("want-ref ")) {
+			wants = append(wants, string(bytes.TrimSpace(c.Argument)))
+		}
+	}
+	sort.Strings(wants)
+	h := sha1.New()
+	for _, w := range wants {
+		io.WriteString(h, w+"\n")
+	}
+	return ip + " " + ClientIdentity(r) + " " + tenant + " " + u.String() + " " + hex.EncodeToString(h.Sum(nil))
+}
+
+// startRound counts a negotiation round of the session, and returns an error
+// if the session exceeds the limit.
+func (t *negotiationTracker) startRound(config *ServerConfig, key string) error {
+	config.settingsMu.RLock()
+	limit := config.MaxNegotiationRounds
+	config.settingsMu.RUnlock()
+	if limit <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.sessions == nil {
+		t.sessions = map[string]*negotiationSession{}
+	}
+	if now.Sub(t.lastPrune) > time.Minute {
+		for k, s := range t.sessions {
+			if now.Sub(s.lastSeen) > negotiationSessionTimeout {
+				delete(t.sessions, k)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	s, ok := t.sessions[key]
+	if !ok {
+		s = &negotiationSession{}
+		t.sessions[key] = s
+	}
+	s.rounds++
+	s.lastSeen = now
+	if s.rounds > limit {
+		delete(t.sessions, key)
+		return status.Errorf(codes.ResourceExhausted, "the negotiation did not converge in %d rounds", limit)
+	}
+	return nil
+}
+
+func (t *negotiationTracker) endSession(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, key)
+}
+
+// packfileDetector is an io.Writer that detects the start of the packfile
+// section in a fetch response.
+type packfileDetector struct {
+	w     io.Writer
+	tail  []byte
+	found bool
+}
+
+func (d *packfileDetector) Write(p []byte) (int, error) {
+	if !d.found {
+		buf := append(d.tail, p...)
+		if bytes.Contains(buf, packfileSectionHeader) {
+			d.found = true
+			d.tail = nil
+		} else {
+			if len(buf) > len(packfileSectionHeader) {
+				buf = buf[len(buf)-len(packfileSectionHeader):]
+			}
+			d.tail = append([]byte{}, buf...)
+		}
+	}
+	return d.w.Write(p)
+}
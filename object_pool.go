@@ -0,0 +1,193 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// objectPoolDir is the directory of the object pools under the cache root of
+// a tenant.
+const objectPoolDir = "goblet-object-pools"
+
+// objectPoolLocks serializes the operations on an object pool. The keys are
+// the paths of the pools.
+var objectPoolLocks sync.Map
+
+// objectPoolName returns the name of the object pool of the repository, or an
+// empty string if its objects are not shared.
+func objectPoolName(config *ServerConfig, u *url.URL) string {
+	for _, o := range findRepoOverrides(config, u) {
+		if o.ObjectPool != "" {
+			return o.ObjectPool
+		}
+	}
+	return ""
+}
+
+func lockObjectPool(pool string) func() {
+	v, _ := objectPoolLocks.LoadOrStore(pool, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// joinObjectPool makes a newly created repository borrow the objects of its
+// object pool. The pool is created if it doesn't exist.
+func joinObjectPool(config *ServerConfig, tenant, localDiskPath string, u *url.URL) error {
+	name := objectPoolName(config, u)
+	if name == "" {
+		return nil
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("invalid object pool name %q", name)
+	}
+	pool := filepath.Join(config.LocalDiskCacheRoot, tenant, objectPoolDir, name)
+	defer lockObjectPool(pool)()
+	if _, err := os.Stat(pool); os.IsNotExist(err) {
+		if err := os.MkdirAll(pool, 0750); err != nil {
+			return err
+		}
+		if err := runGit(noopOperation{}, pool, "init", "--bare"); err != nil {
+			os.RemoveAll(pool)
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(localDiskPath, "objects", "info", "alternates"), []byte(filepath.Join(pool, "objects")+"\n"), 0644)
+}
+
+// objectPool returns the path of the object pool the repository borrows the
+// objects from, or an empty string if it doesn't.
+func (r *managedRepository) objectPool() string {
+	return objectPoolOf(r.localDiskPath)
+}
+
+// objectPoolOf returns the path of the object pool the cached repository at
+// localDiskPath borrows the objects from, or an empty string if it doesn't.
+func objectPoolOf(localDiskPath string) string {
+	bs, err := ioutil.ReadFile(filepath.Join(localDiskPath, "objects", "info", "alternates"))
+	if err != nil {
+		return ""
+	}
+	objects := strings.TrimSpace(string(bs))
+	if filepath.Base(filepath.Dir(filepath.Dir(objects))) != objectPoolDir {
+		return ""
+	}
+	return filepath.Dir(objects)
+}
+
+// shareObjects copies the objects of the repository to its object pool. The
+// refs are kept in the pool under refs/goblet-members/<hash of the upstream
+// URL>/ so that the objects stay reachable there. The pool keeps the
+// unreachable objects as well, since the other forks might have skipped
+// fetching them from the upstream because the pool had them.
+func (r *managedRepository) shareObjects(op RunningOperation, pool string) error {
+	defer lockObjectPool(pool)()
+	member := fmt.Sprintf("%x", sha256.Sum256([]byte(r.upstreamURL.String())))[:32]
+	if err := runGit(op, pool, "fetch", "--prune", "--no-tags", "-q", r.localDiskPath, "+refs/*:refs/goblet-members/"+member+"/*"); err != nil {
+		return err
+	}
+	return runGit(op, pool, "repack", "-a", "-d", "-q", "--keep-unreachable")
+}
+
+// listObjectPools finds the object pools of all tenants.
+func listObjectPools(config *ServerConfig) ([]string, error) {
+	pools := []string{}
+	err := filepath.Walk(config.LocalDiskCacheRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == objectPoolDir {
+			fis, err := ioutil.ReadDir(p)
+			if err != nil {
+				return err
+			}
+			for _, fi := range fis {
+				if fi.IsDir() {
+					pools = append(pools, filepath.Join(p, fi.Name()))
+				}
+			}
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(p, "HEAD")); err == nil {
+			// A cached repository.
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot list the object pools: %v", err)
+	}
+	return pools, nil
+}
+
+// pruneObjectPools removes the object pools that none of the cached
+// repositories borrows the objects from, and returns the total size of the
+// rest.
+func pruneObjectPools(config *ServerConfig, repos []*cachedRepository) (int64, error) {
+	pools, err := listObjectPools(config)
+	if err != nil {
+		return 0, err
+	}
+	members := map[string]bool{}
+	for _, repo := range repos {
+		if pool := objectPoolOf(repo.localDiskPath); pool != "" {
+			members[pool] = true
+		}
+	}
+	var total int64
+	for _, pool := range pools {
+		if !members[pool] {
+			if removed, err := removeOrphanedObjectPool(config, pool); err != nil {
+				return 0, err
+			} else if removed {
+				continue
+			}
+		}
+		total += diskUsage(pool)
+	}
+	return total, nil
+}
+
+// removeOrphanedObjectPool removes the object pool unless a repository has
+// joined it since the orphaned pools were found.
+func removeOrphanedObjectPool(config *ServerConfig, pool string) (bool, error) {
+	defer lockObjectPool(pool)()
+	repos, err := listCachedRepositories(config)
+	if err != nil {
+		return false, err
+	}
+	for _, repo := range repos {
+		if objectPoolOf(repo.localDiskPath) == pool {
+			return false, nil
+		}
+	}
+	if err := os.RemoveAll(pool); err != nil {
+		return false, fmt.Errorf("cannot remove the object pool: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/url"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errOffline is returned instead of contacting the upstream in the Offline
+// mode.
+var errOffline = status.Error(codes.FailedPrecondition, "goblet is offline and does not contact the upstream")
+
+// checkCachedOffline returns an error if the repository is not cached in the
+// Offline mode, so that the clients get a clear error rather than an empty
+// repository.
+func (r *managedRepository) checkCachedOffline() error {
+	if r.config.Offline && !r.hasCachedRefs() {
+		return errNotCachedOffline(r.upstreamURL)
+	}
+	return nil
+}
+
+// errNotCachedOffline returns the error of a repository that is not cached in
+// the Offline mode.
+func errNotCachedOffline(u *url.URL) error {
+	return categoryErrorf(ErrorCategoryNotFound, codes.NotFound, "%s is not cached, and goblet is offline", u)
+}
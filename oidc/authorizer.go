@@ -0,0 +1,391 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// clockSkew is the allowed difference of the clocks of the issuer and
+	// the server.
+	clockSkew = time.Minute
+
+	// minKeyRefreshInterval is the minimum interval of fetching the JWKS
+	// for an unknown key ID.
+	minKeyRefreshInterval = time.Minute
+
+	// fetchTimeout is the timeout of fetching the discovery document and
+	// the JWKS.
+	fetchTimeout = 30 * time.Second
+
+	// verifiedTokenTTL is how long the claims of a verified token are
+	// reused, so that Authorize and Subject, and the requests of a Git
+	// command, don't verify the same token again. maxVerifiedTokens is the
+	// number of the tokens kept.
+	verifiedTokenTTL  = time.Minute
+	maxVerifiedTokens = 1024
+)
+
+// Verifier verifies the JWTs of the requests issued by an OpenID Connect
+// issuer. The token is taken from the Authorization header as a bearer token,
+// or as the password of the basic authentication so that it can be used with
+// Git credential helpers.
+//
+// The signing keys are fetched from the jwks_uri of the OpenID Connect
+// discovery document of the issuer, and refetched when a token is signed with
+// an unknown key. RS256 and ES256 are supported.
+type Verifier struct {
+	ks       *keySet
+	issuer   string
+	audience string
+
+	mu       sync.Mutex
+	verified map[string]*verifiedToken
+}
+
+type verifiedToken struct {
+	claims  *claims
+	expires time.Time
+}
+
+// NewVerifier returns a Verifier of the JWTs issued by issuer for audience.
+func NewVerifier(issuer, audience string) (*Verifier, error) {
+	ks := &keySet{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		client: &http.Client{Timeout: fetchTimeout},
+	}
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+	return &Verifier{ks: ks, issuer: issuer, audience: audience, verified: map[string]*verifiedToken{}}, nil
+}
+
+// Authorize returns nil if the request has a valid JWT.
+func (v *Verifier) Authorize(r *http.Request) error {
+	_, err := v.verifyRequest(r)
+	return err
+}
+
+// Subject returns the "sub" claim of the JWT of the request, or an empty
+// string if the request has no valid JWT. Use this as
+// ServerConfig.ClientIdentifier. The claims of the token verified by
+// Authorize are reused.
+func (v *Verifier) Subject(r *http.Request) string {
+	c, err := v.verifyRequest(r)
+	if err != nil {
+		return ""
+	}
+	return c.Subject
+}
+
+func (v *Verifier) verifyRequest(r *http.Request) (*claims, error) {
+	token, err := tokenFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	v.mu.Lock()
+	t, ok := v.verified[token]
+	v.mu.Unlock()
+	if ok && now.Before(t.expires) {
+		return t.claims, nil
+	}
+
+	c, err := v.ks.verify(token, v.issuer, v.audience, now)
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(verifiedTokenTTL)
+	if exp := time.Unix(int64(c.ExpiresAt), 0).Add(clockSkew); exp.Before(expires) {
+		expires = exp
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.verified) >= maxVerifiedTokens {
+		for k, t := range v.verified {
+			if !now.Before(t.expires) {
+				delete(v.verified, k)
+			}
+		}
+		if len(v.verified) >= maxVerifiedTokens {
+			v.verified = map[string]*verifiedToken{}
+		}
+	}
+	v.verified[token] = &verifiedToken{claims: c, expires: expires}
+	return c, nil
+}
+
+// NewRequestAuthorizer returns a function that authorizes the requests with a
+// JWT issued by issuer for audience. See Verifier.
+func NewRequestAuthorizer(issuer, audience string) (func(*http.Request) error, error) {
+	v, err := NewVerifier(issuer, audience)
+	if err != nil {
+		return nil, err
+	}
+	return v.Authorize, nil
+}
+
+func tokenFromRequest(r *http.Request) (string, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return "", status.Error(codes.Unauthenticated, "no auth token")
+	}
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer "), nil
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password, nil
+	}
+	return "", status.Error(codes.Unauthenticated, "no bearer token")
+}
+
+type keySet struct {
+	issuer string
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+}
+
+// key returns the public key of the key ID. The JWKS is fetched again if the
+// key is unknown.
+func (ks *keySet) key(kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	key, ok := ks.keys[kid]
+	canRefresh := time.Since(ks.lastRefresh) >= minKeyRefreshInterval
+	ks.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !canRefresh {
+		return nil, status.Errorf(codes.Unauthenticated, "unknown signing key %q", kid)
+	}
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+	ks.mu.Lock()
+	key, ok = ks.keys[kid]
+	ks.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (ks *keySet) refresh() error {
+	ks.mu.Lock()
+	ks.lastRefresh = time.Now()
+	ks.mu.Unlock()
+
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(ks.client, ks.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return status.Errorf(codes.Unavailable, "cannot get the OpenID Connect discovery document: %v", err)
+	}
+	if discovery.JWKSURI == "" {
+		return status.Errorf(codes.Unavailable, "no jwks_uri in the OpenID Connect discovery document of %s", ks.issuer)
+	}
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ks.client, discovery.JWKSURI, &jwks); err != nil {
+		return status.Errorf(codes.Unavailable, "cannot get the JWKS: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip the keys of unsupported types.
+			continue
+		}
+		keys[jwk.KID] = key
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+	return nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type jsonWebKey struct {
+	KID string `json:"kid"`
+	KTY string `json:"kty"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	CRV string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KTY {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.CRV != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.CRV)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.KTY)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bs), nil
+}
+
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt float64  `json:"exp"`
+	NotBefore float64  `json:"nbf"`
+}
+
+// audience is the "aud" claim, which can be a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(bs, &ss); err != nil {
+		return err
+	}
+	*a = audience(ss)
+	return nil
+}
+
+// verify checks the signature and the claims of the JWT, and returns the
+// claims.
+func (ks *keySet) verify(token, issuer, aud string, now time.Time) (*claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, status.Error(codes.Unauthenticated, "the token is not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		KID string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot parse the JWT header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot parse the JWT signature: %v", err)
+	}
+	key, err := ks.key(header.KID)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) != nil {
+			return nil, status.Error(codes.Unauthenticated, "invalid JWT signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 || !ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, status.Error(codes.Unauthenticated, "invalid JWT signature")
+		}
+	default:
+		return nil, status.Errorf(codes.Unauthenticated, "unsupported JWT algorithm %q", header.Alg)
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot parse the JWT claims: %v", err)
+	}
+	if strings.TrimSuffix(c.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, status.Errorf(codes.Unauthenticated, "the token is issued by %q", c.Issuer)
+	}
+	if c.ExpiresAt == 0 || now.Add(-clockSkew).After(time.Unix(int64(c.ExpiresAt), 0)) {
+		return nil, status.Error(codes.Unauthenticated, "the token is expired")
+	}
+	if c.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(int64(c.NotBefore), 0)) {
+		return nil, status.Error(codes.Unauthenticated, "the token is not valid yet")
+	}
+	for _, a := range c.Audience {
+		if a == aud {
+			return &c, nil
+		}
+	}
+	return nil, status.Errorf(codes.PermissionDenied, "the token is not for %q", aud)
+}
+
+func decodeSegment(s string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
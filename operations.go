@@ -0,0 +1,146 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// operationMaxMessages is the number of the last messages of an
+	// operation kept for OperationsHandler and /statusz.
+	operationMaxMessages = 10
+)
+
+// operationTracker tracks the RunningOperations in flight for
+// OperationsHandler and /statusz.
+type operationTracker struct {
+	mu     sync.Mutex
+	nextID int64
+	ops    map[int64]*trackedOperation
+}
+
+// trackedOperation is a RunningOperation in operationTracker. state is what
+// the operation is doing, such as waiting for a lock, and messages are the
+// last operationMaxMessages lines printed, such as the progress of
+// git-fetch.
+type trackedOperation struct {
+	RunningOperation
+	tracker     *operationTracker
+	id          int64
+	action      string
+	upstreamURL *url.URL
+	startTime   time.Time
+
+	mu       sync.Mutex
+	state    string
+	messages []string
+}
+
+func (t *operationTracker) start(action string, u *url.URL, op RunningOperation) RunningOperation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ops == nil {
+		t.ops = map[int64]*trackedOperation{}
+	}
+	t.nextID++
+	o := &trackedOperation{
+		RunningOperation: op,
+		tracker:          t,
+		id:               t.nextID,
+		action:           action,
+		upstreamURL:      u,
+		startTime:        time.Now(),
+		state:            "running",
+	}
+	t.ops[o.id] = o
+	return o
+}
+
+func (t *operationTracker) list() []*trackedOperation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ops := make([]*trackedOperation, 0, len(t.ops))
+	for _, o := range t.ops {
+		ops = append(ops, o)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].id < ops[j].id })
+	return ops
+}
+
+func (o *trackedOperation) Printf(format string, a ...interface{}) {
+	if msg := strings.TrimSpace(fmt.Sprintf(format, a...)); msg != "" {
+		o.mu.Lock()
+		o.messages = append(o.messages, msg)
+		if len(o.messages) > operationMaxMessages {
+			o.messages = o.messages[len(o.messages)-operationMaxMessages:]
+		}
+		o.mu.Unlock()
+	}
+	o.RunningOperation.Printf(format, a...)
+}
+
+func (o *trackedOperation) Done(err error) {
+	o.tracker.mu.Lock()
+	delete(o.tracker.ops, o.id)
+	o.tracker.mu.Unlock()
+	o.RunningOperation.Done(err)
+}
+
+// status returns the state and a copy of the messages of the operation.
+func (o *trackedOperation) status() (string, []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.state, append([]string{}, o.messages...)
+}
+
+// setOperationState records what op is doing, such as waiting for a lock, to
+// be shown by OperationsHandler.
+func setOperationState(op RunningOperation, state string) {
+	if o, ok := op.(*trackedOperation); ok {
+		o.mu.Lock()
+		o.state = state
+		o.mu.Unlock()
+	}
+}
+
+// OperationsHandler returns an http.Handler that shows the long-running
+// operations in flight, such as the upstream fetches, with the locks they
+// are waiting for or holding, followed by the stacks of all goroutines. This
+// is meant for debugging a stuck server, and it shouldn't be exposed to the
+// clients.
+func OperationsHandler(config *ServerConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		ops := config.operations.list()
+		fmt.Fprintf(w, "%d operations in flight\n", len(ops))
+		for _, o := range ops {
+			state, messages := o.status()
+			fmt.Fprintf(w, "\n%s %s\n\tstarted %s ago: %s\n", o.action, o.upstreamURL, time.Since(o.startTime).Round(time.Millisecond), state)
+			if len(messages) != 0 {
+				fmt.Fprintf(w, "\tlast output: %s\n", messages[len(messages)-1])
+			}
+		}
+		fmt.Fprintf(w, "\ngoroutines:\n")
+		pprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+}
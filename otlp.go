@@ -0,0 +1,287 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const (
+	otlpFlushInterval = 5 * time.Second
+	otlpMaxBatchSize  = 512
+
+	// otlpMaxBufferedSpans is the number of the spans kept while the
+	// collector is unreachable. The spans beyond this are dropped.
+	otlpMaxBufferedSpans = 8192
+)
+
+// OTLPTraceExporter exports the spans to an OpenTelemetry collector with
+// OTLP/HTTP in the JSON encoding. Register it with trace.RegisterExporter.
+// The spans are sent in batches every few seconds.
+type OTLPTraceExporter struct {
+	endpoint    string
+	header      http.Header
+	serviceName string
+	client      *http.Client
+
+	mu    sync.Mutex
+	spans []*trace.SpanData
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewOTLPTraceExporter returns an exporter that sends the spans to the
+// endpoint, such as "http://localhost:4318/v1/traces", with the additional
+// request headers.
+func NewOTLPTraceExporter(endpoint string, header http.Header, serviceName string) *OTLPTraceExporter {
+	e := &OTLPTraceExporter{
+		endpoint:    endpoint,
+		header:      header,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		stop:        make(chan struct{}),
+	}
+	go runOTLPFlushes(otlpFlushInterval, e.stop, func() {
+		if err := e.Flush(); err != nil {
+			log.Printf("Cannot export the spans: %v", err)
+		}
+	})
+	return e
+}
+
+// runOTLPFlushes calls flush every interval until stop is closed.
+func runOTLPFlushes(interval time.Duration, stop <-chan struct{}, flush func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ExportSpan implements trace.Exporter.
+func (e *OTLPTraceExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	if len(e.spans) < otlpMaxBufferedSpans {
+		e.spans = append(e.spans, s)
+	}
+	n := len(e.spans)
+	e.mu.Unlock()
+	if n == otlpMaxBatchSize {
+		go e.Flush()
+	}
+}
+
+// Close stops the periodic flushes and sends the buffered spans. Unregister
+// the exporter with trace.UnregisterExporter before closing it.
+func (e *OTLPTraceExporter) Close() error {
+	e.stopOnce.Do(func() { close(e.stop) })
+	return e.Flush()
+}
+
+// Flush sends the buffered spans. The spans that cannot be sent are kept
+// for the next flush.
+func (e *OTLPTraceExporter) Flush() error {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > otlpMaxBatchSize {
+			n = otlpMaxBatchSize
+		}
+		if err := e.send(spans[:n]); err != nil {
+			e.mu.Lock()
+			e.spans = append(spans, e.spans...)
+			if len(e.spans) > otlpMaxBufferedSpans {
+				e.spans = e.spans[:otlpMaxBufferedSpans]
+			}
+			e.mu.Unlock()
+			return err
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+func (e *OTLPTraceExporter) send(spans []*trace.SpanData) error {
+	req := &otlpTraceRequest{
+		ResourceSpans: []*otlpResourceSpans{
+			{
+				Resource: &otlpResource{
+					Attributes: []*otlpKeyValue{otlpAttribute("service.name", e.serviceName)},
+				},
+				ScopeSpans: []*otlpScopeSpans{
+					{
+						Scope: &otlpScope{Name: "github.com/google/goblet"},
+					},
+				},
+			},
+		},
+	}
+	scope := req.ResourceSpans[0].ScopeSpans[0]
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, newOTLPSpan(s))
+	}
+	return postOTLP(e.client, e.endpoint, e.header, req)
+}
+
+// postOTLP sends the OTLP/HTTP request in the JSON encoding to the endpoint.
+func postOTLP(client *http.Client, endpoint string, header http.Header, req interface{}) error {
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", endpoint, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			httpReq.Header.Add(k, v)
+		}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got a non-OK response from the collector: %d %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// The types below are the JSON mapping of the OTLP trace protobuf messages.
+
+type otlpTraceRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   *otlpResource     `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope *otlpScope  `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []*otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string        `json:"key"`
+	Value *otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newOTLPSpan(s *trace.SpanData) *otlpSpan {
+	span := &otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+	switch s.SpanKind {
+	case trace.SpanKindServer:
+		span.Kind = 2
+	case trace.SpanKindClient:
+		span.Kind = 3
+	default:
+		span.Kind = 1
+	}
+	for k, v := range s.Attributes {
+		kv := &otlpKeyValue{Key: k, Value: &otlpAnyValue{}}
+		switch v := v.(type) {
+		case string:
+			kv.Value.StringValue = &v
+		case bool:
+			kv.Value.BoolValue = &v
+		case int64:
+			i := strconv.FormatInt(v, 10)
+			kv.Value.IntValue = &i
+		case float64:
+			kv.Value.DoubleValue = &v
+		default:
+			str := fmt.Sprint(v)
+			kv.Value.StringValue = &str
+		}
+		span.Attributes = append(span.Attributes, kv)
+	}
+	if s.Code != 0 {
+		// OpenCensus uses the gRPC status codes. OTLP has only unset,
+		// OK, and error.
+		span.Status = &otlpStatus{Code: 2, Message: s.Message}
+	}
+	return span
+}
+
+func otlpAttribute(key, value string) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: &otlpAnyValue{StringValue: &value}}
+}
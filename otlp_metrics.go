@@ -0,0 +1,241 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+const otlpMetricFlushInterval = time.Minute
+
+// OTLPMetricExporter exports the data of the views to an OpenTelemetry
+// collector with OTLP/HTTP in the JSON encoding, along with the OpenCensus
+// exporters. Register it with view.RegisterExporter. The metrics are named
+// after the views, e.g. github.com/google/goblet/inbound-command-count, so
+// that the dashboards can keep using the view names, and the tags are the
+// attributes named after the last element of the tag keys, e.g.
+// command-type. The counts and the distributions are cumulative.
+type OTLPMetricExporter struct {
+	endpoint    string
+	header      http.Header
+	serviceName string
+	client      *http.Client
+
+	mu      sync.Mutex
+	metrics map[string]*otlpMetric
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewOTLPMetricExporter returns an exporter that sends the metrics to the
+// endpoint, such as "http://localhost:4318/v1/metrics", with the additional
+// request headers.
+func NewOTLPMetricExporter(endpoint string, header http.Header, serviceName string) *OTLPMetricExporter {
+	e := &OTLPMetricExporter{
+		endpoint:    endpoint,
+		header:      header,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		metrics:     map[string]*otlpMetric{},
+		stop:        make(chan struct{}),
+	}
+	go runOTLPFlushes(otlpMetricFlushInterval, e.stop, func() {
+		if err := e.Flush(); err != nil {
+			log.Printf("Cannot export the metrics: %v", err)
+		}
+	})
+	return e
+}
+
+// Close stops the periodic flushes and sends the latest data of the views.
+// Unregister the exporter with view.UnregisterExporter before closing it.
+func (e *OTLPMetricExporter) Close() error {
+	e.stopOnce.Do(func() { close(e.stop) })
+	return e.Flush()
+}
+
+// ExportView implements view.Exporter. Only the latest data of a view is
+// kept until the next flush, as the data is cumulative.
+func (e *OTLPMetricExporter) ExportView(vd *view.Data) {
+	m := newOTLPMetric(vd)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.metrics[vd.View.Name] = m
+}
+
+// Flush sends the latest data of the views.
+func (e *OTLPMetricExporter) Flush() error {
+	e.mu.Lock()
+	metrics := e.metrics
+	e.metrics = map[string]*otlpMetric{}
+	e.mu.Unlock()
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	req := &otlpMetricRequest{
+		ResourceMetrics: []*otlpResourceMetrics{
+			{
+				Resource: &otlpResource{
+					Attributes: []*otlpKeyValue{otlpAttribute("service.name", e.serviceName)},
+				},
+				ScopeMetrics: []*otlpScopeMetrics{
+					{
+						Scope: &otlpScope{Name: "github.com/google/goblet"},
+					},
+				},
+			},
+		},
+	}
+	scope := req.ResourceMetrics[0].ScopeMetrics[0]
+	for _, m := range metrics {
+		scope.Metrics = append(scope.Metrics, m)
+	}
+	sort.Slice(scope.Metrics, func(i, j int) bool { return scope.Metrics[i].Name < scope.Metrics[j].Name })
+	if err := postOTLP(e.client, e.endpoint, e.header, req); err != nil {
+		// Keep the data for the next flush unless it's superseded.
+		e.mu.Lock()
+		for name, m := range metrics {
+			if _, ok := e.metrics[name]; !ok {
+				e.metrics[name] = m
+			}
+		}
+		e.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// The types below are the JSON mapping of the OTLP metrics protobuf messages.
+
+// otlpAggregationTemporalityCumulative is
+// AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpAggregationTemporalityCumulative = 2
+
+type otlpMetricRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpScope    `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                    `json:"aggregationTemporality"`
+	IsMonotonic            bool                   `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                       `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []*otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             *string         `json:"asInt,omitempty"`
+	AsDouble          *float64        `json:"asDouble,omitempty"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []*otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	BucketCounts      []string        `json:"bucketCounts"`
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+}
+
+func newOTLPMetric(vd *view.Data) *otlpMetric {
+	m := &otlpMetric{
+		Name:        vd.View.Name,
+		Description: vd.View.Description,
+		Unit:        vd.View.Measure.Unit(),
+	}
+	start := strconv.FormatInt(vd.Start.UnixNano(), 10)
+	end := strconv.FormatInt(vd.End.UnixNano(), 10)
+	switch vd.View.Aggregation.Type {
+	case view.AggTypeCount, view.AggTypeSum:
+		m.Sum = &otlpSum{AggregationTemporality: otlpAggregationTemporalityCumulative, IsMonotonic: true}
+	case view.AggTypeDistribution:
+		m.Histogram = &otlpHistogram{AggregationTemporality: otlpAggregationTemporalityCumulative}
+	default:
+		m.Gauge = &otlpGauge{}
+	}
+	for _, row := range vd.Rows {
+		attrs := []*otlpKeyValue{}
+		for _, t := range row.Tags {
+			attrs = append(attrs, otlpAttribute(path.Base(t.Key.Name()), t.Value))
+		}
+		switch data := row.Data.(type) {
+		case *view.CountData:
+			i := strconv.FormatInt(data.Value, 10)
+			m.Sum.DataPoints = append(m.Sum.DataPoints, &otlpNumberDataPoint{Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: end, AsInt: &i})
+		case *view.SumData:
+			f := data.Value
+			m.Sum.DataPoints = append(m.Sum.DataPoints, &otlpNumberDataPoint{Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: end, AsDouble: &f})
+		case *view.LastValueData:
+			f := data.Value
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, &otlpNumberDataPoint{Attributes: attrs, TimeUnixNano: end, AsDouble: &f})
+		case *view.DistributionData:
+			p := &otlpHistogramDataPoint{
+				Attributes:        attrs,
+				StartTimeUnixNano: start,
+				TimeUnixNano:      end,
+				Count:             strconv.FormatInt(data.Count, 10),
+				Sum:               data.Sum(),
+				ExplicitBounds:    vd.View.Aggregation.Buckets,
+			}
+			// OpenCensus has a bucket for each bound and one for the
+			// values over the last bound, as OTLP does.
+			for _, c := range data.CountPerBucket {
+				p.BucketCounts = append(p.BucketCounts, strconv.FormatInt(c, 10))
+			}
+			m.Histogram.DataPoints = append(m.Histogram.DataPoints, p)
+		}
+	}
+	return m
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"go.opencensus.io/stats"
+)
+
+// packCacheEvictMu serializes the evictions of the pack response cache.
+var packCacheEvictMu sync.Mutex
+
+// isCacheableFetch returns true if the fetch command has no haves, such as
+// the ones of the clones. The responses of the other fetches depend on what
+// the clients have, and they are rarely identical.
+func isCacheableFetch(command []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	for _, ch := range command {
+		if ch.Argument != nil && strings.HasPrefix(string(ch.Argument), "have ") {
+			return false
+		}
+	}
+	return true
+}
+
+// packCachePath returns the path of the cached response of the fetch command.
+// The key includes the last upstream fetch time and the hidden refs, as the
+// response can include the tags that point to the wanted objects.
+func (r *managedRepository) packCachePath(command []*gitprotocolio.ProtocolV2RequestChunk) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s", fetchFlightKey(r.localDiskPath, command), lastFetchTime(r.localDiskPath).UnixNano(), strings.Join(uploadPackHideRefsOptions(r.config), "\x00"))
+	key := fmt.Sprintf("%x", h.Sum(nil))
+	return filepath.Join(r.config.PackCacheRoot, "packs", key[0:2], key)
+}
+
+// serveFetchCached serves the fetch command from the pack response cache. If
+// the response is not cached, it's generated and stored in the cache while
+// it's sent.
+func (r *managedRepository) serveFetchCached(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	p := r.packCachePath(command)
+	if f, err := os.Open(p); err == nil {
+		defer f.Close()
+		stats.Record(context.Background(), PackCacheHitCount.M(1))
+		// The modification time is the last access time for the
+		// eviction.
+		now := time.Now()
+		os.Chtimes(p, now, now)
+		_, err := io.Copy(w, f)
+		return err
+	}
+	stats.Record(context.Background(), PackCacheMissCount.M(1))
+
+	tmpDir := filepath.Join(r.config.PackCacheRoot, "tmp")
+	if err := os.MkdirAll(tmpDir, 0750); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(tmpDir, filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = r.generatePack(ctx, command, io.MultiWriter(w, f))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		log.Printf("Cannot cache the pack response: %v", err)
+		return nil
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		log.Printf("Cannot cache the pack response: %v", err)
+		return nil
+	}
+	evictPackCache(r.config, p)
+	return nil
+}
+
+// evictPackCache removes the least recently used responses until the total
+// size is at most PackCacheMaxBytes. The response at keep, which has just
+// been cached, is not removed.
+func evictPackCache(config *ServerConfig, keep string) {
+	packCacheEvictMu.Lock()
+	defer packCacheEvictMu.Unlock()
+
+	total, err := evictLeastRecentlyUsedFiles(filepath.Join(config.PackCacheRoot, "packs"), config.PackCacheMaxBytes, keep, func() {
+		stats.Record(context.Background(), PackCacheEvictionCount.M(1))
+	})
+	if err != nil {
+		log.Printf("Cannot evict the pack responses: %v", err)
+		return
+	}
+	stats.Record(context.Background(), PackCacheBytes.M(total))
+}
+
+// evictLeastRecentlyUsedFiles removes the files under the directory in the
+// order of their modification times until their total size is at most
+// maxBytes, and returns the total size. The file at keep is not removed, and
+// evicted is called for each removed file. Nothing is removed if maxBytes is
+// zero.
+func evictLeastRecentlyUsedFiles(dir string, maxBytes int64, keep string, evicted func()) (int64, error) {
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	total := int64(0)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			entries = append(entries, entry{p, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if maxBytes > 0 && total > maxBytes {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+		for _, e := range entries {
+			if total <= maxBytes {
+				break
+			}
+			if e.path == keep {
+				continue
+			}
+			if err := os.Remove(e.path); err != nil {
+				log.Printf("Cannot evict %s: %v", e.path, err)
+				continue
+			}
+			total -= e.size
+			evicted()
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,363 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// lowMemoryPackOptions are the git options used when retrying a failed pack
+// generation. They trade the pack size and the speed for the memory usage.
+var lowMemoryPackOptions = []string{
+	"-c", "pack.threads=1",
+	"-c", "pack.window=4",
+	"-c", "pack.windowMemory=64m",
+	"-c", "pack.deltaCacheSize=16m",
+}
+
+// serveFetchLocal serves the command from the local disk. git-upload-pack is
+// killed when ctx is done, such as when the client goes away.
+func (r *managedRepository) serveFetchLocal(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	if command[0].Command != "fetch" {
+		return r.serveUploadPack(ctx, command, w)
+	}
+	if r.config.PackCacheRoot != "" && isCacheableFetch(command) {
+		return r.serveFetchCached(ctx, command, w)
+	}
+	return r.generatePack(ctx, command, w)
+}
+
+// generatePack serves the fetch command with a newly generated response.
+func (r *managedRepository) generatePack(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	if r.config.CoalesceFetches {
+		return r.serveFetchCoalesced(command, w)
+	}
+	return r.serveUploadPack(ctx, command, w)
+}
+
+// serveUploadPack runs git-upload-pack for the command, and retries it with
+// lowMemoryPackOptions if RetryPackServe is set.
+func (r *managedRepository) serveUploadPack(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	if !r.config.RetryPackServe {
+		return r.runUploadPack(ctx, command, w, nil)
+	}
+
+	// Hold the response until the pack data starts so that a failed
+	// attempt can be retried without sending a broken response.
+	b := &packDataBuffer{w: w, held: newSpillBuffer(r.config)}
+	defer b.held.Close()
+	err := r.runUploadPack(ctx, command, b, nil)
+	if err != nil && !b.started && ctx.Err() == nil && isRetryablePackServeError(err) {
+		stats.Record(context.Background(), PackServeRetryCount.M(1))
+		b.held.Close()
+		b = &packDataBuffer{w: w, held: newSpillBuffer(r.config)}
+		defer b.held.Close()
+		err = r.runUploadPack(ctx, command, b, lowMemoryPackOptions)
+	}
+	if err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+// packServeResourceErrors are the messages of git-upload-pack and
+// git-pack-objects that show a failure of the server rather than of the
+// request.
+var packServeResourceErrors = []string{
+	"Out of memory",
+	"out of memory",
+	"Cannot allocate memory",
+	"mmap failed",
+	"unable to create thread",
+	"pack-objects died",
+}
+
+// uploadPackFailure is an error of a git-upload-pack that exited with an
+// error.
+type uploadPackFailure struct {
+	err error
+	// serverSide is true if it's killed by a signal, such as by the OOM
+	// killer, or its output shows packServeResourceErrors.
+	serverSide bool
+}
+
+func (e *uploadPackFailure) Error() string {
+	return e.err.Error()
+}
+
+// isRetryablePackServeError returns true if a git-upload-pack failed on the
+// server side, such as being killed by PackServeTimeout or running out of
+// memory. The errors of the request, such as an invalid argument, are not
+// retried.
+func isRetryablePackServeError(err error) bool {
+	if status.Code(err) == codes.DeadlineExceeded {
+		return true
+	}
+	if f, ok := err.(*uploadPackFailure); ok {
+		return f.serverSide
+	}
+	return false
+}
+
+// runUploadPack runs git-upload-pack for the command. It's killed with its
+// child processes if it doesn't start sending the pack data within
+// PackServeTimeout, or when ctx is done.
+func (r *managedRepository) runUploadPack(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer, options []string) error {
+	// The want-refs are resolved before this (see resolveWantRefs), as
+	// the refs can be updated by fetch-upstream while this runs.
+	//
+	// The partial clones are always allowed, as the cached repositories
+	// restored from a bundle or created by an older version may not have
+	// uploadpack.allowfilter.
+	release, err := r.config.uploadPackSlots.tryAcquire(r.config.MaxUploadPacks, priorityFromContext(ctx), "too many git-upload-pack processes")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	args := append([]string{"-c", "uploadpack.allowFilter=1"}, uploadPackHideRefsOptions(r.config)...)
+	args = append(args, options...)
+	cmd := exec.Command(gitBinary, append(args, "upload-pack", "--stateless-rpc", r.localDiskPath)...)
+	cmd.Env = []string{"GIT_PROTOCOL=version=2"}
+	if trace := gitTrace2PerfFromContext(ctx); trace != "" {
+		// pack-objects inherits this and appends to the same file.
+		cmd.Env = append(cmd.Env, "GIT_TRACE2_PERF="+trace)
+	}
+	cmd.Dir = r.localDiskPath
+	// A large negotiation can have many haves. Spill them over
+	// RequestMemoryBudget rather than holding a copy of the request.
+	req := newSpillBuffer(r.config)
+	defer req.Close()
+	if _, err := io.Copy(req, newGitRequest(command)); err != nil {
+		return err
+	}
+	cmd.Stdin = req.Reader()
+	cmd.Stdout = w
+	stderr := &outputTail{}
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	r.config.settingsMu.RLock()
+	timeout := r.config.PackServeTimeout
+	r.config.settingsMu.RUnlock()
+	if timeout <= 0 && ctx.Done() == nil {
+		return uploadPackError(cmd.Run(), stderr)
+	}
+	// The timeout covers only the pack generation. Once the pack data
+	// starts, the response is streamed at the client's pace.
+	const (
+		generating int32 = iota
+		streaming
+		killed
+	)
+	state := generating
+	if timeout > 0 {
+		cmd.Stdout = &packDataWatcher{w: w, onStart: func() {
+			atomic.CompareAndSwapInt32(&state, generating, streaming)
+		}}
+	}
+
+	// Run in a new process group so that pack-objects is killed together.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			if !atomic.CompareAndSwapInt32(&state, generating, killed) {
+				return
+			}
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			stats.Record(context.Background(), PackServeKillCount.M(1))
+		})
+		defer timer.Stop()
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	if atomic.LoadInt32(&state) == killed {
+		return status.Errorf(codes.DeadlineExceeded, "git-upload-pack did not start sending the pack in %v", timeout)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errRequestDeadlineExceeded
+	} else if ctx.Err() != nil {
+		return status.Errorf(codes.Canceled, "the request is canceled: %v", ctx.Err())
+	}
+	return uploadPackError(err, stderr)
+}
+
+// uploadPackError returns an uploadPackFailure if err is an exit error of
+// git-upload-pack.
+func uploadPackError(err error, stderr *outputTail) error {
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+	f := &uploadPackFailure{err: err}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		f.serverSide = true
+	}
+	for _, s := range packServeResourceErrors {
+		if stderr.contains(s) {
+			f.serverSide = true
+		}
+	}
+	return f
+}
+
+// outputTail is an io.Writer that keeps the last gitOutputTailBytes of the
+// output of a command.
+type outputTail struct {
+	mu   sync.Mutex
+	tail []byte
+}
+
+func (o *outputTail) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.tail = append(o.tail, p...)
+	if len(o.tail) > gitOutputTailBytes {
+		o.tail = append([]byte(nil), o.tail[len(o.tail)-gitOutputTailBytes:]...)
+	}
+	return len(p), nil
+}
+
+func (o *outputTail) contains(s string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return bytes.Contains(o.tail, []byte(s))
+}
+
+// packDataScanner scans an upload-pack response for the first pack data
+// packet in the packfile section.
+type packDataScanner struct {
+	// pending is the incomplete pkt-line at the end of the scanned
+	// response.
+	pending    []byte
+	inPackfile bool
+	// started is true once the pack data starts, or if the response is
+	// not a pkt-line stream.
+	started bool
+}
+
+func (s *packDataScanner) scan(p []byte) {
+	if s.started {
+		return
+	}
+	bs := append(s.pending, p...)
+	scanned := 0
+	for scanned+4 <= len(bs) {
+		var l [2]byte
+		if _, err := hex.Decode(l[:], bs[scanned:scanned+4]); err != nil {
+			// Not a pkt-line stream.
+			s.started = true
+			break
+		}
+		n := int(l[0])<<8 | int(l[1])
+		if n < 4 {
+			// Special packets.
+			scanned += 4
+			continue
+		}
+		if scanned+n > len(bs) {
+			break
+		}
+		payload := bs[scanned+4 : scanned+n]
+		scanned += n
+		if !s.inPackfile {
+			s.inPackfile = string(payload) == "packfile\n"
+		} else if len(payload) > 0 && payload[0] == 1 {
+			s.started = true
+			break
+		}
+	}
+	if s.started {
+		s.pending = nil
+	} else {
+		s.pending = append([]byte(nil), bs[scanned:]...)
+	}
+}
+
+// packDataWatcher is an io.Writer that calls onStart when the pack data of
+// an upload-pack response starts.
+type packDataWatcher struct {
+	w       io.Writer
+	scanner packDataScanner
+	onStart func()
+}
+
+func (pw *packDataWatcher) Write(p []byte) (int, error) {
+	if !pw.scanner.started {
+		pw.scanner.scan(p)
+		if pw.scanner.started {
+			pw.onStart()
+		}
+	}
+	return pw.w.Write(p)
+}
+
+// packDataBuffer is an io.Writer that holds an upload-pack response until
+// the first pack data packet in the packfile section, and passes through the
+// rest. The held response is spilled to disk over RequestMemoryBudget, as the
+// acknowledgments of a large negotiation can be large.
+type packDataBuffer struct {
+	packDataScanner
+	w    io.Writer
+	held *spillBuffer
+}
+
+func (b *packDataBuffer) Write(p []byte) (int, error) {
+	if b.started {
+		return b.w.Write(p)
+	}
+	if _, err := b.held.Write(p); err != nil {
+		return 0, err
+	}
+	b.scan(p)
+	if b.started {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (b *packDataBuffer) flush() error {
+	if b.held.Len() == 0 {
+		return nil
+	}
+	_, err := io.Copy(b.w, b.held.Reader())
+	b.held.Close()
+	return err
+}
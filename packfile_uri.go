@@ -0,0 +1,194 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+const defaultPackfileURIMaxAge = 24 * time.Hour
+
+// offloadedPack is a base pack of a repository uploaded with
+// PackfileURIUploader. uri is empty if the pack was smaller than
+// PackfileURIMinBytes and not uploaded.
+type offloadedPack struct {
+	hash    string
+	uri     string
+	tips    []string
+	created time.Time
+}
+
+func packfileURIMaxAge(config *ServerConfig) time.Duration {
+	if config.PackfileURIMaxAge > 0 {
+		return config.PackfileURIMaxAge
+	}
+	return defaultPackfileURIMaxAge
+}
+
+func (r *managedRepository) currentBasePack() *offloadedPack {
+	r.basePackMu.Lock()
+	defer r.basePackMu.Unlock()
+	return r.basePack
+}
+
+// refreshBasePack regenerates and uploads the base pack of the repository if
+// there's none or it's older than PackfileURIMaxAge. Only one runs at a time
+// per repository.
+func (r *managedRepository) refreshBasePack() (err error) {
+	if r.config.PackfileURIUploader == nil {
+		return nil
+	}
+	if p := r.currentBasePack(); p != nil && time.Since(p.created) < packfileURIMaxAge(r.config) {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&r.offloading, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&r.offloading, 0)
+
+	op := r.startOperation("CreateBasePack")
+	defer func() {
+		op.Done(err)
+	}()
+	refs, err := r.listLocalRefs(op)
+	if err != nil {
+		return err
+	}
+	// The objects only reachable from the hidden refs must not be
+	// downloadable.
+	seen := map[string]bool{}
+	var tips []string
+	for refName, hash := range refs {
+		if !isHiddenRef(r.config, refName) && !seen[hash] {
+			seen[hash] = true
+			tips = append(tips, hash)
+		}
+	}
+	if len(tips) == 0 {
+		return nil
+	}
+	sort.Strings(tips)
+
+	dir, err := ioutil.TempDir("", "goblet_base_pack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	var out bytes.Buffer
+	r.mu.RLock()
+	err = runGitWithStdInOut(op, strings.NewReader(strings.Join(tips, "\n")+"\n"), &out, r.localDiskPath, "pack-objects", "--revs", "--delta-base-offset", filepath.Join(dir, "pack"))
+	r.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	p := &offloadedPack{
+		hash:    strings.TrimSpace(out.String()),
+		tips:    tips,
+		created: time.Now(),
+	}
+	f, err := os.Open(filepath.Join(dir, "pack-"+p.hash+".pack"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= r.config.PackfileURIMinBytes {
+		name := path.Join(r.tenant, r.upstreamURL.Host, r.upstreamURL.Path, "pack-"+p.hash+".pack")
+		if p.uri, err = r.config.PackfileURIUploader(context.Background(), name, f); err != nil {
+			return err
+		}
+	}
+
+	r.basePackMu.Lock()
+	r.basePack = p
+	r.basePackMu.Unlock()
+	return nil
+}
+
+// offloadBasePack returns the fetch command that excludes the objects in the
+// base pack and the packfile-uris section that points to the base pack. It
+// returns false if the base pack cannot be used for the fetch.
+//
+// Only the initial clones are offloaded. The client downloads the base pack,
+// and the wants are served as if the client had the tips of the base pack.
+// The thin packs are not used as the packfile is indexed before the base
+// pack is downloaded.
+func (r *managedRepository) offloadBasePack(command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2RequestChunk, []byte, bool) {
+	p := r.currentBasePack()
+	if p == nil || p.uri == "" || !hasFetchArgument(command, "done") {
+		return nil, nil, false
+	}
+	u, err := url.Parse(p.uri)
+	if err != nil {
+		return nil, nil, false
+	}
+	acceptsScheme := false
+	for _, ch := range command {
+		if ch.Argument == nil {
+			continue
+		}
+		arg := strings.TrimSpace(string(ch.Argument))
+		name := capabilityName(arg)
+		if name == "have" || fetchArgumentFeatures[name] == "shallow" || fetchArgumentFeatures[name] == "filter" {
+			return nil, nil, false
+		}
+		if name == "packfile-uris" {
+			for _, scheme := range strings.Split(strings.TrimPrefix(arg, "packfile-uris "), ",") {
+				if scheme == u.Scheme {
+					acceptsScheme = true
+				}
+			}
+		}
+	}
+	if !acceptsScheme {
+		return nil, nil, false
+	}
+
+	ret := make([]*gitprotocolio.ProtocolV2RequestChunk, 0, len(command)+len(p.tips))
+	for _, ch := range command {
+		if ch.Argument != nil {
+			switch capabilityName(string(ch.Argument)) {
+			case "packfile-uris", "thin-pack":
+				continue
+			case "done":
+				for _, tip := range p.tips {
+					ret = append(ret, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("have " + tip + "\n")})
+				}
+			}
+		}
+		ret = append(ret, ch)
+	}
+
+	var b bytes.Buffer
+	b.Write(gitprotocolio.BytesPacket("packfile-uris\n").EncodeToPktLine())
+	b.Write(gitprotocolio.BytesPacket(p.hash + " " + p.uri + "\n").EncodeToPktLine())
+	b.Write(gitprotocolio.DelimPacket{}.EncodeToPktLine())
+	return ret, b.Bytes(), true
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// fetchFromPeer fetches the refs and the objects of the repository from the
+// peer goblet instance of PeerURL. This is done before the initial fetch from
+// the upstream so that the upstream fetch only needs to transfer what the
+// peer doesn't have.
+func (r *managedRepository) fetchFromPeer(op RunningOperation) error {
+	u, err := r.config.PeerURL(r.upstreamURL)
+	if err != nil {
+		return fmt.Errorf("cannot get the peer URL: %v", err)
+	}
+	var t *oauth2.Token
+	if r.config.PeerTokenSource != nil {
+		t, err = r.config.PeerTokenSource.Token()
+	} else {
+		t, err = upstreamToken(r.config, r.upstreamURL)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot obtain a token for the peer: %v", err)
+	}
+	refspecs := upstreamFetchRefspecs(r.config)
+	if refspecs == nil {
+		refspecs = []string{"+refs/*:refs/*"}
+	}
+	ctx, cancel := upstreamTimeoutContext(r.config.upstreamFetches.context(), r.config.UpstreamFetchTimeout)
+	defer cancel()
+	err = runGitContext(ctx, op, r.localDiskPath, append([]string{"-c", "protocol.version=2", "-c", "http.extraHeader=Authorization: " + authorizationHeader(t), "fetch", "--progress", "-f", u.String()}, refspecs...)...)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("the peer fetch did not finish in %v", r.config.UpstreamFetchTimeout)
+	}
+	return err
+}
@@ -0,0 +1,231 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Priority is the priority of a request, given by the Goblet-Priority
+// header.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = 3
+)
+
+const priorityHeader = "Goblet-Priority"
+
+// errLowPriorityShed is returned when a low priority request is shed because
+// the server is saturated.
+var errLowPriorityShed = errors.New("low priority request is shed")
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// requestPriority returns the priority of the request. A request that claims
+// the high priority is treated as a normal one unless its client is one of
+// HighPriorityClients or HighPriorityAuthorizer approves it, and so is a
+// request with an unknown priority.
+func requestPriority(config *ServerConfig, r *http.Request) Priority {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get(priorityHeader))) {
+	case "low":
+		return PriorityLow
+	case "high":
+		config.settingsMu.RLock()
+		clients := config.HighPriorityClients
+		authorizer := config.HighPriorityAuthorizer
+		config.settingsMu.RUnlock()
+		if len(clients) != 0 {
+			if identity := clientIdentity(config, r); identity != "" {
+				for _, pattern := range clients {
+					if ok, _ := path.Match(pattern, identity); ok {
+						return PriorityHigh
+					}
+				}
+			}
+		}
+		if authorizer != nil && authorizer(r) == nil {
+			return PriorityHigh
+		}
+	}
+	return PriorityNormal
+}
+
+type priorityKey struct{}
+
+// withPriority returns a context that carries the priority of the request
+// to the upstream fetches and the git-upload-pack processes it starts.
+func withPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFromContext returns the priority set by withPriority, or
+// PriorityNormal for the background operations.
+func priorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// priorityLimit returns the number of the slots out of limit that an
+// operation of the priority can take. A quarter of the slots is kept for the
+// high priority operations, and the low priority ones can take half of them,
+// so that the higher priorities are not rejected as soon as the lower ones
+// saturate the server. No limit if limit is zero.
+func priorityLimit(limit int, p Priority) int {
+	switch {
+	case limit <= 0:
+		return limit
+	case p == PriorityHigh:
+		return limit
+	case p == PriorityNormal:
+		return limit - limit/4
+	}
+	if limit < 2 {
+		return limit
+	}
+	return limit / 2
+}
+
+// fetchScheduler limits the number of the fetch requests processed at the
+// same time to MaxConcurrentFetches. The waiting requests are started in the
+// order of their priority, and first-come first-served within the same
+// priority.
+type fetchScheduler struct {
+	mu      sync.Mutex
+	running int
+	// limit is the MaxConcurrentFetches seen last. It can be changed by
+	// UpdateSettings.
+	limit   int
+	waiters [numPriorities][]chan struct{}
+}
+
+// acquire waits until the request can be processed, and returns a function
+// to call when it's done. If the server is saturated, a low priority request
+// is not queued but shed with ShedLowPriority.
+func (s *fetchScheduler) acquire(ctx context.Context, config *ServerConfig, p Priority) (func(), error) {
+	config.settingsMu.RLock()
+	limit := config.MaxConcurrentFetches
+	shedLowPriority := config.ShedLowPriority
+	config.settingsMu.RUnlock()
+
+	s.mu.Lock()
+	if s.limit != limit {
+		s.limit = limit
+		s.startWaitersLocked()
+	}
+	if limit <= 0 {
+		s.mu.Unlock()
+		return func() {}, nil
+	}
+	if s.running < limit && !s.hasWaitersLocked() {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	if p == PriorityLow && shedLowPriority {
+		s.mu.Unlock()
+		return nil, errLowPriorityShed
+	}
+	ch := make(chan struct{})
+	s.waiters[p] = append(s.waiters[p], ch)
+	s.recordQueueDepthLocked(p)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	queued := false
+	for i, c := range s.waiters[p] {
+		if c == ch {
+			s.waiters[p] = append(s.waiters[p][:i], s.waiters[p][i+1:]...)
+			s.recordQueueDepthLocked(p)
+			queued = true
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !queued {
+		// The request has been started while it's being canceled.
+		s.release()
+	}
+	return nil, status.Error(codes.Canceled, "canceled while waiting for the other fetches")
+}
+
+func (s *fetchScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.startWaitersLocked()
+}
+
+// startWaitersLocked starts the waiting requests in the order of their
+// priority while the running ones are under the limit.
+func (s *fetchScheduler) startWaitersLocked() {
+	for s.limit <= 0 || s.running < s.limit {
+		p := PriorityHigh
+		for p >= PriorityLow && len(s.waiters[p]) == 0 {
+			p--
+		}
+		if p < PriorityLow {
+			return
+		}
+		ch := s.waiters[p][0]
+		s.waiters[p] = s.waiters[p][1:]
+		s.recordQueueDepthLocked(p)
+		s.running++
+		close(ch)
+	}
+}
+
+func (s *fetchScheduler) hasWaitersLocked() bool {
+	for _, w := range s.waiters {
+		if len(w) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fetchScheduler) recordQueueDepthLocked(p Priority) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(PriorityKey, p.String())}, FetchQueueDepth.M(int64(len(s.waiters[p]))))
+}
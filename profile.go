@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"runtime/pprof"
+	"sync"
+)
+
+var (
+	// armedProfile is the CPU profile request waiting for the next fetch
+	// of the repository. Only one request can be armed at a time.
+	armedProfile   *profileRequest
+	armedProfileMu sync.Mutex
+)
+
+type profileRequest struct {
+	upstreamURL string
+	done        chan profileResult
+}
+
+type profileResult struct {
+	profile []byte
+	// trace is the GIT_TRACE2_PERF output of the git-upload-pack
+	// processes of the fetch.
+	trace []byte
+	err   error
+}
+
+// gitTrace2PerfKey is the context key of the file that the git-upload-pack
+// of a profiled fetch writes GIT_TRACE2_PERF to.
+type gitTrace2PerfKey struct{}
+
+// gitTrace2PerfFromContext returns the GIT_TRACE2_PERF file of the request,
+// or empty if the request is not profiled.
+func gitTrace2PerfFromContext(ctx context.Context) string {
+	s, _ := ctx.Value(gitTrace2PerfKey{}).(string)
+	return s
+}
+
+// fetchProfileLabels returns the pprof labels of the fetch, with which the
+// samples of the fetch can be picked from a CPU profile with -tagfocus.
+func fetchProfileLabels(ctx context.Context, u *url.URL) pprof.LabelSet {
+	return pprof.Labels("goblet_repo", u.String(), "goblet_request", requestInfoFromContext(ctx).requestID)
+}
+
+// startArmedProfile starts a CPU profile if one is armed for the repository,
+// and returns the context that traces the git-upload-pack of the fetch. The
+// returned function stops the profile and delivers it to the requester.
+func startArmedProfile(ctx context.Context, u *url.URL) (context.Context, func()) {
+	armedProfileMu.Lock()
+	p := armedProfile
+	if p == nil || p.upstreamURL != u.String() {
+		armedProfileMu.Unlock()
+		return ctx, func() {}
+	}
+	armedProfile = nil
+	armedProfileMu.Unlock()
+
+	trace, err := ioutil.TempFile("", "goblet-trace2-")
+	if err != nil {
+		p.done <- profileResult{err: err}
+		return ctx, func() {}
+	}
+	trace.Close()
+	buf := new(bytes.Buffer)
+	if err := pprof.StartCPUProfile(buf); err != nil {
+		os.Remove(trace.Name())
+		p.done <- profileResult{err: err}
+		return ctx, func() {}
+	}
+	return context.WithValue(ctx, gitTrace2PerfKey{}, trace.Name()), func() {
+		pprof.StopCPUProfile()
+		bs, err := ioutil.ReadFile(trace.Name())
+		os.Remove(trace.Name())
+		p.done <- profileResult{profile: buf.Bytes(), trace: bs, err: err}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const gobletMetricPrefix = "github.com/google/goblet/"
+
+// PrometheusHandler returns an HTTP handler that serves the data of the
+// registered views in the Prometheus text exposition format. The view names
+// under github.com/google/goblet/ are exported with a "goblet_" prefix,
+// e.g. goblet_inbound_command_count_total.
+func PrometheusHandler(views []*view.View) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		defer bw.Flush()
+		for _, v := range views {
+			rows, err := view.RetrieveData(v.Name)
+			if err != nil {
+				// Not registered.
+				continue
+			}
+			writePrometheusView(bw, v, rows)
+		}
+	})
+}
+
+func writePrometheusView(w *bufio.Writer, v *view.View, rows []*view.Row) {
+	name := prometheusMetricName(v.Name)
+	typ := "gauge"
+	switch v.Aggregation.Type {
+	case view.AggTypeCount, view.AggTypeSum:
+		typ = "counter"
+		if !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+	case view.AggTypeDistribution:
+		typ = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escapePrometheusHelp(v.Description))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+
+	sort.Slice(rows, func(i, j int) bool {
+		return prometheusLabels(rows[i].Tags, "") < prometheusLabels(rows[j].Tags, "")
+	})
+	for _, row := range rows {
+		switch data := row.Data.(type) {
+		case *view.CountData:
+			fmt.Fprintf(w, "%s%s %d\n", name, prometheusLabels(row.Tags, ""), data.Value)
+		case *view.SumData:
+			fmt.Fprintf(w, "%s%s %s\n", name, prometheusLabels(row.Tags, ""), formatPrometheusFloat(data.Value))
+		case *view.LastValueData:
+			fmt.Fprintf(w, "%s%s %s\n", name, prometheusLabels(row.Tags, ""), formatPrometheusFloat(data.Value))
+		case *view.DistributionData:
+			var cumulative int64
+			for i, bound := range v.Aggregation.Buckets {
+				if i < len(data.CountPerBucket) {
+					cumulative += data.CountPerBucket[i]
+				}
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, prometheusLabels(row.Tags, formatPrometheusFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, prometheusLabels(row.Tags, "+Inf"), data.Count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, prometheusLabels(row.Tags, ""), formatPrometheusFloat(data.Sum()))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, prometheusLabels(row.Tags, ""), data.Count)
+		}
+	}
+}
+
+func prometheusMetricName(viewName string) string {
+	if strings.HasPrefix(viewName, gobletMetricPrefix) {
+		viewName = "goblet_" + strings.TrimPrefix(viewName, gobletMetricPrefix)
+	}
+	return sanitizePrometheusName(viewName)
+}
+
+func sanitizePrometheusName(s string) string {
+	bs := []byte(s)
+	for i, b := range bs {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '_' || b == ':' || i > 0 && b >= '0' && b <= '9') {
+			bs[i] = '_'
+		}
+	}
+	return string(bs)
+}
+
+// prometheusLabels formats the tags as Prometheus labels. If le is not
+// empty, it's added as the histogram bucket label.
+func prometheusLabels(tags []tag.Tag, le string) string {
+	labels := []string{}
+	for _, t := range tags {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, sanitizePrometheusName(path.Base(t.Key.Name())), escapePrometheusLabelValue(t.Value)))
+	}
+	sort.Strings(labels)
+	if le != "" {
+		labels = append(labels, fmt.Sprintf("le=%q", le))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func escapePrometheusLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func escapePrometheusHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatPrometheusFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PushPolicy specifies how the pushes (git-receive-pack) are handled.
+type PushPolicy int
+
+const (
+	// PushReject rejects the pushes.
+	PushReject PushPolicy = iota
+
+	// PushWithServerCredentials forwards the pushes to the upstream with
+	// the credentials of the server. The pushes are authorized with
+	// RequestAuthorizer and AccessRules as the fetches are.
+	PushWithServerCredentials
+
+	// PushWithClientCredentials forwards the pushes to the upstream with
+	// the Authorization header of the client. The upstream authorizes
+	// the pushes instead of RequestAuthorizer. AccessRules still apply.
+	PushWithClientCredentials
+)
+
+// receivePackForwardedHeaders are the request headers that are forwarded to
+// the upstream with the pushes.
+var receivePackForwardedHeaders = []string{"Accept", "Content-Encoding", "Content-Type", "Git-Protocol"}
+
+// receivePackReturnedHeaders are the upstream response headers that are
+// returned to the client.
+var receivePackReturnedHeaders = []string{"Cache-Control", "Content-Type", "WWW-Authenticate"}
+
+// isPushRequest returns true if the request is a part of a push.
+func isPushRequest(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, "/git-receive-pack") {
+		return true
+	}
+	return strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") == "git-receive-pack"
+}
+
+// receivePackHandler forwards a push request to the upstream. After a push,
+// the cached repository is updated before the response completes so that the
+// pushed commits can be fetched right after the push.
+func (s *httpProxyServer) receivePackHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, tenant string) {
+	// The repository is opened only after the upstream accepts the push
+	// so that the unauthorized clients cannot create cache entries with
+	// PushWithClientCredentials.
+	upstreamURL, err := canonicalUpstreamURL(s.config, r.URL)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+
+	u := *upstreamURL
+	if strings.HasSuffix(r.URL.Path, "/info/refs") {
+		u.Path += "/info/refs"
+		u.RawQuery = "service=git-receive-pack"
+	} else {
+		u.Path += "/git-receive-pack"
+	}
+	req, err := http.NewRequest(r.Method, u.String(), r.Body)
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.Internal, "cannot construct a request object: %v", err))
+		return
+	}
+	req = req.WithContext(r.Context())
+	for _, h := range receivePackForwardedHeaders {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	if s.config.PushPolicy == PushWithClientCredentials {
+		if v := r.Header.Get("Authorization"); v != "" {
+			req.Header.Set("Authorization", v)
+		}
+	} else {
+		t, err := upstreamToken(s.config, upstreamURL)
+		if err != nil {
+			reporter.reportError(status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err))
+			return
+		}
+		t.SetAuthHeader(req)
+	}
+
+	resp, err := upstreamHTTPClient(s.config).Do(req)
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.Unavailable, "cannot send a request to the upstream: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	for _, h := range receivePackReturnedHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return
+	}
+	if r.Method == "POST" && resp.StatusCode == http.StatusOK {
+		repo, err := openCanonicalManagedRepository(s.config, tenant, upstreamURL)
+		if err != nil {
+			log.Printf("Cannot open %s after a push: %v", upstreamURL, err)
+			return
+		}
+		if err := repo.fetchUpstream(); err != nil {
+			log.Printf("Cannot update %s after a push: %v", repo.upstreamURL, err)
+		}
+	}
+}
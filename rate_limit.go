@@ -0,0 +1,112 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+)
+
+// clientRateLimiter limits the request rate of each client with a token
+// bucket of ClientRateLimit and ClientRateBurst. The clients are identified
+// by their identities, or their IP addresses if they are anonymous.
+type clientRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func clientRateLimitKey(config *ServerConfig, r *http.Request) string {
+	if identity := clientIdentity(config, r); identity != "" {
+		return "identity:" + identity
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// allow takes a token from the bucket of the client. If the bucket is empty,
+// it returns false and the time until the next token.
+func (l *clientRateLimiter) allow(config *ServerConfig, r *http.Request) (bool, time.Duration) {
+	config.settingsMu.RLock()
+	rate := config.ClientRateLimit
+	burst := float64(config.ClientRateBurst)
+	config.settingsMu.RUnlock()
+	// The requests forwarded by another replica are limited by it.
+	if rate <= 0 || clusterHopFromContext(r.Context()) != nil {
+		return true, 0
+	}
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(rate))
+	}
+	key := clientRateLimitKey(config, r)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	if now.Sub(l.lastPrune) > time.Minute {
+		// A full bucket is the same as a new one.
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// writeThrottledResponse responds with 429 Too Many Requests. The clients
+// are asked to retry after the time until the next token.
+func writeThrottledResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	stats.RecordWithTags(
+		r.Context(),
+		[]tag.Mutator{tag.Insert(CommandCanonicalStatusKey, codes.ResourceExhausted.String())},
+		InboundCommandCount.M(1),
+		ThrottledRequestCount.M(1),
+	)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests from the client; retry later", http.StatusTooManyRequests)
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+const (
+	// readinessCanaryInterval is how long the result of the ls-refs of
+	// ReadinessCanaryURL is reused, so that the frequent probes don't
+	// send requests to the upstream each time.
+	readinessCanaryInterval = 30 * time.Second
+
+	// readinessCanaryTimeout is the timeout of the ls-refs of
+	// ReadinessCanaryURL.
+	readinessCanaryTimeout = 10 * time.Second
+)
+
+// ReadinessHandler returns an http.Handler of a readiness probe for the load
+// balancers. It responds with 503 Service Unavailable if the server is
+// shutting down, if a cache root is not writable, or if the ls-refs of
+// ReadinessCanaryURL fails. The failures are listed in the response body.
+// Unlike a static health check, this takes the instances with a broken disk
+// or a broken upstream connection out of the rotation.
+func ReadinessHandler(config *ServerConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		problems := checkReadiness(config)
+		if len(problems) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready:\n%s\n", strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+	})
+}
+
+func checkReadiness(config *ServerConfig) []string {
+	if config.upstreamFetches.isShuttingDown() {
+		return []string{"the server is shutting down"}
+	}
+	problems := []string{}
+	for _, root := range cacheRoots(config) {
+		if err := checkWritable(root); err != nil {
+			problems = append(problems, fmt.Sprintf("the cache root %s is not writable: %v", root, err))
+		}
+	}
+	if err := checkReadinessCanary(config); err != nil {
+		problems = append(problems, fmt.Sprintf("cannot run ls-refs against %s: %v", config.ReadinessCanaryURL, err))
+	}
+	return problems
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".goblet-readiness-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok\n")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkReadinessCanary runs ls-refs of HEAD against ReadinessCanaryURL, and
+// returns its error. The result is reused for readinessCanaryInterval. It's
+// skipped in the Offline mode.
+func checkReadinessCanary(config *ServerConfig) error {
+	if config.ReadinessCanaryURL == nil || config.Offline {
+		return nil
+	}
+	config.readinessMu.Lock()
+	defer config.readinessMu.Unlock()
+	if time.Since(config.readinessCheckTime) < readinessCanaryInterval {
+		return config.readinessCanaryErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readinessCanaryTimeout)
+	defer cancel()
+	// The canary is not cached, and its repository is not opened.
+	r := &managedRepository{upstreamURL: config.ReadinessCanaryURL, config: config}
+	_, err := r.lsRefsUpstream(ctx, []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{EndCapability: true},
+		{Argument: []byte("ref-prefix HEAD\n")},
+		{EndRequest: true},
+	})
+	config.readinessCheckTime = time.Now()
+	config.readinessCanaryErr = err
+	return err
+}
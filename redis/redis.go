@@ -0,0 +1,194 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/goblet"
+)
+
+const (
+	// defaultTimeout is the timeout of a command if the context has no
+	// deadline.
+	defaultTimeout = 5 * time.Second
+
+	lastFetchKeyPrefix = "goblet:last-fetch:"
+	fetchLockKeyPrefix = "goblet:fetch-lock:"
+
+	// releaseScript deletes the lock only if it's still held with the
+	// token, so that a lock that expired and was acquired by another
+	// replica is not released.
+	releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+)
+
+// NewFetchStateStore returns a FetchStateStore in the Redis server at addr,
+// such as "redis.example.com:6379". The commands are sent over a single
+// connection, which is reconnected after an error.
+func NewFetchStateStore(addr string) goblet.FetchStateStore {
+	return &fetchStateStore{addr: addr}
+}
+
+type fetchStateStore struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *fetchStateStore) LastFetchTime(ctx context.Context, repo string) (time.Time, error) {
+	v, err := s.do(ctx, "GET", lastFetchKeyPrefix+repo)
+	if err != nil || v == nil {
+		return time.Time{}, err
+	}
+	ns, err := strconv.ParseInt(v.(string), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid last fetch time %q: %v", v, err)
+	}
+	return time.Unix(0, ns), nil
+}
+
+func (s *fetchStateStore) SetLastFetchTime(ctx context.Context, repo string, t time.Time) error {
+	_, err := s.do(ctx, "SET", lastFetchKeyPrefix+repo, strconv.FormatInt(t.UnixNano(), 10))
+	return err
+}
+
+func (s *fetchStateStore) TryLockFetch(ctx context.Context, repo string, ttl time.Duration) (func(), bool, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(bs)
+	key := fetchLockKeyPrefix + repo
+	v, err := s.do(ctx, "SET", key, token, "NX", "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil || v == nil {
+		return nil, false, err
+	}
+	release := func() {
+		// The lock expires after ttl if this fails.
+		s.do(context.Background(), "EVAL", releaseScript, "1", key, token)
+	}
+	return release, true, nil
+}
+
+// do sends a command and returns its reply. The reply is a string, an
+// int64, nil, or a []interface{} of them.
+func (s *fetchStateStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	if s.conn == nil {
+		d := net.Dialer{Deadline: deadline}
+		conn, err := d.DialContext(ctx, "tcp", s.addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to Redis: %v", err)
+		}
+		s.conn = conn
+		s.r = bufio.NewReader(conn)
+	}
+	s.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	v, err := s.roundTrip(b.String())
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection is in an unknown state.
+			s.conn.Close()
+			s.conn = nil
+		}
+	}
+	return v, err
+}
+
+func (s *fetchStateStore) roundTrip(command string) (interface{}, error) {
+	if _, err := io.WriteString(s.conn, command); err != nil {
+		return nil, fmt.Errorf("cannot send a Redis command: %v", err)
+	}
+	return readReply(s.r)
+}
+
+// redisError is an error reply of Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis error: " + string(e)
+}
+
+// readReply reads a reply in the Redis serialization protocol.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("cannot read a Redis reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis bulk string length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		bs := make([]byte, n+2)
+		if _, err := io.ReadFull(r, bs); err != nil {
+			return nil, fmt.Errorf("cannot read a Redis reply: %v", err)
+		}
+		return string(bs[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		vs := make([]interface{}, n)
+		for i := range vs {
+			if vs[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return vs, nil
+	}
+	return nil, fmt.Errorf("unknown Redis reply %q", line)
+}
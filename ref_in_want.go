@@ -0,0 +1,174 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// resolveWantRefs returns the hashes that the refs point to. As ls-refs, the
+// refs are resolved in the cached repository if it's fresh, and in the
+// upstream otherwise. If the upstream fails, the cached refs are used when
+// canServeStale allows.
+//
+// The local upload-pack supports want-ref, but it reads the refs while
+// fetch-upstream may be updating them, and it cannot tell if the cached refs
+// are behind the upstream. The want-ref arguments are replaced with the wants
+// of the resolved hashes instead.
+func (r *managedRepository) resolveWantRefs(ctx context.Context, refs []string) (map[string]plumbing.Hash, error) {
+	ret := map[string]plumbing.Hash{}
+	if !r.isFresh() {
+		command := []*gitprotocolio.ProtocolV2RequestChunk{
+			{Command: "ls-refs"},
+			{EndCapability: true},
+		}
+		for _, refName := range refs {
+			command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("ref-prefix " + refName + "\n")})
+		}
+		command = append(command, &gitprotocolio.ProtocolV2RequestChunk{EndRequest: true})
+		resp, err := r.lsRefsUpstream(ctx, command)
+		if err == nil {
+			upstreamRefs, err := parseLsRefsResponse(filterHiddenRefs(r.config, resp))
+			if err != nil {
+				return nil, err
+			}
+			for _, refName := range refs {
+				h, ok := upstreamRefs[refName]
+				if !ok {
+					return nil, status.Errorf(codes.InvalidArgument, "unknown ref %s", refName)
+				}
+				ret[refName] = h
+			}
+			return ret, nil
+		}
+		if !r.canServeStale(ctx, err) {
+			return nil, err
+		}
+		// Resolve the refs with the cached ones as the upstream is
+		// unavailable.
+		recordServedStale(ctx)
+	}
+
+	err := r.withSnapshot(func(s *repositorySnapshot) error {
+		for _, refName := range refs {
+			h, ok := s.refs[refName]
+			if !ok {
+				return status.Errorf(codes.InvalidArgument, "unknown ref %s", refName)
+			}
+			ret[refName] = h
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// replaceWantRefs replaces the want-ref arguments of the fetch command with
+// the wants of the resolved hashes.
+func replaceWantRefs(command []*gitprotocolio.ProtocolV2RequestChunk, resolved map[string]plumbing.Hash) []*gitprotocolio.ProtocolV2RequestChunk {
+	ret := make([]*gitprotocolio.ProtocolV2RequestChunk, 0, len(command))
+	for _, ch := range command {
+		if ch.Argument != nil && strings.HasPrefix(string(ch.Argument), "want-ref ") {
+			refName := strings.TrimSpace(strings.TrimPrefix(string(ch.Argument), "want-ref "))
+			ret = append(ret, &gitprotocolio.ProtocolV2RequestChunk{
+				Argument: []byte("want " + resolved[refName].String() + "\n"),
+			})
+			continue
+		}
+		ret = append(ret, ch)
+	}
+	return ret
+}
+
+// wantedRefsSection returns the wanted-refs section of the resolved refs in
+// the order of refs.
+func wantedRefsSection(refs []string, resolved map[string]plumbing.Hash) []byte {
+	var b bytes.Buffer
+	b.Write(gitprotocolio.BytesPacket("wanted-refs\n").EncodeToPktLine())
+	seen := map[string]bool{}
+	for _, refName := range refs {
+		if seen[refName] {
+			continue
+		}
+		seen[refName] = true
+		b.Write(gitprotocolio.BytesPacket(resolved[refName].String() + " " + refName + "\n").EncodeToPktLine())
+	}
+	b.Write(gitprotocolio.DelimPacket{}.EncodeToPktLine())
+	return b.Bytes()
+}
+
+// sectionInserter inserts a section, such as wanted-refs, right before the
+// packfile section of the upload-pack output. The output without a packfile
+// section, such as the acknowledgments in the middle of a negotiation, is
+// passed through.
+type sectionInserter struct {
+	w       io.Writer
+	section []byte
+	buf     bytes.Buffer
+	done    bool
+}
+
+func (s *sectionInserter) Write(p []byte) (int, error) {
+	if s.done {
+		return s.w.Write(p)
+	}
+	s.buf.Write(p)
+	for !s.done {
+		bs := s.buf.Bytes()
+		if len(bs) < 4 {
+			break
+		}
+		var l [2]byte
+		if _, err := hex.Decode(l[:], bs[:4]); err != nil {
+			// Not a pkt-line stream. Pass it through.
+			s.done = true
+			break
+		}
+		n := int(l[0])<<8 | int(l[1])
+		if n < 4 {
+			// Special packets.
+			n = 4
+		}
+		if n > len(bs) {
+			break
+		}
+		if string(bs[4:n]) == "packfile\n" {
+			if _, err := s.w.Write(s.section); err != nil {
+				return 0, err
+			}
+			s.done = true
+			break
+		}
+		if _, err := s.w.Write(bs[:n]); err != nil {
+			return 0, err
+		}
+		s.buf.Next(n)
+	}
+	if s.done && s.buf.Len() != 0 {
+		if _, err := s.w.Write(s.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buf.Reset()
+	}
+	return len(p), nil
+}
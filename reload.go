@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// UpdateSettings replaces the settings of the config that can be changed
+// while the server is running with the ones of newConfig. This is safe to
+// call while the server is running, and it doesn't interrupt the in-flight
+// requests. The other settings of newConfig, such as
+// LocalDiskCacheRoot, are ignored. The settings are:
+//
+//   - RequestAuthorizer, TokenSource, and UpstreamCredentialProvider
+//   - AllowedClientCapabilities and HiddenRefs
+//   - MaxConcurrentFetches, HighPriorityClients, HighPriorityAuthorizer,
+//     ShedLowPriority, MaxNegotiationRounds, and MaxRequestBytes
+//   - FetchFreshnessWindow, HeadOnlyCacheTTL, NegativeCacheTTL,
+//     RepoOverrides, and PackServeTimeout
+//   - AccessRules, ClientIdentifier, ClientRateLimit, and ClientRateBurst
+//   - WarmRepositories and WebhookSecret
+//
+// Lowering MaxConcurrentFetches doesn't stop the running fetches, and raising
+// it starts the waiting ones as the running ones finish. Use
+// UpdateBlockedRepos and UpdateAllowedRepos to change BlockedRepos and
+// AllowedRepos.
+func UpdateSettings(config, newConfig *ServerConfig) error {
+	if newConfig.RequestAuthorizer == nil {
+		return fmt.Errorf("RequestAuthorizer must be set")
+	}
+	if newConfig.TokenSource == nil && newConfig.UpstreamCredentialProvider == nil {
+		return fmt.Errorf("TokenSource or UpstreamCredentialProvider must be set")
+	}
+	for _, p := range newConfig.HighPriorityClients {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid high priority client pattern %q: %v", p, err)
+		}
+	}
+	for _, rule := range newConfig.AccessRules {
+		for _, p := range append(append([]string{}, rule.Identities...), rule.Repos...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid access rule pattern %q: %v", p, err)
+			}
+		}
+	}
+	if err := validateRepoOverrides(newConfig.RepoOverrides); err != nil {
+		return err
+	}
+	if err := validateWarmRepositories(newConfig.WarmRepositories); err != nil {
+		return err
+	}
+
+	config.settingsMu.Lock()
+	defer config.settingsMu.Unlock()
+	config.RequestAuthorizer = newConfig.RequestAuthorizer
+	config.TokenSource = newConfig.TokenSource
+	config.UpstreamCredentialProvider = newConfig.UpstreamCredentialProvider
+	config.AllowedClientCapabilities = newConfig.AllowedClientCapabilities
+	config.HiddenRefs = newConfig.HiddenRefs
+	config.MaxConcurrentFetches = newConfig.MaxConcurrentFetches
+	config.HighPriorityClients = newConfig.HighPriorityClients
+	config.HighPriorityAuthorizer = newConfig.HighPriorityAuthorizer
+	config.ShedLowPriority = newConfig.ShedLowPriority
+	config.MaxNegotiationRounds = newConfig.MaxNegotiationRounds
+	config.MaxRequestBytes = newConfig.MaxRequestBytes
+	config.FetchFreshnessWindow = newConfig.FetchFreshnessWindow
+	config.HeadOnlyCacheTTL = newConfig.HeadOnlyCacheTTL
+	config.NegativeCacheTTL = newConfig.NegativeCacheTTL
+	config.RepoOverrides = newConfig.RepoOverrides
+	config.PackServeTimeout = newConfig.PackServeTimeout
+	config.AccessRules = newConfig.AccessRules
+	config.ClientIdentifier = newConfig.ClientIdentifier
+	config.ClientRateLimit = newConfig.ClientRateLimit
+	config.ClientRateBurst = newConfig.ClientRateBurst
+	config.WarmRepositories = newConfig.WarmRepositories
+	config.WebhookSecret = newConfig.WebhookSecret
+	return nil
+}
+
+func authorizeRequest(config *ServerConfig, r *http.Request) error {
+	if streamSessionFromContext(r.Context()) != nil {
+		// Authorized by SSHServerConfig.PublicKeyAuthorizer, or
+		// anonymous for ServeGitDaemon.
+		return nil
+	}
+	if clusterHopFromContext(r.Context()) != nil {
+		// Authorized by the replica that forwarded it.
+		return nil
+	}
+	config.settingsMu.RLock()
+	authorizer := config.RequestAuthorizer
+	config.settingsMu.RUnlock()
+	return authorizer(r)
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+)
+
+// matchRepoPattern returns true if the canonical URL matches with the glob
+// pattern. The pattern is matched against the URL with and without the
+// scheme.
+func matchRepoPattern(pattern string, u *url.URL) bool {
+	if ok, _ := path.Match(pattern, u.String()); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, u.Host+u.Path)
+	return ok
+}
+
+// patternSpecificity returns the number of non-wildcard characters in the
+// pattern.
+func patternSpecificity(pattern string) int {
+	n := 0
+	inClass := false
+	for _, c := range pattern {
+		switch {
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c != '*' && c != '?' && c != '\\':
+			n++
+		}
+	}
+	return n
+}
+
+// SetRepoOverrides replaces the RepoOverrides of the config. This is safe to
+// call while the server is running. The overrides are replaced again by
+// UpdateSettings on the next reload.
+func SetRepoOverrides(config *ServerConfig, overrides []*RepoOverride) error {
+	if err := validateRepoOverrides(overrides); err != nil {
+		return err
+	}
+	config.settingsMu.Lock()
+	defer config.settingsMu.Unlock()
+	config.RepoOverrides = overrides
+	return nil
+}
+
+func validateRepoOverrides(overrides []*RepoOverride) error {
+	for _, o := range overrides {
+		if _, err := path.Match(o.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository override pattern %q: %v", o.Pattern, err)
+		}
+		if o.FetchFreshnessWindow < 0 {
+			return fmt.Errorf("negative fetch freshness window for %q", o.Pattern)
+		}
+	}
+	return nil
+}
+
+// findRepoOverrides returns the matching RepoOverrides, the most specific one
+// first.
+func findRepoOverrides(config *ServerConfig, u *url.URL) []*RepoOverride {
+	config.settingsMu.RLock()
+	overrides := config.RepoOverrides
+	config.settingsMu.RUnlock()
+	ret := []*RepoOverride{}
+	for _, o := range overrides {
+		if !matchRepoPattern(o.Pattern, u) {
+			continue
+		}
+		i := len(ret)
+		for i > 0 && patternSpecificity(ret[i-1].Pattern) < patternSpecificity(o.Pattern) {
+			i--
+		}
+		ret = append(ret[:i], append([]*RepoOverride{o}, ret[i:]...)...)
+	}
+	return ret
+}
+
+// fetchFreshnessWindow returns the effective FetchFreshnessWindow of the
+// repository.
+func fetchFreshnessWindow(config *ServerConfig, u *url.URL) time.Duration {
+	for _, o := range findRepoOverrides(config, u) {
+		if o.FetchFreshnessWindow != 0 {
+			return o.FetchFreshnessWindow
+		}
+	}
+	config.settingsMu.RLock()
+	defer config.settingsMu.RUnlock()
+	return config.FetchFreshnessWindow
+}
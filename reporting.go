@@ -21,7 +21,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"google.golang.org/grpc/codes"
@@ -45,6 +44,7 @@ type httpErrorReporter struct {
 }
 
 func (h *httpErrorReporter) reportError(err error) {
+	requestInfoFromContext(h.req.Context()).err = err
 	code := codes.Internal
 	message := ""
 	if st, ok := status.FromError(err); ok {
@@ -53,21 +53,25 @@ func (h *httpErrorReporter) reportError(err error) {
 	}
 	stats.RecordWithTags(
 		h.req.Context(),
-		[]tag.Mutator{tag.Insert(CommandCanonicalStatusKey, code.String())},
+		statusTagMutators(code, err),
 		InboundCommandCount.M(1),
 	)
 
-	if code == codes.Unauthenticated {
+	category := ErrorCategoryOf(err)
+	if code == codes.Unauthenticated && category == "" {
 		h.w.Header().Add("WWW-Authenticate", "Bearer")
 		h.w.Header().Add("WWW-Authenticate", "Basic realm=goblet")
 	}
-	httpStatus := runtime.HTTPStatusFromCode(code)
+	if category != "" {
+		h.w.Header().Set(errorCategoryHeader, string(category))
+	}
+	httpStatus := errorHTTPStatus(err)
 	if message == "" {
 		message = http.StatusText(httpStatus)
 	}
 	http.Error(h.w, message, httpStatus)
 
-	if !serverErrorCodes[code] {
+	if !isServerError(err) {
 		return
 	}
 
@@ -75,7 +79,7 @@ func (h *httpErrorReporter) reportError(err error) {
 		h.config.ErrorReporter(h.req, err)
 		return
 	}
-	log.Printf("Error while processing a request: %v", err)
+	log.Printf("Error while processing request %s: %v", RequestID(h.req), err)
 }
 
 type gitProtocolHTTPErrorReporter struct {
@@ -85,22 +89,39 @@ type gitProtocolHTTPErrorReporter struct {
 }
 
 func (h *gitProtocolHTTPErrorReporter) reportError(ctx context.Context, startTime time.Time, err error) {
+	if err != nil && h.req.Context().Err() == context.DeadlineExceeded {
+		// The command failed because RequestTimeout or CloneTimeout
+		// passed.
+		err = errRequestDeadlineExceeded
+	}
+	if err != nil {
+		requestInfoFromContext(h.req.Context()).err = err
+	}
+	if isSaturated(err) && !responseStarted(h.w) {
+		writeCategorizedShedResponse(h.w, h.req, ErrorCategoryOf(err), err.Error()+"; retry later")
+		return
+	}
 	code := codes.Internal
 	if st, ok := status.FromError(err); ok {
 		code = st.Code()
 	}
 	stats.RecordWithTags(
 		ctx,
-		[]tag.Mutator{tag.Insert(CommandCanonicalStatusKey, code.String())},
+		statusTagMutators(code, err),
 		InboundCommandCount.M(1),
 		InboundCommandProcessingTime.M(int64(time.Now().Sub(startTime)/time.Millisecond)),
 	)
 
 	if err != nil {
+		if category := ErrorCategoryOf(err); category != "" && !responseStarted(h.w) {
+			// The error is sent in the Git protocol with 200 OK.
+			// Tell the category in the header as well.
+			h.w.Header().Set(errorCategoryHeader, string(category))
+		}
 		writeError(h.w, err)
 	}
 
-	if !serverErrorCodes[code] {
+	if !isServerError(err) {
 		return
 	}
 
@@ -108,10 +129,20 @@ func (h *gitProtocolHTTPErrorReporter) reportError(ctx context.Context, startTim
 		h.config.ErrorReporter(h.req.WithContext(ctx), err)
 		return
 	}
-	log.Printf("Error while processing a request: %v", err)
+	log.Printf("Error while processing request %s: %v", RequestID(h.req), err)
 }
 
-func logHTTPRequest(config *ServerConfig, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+// statusTagMutators returns the tags of the result of a command, the status
+// code and the ErrorCategory of the error if it has one.
+func statusTagMutators(code codes.Code, err error) []tag.Mutator {
+	mutators := []tag.Mutator{tag.Insert(CommandCanonicalStatusKey, code.String())}
+	if category := ErrorCategoryOf(err); category != "" {
+		mutators = append(mutators, tag.Insert(ErrorCategoryKey, string(category)))
+	}
+	return mutators
+}
+
+func logHTTPRequest(config *ServerConfig, accessLogger func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration), w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
 	startTime := time.Now()
 	monR := &monitoringReader{r: r.Body}
 	r.Body = monR
@@ -124,12 +155,15 @@ func logHTTPRequest(config *ServerConfig, w http.ResponseWriter, r *http.Request
 	}
 
 	return monW, func() {
-		if config.RequestLogger == nil {
-			return
-		}
 		endTime := time.Now()
 
-		config.RequestLogger(r, monW.status, monR.bytesRead, monW.bytesWritten, endTime.Sub(startTime))
+		if config.RequestLogger != nil {
+			config.RequestLogger(r, monW.status, monR.bytesRead, monW.bytesWritten, endTime.Sub(startTime))
+		}
+		if accessLogger != nil {
+			accessLogger(r, monW.status, monR.bytesRead, monW.bytesWritten, endTime.Sub(startTime))
+		}
+		runAfterRequestHooks(r, monW.status, monR.bytesRead, monW.bytesWritten, endTime.Sub(startTime))
 	}
 }
 
@@ -145,7 +179,7 @@ func (r *monitoringReader) Read(p []byte) (int, error) {
 }
 
 func (r *monitoringReader) Close() error {
-	return r.Close()
+	return r.r.Close()
 }
 
 type monitoringWriter struct {
@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// repositoryLockSuffix is the suffix of the lock files of the cached
+	// repositories used with CrossProcessLocking. The lock file is next to
+	// the repository so that it can be locked before the repository is
+	// created. It's not removed with the repository, since a process
+	// waiting for it would lock the removed file.
+	repositoryLockSuffix = ".goblet-lock"
+)
+
+// lockRepositoryFile locks the lock file of the repository at localDiskPath
+// with flock(2), waiting for the other processes to release it. The lock is
+// released by the kernel, or the NFS server once its lease expires, if the
+// process dies. The holder is written to the file while it's held, so that a
+// holder that died can be told apart from one that released it, and the git
+// lock files that the died holder might have left are removed.
+func lockRepositoryFile(op RunningOperation, localDiskPath string) (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(localDiskPath), 0750); err != nil {
+		return nil, fmt.Errorf("cannot create a cache dir: %v", err)
+	}
+	f, err := os.OpenFile(localDiskPath+repositoryLockSuffix, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the lock file: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot lock %s: %v", f.Name(), err)
+	}
+	if holder, err := ioutil.ReadAll(f); err == nil && len(holder) != 0 {
+		op.Printf("the previous lock holder %s did not release the lock, removing the stale git lock files", strings.TrimSpace(string(holder)))
+		if err := removeStaleGitLocks(localDiskPath); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cannot remove the stale git lock files: %v", err)
+		}
+		stats.Record(context.Background(), StaleLockRecoveryCount.M(1))
+	}
+	hostname, _ := os.Hostname()
+	if err := writeLockHolder(f, fmt.Sprintf("%s:%d\n", hostname, os.Getpid())); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot write the lock holder: %v", err)
+	}
+	return func() {
+		writeLockHolder(f, "")
+		f.Close()
+	}, nil
+}
+
+func writeLockHolder(f *os.File, holder string) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(holder), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// removeStaleGitLocks removes the *.lock files that git creates while it
+// updates a repository, such as packed-refs.lock and the ones of the refs,
+// and the temporary packs of the fetches, tmp_pack_* and tmp_idx_*. git
+// refuses to update the files while the lock files exist. The loose objects
+// are not searched.
+func removeStaleGitLocks(localDiskPath string) error {
+	err := filepath.Walk(localDiskPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filepath.Base(filepath.Dir(p)) == "objects" && len(info.Name()) == 2 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(p, ".lock") || strings.HasPrefix(info.Name(), "tmp_pack_") || strings.HasPrefix(info.Name(), "tmp_idx_") {
+			return os.Remove(p)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// lock takes r.mu, and the lock file of the repository with
+// CrossProcessLocking. Call unlock to release them.
+func (r *managedRepository) lock(op RunningOperation) (unlock func(), err error) {
+	setOperationState(op, "waiting for the repository lock")
+	r.mu.Lock()
+	if !r.config.CrossProcessLocking {
+		setOperationState(op, "holding the repository lock")
+		return r.mu.Unlock, nil
+	}
+	setOperationState(op, "waiting for the repository lock file")
+	unlockFile, err := lockRepositoryFile(op, r.localDiskPath)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+	setOperationState(op, "holding the repository lock")
+	return func() {
+		unlockFile()
+		r.mu.Unlock()
+	}, nil
+}
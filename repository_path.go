@@ -0,0 +1,57 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gitHTTPEndpoints are the suffixes of the Git HTTP request paths after the
+// repository path.
+var gitHTTPEndpoints = []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"}
+
+// TrimGitHTTPEndpoint returns the path of a Git HTTP request without the
+// endpoint, such as "/info/refs".
+func TrimGitHTTPEndpoint(p string) string {
+	for _, suffix := range gitHTTPEndpoints {
+		if strings.HasSuffix(p, suffix) {
+			return strings.TrimSuffix(p, suffix)
+		}
+	}
+	return p
+}
+
+// SplitRepositoryPath splits the path of a repository URL, without the Git
+// HTTP endpoint, the slashes around it, and ".git", into its elements. An
+// empty path has no elements. It returns an InvalidArgument error if an
+// element is empty, ".", or "..", as such a path can resolve outside the
+// cache directory of the host, and bypass BlockedRepos and AccessRules. Use
+// this in a URLCanonializer.
+func SplitRepositoryPath(p string) ([]string, error) {
+	p = strings.TrimSuffix(strings.Trim(TrimGitHTTPEndpoint(p), "/"), ".git")
+	if p == "" {
+		return []string{}, nil
+	}
+	ss := strings.Split(p, "/")
+	for _, s := range ss {
+		if s == "" || s == "." || s == ".." {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid repository path: %q", p)
+		}
+	}
+	return ss, nil
+}
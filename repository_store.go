@@ -0,0 +1,306 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// RepositoryStore stores the cached repositories. The local disk is the
+// default, and the other backends, such as a shared filesystem, an object
+// storage, or an in-memory one for the tests, can be implemented outside this
+// package and set to RepositoryStore of ServerConfig. The URLs passed to the
+// store are canonicalized by URLCanonializer, and tenant is the one of the
+// request, or empty.
+type RepositoryStore interface {
+	// Open returns the repository that caches u. The repository is
+	// created if it's not stored yet, and it's fetched from the upstream
+	// by StoredRepository.Fetch.
+	Open(tenant string, u *url.URL) (StoredRepository, error)
+
+	// Usage returns the usage of the stored repositories, including the
+	// ones not opened since the server started.
+	Usage() ([]*RepositoryUsage, error)
+
+	// Evict removes the repository that caches u. It's not an error if
+	// the repository is not stored.
+	Evict(tenant string, u *url.URL) error
+}
+
+// StoredRepository is a repository opened by RepositoryStore.Open. The errors
+// are sent to the clients with their gRPC status codes.
+type StoredRepository interface {
+	UpstreamURL() *url.URL
+
+	// LastUpdateTime returns the time of the last Fetch, or zero if the
+	// repository is not fetched since the server started.
+	LastUpdateTime() time.Time
+
+	// Fetch fetches the repository from the upstream.
+	Fetch(ctx context.Context) error
+
+	// ServeUploadPack serves a Git protocol v2 command, such as ls-refs and
+	// fetch, from the stored repository, as git-upload-pack does, and
+	// writes the response to w.
+	ServeUploadPack(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error
+}
+
+// RepositoryUsage is the usage of a stored repository.
+type RepositoryUsage struct {
+	Tenant         string
+	UpstreamURL    *url.URL
+	Bytes          int64
+	LastUpdateTime time.Time
+}
+
+// NewLocalDiskStore returns the RepositoryStore that caches the repositories
+// under LocalDiskCacheRoot and CacheShardRoots of the config. This is the
+// store used if RepositoryStore is nil.
+func NewLocalDiskStore(config *ServerConfig) RepositoryStore {
+	return &localDiskStore{config}
+}
+
+type localDiskStore struct {
+	config *ServerConfig
+}
+
+func (s *localDiskStore) Open(tenant string, u *url.URL) (StoredRepository, error) {
+	return openCanonicalManagedRepository(s.config, tenant, u)
+}
+
+func (s *localDiskStore) Usage() ([]*RepositoryUsage, error) {
+	cached, err := listCachedRepositories(s.config)
+	if err != nil {
+		return nil, err
+	}
+	usage := make([]*RepositoryUsage, 0, len(cached))
+	for _, c := range cached {
+		lastUpdate := lastFetchTime(c.localDiskPath)
+		if v, ok := managedRepos.Load(c.localDiskPath); ok {
+			if t := v.(*managedRepository).LastUpdateTime(); !t.IsZero() {
+				lastUpdate = t
+			}
+		}
+		usage = append(usage, &RepositoryUsage{
+			Tenant:         cachedRepositoryTenant(s.config, c),
+			UpstreamURL:    c.upstreamURL,
+			Bytes:          diskUsage(c.localDiskPath),
+			LastUpdateTime: lastUpdate,
+		})
+	}
+	return usage, nil
+}
+
+// Evict removes the repository from all cache roots, including the ones it
+// doesn't belong to until RebalanceCacheShards moves it.
+func (s *localDiskStore) Evict(tenant string, u *url.URL) error {
+	rel := filepath.Join(tenant, u.Host, u.Path)
+	for _, root := range cacheRoots(s.config) {
+		p := filepath.Join(root, rel)
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if err := evictCachedRepository(s.config, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictListedRepository removes a repository found in the cache roots with
+// RepositoryStore.Evict.
+func evictListedRepository(config *ServerConfig, c *cachedRepository) error {
+	return repositoryStore(config).Evict(cachedRepositoryTenant(config, c), c.upstreamURL)
+}
+
+// Fetch fetches the repository from the upstream. The fetch is stopped when
+// ctx is done.
+func (r *managedRepository) Fetch(ctx context.Context) error {
+	return r.fetchUpstreamContext(ctx)
+}
+
+// ServeUploadPack serves the command from the local disk. This doesn't query
+// the upstream.
+func (r *managedRepository) ServeUploadPack(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	return serveFetchLocalTraced(ctx, r, command, w)
+}
+
+// repositoryStore returns the RepositoryStore of the config.
+func repositoryStore(config *ServerConfig) RepositoryStore {
+	if config.RepositoryStore != nil {
+		return config.RepositoryStore
+	}
+	return NewLocalDiskStore(config)
+}
+
+// isLocalDiskStore returns true if the repositories are cached on the local
+// disk.
+func isLocalDiskStore(config *ServerConfig) bool {
+	_, ok := repositoryStore(config).(*localDiskStore)
+	return ok
+}
+
+// openStoredRepository opens the repository of the request URL from the
+// RepositoryStore. The repositories on the local disk are returned as
+// *managedRepository.
+func openStoredRepository(config *ServerConfig, tenant string, u *url.URL) (StoredRepository, error) {
+	u, err := canonicalUpstreamURL(config, u)
+	if err != nil {
+		return nil, err
+	}
+	return repositoryStore(config).Open(tenant, u)
+}
+
+// isStoredRepositoryFresh returns true if the repository is fetched from the
+// upstream within the effective FetchFreshnessWindow. See
+// managedRepository.isFresh.
+func isStoredRepositoryFresh(config *ServerConfig, repo StoredRepository) bool {
+	if m, ok := repo.(*managedRepository); ok {
+		return m.isFresh()
+	}
+	if config.Offline {
+		return true
+	}
+	window := fetchFreshnessWindow(config, repo.UpstreamURL())
+	if window <= 0 {
+		return false
+	}
+	lastUpdate := repo.LastUpdateTime()
+	return !lastUpdate.IsZero() && time.Since(lastUpdate) < window
+}
+
+// handleStoredV2Command serves a command from a repository of a
+// RepositoryStore other than the local disk. The repository is fetched first
+// if it's older than FetchFreshnessWindow. The hidden refs are removed from
+// the ls-refs responses, and the fetches of the objects only reachable from
+// them are rejected, as handleV2Command does.
+func handleStoredV2Command(ctx context.Context, config *ServerConfig, reporter gitProtocolErrorReporter, tenant string, repo StoredRepository, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) bool {
+	startTime := time.Now()
+	cacheState := "locally-served"
+	if command[0].Command != "bundle-uri" && !isStoredRepositoryFresh(config, repo) {
+		cacheState = "queried-upstream"
+	}
+	mutators := []tag.Mutator{tag.Upsert(CommandTypeKey, command[0].Command), tag.Upsert(CommandCacheStateKey, cacheState)}
+	if config.RepositoryMetricTag {
+		mutators = append(mutators, tag.Upsert(RepositoryKey, repositoryTagValue(config, repo.UpstreamURL())))
+	}
+	ctx, err := tag.New(ctx, mutators...)
+	if err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
+	info := requestInfoFromContext(ctx)
+	info.commandType = command[0].Command
+	info.cacheState = cacheState
+	if config.AuditLogger != nil {
+		aw := &auditWriter{w: w}
+		w = aw
+		reporter = &auditErrorReporter{gitProtocolErrorReporter: reporter, logger: config.AuditLogger, event: newAuditEvent(ctx, tenant, repo.UpstreamURL(), command), w: aw}
+	}
+
+	if cacheState == "queried-upstream" {
+		if err := repo.Fetch(ctx); err != nil {
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
+	}
+	switch command[0].Command {
+	case "ls-refs":
+		err = serveStoredLsRefs(ctx, config, repo, command, w)
+	case "fetch":
+		var wantHashes []plumbing.Hash
+		var wantRefs []string
+		if wantHashes, wantRefs, err = parseFetchWants(command); err == nil {
+			err = checkStoredWantsVisible(ctx, config, repo, wantHashes, wantRefs)
+		}
+		if err == nil {
+			err = repo.ServeUploadPack(ctx, command, w)
+		}
+	default:
+		err = repo.ServeUploadPack(ctx, command, w)
+	}
+	reporter.reportError(ctx, startTime, err)
+	return err == nil
+}
+
+// serveStoredLsRefs serves ls-refs from the stored repository without the
+// hidden refs.
+func serveStoredLsRefs(ctx context.Context, config *ServerConfig, repo StoredRepository, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	chunks, err := storedLsRefs(ctx, repo, command)
+	if err != nil {
+		return err
+	}
+	return writeResp(w, filterChangeRefs(config, command, filterHiddenRefs(config, chunks)))
+}
+
+// storedLsRefs runs ls-refs on the stored repository.
+func storedLsRefs(ctx context.Context, repo StoredRepository, command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+	out := new(bytes.Buffer)
+	if err := repo.ServeUploadPack(ctx, command, out); err != nil {
+		return nil, err
+	}
+	chunks := []*gitprotocolio.ProtocolV2ResponseChunk{}
+	v2Resp := gitprotocolio.NewProtocolV2Response(out)
+	for v2Resp.Scan() {
+		chunks = append(chunks, copyResponseChunk(v2Resp.Chunk()))
+	}
+	if err := v2Resp.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot parse the ls-refs response of the store: %v", err)
+	}
+	return chunks, nil
+}
+
+// storedRequestCounter counts the in-flight requests of the repositories of a
+// RepositoryStore other than the local disk for MaxRepoRequests.
+type storedRequestCounter struct {
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+// start counts an in-flight request of the repository, and returns the
+// function that finishes it. It returns an error if the repository has
+// MaxRepoRequests in-flight requests.
+func (c *storedRequestCounter) start(config *ServerConfig, tenant string, u *url.URL) (func(), error) {
+	key := tenant + " " + u.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if limit := config.MaxRepoRequests; limit > 0 && c.inflight[key] >= limit {
+		return nil, &saturationError{"too many requests for the repository", ErrorCategoryOverloaded}
+	}
+	if c.inflight == nil {
+		c.inflight = map[string]int{}
+	}
+	c.inflight[key]++
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.inflight[key]--; c.inflight[key] == 0 {
+			delete(c.inflight, key)
+		}
+	}, nil
+}
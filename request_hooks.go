@@ -0,0 +1,105 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RequestHook is called around the requests that HTTPHandler serves, so that
+// the programs embedding goblet can authorize, throttle, and tag the requests
+// without changing the request handling. See RequestHooks.
+type RequestHook interface {
+	// BeforeRequest is called after the request is authorized by
+	// RequestAuthorizer and checked against BlockedRepos and
+	// AllowedRepos, and before it's served. upstreamURL is the canonical
+	// URL of the repository, or nil if the request URL cannot be
+	// canonicalized. The hook can set the response headers in header. It
+	// returns the request to serve, which is r itself or r with a context
+	// derived from the one of r, such as with the OpenCensus tags that
+	// the measures of the request are recorded with. If it returns an
+	// error, the request is rejected with it, and the hooks after it are
+	// not called. The HTTP status is chosen by the gRPC status code of the
+	// error, such as 429 for codes.ResourceExhausted.
+	BeforeRequest(header http.Header, r *http.Request, upstreamURL *url.URL) (*http.Request, error)
+
+	// AfterRequest is called after the response is written, in the
+	// reverse order of BeforeRequest. It's called only for the hooks
+	// whose BeforeRequest is called, including the one that rejected the
+	// request. r is the request returned by the last BeforeRequest.
+	AfterRequest(r *http.Request, outcome *RequestOutcome)
+}
+
+// RequestOutcome is the result of a request passed to
+// RequestHook.AfterRequest.
+type RequestOutcome struct {
+	// Status is the HTTP status of the response. The errors of the Git
+	// protocol v2 commands are sent with 200 as the protocol requires.
+	Status       int
+	RequestSize  int64
+	ResponseSize int64
+	Latency      time.Duration
+
+	// CommandType and CacheState are the ones of the last Git protocol v2
+	// command of the request, such as "fetch" and "locally-served". They
+	// are empty if the request has no command.
+	CommandType string
+	CacheState  string
+
+	// Err is the error that the request failed with, or nil.
+	Err error
+}
+
+// runBeforeRequestHooks calls BeforeRequest of RequestHooks, and returns the
+// request to serve.
+func runBeforeRequestHooks(config *ServerConfig, w http.ResponseWriter, r *http.Request, upstreamURL *url.URL) (*http.Request, error) {
+	info := requestInfoFromContext(r.Context())
+	info.hookRequest = r
+	for _, h := range config.RequestHooks {
+		info.hooks = append(info.hooks, h)
+		newReq, err := h.BeforeRequest(w.Header(), r, upstreamURL)
+		if err != nil {
+			return r, err
+		}
+		if newReq != nil {
+			r = newReq
+			info.hookRequest = r
+		}
+	}
+	return r, nil
+}
+
+// runAfterRequestHooks calls AfterRequest of the hooks whose BeforeRequest is
+// called for the request.
+func runAfterRequestHooks(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+	info := requestInfoFromContext(r.Context())
+	if len(info.hooks) == 0 {
+		return
+	}
+	outcome := &RequestOutcome{
+		Status:       status,
+		RequestSize:  requestSize,
+		ResponseSize: responseSize,
+		Latency:      latency,
+		CommandType:  info.commandType,
+		CacheState:   info.cacheState,
+		Err:          info.err,
+	}
+	for i := len(info.hooks) - 1; i >= 0; i-- {
+		info.hooks[i].AfterRequest(info.hookRequest, outcome)
+	}
+}
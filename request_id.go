@@ -0,0 +1,97 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	// requestIDHeader is the header of the request IDs, both from the
+	// clients and to the upstream.
+	requestIDHeader = "X-Request-Id"
+
+	// maxRequestIDLength is the maximum length of the request IDs taken
+	// from the clients. Longer ones are replaced.
+	maxRequestIDLength = 128
+)
+
+// withRequestID sets the request ID of the request in requestInfo and the
+// X-Request-Id headers of the request and the response. The ID from the
+// client is used if it's valid, so that a failed clone can be correlated
+// with the logs of the client, such as a CI system. Otherwise, a new one is
+// generated.
+func withRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if !isValidRequestID(id) {
+		id = newRequestID()
+		r.Header.Set(requestIDHeader, id)
+	}
+	requestInfoFromContext(r.Context()).requestID = id
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	bs := make([]byte, 16)
+	rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+// RequestID returns the ID of a request to HTTPHandler, either the
+// X-Request-Id of the client or the one generated by goblet. Use this to
+// include the ID in RequestLogger and ErrorReporter.
+func RequestID(r *http.Request) string {
+	if id := requestInfoFromContext(r.Context()).requestID; id != "" {
+		return id
+	}
+	return r.Header.Get(requestIDHeader)
+}
+
+// requestIDTransport sets X-Request-Id of the requests to the upstream made
+// while serving a client request, such as ls-refs.
+type requestIDTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := requestInfoFromContext(req.Context()).requestID
+	if id == "" || req.Header.Get(requestIDHeader) != "" {
+		return t.rt.RoundTrip(req)
+	}
+	// RoundTrip must not modify the request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set(requestIDHeader, id)
+	return t.rt.RoundTrip(r)
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"io"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultMaxRequestBytes = 32 << 20
+
+// requestSizeLimiter fails the reads of an upload-pack request once it
+// exceeds MaxRequestBytes. Unlike io.LimitReader, a request over the limit is
+// an error rather than a truncated request.
+type requestSizeLimiter struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func newRequestSizeLimiter(config *ServerConfig, r io.Reader) *requestSizeLimiter {
+	config.settingsMu.RLock()
+	limit := config.MaxRequestBytes
+	config.settingsMu.RUnlock()
+	if limit == 0 {
+		limit = defaultMaxRequestBytes
+	}
+	return &requestSizeLimiter{r: r, limit: limit}
+}
+
+func (l *requestSizeLimiter) Read(p []byte) (int, error) {
+	if l.exceeded() {
+		return 0, l.err()
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.exceeded() {
+		return 0, l.err()
+	}
+	return n, err
+}
+
+func (l *requestSizeLimiter) exceeded() bool {
+	return l.limit >= 0 && l.n > l.limit
+}
+
+func (l *requestSizeLimiter) err() error {
+	return status.Errorf(codes.ResourceExhausted, "the request exceeds %d bytes", l.limit)
+}
@@ -0,0 +1,216 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultGoogleSecretManagerEndpoint is the endpoint of Google Secret
+	// Manager.
+	DefaultGoogleSecretManagerEndpoint = "https://secretmanager.googleapis.com"
+
+	// retryInterval is the interval of refetching a secret after a
+	// failure while the previous value is still used.
+	retryInterval = time.Minute
+)
+
+// Fetcher returns the current value of a secret.
+type Fetcher func() (string, error)
+
+// Config specifies how to access the secret stores.
+type Config struct {
+	// GoogleTokenSource provides the credentials for Google Secret
+	// Manager.
+	GoogleTokenSource oauth2.TokenSource
+
+	// GoogleSecretManagerEndpoint defaults to
+	// DefaultGoogleSecretManagerEndpoint.
+	GoogleSecretManagerEndpoint string
+
+	// VaultAddr is the address of the Vault server, such as
+	// https://vault.example.com:8200.
+	VaultAddr string
+
+	// VaultTokenFile is the file of the Vault token. The file is read
+	// for every fetch so that it can be rotated by Vault Agent.
+	VaultTokenFile string
+}
+
+// Fetcher returns the Fetcher of a secret reference. The reference is one of:
+//
+//   - gcp-secret-manager:<version>, where <version> is the resource name of a
+//     secret version such as
+//     projects/my-project/secrets/my-secret/versions/latest
+//   - vault:<path>#<field>, where <path> is the path of a KV secret such as
+//     secret/data/goblet for the version 2 engine
+//   - file:<path>
+func (c *Config) Fetcher(ref string) (Fetcher, error) {
+	ss := strings.SplitN(ref, ":", 2)
+	if len(ss) != 2 || ss[1] == "" {
+		return nil, fmt.Errorf("cannot parse the secret reference %q", ref)
+	}
+	switch ss[0] {
+	case "gcp-secret-manager":
+		if c.GoogleTokenSource == nil {
+			return nil, fmt.Errorf("no credentials for Google Secret Manager")
+		}
+		return c.googleSecretManager(ss[1]), nil
+	case "vault":
+		ps := strings.SplitN(ss[1], "#", 2)
+		if len(ps) != 2 || ps[0] == "" || ps[1] == "" {
+			return nil, fmt.Errorf("the Vault secret reference %q must be vault:<path>#<field>", ref)
+		}
+		if c.VaultAddr == "" {
+			return nil, fmt.Errorf("the Vault address is not specified")
+		}
+		return c.vault(ps[0], ps[1]), nil
+	case "file":
+		return func() (string, error) {
+			bs, err := ioutil.ReadFile(ss[1])
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(string(bs)), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown secret store %q", ss[0])
+}
+
+func (c *Config) googleSecretManager(name string) Fetcher {
+	endpoint := c.GoogleSecretManagerEndpoint
+	if endpoint == "" {
+		endpoint = DefaultGoogleSecretManagerEndpoint
+	}
+	client := oauth2.NewClient(context.Background(), c.GoogleTokenSource)
+	return func() (string, error) {
+		var resp struct {
+			Payload struct {
+				Data string `json:"data"`
+			} `json:"payload"`
+		}
+		if err := getJSON(client, strings.TrimSuffix(endpoint, "/")+"/v1/"+name+":access", nil, &resp); err != nil {
+			return "", fmt.Errorf("cannot access the secret %s: %v", name, err)
+		}
+		bs, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+		if err != nil {
+			return "", fmt.Errorf("cannot decode the secret %s: %v", name, err)
+		}
+		return string(bs), nil
+	}
+}
+
+func (c *Config) vault(path, field string) Fetcher {
+	return func() (string, error) {
+		header := http.Header{}
+		if c.VaultTokenFile != "" {
+			bs, err := ioutil.ReadFile(c.VaultTokenFile)
+			if err != nil {
+				return "", fmt.Errorf("cannot read the Vault token: %v", err)
+			}
+			header.Set("X-Vault-Token", strings.TrimSpace(string(bs)))
+		}
+		var resp struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		if err := getJSON(http.DefaultClient, strings.TrimSuffix(c.VaultAddr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), header, &resp); err != nil {
+			return "", fmt.Errorf("cannot read the Vault secret %s: %v", path, err)
+		}
+		data := resp.Data
+		// The version 2 KV engine nests the secret with its metadata.
+		if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+			data = nested
+		}
+		v, ok := data[field].(string)
+		if !ok {
+			return "", fmt.Errorf("the Vault secret %s has no field %q", path, field)
+		}
+		return v, nil
+	}
+}
+
+func getJSON(client *http.Client, url string, header http.Header, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// NewRotatingTokenSource returns a TokenSource that fetches the secret every
+// refreshInterval and converts it to the tokens with newTokenSource, so that
+// the rotated secrets are picked up. If a fetch fails, the previous secret is
+// used and the fetch is retried a minute later.
+func NewRotatingTokenSource(fetch Fetcher, refreshInterval time.Duration, newTokenSource func(secret string) oauth2.TokenSource) (oauth2.TokenSource, error) {
+	secret, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingTokenSource{
+		fetch:           fetch,
+		refreshInterval: refreshInterval,
+		newTokenSource:  newTokenSource,
+		ts:              newTokenSource(secret),
+		nextFetch:       time.Now().Add(refreshInterval),
+	}, nil
+}
+
+type rotatingTokenSource struct {
+	fetch           Fetcher
+	refreshInterval time.Duration
+	newTokenSource  func(string) oauth2.TokenSource
+
+	mu        sync.Mutex
+	ts        oauth2.TokenSource
+	nextFetch time.Time
+}
+
+func (s *rotatingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().After(s.nextFetch) {
+		if secret, err := s.fetch(); err != nil {
+			log.Printf("Cannot refresh the secret, using the previous one: %v", err)
+			s.nextFetch = time.Now().Add(retryInterval)
+		} else {
+			s.ts = s.newTokenSource(secret)
+			s.nextFetch = time.Now().Add(s.refreshInterval)
+		}
+	}
+	return s.ts.Token()
+}
@@ -0,0 +1,378 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultCacheCleanupInterval = 10 * time.Minute
+	defaultWarmUpInterval       = time.Hour
+	defaultHotRefreshInterval   = time.Minute
+
+	// maintenanceCheckInterval is the interval of RunMaintenancePass,
+	// which maintains only the repositories due for MaintenanceInterval.
+	maintenanceCheckInterval = time.Minute
+)
+
+// Server is a goblet server embedded in a Go program. It serves the Git
+// requests as an http.Handler, and runs the background tasks between Start
+// and Shutdown:
+//
+//   - MoveColdRepositories, EvictIdleRepositories, and EnforceCacheQuota
+//     every cache cleanup interval
+//   - WarmUpRepositories at Start and every warm-up interval
+//   - RefreshHotRepositories every hot refresh interval
+//   - RunMaintenancePass every minute
+//
+// The tasks do nothing unless the ServerConfig enables them. Create one with
+// NewServer.
+type Server struct {
+	config  *ServerConfig
+	handler http.Handler
+
+	cacheCleanupInterval time.Duration
+	warmUpInterval       time.Duration
+	hotRefreshInterval   time.Duration
+
+	mu       sync.Mutex
+	started  bool
+	shutDown bool
+	paused   bool
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Option configures a Server created by NewServer.
+type Option func(*Server) error
+
+// NewServer returns a Server configured by the options. The cache root, the
+// URL canonicalizer, the request authorizer, and the token source or the
+// upstream credential provider must be set. The options are applied in
+// order.
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		config:               &ServerConfig{},
+		cacheCleanupInterval: defaultCacheCleanupInterval,
+		warmUpInterval:       defaultWarmUpInterval,
+		hotRefreshInterval:   defaultHotRefreshInterval,
+		stop:                 make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.config.LocalDiskCacheRoot == "" {
+		return nil, fmt.Errorf("the cache root must be set")
+	}
+	if s.config.URLCanonializer == nil {
+		return nil, fmt.Errorf("the URL canonicalizer must be set")
+	}
+	if s.config.RequestAuthorizer == nil {
+		return nil, fmt.Errorf("the request authorizer must be set")
+	}
+	if s.config.TokenSource == nil && s.config.UpstreamCredentialProvider == nil {
+		return nil, fmt.Errorf("the token source or the upstream credential provider must be set")
+	}
+	if err := validateRepoOverrides(s.config.RepoOverrides); err != nil {
+		return nil, err
+	}
+	if err := validateWarmRepositories(s.config.WarmRepositories); err != nil {
+		return nil, err
+	}
+	s.handler = HTTPHandler(s.config)
+	return s, nil
+}
+
+// WithServerConfig makes the Server use config, such as for the settings
+// that have no options. The options after this modify config, and config
+// can be passed to the functions that take a ServerConfig, such as
+// UpdateSettings and AdminHandler.
+func WithServerConfig(config *ServerConfig) Option {
+	return func(s *Server) error {
+		s.config = config
+		return nil
+	}
+}
+
+// WithCacheRoot sets the directory of the cached repositories, and the
+// shard roots that they are spread across. See CacheShardRoots.
+func WithCacheRoot(root string, shardRoots ...string) Option {
+	return func(s *Server) error {
+		s.config.LocalDiskCacheRoot = root
+		s.config.CacheShardRoots = shardRoots
+		return nil
+	}
+}
+
+// WithURLCanonicalizer sets the function that maps the request URLs to the
+// upstream URLs.
+func WithURLCanonicalizer(f func(*url.URL) (*url.URL, error)) Option {
+	return func(s *Server) error {
+		s.config.URLCanonializer = f
+		return nil
+	}
+}
+
+// WithRequestAuthorizer sets the function that authorizes the requests.
+func WithRequestAuthorizer(f func(*http.Request) error) Option {
+	return func(s *Server) error {
+		s.config.RequestAuthorizer = f
+		return nil
+	}
+}
+
+// WithTokenSource sets the credentials for the upstream.
+func WithTokenSource(ts oauth2.TokenSource) Option {
+	return func(s *Server) error {
+		s.config.TokenSource = ts
+		return nil
+	}
+}
+
+// WithUpstreamCredentialProvider sets the credentials for each upstream
+// repository. See UpstreamCredentialProvider.
+func WithUpstreamCredentialProvider(p UpstreamCredentialProvider) Option {
+	return func(s *Server) error {
+		s.config.UpstreamCredentialProvider = p
+		return nil
+	}
+}
+
+// WithRequestLogger sets the function that logs the requests.
+func WithRequestLogger(f func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)) Option {
+	return func(s *Server) error {
+		s.config.RequestLogger = f
+		return nil
+	}
+}
+
+// WithErrorReporter sets the function that reports the errors of the
+// requests.
+func WithErrorReporter(f func(*http.Request, error)) Option {
+	return func(s *Server) error {
+		s.config.ErrorReporter = f
+		return nil
+	}
+}
+
+// WithRequestHooks adds the hooks called before and after the requests. See
+// RequestHook.
+func WithRequestHooks(hooks ...RequestHook) Option {
+	return func(s *Server) error {
+		s.config.RequestHooks = append(s.config.RequestHooks, hooks...)
+		return nil
+	}
+}
+
+// WithConcurrencyLimits sets MaxUpstreamFetches, MaxUploadPacks, and
+// MaxRepoRequests. Zero means unlimited.
+func WithConcurrencyLimits(maxUpstreamFetches, maxUploadPacks, maxRepoRequests int) Option {
+	return func(s *Server) error {
+		if maxUpstreamFetches < 0 || maxUploadPacks < 0 || maxRepoRequests < 0 {
+			return fmt.Errorf("the concurrency limits must not be negative")
+		}
+		s.config.MaxUpstreamFetches = maxUpstreamFetches
+		s.config.MaxUploadPacks = maxUploadPacks
+		s.config.MaxRepoRequests = maxRepoRequests
+		return nil
+	}
+}
+
+// WithMaxCacheBytes sets the total size of the cache roots above which the
+// least recently fetched repositories are removed. See MaxCacheBytes.
+func WithMaxCacheBytes(n int64) Option {
+	return func(s *Server) error {
+		s.config.MaxCacheBytes = n
+		return nil
+	}
+}
+
+// WithCacheCleanupInterval sets the interval of moving the cold
+// repositories, evicting the idle ones, and enforcing MaxCacheBytes. It
+// defaults to 10 minutes. The cache is not cleaned up if zero.
+func WithCacheCleanupInterval(d time.Duration) Option {
+	return func(s *Server) error {
+		s.cacheCleanupInterval = d
+		return nil
+	}
+}
+
+// WithWarmUpInterval sets the interval of fetching WarmRepositories. It
+// defaults to an hour. They are fetched only at Start if zero.
+func WithWarmUpInterval(d time.Duration) Option {
+	return func(s *Server) error {
+		s.warmUpInterval = d
+		return nil
+	}
+}
+
+// WithHotRefreshInterval sets the interval of refreshing the
+// HotRepositoryCount most requested repositories. It defaults to a minute.
+// They are not refreshed if zero.
+func WithHotRefreshInterval(d time.Duration) Option {
+	return func(s *Server) error {
+		s.hotRefreshInterval = d
+		return nil
+	}
+}
+
+// Config returns the ServerConfig of the server.
+func (s *Server) Config() *ServerConfig {
+	return s.config
+}
+
+// ServeHTTP serves the Git requests as HTTPHandler does.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Start starts the background tasks. It returns an error if the server is
+// already started or shut down.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutDown {
+		return fmt.Errorf("the server is shut down")
+	}
+	if s.started {
+		return fmt.Errorf("the server is already started")
+	}
+	s.started = true
+
+	s.runEvery(s.cacheCleanupInterval, true, func() {
+		if err := MoveColdRepositories(s.config); err != nil {
+			log.Printf("Cannot move the cold repositories: %v", err)
+		}
+		if err := EvictIdleRepositories(s.config); err != nil {
+			log.Printf("Cannot evict the idle repositories: %v", err)
+		}
+		if err := EnforceCacheQuota(s.config); err != nil {
+			log.Printf("Cannot enforce the cache quota: %v", err)
+		}
+	})
+	s.runEvery(s.warmUpInterval, true, func() {
+		if err := WarmUpRepositories(s.config); err != nil {
+			log.Printf("Cannot warm up the repositories: %v", err)
+		}
+	})
+	s.runEvery(s.hotRefreshInterval, false, func() {
+		if err := RefreshHotRepositories(s.config); err != nil {
+			log.Printf("Cannot refresh the hot repositories: %v", err)
+		}
+	})
+	s.runEvery(maintenanceCheckInterval, true, func() {
+		if err := RunMaintenancePass(s.config); err != nil {
+			log.Printf("Cannot maintain the cached repositories: %v", err)
+		}
+	})
+	return nil
+}
+
+// runEvery runs f every interval until Shutdown, and also right away if
+// immediately is true. f is run only right away if interval is zero, and
+// never if it's zero and immediately is false. f is skipped while the
+// background tasks are paused.
+func (s *Server) runEvery(interval time.Duration, immediately bool, f func()) {
+	if interval <= 0 && !immediately {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if immediately {
+			s.runUnlessPaused(f)
+		}
+		if interval <= 0 {
+			return
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				s.runUnlessPaused(f)
+			}
+		}
+	}()
+}
+
+func (s *Server) runUnlessPaused(f func()) {
+	s.mu.Lock()
+	skip := s.paused || s.shutDown
+	s.mu.Unlock()
+	if !skip {
+		f()
+	}
+}
+
+// PauseBackgroundTasks stops starting the background tasks until
+// ResumeBackgroundTasks, such as while the cache roots are backed up. The
+// running ones are not interrupted. The requests are served as usual.
+func (s *Server) PauseBackgroundTasks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = true
+}
+
+// ResumeBackgroundTasks resumes the background tasks paused by
+// PauseBackgroundTasks. The tasks skipped while paused run at their next
+// intervals.
+func (s *Server) ResumeBackgroundTasks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = false
+}
+
+// Shutdown stops the background tasks, and waits for them and the upstream
+// fetches as Shutdown does. Call this after http.Server.Shutdown of the
+// servers serving s so that the in-flight requests can use the upstream
+// fetches they wait for. If ctx is done first, the upstream fetches are
+// aborted, and it returns the error of ctx.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.shutDown {
+		s.shutDown = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	err := Shutdown(ctx, s.config)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ShallowCachePolicy specifies how a shallow cached repository serves the
+// requests that need more history than it has. Goblet itself fetches the
+// full history, but a cache can be seeded with a shallow clone.
+type ShallowCachePolicy int
+
+const (
+	// ShallowCacheUnshallow fetches the rest of the history from the
+	// upstream before serving the request.
+	ShallowCacheUnshallow ShallowCachePolicy = iota
+
+	// ShallowCacheReject rejects the request.
+	ShallowCacheReject
+
+	// ShallowCacheDeepen fetches only as much history as the request
+	// needs from the upstream, so that the cached repository stays
+	// shallow. The requests with "deepen", "deepen-since", or
+	// "deepen-not" deepen the cached repository in the same way, and the
+	// other requests fetch the rest of the history.
+	ShallowCacheDeepen
+)
+
+// isShallow returns true if the cached repository has a shallow history.
+func (r *managedRepository) isShallow() bool {
+	_, err := os.Stat(filepath.Join(r.localDiskPath, "shallow"))
+	return err == nil
+}
+
+// needsFullHistory returns true if a fetch command cannot be served from a
+// shallow repository. Only "deepen 1" is known to be satisfied by any
+// shallow repository that has the wants; the other requests can go past its
+// shallow boundary.
+func needsFullHistory(command []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	for _, ch := range command {
+		if ch.Argument != nil && strings.TrimSpace(string(ch.Argument)) == "deepen 1" {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureHistory makes sure that the cached repository has enough history to
+// serve the fetch command.
+func (r *managedRepository) ensureHistory(command []*gitprotocolio.ProtocolV2RequestChunk) error {
+	if !r.isShallow() || !needsFullHistory(command) {
+		return nil
+	}
+	if r.config.ShallowCachePolicy == ShallowCacheReject {
+		return status.Error(codes.FailedPrecondition, "the cached repository is shallow and cannot serve the full history")
+	}
+	if r.config.ShallowCachePolicy == ShallowCacheDeepen {
+		if args := upstreamDeepenArguments(command); args != nil {
+			return r.deepen(command, args)
+		}
+	}
+	return r.unshallow()
+}
+
+// upstreamDeepenArguments returns the git-fetch arguments that fetch the
+// history that the fetch command asks for, or nil if the command doesn't
+// limit the history. "deepen-relative" needs the client's shallow boundary,
+// and cannot be converted.
+func upstreamDeepenArguments(command []*gitprotocolio.ProtocolV2RequestChunk) []string {
+	var args []string
+	for _, ch := range command {
+		if ch.Argument == nil {
+			continue
+		}
+		s := strings.TrimSpace(string(ch.Argument))
+		switch {
+		case s == "deepen-relative":
+			return nil
+		case strings.HasPrefix(s, "deepen "):
+			args = append(args, "--depth="+strings.TrimPrefix(s, "deepen "))
+		case strings.HasPrefix(s, "deepen-since "):
+			// A raw timestamp is "@<seconds since the epoch>".
+			args = append(args, "--shallow-since=@"+strings.TrimPrefix(s, "deepen-since "))
+		case strings.HasPrefix(s, "deepen-not "):
+			args = append(args, "--shallow-exclude="+strings.TrimPrefix(s, "deepen-not "))
+		}
+	}
+	return args
+}
+
+// deepen fetches the history of the wants of the fetch command from the
+// upstream with the deepen arguments.
+func (r *managedRepository) deepen(command []*gitprotocolio.ProtocolV2RequestChunk, deepenArgs []string) (err error) {
+	op := r.startOperation("Deepen")
+	defer func() {
+		op.Done(err)
+	}()
+	wantHashes, wantRefs, err := parseFetchWants(command)
+	if err != nil {
+		return err
+	}
+	finish, err := r.config.upstreamFetches.start()
+	if err != nil {
+		return err
+	}
+	defer finish()
+
+	gitOptions, err := upstreamGitOptions(r.config, r.upstreamURL)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "%v", err)
+	}
+	t, err := upstreamToken(r.config, r.upstreamURL)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+	}
+
+	startTime := time.Now()
+	unlock, err := r.lock(op)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer r.invalidateSnapshot()
+	args := append(gitOptions, "-c", "http.extraHeader=Authorization: "+authorizationHeader(t), "fetch", "--progress")
+	args = append(append(args, deepenArgs...), "origin")
+	for _, h := range wantHashes {
+		args = append(args, h.String())
+	}
+	args = append(args, wantRefs...)
+	err = r.runUpstreamGit(op, args...)
+	r.logStats("deepen", startTime, err)
+	if isSaturated(err) {
+		return err
+	} else if err != nil {
+		return status.Errorf(codes.Unavailable, "cannot fetch the history: %v", err)
+	}
+	return nil
+}
+
+func (r *managedRepository) unshallow() (err error) {
+	op := r.startOperation("Unshallow")
+	defer func() {
+		op.Done(err)
+	}()
+	finish, err := r.config.upstreamFetches.start()
+	if err != nil {
+		return err
+	}
+	defer finish()
+
+	gitOptions, err := upstreamGitOptions(r.config, r.upstreamURL)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "%v", err)
+	}
+	t, err := upstreamToken(r.config, r.upstreamURL)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+	}
+
+	startTime := time.Now()
+	unlock, err := r.lock(op)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !r.isShallow() {
+		// Another request has unshallowed the repository.
+		return nil
+	}
+	defer r.invalidateSnapshot()
+	args := append(gitOptions, "-c", "http.extraHeader=Authorization: "+authorizationHeader(t), "fetch", "--progress", "-f", "--unshallow", "origin")
+	err = r.runUpstreamGit(op, append(args, upstreamFetchRefspecs(r.config)...)...)
+	r.logStats("unshallow", startTime, err)
+	if isSaturated(err) {
+		return err
+	} else if err != nil {
+		return status.Errorf(codes.Unavailable, "cannot fetch the full history: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// upstreamFetchTracker tracks the upstream fetches running in the background
+// so that Shutdown can wait for them.
+type upstreamFetchTracker struct {
+	mu           sync.Mutex
+	running      int
+	shuttingDown bool
+	idle         chan struct{}
+
+	// ctx is canceled to abort the running git-fetch commands.
+	ctxOnce sync.Once
+	ctx     context.Context
+	abort   context.CancelFunc
+}
+
+func (t *upstreamFetchTracker) context() context.Context {
+	t.ctxOnce.Do(func() {
+		t.ctx, t.abort = context.WithCancel(context.Background())
+	})
+	return t.ctx
+}
+
+// start counts a running upstream fetch, and returns a function to call when
+// it's done. It returns an error after Shutdown is called.
+func (t *upstreamFetchTracker) start() (func(), error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shuttingDown {
+		return nil, status.Error(codes.Unavailable, "the server is shutting down")
+	}
+	t.running++
+	return t.finish, nil
+}
+
+func (t *upstreamFetchTracker) isShuttingDown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.shuttingDown
+}
+
+func (t *upstreamFetchTracker) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	if t.running == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// Shutdown stops starting new upstream fetches, and waits for the running
+// ones to complete. If ctx is done first, the running fetches are aborted,
+// and it returns the error of ctx. git-fetch updates the refs only after it
+// receives the objects, and an aborted fetch leaves the cached repository
+// usable.
+//
+// Call this after http.Server.Shutdown of the servers with HTTPHandler so
+// that the in-flight requests can use the upstream fetches they wait for.
+// It also closes the access log file, and releases the managed repositories
+// of config so that another ServerConfig can serve the cache roots.
+func Shutdown(ctx context.Context, config *ServerConfig) error {
+	defer closeAccessLogFile(config)
+	defer releaseManagedRepositories(config)
+
+	t := &config.upstreamFetches
+	t.mu.Lock()
+	t.shuttingDown = true
+	if t.running == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+	t.context()
+	t.abort()
+	<-idle
+	return ctx.Err()
+}
+
+// releaseManagedRepositories forgets the managed repositories opened with
+// config.
+func releaseManagedRepositories(config *ServerConfig) {
+	managedRepos.Range(func(key, value interface{}) bool {
+		if value.(*managedRepository).config == config {
+			managedRepos.Delete(key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"go.opencensus.io/stats"
+)
+
+// spillBuffer is a buffer that holds up to RequestMemoryBudget bytes in
+// memory, and spills the rest to a temporary file under LocalDiskCacheRoot.
+type spillBuffer struct {
+	dir    string
+	budget int64
+	mem    bytes.Buffer
+	f      *os.File
+	// spilled is the size of the data in f.
+	spilled int64
+}
+
+func newSpillBuffer(config *ServerConfig) *spillBuffer {
+	return &spillBuffer{dir: config.LocalDiskCacheRoot, budget: config.RequestMemoryBudget}
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.f == nil {
+		if b.budget <= 0 || int64(b.mem.Len()+len(p)) <= b.budget {
+			return b.mem.Write(p)
+		}
+		n, _ := b.mem.Write(p[:b.budget-int64(b.mem.Len())])
+		f, err := ioutil.TempFile(b.dir, "goblet-spill-")
+		if err != nil {
+			return n, err
+		}
+		// Only the open file is used, and it's gone when it's closed.
+		os.Remove(f.Name())
+		b.f = f
+		stats.Record(context.Background(), RequestSpillCount.M(1))
+		m, err := b.Write(p[n:])
+		return n + m, err
+	}
+	n, err := b.f.Write(p)
+	b.spilled += int64(n)
+	return n, err
+}
+
+// Len returns the size of the buffered data.
+func (b *spillBuffer) Len() int64 {
+	return int64(b.mem.Len()) + b.spilled
+}
+
+// Reader returns a reader of the buffered data. The buffer must not be
+// written while it's read.
+func (b *spillBuffer) Reader() io.Reader {
+	if b.f == nil {
+		return bytes.NewReader(b.mem.Bytes())
+	}
+	return io.MultiReader(bytes.NewReader(b.mem.Bytes()), io.NewSectionReader(b.f, 0, b.spilled))
+}
+
+// Close discards the buffered data.
+func (b *spillBuffer) Close() error {
+	b.mem = bytes.Buffer{}
+	b.spilled = 0
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
@@ -0,0 +1,344 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshIdentityExtension is the ssh.Permissions extension that holds the
+// client identity that PublicKeyAuthorizer returns.
+const sshIdentityExtension = "goblet-identity"
+
+// SSHServerConfig specifies the SSH frontend.
+type SSHServerConfig struct {
+	// HostKeys are the host keys of the server.
+	HostKeys []ssh.Signer
+
+	// PublicKeyAuthorizer authorizes the public key of the user, and
+	// returns the client identity that AccessRules match with.
+	PublicKeyAuthorizer func(user string, key ssh.PublicKey) (string, error)
+}
+
+// streamSessionKey is the context key of the streamSession of the requests
+// that come from the SSH and the git:// frontends.
+type streamSessionKey struct{}
+
+type streamSession struct {
+	// identity is the client identity, or empty for the anonymous
+	// clients.
+	identity string
+}
+
+// streamSessionFromContext returns the streamSession of the request, or nil if
+// it doesn't come from the SSH or the git:// frontends.
+func streamSessionFromContext(ctx context.Context) *streamSession {
+	s, _ := ctx.Value(streamSessionKey{}).(*streamSession)
+	return s
+}
+
+// ServeSSH serves git-upload-pack over SSH on the listener. Each request is
+// handled by handler, which is usually the one HTTPHandler returns, so that the
+// SSH clients share the cache and the limits with the HTTP ones.
+//
+// The repository path is the host and the path of the upstream URL, such as
+// ssh://goblet.example.com/github.com/google/goblet.git. Only the protocol v2
+// is supported. The clients are authorized with PublicKeyAuthorizer instead
+// of RequestAuthorizer. This returns when the listener is closed.
+func ServeSSH(l net.Listener, handler http.Handler, config *SSHServerConfig) error {
+	if config.PublicKeyAuthorizer == nil {
+		return fmt.Errorf("PublicKeyAuthorizer must be set")
+	}
+	sshConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			identity, err := config.PublicKeyAuthorizer(conn.User(), key)
+			if err != nil {
+				return nil, err
+			}
+			return &ssh.Permissions{Extensions: map[string]string{sshIdentityExtension: identity}}, nil
+		},
+	}
+	for _, k := range config.HostKeys {
+		sshConfig.AddHostKey(k)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSSHConn(conn, handler, sshConfig)
+	}
+}
+
+func serveSSHConn(conn net.Conn, handler http.Handler, sshConfig *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only the session channels are supported")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSSHSession(serverConn, ch, chReqs, handler)
+	}
+}
+
+func serveSSHSession(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request, handler http.Handler) {
+	defer ch.Close()
+	env := map[string]string{}
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &kv); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			env[kv.Name] = kv.Value
+			req.Reply(true, nil)
+		case "exec":
+			var cmd struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &cmd); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+
+			exitStatus := uint32(0)
+			ctx := context.WithValue(context.Background(), streamSessionKey{}, &streamSession{
+				identity: conn.Permissions.Extensions[sshIdentityExtension],
+			})
+			if err := serveSSHUploadPack(ctx, conn.RemoteAddr().String(), cmd.Command, env, ch, handler); err != nil {
+				fmt.Fprintf(ch.Stderr(), "goblet: %v\n", err)
+				exitStatus = 1
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{exitStatus}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func serveSSHUploadPack(ctx context.Context, remoteAddr, command string, env map[string]string, ch ssh.Channel, handler http.Handler) error {
+	u, err := parseSSHUploadPackCommand(command)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(env["GIT_PROTOCOL"], "version=2") {
+		// The client expects the protocol v0 advertisement. An ERR
+		// packet is shown as is.
+		writeError(ch, fmt.Errorf("accepts only Git protocol v2"))
+		return nil
+	}
+	return serveUploadPackStream(ctx, remoteAddr, u, ch, handler)
+}
+
+// serveUploadPackStream runs git-upload-pack of the protocol v2 over the
+// stream by sending the capability advertisement and the commands to handler
+// as HTTP requests.
+func serveUploadPackStream(ctx context.Context, remoteAddr string, u *url.URL, ch io.ReadWriter, handler http.Handler) error {
+	serve := func(method, path string, body io.Reader) bool {
+		req, err := http.NewRequest(method, u.String()+path, body)
+		if err != nil {
+			writeError(ch, err)
+			return false
+		}
+		req = req.WithContext(ctx)
+		req.RemoteAddr = remoteAddr
+		if body != nil {
+			// The size is unknown until the flush-pkt. A zero
+			// size would drop the body when the request is
+			// forwarded to the owner replica.
+			req.ContentLength = -1
+		}
+		req.Header.Set("Git-Protocol", "version=2")
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		}
+		w := &streamResponseWriter{w: ch, header: http.Header{}}
+		handler.ServeHTTP(w, req)
+		if w.status != 0 && w.status != http.StatusOK {
+			msg := strings.TrimSpace(w.errBody.String())
+			if msg == "" {
+				msg = http.StatusText(w.status)
+			}
+			writeError(ch, fmt.Errorf("%s", msg))
+			return false
+		}
+		return true
+	}
+
+	if !serve("GET", "/info/refs?service=git-upload-pack", nil) {
+		return nil
+	}
+	r := bufio.NewReader(ch)
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot read the request: %v", err)
+		}
+		body := &pktLineRequestReader{r: r}
+		if !serve("POST", "/git-upload-pack", body) {
+			return nil
+		}
+		// The next request starts after the flush-pkt.
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return err
+		}
+	}
+}
+
+// parseSSHUploadPackCommand returns the URL of the repository of the command,
+// such as "git-upload-pack '/github.com/google/goblet.git'".
+func parseSSHUploadPackCommand(command string) (*url.URL, error) {
+	var p string
+	switch {
+	case strings.HasPrefix(command, "git-upload-pack "):
+		p = strings.TrimPrefix(command, "git-upload-pack ")
+	case strings.HasPrefix(command, "git upload-pack "):
+		p = strings.TrimPrefix(command, "git upload-pack ")
+	default:
+		return nil, fmt.Errorf("only git-upload-pack is supported")
+	}
+	return parseRepositoryPath(strings.Trim(strings.TrimSpace(p), "'\""))
+}
+
+// parseRepositoryPath returns the upstream URL of the repository path of the
+// SSH and the git:// frontends, such as "/github.com/google/goblet.git".
+func parseRepositoryPath(p string) (*url.URL, error) {
+	ss := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	if len(ss) != 2 || ss[0] == "" || ss[0] == "." || ss[0] == ".." {
+		return nil, fmt.Errorf("the repository path must be /<host>/<path>: %s", p)
+	}
+	if elems, err := SplitRepositoryPath(ss[1]); err != nil || len(elems) == 0 {
+		return nil, fmt.Errorf("the repository path must be /<host>/<path>: %s", p)
+	}
+	return &url.URL{Scheme: "https", Host: ss[0], Path: "/" + ss[1]}, nil
+}
+
+// pktLineRequestReader reads the pkt-lines of a request up to and including
+// a flush-pkt from the stream. The request is passed through as it's read
+// rather than buffered, and its size is limited by the handler.
+type pktLineRequestReader struct {
+	r *bufio.Reader
+	// header is the unread part of the current pkt-line length.
+	header []byte
+	// remaining is the unread size of the current pkt-line payload.
+	remaining int
+	done      bool
+}
+
+func (p *pktLineRequestReader) Read(b []byte) (int, error) {
+	if len(p.header) == 0 && p.remaining == 0 {
+		if p.done {
+			return 0, io.EOF
+		}
+		if err := p.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p.header) != 0 {
+		n := copy(b, p.header)
+		p.header = p.header[n:]
+		return n, nil
+	}
+	if len(b) > p.remaining {
+		b = b[:p.remaining]
+	}
+	n, err := p.r.Read(b)
+	p.remaining -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, fmt.Errorf("cannot read the request: %v", err)
+	}
+	return n, nil
+}
+
+func (p *pktLineRequestReader) readHeader() error {
+	lenBytes := make([]byte, 4)
+	if _, err := io.ReadFull(p.r, lenBytes); err != nil {
+		return fmt.Errorf("cannot read the request: %v", err)
+	}
+	n, err := strconv.ParseUint(string(lenBytes), 16, 16)
+	if err != nil {
+		return fmt.Errorf("invalid pkt-line length %q", lenBytes)
+	}
+	switch {
+	case n == 0:
+		p.done = true
+	case n <= 2:
+		// delim-pkt and response-end-pkt.
+	case n < 4:
+		return fmt.Errorf("invalid pkt-line length %q", lenBytes)
+	default:
+		p.remaining = int(n - 4)
+	}
+	p.header = lenBytes
+	return nil
+}
+
+// streamResponseWriter writes the successful responses to the stream, and
+// holds the bodies of the failed ones to report them as ERR packets.
+type streamResponseWriter struct {
+	w       io.Writer
+	header  http.Header
+	status  int
+	errBody bytes.Buffer
+}
+
+func (w *streamResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *streamResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status != http.StatusOK {
+		return w.errBody.Write(p)
+	}
+	return w.w.Write(p)
+}
+
+func (w *streamResponseWriter) Flush() {}
@@ -0,0 +1,58 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// servedStaleHeader is the response header set when the response is served
+// from the cache because the upstream failed.
+const servedStaleHeader = "Goblet-Served-Stale"
+
+// canServeStale returns true if the cached refs can be served instead of
+// failing with err, the error of querying the upstream. This is the case
+// when the circuit breaker of the upstream is open, and with
+// ServeStaleOnFailure when the upstream fails for other reasons than the
+// repository being gone or inaccessible. The refs are never served if the
+// client has gone away or the repository has never been fetched.
+func (r *managedRepository) canServeStale(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if !isSaturated(err) {
+		if !r.config.ServeStaleOnFailure {
+			return false
+		}
+		switch status.Code(err) {
+		case codes.NotFound, codes.PermissionDenied, codes.Unauthenticated:
+			return false
+		}
+	}
+	return r.hasCachedRefs()
+}
+
+// recordServedStale records that the command is served from the cache
+// because the upstream failed.
+func recordServedStale(ctx context.Context) {
+	stats.Record(ctx, StaleServeCount.M(1))
+	if h := requestInfoFromContext(ctx).header; h != nil {
+		h.Set(servedStaleHeader, "true")
+	}
+}
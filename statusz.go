@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type statuszOperation struct {
+	Action         string    `json:"action"`
+	UpstreamURL    string    `json:"upstream_url"`
+	StartTime      time.Time `json:"start_time"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	State          string    `json:"state"`
+	Messages       []string  `json:"messages"`
+}
+
+type statuszPage struct {
+	Time       time.Time           `json:"time"`
+	Operations []*statuszOperation `json:"operations"`
+}
+
+var statuszTemplate = template.Must(template.New("statusz").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>goblet status</title>
+<style>
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+pre { margin: 0; }
+</style>
+</head>
+<body>
+<h1>goblet status</h1>
+<p>{{len .Operations}} operations running at {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+{{if .Operations}}
+<table>
+<tr><th>Repository</th><th>Action</th><th>Elapsed</th><th>State</th><th>Progress</th></tr>
+{{range .Operations}}
+<tr><td>{{.UpstreamURL}}</td><td>{{.Action}}</td><td>{{printf "%.1f" .ElapsedSeconds}}s</td><td>{{.State}}</td><td><pre>{{range .Messages}}{{.}}
+{{end}}</pre></td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// statuszHandler shows the long-running operations in flight, such as the
+// upstream fetches, with the messages that they printed to
+// LongRunningOperationLogger. This is HTML unless JSON is requested with
+// format=json or the Accept header.
+func (s *adminServer) statuszHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	page := &statuszPage{Time: now, Operations: []*statuszOperation{}}
+	for _, o := range s.config.operations.list() {
+		state, messages := o.status()
+		page.Operations = append(page.Operations, &statuszOperation{
+			Action:         o.action,
+			UpstreamURL:    o.upstreamURL.String(),
+			StartTime:      o.startTime,
+			ElapsedSeconds: now.Sub(o.startTime).Seconds(),
+			State:          state,
+			Messages:       messages,
+		})
+	}
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, page)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statuszTemplate.Execute(w, page)
+}
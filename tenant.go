@@ -0,0 +1,76 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"regexp"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultMaxTenantTagValues = 100
+
+	// otherTenantTagValue is the TenantKey value for the tenants over
+	// MaxTenantTagValues.
+	otherTenantTagValue = "other"
+
+	// invalidTenantTagValue is the TenantKey value for the invalid
+	// tenants. It's not a valid tenant itself.
+	invalidTenantTagValue = "(invalid)"
+)
+
+var (
+	validTenant = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+	// tenantTagValues is the set of the tenants that are used as TenantKey
+	// values.
+	tenantTagValues   = map[string]bool{}
+	tenantTagValuesMu sync.Mutex
+)
+
+// validateTenant checks that the tenant can be used as a directory name.
+func validateTenant(tenant string) error {
+	if tenant == "" {
+		return status.Error(codes.PermissionDenied, "no tenant is specified")
+	}
+	if !validTenant.MatchString(tenant) {
+		return status.Errorf(codes.InvalidArgument, "invalid tenant: %q", tenant)
+	}
+	return nil
+}
+
+// tenantTagValue returns the TenantKey value for the tenant. The first
+// MaxTenantTagValues tenants are used as is, and the others are aggregated as
+// "other".
+func tenantTagValue(config *ServerConfig, tenant string) string {
+	limit := config.MaxTenantTagValues
+	if limit == 0 {
+		limit = defaultMaxTenantTagValues
+	}
+
+	tenantTagValuesMu.Lock()
+	defer tenantTagValuesMu.Unlock()
+	if tenantTagValues[tenant] {
+		return tenant
+	}
+	if len(tenantTagValues) >= limit {
+		return otherTenantTagValue
+	}
+	tenantTagValues[tenant] = true
+	return tenant
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestAccessLog_ConcurrentRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goblet_access_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:   goblettest.TestRequestAuthorizer,
+		TokenSource:         goblettest.TestTokenSource,
+		AccessLogFile:       filepath.Join(dir, "access.log"),
+		AccessLogMaxBytes:   1024,
+		AccessLogMaxBackups: 1000,
+	})
+	defer ts.Close()
+
+	const numRequests = 100
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", ts.ProxyServerURL+"info/refs?service=git-upload-pack", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Add("Git-Protocol", "version=2")
+			req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) < 2 {
+		t.Errorf("got %d log files, want the log rotated", len(fis))
+	}
+	lines := 0
+	for _, fi := range fis {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n") {
+			var entry struct {
+				Status int `json:"status"`
+			}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Errorf("cannot parse %q: %v", line, err)
+			} else if entry.Status != http.StatusOK {
+				t.Errorf("got status %d, want %d", entry.Status, http.StatusOK)
+			}
+			lines++
+		}
+	}
+	if lines != numRequests {
+		t.Errorf("got %d lines, want %d", lines, numRequests)
+	}
+}
+
+func TestAccessLog_SharedAmongHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goblet_access_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const maxBytes = 1024
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:   goblettest.TestRequestAuthorizer,
+		TokenSource:         goblettest.TestTokenSource,
+		AccessLogFile:       filepath.Join(dir, "access.log"),
+		AccessLogMaxBytes:   maxBytes,
+		AccessLogMaxBackups: 1000,
+	})
+	defer ts.Close()
+	second := httptest.NewServer(goblet.HTTPHandler(ts.ServerConfig))
+	defer second.Close()
+
+	const numRequests = 50
+	for i := 0; i < numRequests; i++ {
+		serverURL := ts.ProxyServerURL
+		if i%2 == 1 {
+			serverURL = second.URL + "/"
+		}
+		req, err := http.NewRequest("GET", serverURL+"info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Git-Protocol", "version=2")
+		req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err := goblet.Shutdown(context.Background(), ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for _, fi := range fis {
+		// The handlers rotating the file independently would each
+		// write up to maxBytes to a file.
+		if fi.Size() > maxBytes {
+			t.Errorf("%s has %d bytes, want at most %d", fi.Name(), fi.Size(), maxBytes)
+		}
+		bs, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += strings.Count(string(bs), "\n")
+	}
+	if lines != numRequests {
+		t.Errorf("got %d lines, want %d", lines, numRequests)
+	}
+}
+
+func TestJSONRequestLogger(t *testing.T) {
+	var mu sync.Mutex
+	buf := new(bytes.Buffer)
+	logger := goblet.NewJSONRequestLogger(&lockedWriter{mu: &mu, w: buf})
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		RequestLogger:     logger,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	got := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var entry struct {
+			Repo        string `json:"repo"`
+			CommandType string `json:"command_type"`
+			CacheState  string `json:"cache_state"`
+			RemoteIP    string `json:"remote_ip"`
+			Status      int    `json:"status"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("cannot parse %q: %v", line, err)
+		}
+		if want := strings.TrimSuffix(ts.UpstreamServerURL, "/"); entry.Repo != want {
+			t.Errorf("got repo %q, want %q", entry.Repo, want)
+		}
+		if entry.RemoteIP == "" || entry.Status != http.StatusOK {
+			t.Errorf("unexpected entry: %s", line)
+		}
+		if entry.CommandType != "" {
+			got[entry.CommandType] = entry.CacheState
+		}
+	}
+	want := map[string]string{"ls-refs": "queried-upstream", "fetch": "queried-upstream"}
+	for command, state := range want {
+		if got[command] != state {
+			t.Errorf("got cache state %q for %s, want %q", got[command], command, state)
+		}
+	}
+}
+
+func TestAccessLog_CombinedFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goblet_access_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AccessLogFile:     filepath.Join(dir, "access.log"),
+		AccessLogFormat:   "combined",
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "access.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`^\S+ - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "(GET|POST) /\S+ HTTP/1\.1" 200 \d+ "-" "git/[^"]+" "request_id=[0-9a-f]{32} repo=(\S+) command_type=(\S+) cache_state=(\S+) latency_ms=\d+"$`)
+	got := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n") {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("%q is not in the Combined Log Format", line)
+			continue
+		}
+		if want := strings.TrimSuffix(ts.UpstreamServerURL, "/"); m[2] != want {
+			t.Errorf("got repo %q, want %q", m[2], want)
+		}
+		if m[3] != "-" {
+			got[m[3]] = m[4]
+		}
+	}
+	want := map[string]string{"ls-refs": "queried-upstream", "fetch": "queried-upstream"}
+	for command, state := range want {
+		if got[command] != state {
+			t.Errorf("got cache state %q for %s, want %q", got[command], command, state)
+		}
+	}
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestAccessRules(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, loopback6, _ := net.ParseCIDR("::1/128")
+	_, otherRange, _ := net.ParseCIDR("192.0.2.0/24")
+	tests := []struct {
+		name  string
+		rules []*goblet.AccessRule
+		ok    bool
+	}{
+		{"no rules", nil, true},
+		{"identity", []*goblet.AccessRule{{Identities: []string{"team-a/*"}, Repos: []string{"*"}}}, true},
+		{"other identity", []*goblet.AccessRule{{Identities: []string{"team-b/*"}, Repos: []string{"*"}}}, false},
+		{"source range", []*goblet.AccessRule{{SourceRanges: []*net.IPNet{loopback, loopback6}, Repos: []string{"*"}}}, true},
+		{"other source range", []*goblet.AccessRule{{SourceRanges: []*net.IPNet{otherRange}, Repos: []string{"*"}}}, false},
+		{"other repo", []*goblet.AccessRule{{Identities: []string{"team-a/*"}, Repos: []string{"example.com/*"}}}, false},
+		{
+			"second rule",
+			[]*goblet.AccessRule{
+				{Identities: []string{"team-b/*"}, Repos: []string{"*"}},
+				{Identities: []string{"team-a/builder"}, SourceRanges: []*net.IPNet{loopback, loopback6}, Repos: []string{"*"}},
+			},
+			true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer: goblettest.TestRequestAuthorizer,
+				TokenSource:       goblettest.TestTokenSource,
+				AccessRules:       tc.rules,
+				ClientIdentifier: func(*http.Request) string {
+					return "team-a/builder"
+				},
+			})
+			defer ts.Close()
+			if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+				t.Fatal(err)
+			}
+
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+			if tc.ok && err != nil {
+				t.Errorf("got %v, want the fetch to be allowed", err)
+			} else if !tc.ok && err == nil {
+				t.Errorf("the fetch is allowed")
+			}
+		})
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestAdmin_Unauthorized(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+	})
+	defer ts.Close()
+
+	rec := httptest.NewRecorder()
+	goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/repos", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+// readZip returns the files in the zip archive by their names.
+func readZip(t *testing.T, bs []byte) map[string][]byte {
+	zr, err := zip.NewReader(bytes.NewReader(bs), int64(len(bs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestAdmin_ProfileNext(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+	})
+	defer ts.Close()
+	admin := httptest.NewServer(goblet.AdminHandler(ts.ServerConfig))
+	defer admin.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	profile := make(chan *http.Response, 1)
+	go func() {
+		repoURL := strings.TrimSuffix(ts.ProxyServerURL, "/")
+		req, err := http.NewRequest("POST", admin.URL+"/admin/profile/next?url="+url.QueryEscape(repoURL), nil)
+		if err != nil {
+			t.Error(err)
+			profile <- nil
+			return
+		}
+		req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Error(err)
+		}
+		profile <- resp
+	}()
+
+	// The profile might not be armed yet for the first few fetches.
+	for i := 0; i < 50; i++ {
+		client := goblettest.NewLocalGitRepo()
+		_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case resp := <-profile:
+			if resp == nil {
+				return
+			}
+			defer resp.Body.Close()
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got %d: %s", resp.StatusCode, buf.String())
+			}
+			files := readZip(t, buf.Bytes())
+			// The pprof format is gzipped.
+			if !bytes.HasPrefix(files["cpu.pprof"], []byte{0x1f, 0x8b}) {
+				t.Errorf("got a non-pprof profile")
+			}
+			if !bytes.Contains(files["git-trace2-perf.txt"], []byte("upload-pack")) {
+				t.Errorf("got a trace without git-upload-pack: %s", files["git-trace2-perf.txt"])
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("no profile is taken")
+}
+
+func TestAdmin_DrainRepo(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+		UpstreamLatency:   500 * time.Millisecond,
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a request that waits for the upstream fetch.
+	inflight := make(chan error, 1)
+	go func() {
+		_, err := ts.SendProtocolV2Request(fetchRequest(hash))
+		inflight <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	repoURL := strings.TrimSuffix(ts.ProxyServerURL, "/")
+	req := httptest.NewRequest("POST", "/admin/repos/drain?url="+url.QueryEscape(repoURL), nil)
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	rec := httptest.NewRecorder()
+	goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"draining": true`) {
+		t.Fatalf("got %d %s, want the repository to be draining", rec.Code, rec.Body.String())
+	}
+
+	if _, err := ts.SendProtocolV2Request(fetchRequest(hash)); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want a new request to be rejected", err)
+	}
+	if err := <-inflight; err != nil {
+		t.Errorf("the in-flight request failed: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest("GET", "/admin/repos", nil)
+		req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+		rec := httptest.NewRecorder()
+		goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+		if !strings.Contains(rec.Body.String(), strings.TrimSuffix(ts.UpstreamServerURL, "/")) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("the drained repository is not evicted")
+}
+
+func TestAdmin_EvictRepo(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+		TenantExtractor: func(r *http.Request) string {
+			return r.Header.Get(tenantHeader)
+		},
+		// The repositories below are cached with the plain HTTP
+		// upstream URL before the upgrade is enabled.
+		ForceUpstreamHTTPS: true,
+	})
+	defer ts.Close()
+
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The repositories cached by a previous server process.
+	for _, tenant := range []string{"a", "b"} {
+		cache := goblettest.GitRepo(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, tenant, u.Host))
+		if err := os.MkdirAll(string(cache), 0750); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range [][]string{
+			{"init", "--bare"},
+			{"remote", "add", "--mirror=fetch", "origin", strings.TrimSuffix(ts.UpstreamServerURL, "/")},
+		} {
+			if _, err := cache.Run(args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	evict := func(params string) (int, string) {
+		repoURL := strings.TrimSuffix(ts.ProxyServerURL, "/")
+		req := httptest.NewRequest("POST", "/admin/repos/evict?url="+url.QueryEscape(repoURL)+params, nil)
+		req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+		rec := httptest.NewRecorder()
+		goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	exists := func(tenant string) bool {
+		_, err := os.Stat(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, tenant, u.Host))
+		return err == nil
+	}
+
+	if code, body := evict("&tenant=a"); code != http.StatusOK || !strings.Contains(body, `"tenant": "a"`) || strings.Contains(body, `"tenant": "b"`) {
+		t.Errorf("got %d %s, want the repository of tenant a to be evicted", code, body)
+	}
+	if exists("a") || !exists("b") {
+		t.Errorf("got tenant a cached %t and tenant b cached %t, want only tenant b to be cached", exists("a"), exists("b"))
+	}
+	if code, body := evict(""); code != http.StatusOK || !strings.Contains(body, `"tenant": "b"`) {
+		t.Errorf("got %d %s, want the repository of tenant b to be evicted", code, body)
+	}
+	if exists("b") {
+		t.Error("the repository of tenant b is not evicted")
+	}
+	if code, body := evict(""); code != http.StatusNotFound {
+		t.Errorf("got %d %s, want %d", code, body, http.StatusNotFound)
+	}
+}
+
+func TestAdmin_RefreshRepo(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repoURL := strings.TrimSuffix(ts.ProxyServerURL, "/")
+	req := httptest.NewRequest("POST", "/admin/repos/refresh?url="+url.QueryEscape(repoURL), nil)
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	rec := httptest.NewRecorder()
+	goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want %d", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+
+	// The refreshed repository serves the commit without an upstream
+	// fetch.
+	if err := ts.UpstreamGitRepo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !fetchesPack(t, ts, fetchRequest(hash)) {
+		t.Errorf("the refreshed repository doesn't have the commit")
+	}
+
+	repos := listAdminRepos(t, ts)
+	if len(repos) != 1 || repos[0].LastUpdateTime.IsZero() || repos[0].DiskUsageBytes == 0 {
+		t.Errorf("got %+v, want the refreshed repository with its last fetch time and disk usage", repos)
+	}
+}
+
+func TestAdmin_ListsReposOnDisk(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	// A repository cached by a previous server process.
+	seedShallowCache(t, ts)
+
+	repos := listAdminRepos(t, ts)
+	if len(repos) != 1 || repos[0].Opened || repos[0].LastUpdateTime.IsZero() || repos[0].DiskUsageBytes == 0 {
+		t.Errorf("got %+v, want the cached repository that is not opened", repos)
+	}
+}
+
+func TestAdmin_RepoOverrides(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+	})
+	defer ts.Close()
+	admin := httptest.NewServer(goblet.AdminHandler(ts.ServerConfig))
+	defer admin.Close()
+
+	put := func(body string) (int, string) {
+		req, err := http.NewRequest("PUT", admin.URL+"/admin/repo-overrides", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var b bytes.Buffer
+		b.ReadFrom(resp.Body)
+		return resp.StatusCode, b.String()
+	}
+	if code, body := put(`[{"pattern": "[", "fetch_freshness_window": "30s"}]`); code != http.StatusBadRequest {
+		t.Errorf("an invalid pattern is accepted: %d %s", code, body)
+	}
+	if code, body := put(`[{"pattern": "*", "fetch_freshness_window": "10m"}]`); code != http.StatusOK || !strings.Contains(body, `"fetch_freshness_window": "10m0s"`) {
+		t.Errorf("cannot replace the overrides: %d %s", code, body)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	first, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if repos := listAdminRepos(t, ts); len(repos) != 1 || repos[0].FetchFreshnessWindow != "10m0s" {
+		t.Errorf("got %+v, want the repository with the overridden window", repos)
+	}
+
+	// The refs are served from the cache within the overridden window.
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL, "refs/heads/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(out)[0]; got != strings.TrimSpace(first) {
+		t.Errorf("got %s, want the cached %s", got, first)
+	}
+}
+
+type adminRepo struct {
+	UpstreamURL          string    `json:"upstream_url"`
+	LastUpdateTime       time.Time `json:"last_update_time"`
+	FetchFreshnessWindow string    `json:"fetch_freshness_window"`
+	DiskUsageBytes       int64     `json:"disk_usage_bytes"`
+	Opened               bool      `json:"opened"`
+}
+
+// listAdminRepos returns the repositories of the test server listed by
+// /admin/repos. They're matched by the port of the upstream server, which
+// stays the same with UpstreamHostname and ForceUpstreamHTTPS.
+func listAdminRepos(t *testing.T, ts *goblettest.TestServer) []*adminRepo {
+	req := httptest.NewRequest("GET", "/admin/repos", nil)
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	rec := httptest.NewRecorder()
+	goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+	var all []*adminRepo
+	if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil {
+		t.Fatalf("cannot parse %s: %v", rec.Body.String(), err)
+	}
+	upstream, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := []*adminRepo{}
+	for _, r := range all {
+		// The managed repositories of the other test servers are
+		// listed too.
+		if u, err := url.Parse(r.UpstreamURL); err == nil && u.Port() == upstream.Port() {
+			repos = append(repos, r)
+		}
+	}
+	return repos
+}
+
+func TestAdmin_Statusz(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+		UpstreamLatency:   200 * time.Millisecond,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+		errCh <- err
+	}()
+
+	statusz := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+		rec := httptest.NewRecorder()
+		goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d %s, want %d", rec.Code, rec.Body.String(), http.StatusOK)
+		}
+		return rec
+	}
+	upstreamURL := strings.TrimSuffix(ts.UpstreamServerURL, "/")
+	found := false
+	for deadline := time.Now().Add(10 * time.Second); !found && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var page struct {
+			Operations []struct {
+				Action         string  `json:"action"`
+				UpstreamURL    string  `json:"upstream_url"`
+				ElapsedSeconds float64 `json:"elapsed_seconds"`
+			} `json:"operations"`
+		}
+		if err := json.Unmarshal(statusz("/statusz?format=json").Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range page.Operations {
+			if o.Action == "FetchUpstream" && o.UpstreamURL == upstreamURL {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Error("got no upstream fetch on /statusz, want the one in flight")
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	rec := statusz("/statusz")
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("got Content-Type %q, want HTML", got)
+	}
+	if !strings.Contains(rec.Body.String(), "operations running") {
+		t.Errorf("got %q, want the status page", rec.Body.String())
+	}
+}
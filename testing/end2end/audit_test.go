@@ -0,0 +1,96 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestAuditLogger(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	var mu sync.Mutex
+	var buf bytes.Buffer
+	jsonLogger := goblet.NewJSONAuditLogger(&buf)
+	ts.ServerConfig.AuditLogger = func(e *goblet.AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		jsonLogger(e)
+	}
+	ts.ServerConfig.ClientIdentifier = func(r *http.Request) string {
+		return "test-client"
+	}
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash = strings.TrimSpace(hash)
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	events := map[string]*goblet.AuditEvent{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		e := &goblet.AuditEvent{}
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			t.Fatalf("cannot parse %q: %v", line, err)
+		}
+		events[e.Command] = e
+	}
+	repo := strings.TrimSuffix(ts.UpstreamServerURL, "/")
+	lsRefs, fetch := events["ls-refs"], events["fetch"]
+	if lsRefs == nil || fetch == nil {
+		t.Fatalf("got %s, want an ls-refs and a fetch", buf.String())
+	}
+	for _, e := range []*goblet.AuditEvent{lsRefs, fetch} {
+		if e.ClientIdentity != "test-client" || e.RemoteIP == "" || e.Repo != repo || e.BytesServed == 0 || e.Error != "" {
+			t.Errorf("got %+v, want a successful %s of %s by test-client", e, e.Command, repo)
+		}
+	}
+	if !containsString(lsRefs.RefPrefixes, "refs/heads/master") {
+		t.Errorf("got ref prefixes %v, want refs/heads/master", lsRefs.RefPrefixes)
+	}
+	if !containsString(fetch.WantRefs, "refs/heads/master") {
+		t.Errorf("got want-refs %v, want refs/heads/master", fetch.WantRefs)
+	}
+	if !containsString(fetch.Wants, hash) {
+		t.Errorf("got wants %v, want %s", fetch.Wants, hash)
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
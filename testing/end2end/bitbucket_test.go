@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/google/goblet/bitbucket"
+	"golang.org/x/oauth2"
+)
+
+func TestBitbucketTokenSource(t *testing.T) {
+	tests := []struct {
+		name         string
+		ts           oauth2.TokenSource
+		wantUser     string
+		wantPassword string
+		wantBearer   string
+	}{
+		{"password", bitbucket.NewPasswordTokenSource("alice", "app-password"), "alice", "app-password", ""},
+		{"cloud", bitbucket.NewCloudAccessTokenSource("cloud-token"), "x-token-auth", "cloud-token", ""},
+		{"server", bitbucket.NewServerAccessTokenSource("server-token"), "", "", "server-token"},
+	}
+	for _, tc := range tests {
+		token, err := tc.ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := http.NewRequest("GET", "https://bitbucket.org/", nil)
+		token.SetAuthHeader(r)
+		if tc.wantBearer != "" {
+			if got, want := r.Header.Get("Authorization"), "Bearer "+tc.wantBearer; got != want {
+				t.Errorf("%s: got %q, want %q", tc.name, got, want)
+			}
+			continue
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok || user != tc.wantUser || password != tc.wantPassword {
+			t.Errorf("%s: got %q:%q, want %q:%q", tc.name, user, password, tc.wantUser, tc.wantPassword)
+		}
+	}
+}
+
+func TestBitbucketURLCanonicalizer(t *testing.T) {
+	cloud := bitbucket.NewCloudURLCanonicalizer()
+	server := bitbucket.NewServerURLCanonicalizer("bitbucket.example.com")
+	tests := []struct {
+		canonicalize func(*url.URL) (*url.URL, error)
+		url          string
+		want         string
+	}{
+		{cloud, "https://bitbucket.org/workspace/repo", "https://bitbucket.org/workspace/repo"},
+		{cloud, "https://bitbucket.org/Workspace/Repo.git/info/refs", "https://bitbucket.org/workspace/repo"},
+		{cloud, "https://bitbucket.org/workspace", ""},
+		{cloud, "https://bitbucket.example.com/scm/proj/repo.git", ""},
+		{cloud, "https://bitbucket.org/workspace/..", ""},
+		{server, "https://bitbucket.example.com/scm/PROJ/repo.git", "https://bitbucket.example.com/scm/proj/repo"},
+		{server, "https://bitbucket.example.com/scm/~alice/repo.git/git-upload-pack", "https://bitbucket.example.com/scm/~alice/repo"},
+		{server, "https://bitbucket.example.com/projects/PROJ/repos/repo", ""},
+		{server, "https://bitbucket.example.com/scm/proj/..", ""},
+		{server, "https://bitbucket.org/workspace/repo", ""},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tc.canonicalize(u)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", tc.url, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+		} else if got.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.url, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_BlockedRepo(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test repository's URL is "http://[::]:port", and its host
+	// cannot be written literally in a pattern.
+	if err := goblet.UpdateBlockedRepos(ts.ServerConfig, []string{"*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got %v, want a 403 error", err)
+	}
+
+	found := false
+	goblet.ListManagedRepositories(func(m goblet.ManagedRepository) {
+		if m.UpstreamURL().Host == u.Host {
+			found = true
+		}
+	})
+	if found {
+		t.Errorf("the blocked repository is not evicted")
+	}
+}
+
+func TestFetch_AllowedRepos(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	for _, p := range []string{"ours", "theirs"} {
+		if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	// The host, "[::]:port", cannot be written literally in a pattern.
+	if err := goblet.UpdateAllowedRepos(ts.ServerConfig, []string{"*/ours"}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	fetch := func(p string) error {
+		_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+p)
+		return err
+	}
+	if err := fetch("ours"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetch("theirs"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got %v, want a 403 error", err)
+	}
+	if got := cachedMaster(t, ts, "theirs"); got != "" {
+		t.Errorf("the repository not allowed is cached at %s", got)
+	}
+
+	// The repositories no longer allowed are evicted.
+	if err := goblet.UpdateAllowedRepos(ts.ServerConfig, []string{"*/theirs"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedMaster(t, ts, "ours"); got != "" {
+		t.Errorf("the repository no longer allowed is cached at %s", got)
+	}
+	if err := fetch("theirs"); err != nil {
+		t.Fatal(err)
+	}
+}
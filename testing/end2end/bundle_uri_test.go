@@ -0,0 +1,201 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestBundleURI(t *testing.T) {
+	bundleRoot, err := ioutil.TempDir("", "goblet_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundleRoot)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		BundleRoot:        bundleRoot,
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", ts.ProxyServerURL+"info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bs, []byte("bundle-uri")) {
+		t.Errorf("bundle-uri is not advertised: %s", bs)
+	}
+
+	uri := waitForBundleURI(t, ts)
+
+	req, err = http.NewRequest("GET", uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cannot download the bundle: %d %s", resp.StatusCode, bs)
+	}
+	bundleFile := filepath.Join(bundleRoot, "downloaded.bundle")
+	if err := ioutil.WriteFile(bundleFile, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bootstrapped := goblettest.NewLocalGitRepo()
+	defer bootstrapped.Close()
+	if _, err := bootstrapped.Run("fetch", bundleFile, "refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bootstrapped.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestBundleURI_BaseURL(t *testing.T) {
+	bundleRoot, err := ioutil.TempDir("", "goblet_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundleRoot)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		BundleRoot:        bundleRoot,
+		BundleBaseURL:     "https://goblet.example.com/",
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := waitForBundleURI(t, ts), "https://goblet.example.com/info/goblet-bundle"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestBundleURI_GitDaemon(t *testing.T) {
+	bundleRoot, err := ioutil.TempDir("", "goblet_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundleRoot)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		BundleRoot:        bundleRoot,
+	})
+	defer ts.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go goblet.ServeGitDaemon(l, goblet.HTTPHandler(ts.ServerConfig))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req := gitprotocolio.BytesPacket("git-upload-pack /example.com/repo.git\x00host=goblet\x00\x00version=2\x00").EncodeToPktLine()
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	sc := gitprotocolio.NewPacketScanner(conn)
+	for sc.Scan() {
+		p, ok := sc.Packet().(gitprotocolio.BytesPacket)
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(string(p), "bundle-uri") {
+			t.Errorf("bundle-uri is advertised to the git:// client")
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForBundleURI fetches the repository so that its bundle is generated in
+// the background, and returns the bundle URI listed once it's generated.
+func waitForBundleURI(t *testing.T, ts *goblettest.TestServer) string {
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		bs, err := ts.SendProtocolV2Request([]*gitprotocolio.ProtocolV2RequestChunk{
+			{Command: "bundle-uri"},
+			{EndCapability: true},
+			{EndRequest: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(bs), "\n") {
+			if i := strings.Index(line, "bundle.goblet.uri="); i >= 0 {
+				return line[i+len("bundle.goblet.uri="):]
+			}
+		}
+	}
+	t.Fatal("no bundle is listed")
+	return ""
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func dirSize(t *testing.T, dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return size
+}
+
+func TestCacheQuota(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		TenantExtractor: func(r *http.Request) string {
+			return r.Header.Get(tenantHeader)
+		},
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tenant a's cache is fetched before tenant b's.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	for _, tenant := range []string{"a", "b"} {
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader="+tenantHeader+": "+tenant, "fetch", ts.ProxyServerURL); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	root := ts.ServerConfig.LocalDiskCacheRoot
+	total := dirSize(t, filepath.Join(root, "a")) + dirSize(t, filepath.Join(root, "b"))
+	ts.ServerConfig.MaxCacheBytes = total
+	if err := goblet.EnforceCacheQuota(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a")); err != nil {
+		t.Errorf("a repository is evicted within the quota: %v", err)
+	}
+
+	ts.ServerConfig.MaxCacheBytes = total - 1
+	if err := goblet.EnforceCacheQuota(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if repos, err := filepath.Glob(filepath.Join(root, "a", "*")); err != nil || len(repos) != 0 {
+		t.Errorf("the least recently fetched repository is not evicted: %v %v", repos, err)
+	}
+	if out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader="+tenantHeader+": b", "ls-remote", ts.ProxyServerURL, "refs/heads/master"); err != nil {
+		t.Error(err)
+	} else if got := strings.Fields(out)[0]; got != strings.TrimSpace(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
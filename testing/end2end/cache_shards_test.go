@@ -0,0 +1,163 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+var shardTestForks []string
+
+func init() {
+	// Enough repositories that they don't end up in one root by chance.
+	for c := 'a'; c <= 'p'; c++ {
+		shardTestForks = append(shardTestForks, "fork-"+string(c))
+	}
+}
+
+func shardTestServerConfig(shardRoots []string) *goblettest.TestServerConfig {
+	return &goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+		CacheShardRoots:   shardRoots,
+	}
+}
+
+func newShardTestServer(t *testing.T, shardRoots []string) *goblettest.TestServer {
+	ts := goblettest.NewTestServer(shardTestServerConfig(shardRoots))
+	// The upstream serves the same repository under multiple paths.
+	for _, fork := range shardTestForks {
+		if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), fork)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func newShardRoots(t *testing.T, n int) []string {
+	roots := []string{}
+	for i := 0; i < n; i++ {
+		dir, err := ioutil.TempDir("", "goblet_shard")
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, dir)
+	}
+	return roots
+}
+
+func fetchShardTestForks(t *testing.T, ts *goblettest.TestServer) {
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	for _, fork := range shardTestForks {
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+fork); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkShardedOnce checks that each fork is cached in exactly one of the
+// roots, and returns the number of the forks in each root.
+func checkShardedOnce(t *testing.T, ts *goblettest.TestServer, roots []string) map[string]int {
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, fork := range shardTestForks {
+		found := []string{}
+		for _, root := range roots {
+			if _, err := os.Stat(filepath.Join(root, u.Host, fork, "HEAD")); err == nil {
+				found = append(found, root)
+				counts[root]++
+			}
+		}
+		if len(found) != 1 {
+			t.Errorf("%s is cached in %v, want exactly one root", fork, found)
+		}
+	}
+	return counts
+}
+
+func TestCacheShards(t *testing.T) {
+	shardRoots := newShardRoots(t, 2)
+	for _, root := range shardRoots {
+		defer os.RemoveAll(root)
+	}
+	ts := newShardTestServer(t, shardRoots)
+	defer ts.Close()
+
+	fetchShardTestForks(t, ts)
+	roots := append([]string{ts.ServerConfig.LocalDiskCacheRoot}, shardRoots...)
+	counts := checkShardedOnce(t, ts, roots)
+	if len(counts) < 2 {
+		t.Errorf("got %v, want the repositories spread across the roots", counts)
+	}
+
+	// The repositories in all roots are listed.
+	listed := 0
+	for _, r := range listAdminRepos(t, ts) {
+		if strings.HasPrefix(r.UpstreamURL, ts.UpstreamServerURL+"fork-") {
+			listed++
+		}
+	}
+	if listed != len(shardTestForks) {
+		t.Errorf("got %d repositories, want %d", listed, len(shardTestForks))
+	}
+}
+
+func TestCacheShards_Rebalance(t *testing.T) {
+	ts := newShardTestServer(t, nil)
+	defer ts.Close()
+	fetchShardTestForks(t, ts)
+
+	// Add a root. Some repositories now belong to it.
+	shardRoots := newShardRoots(t, 1)
+	defer os.RemoveAll(shardRoots[0])
+	ts.Restart(shardTestServerConfig(shardRoots))
+	if err := goblet.RebalanceCacheShards(ts.ServerConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The requests find the moved repositories instead of cloning them
+	// again in the new root.
+	fetchShardTestForks(t, ts)
+	roots := append([]string{ts.ServerConfig.LocalDiskCacheRoot}, shardRoots...)
+	counts := checkShardedOnce(t, ts, roots)
+	if counts[shardRoots[0]] == 0 {
+		t.Errorf("got %v, want some repositories moved to the new root", counts)
+	}
+
+	// Remove the root. Its repositories move back.
+	ts.Restart(shardTestServerConfig(nil))
+	if err := goblet.RebalanceCacheShards(ts.ServerConfig, shardRoots); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkShardedOnce(t, ts, roots); got[shardRoots[0]] != 0 {
+		t.Errorf("got %v, want no repository in the removed root", got)
+	}
+}
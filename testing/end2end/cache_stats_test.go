@@ -0,0 +1,104 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+type adminRepoStats struct {
+	UpstreamURL   string `json:"upstream_url"`
+	Hits          int64  `json:"hits"`
+	StaleHits     int64  `json:"stale_hits"`
+	Misses        int64  `json:"misses"`
+	HitBytes      int64  `json:"hit_bytes"`
+	StaleHitBytes int64  `json:"stale_hit_bytes"`
+	MissBytes     int64  `json:"miss_bytes"`
+}
+
+// repoStats returns the cache stats of the repository at the path.
+func repoStats(t *testing.T, ts *goblettest.TestServer, p string) *adminRepoStats {
+	req := httptest.NewRequest("GET", "/admin/repos/stats", nil)
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	rec := httptest.NewRecorder()
+	goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+	var resp struct {
+		Total        *adminRepoStats   `json:"total"`
+		Repositories []*adminRepoStats `json:"repositories"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("cannot parse %q: %v", rec.Body.String(), err)
+	}
+	for _, r := range resp.Repositories {
+		if r.UpstreamURL == ts.UpstreamServerURL+p {
+			return r
+		}
+	}
+	t.Fatalf("%s is not in %s", p, rec.Body.String())
+	return nil
+}
+
+func TestAdmin_RepoStats(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+	})
+	defer ts.Close()
+	if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), "stats")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	// Cache it ahead so that the first fetch is served from the cache.
+	ts.ServerConfig.WarmRepositories = []string{ts.ProxyServerURL + "stats"}
+	if err := goblet.WarmUpRepositories(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	fetch := func() {
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+"stats"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ls-refs queries the upstream as FetchFreshnessWindow is zero, and
+	// finds the cache up to date.
+	fetch()
+	st := repoStats(t, ts, "stats")
+	if st.StaleHits != 1 || st.Hits != 1 || st.Misses != 0 || st.HitBytes == 0 {
+		t.Errorf("got %+v, want a stale ls-refs and a fetch hit", st)
+	}
+
+	// ls-refs finds the new commit. The fetch is a miss unless the
+	// background fetch started by ls-refs has completed.
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	fetch()
+	st = repoStats(t, ts, "stats")
+	if st.StaleHits != 1 || st.Misses < 1 || st.Hits+st.Misses != 3 {
+		t.Errorf("got %+v, want a missed ls-refs and a fetch", st)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestAllowedClientCapabilities(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:         goblettest.TestRequestAuthorizer,
+		TokenSource:               goblettest.TestTokenSource,
+		AllowedClientCapabilities: []string{"agent", "object-format", "symrefs", "peel", "unborn", "thin-pack", "ofs-delta", "no-progress", "include-tag"},
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Run("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := ts.SendProtocolV2Request([]*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want " + strings.TrimSpace(want) + "\n")},
+		{Argument: []byte("filter blob:none\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	}); err == nil || !strings.Contains(err.Error(), "filter is not allowed") {
+		t.Errorf("a fetch with a filter is not rejected: %v", err)
+	}
+	if !fetchesPack(t, ts, fetchRequest(want)) {
+		t.Errorf("cannot fetch without a filter")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestLsRefs_CircuitBreaker(t *testing.T) {
+	openDuration := time.Second
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:   goblettest.TestRequestAuthorizer,
+		TokenSource:         goblettest.TestTokenSource,
+		CircuitErrorRate:    0.1,
+		CircuitMinRequests:  1,
+		CircuitOpenDuration: openDuration,
+	})
+	defer ts.Close()
+	if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), "uncached")); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	run := func(args ...string) (string, error) {
+		return client.Run(append([]string{"-c", "http.extraHeader=Authorization: Bearer " + goblettest.ValidClientAuthToken}, args...)...)
+	}
+	if _, err := run("fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failure opens the circuit.
+	ts.FailUpstreamRequests(1)
+	run("ls-remote", ts.ProxyServerURL)
+	latest, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached refs are served without querying the upstream, and the
+	// uncached repositories fail fast.
+	if out, err := run("ls-remote", ts.ProxyServerURL); err != nil || !strings.Contains(out, strings.TrimSpace(cached)) || strings.Contains(out, strings.TrimSpace(latest)) {
+		t.Errorf("got %q, %v, want the cached %s", out, err, cached)
+	}
+	if _, err := run("ls-remote", ts.ProxyServerURL+"uncached"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want 503", err)
+	}
+
+	// The probe after the open duration closes the circuit.
+	time.Sleep(openDuration)
+	if out, err := run("ls-remote", ts.ProxyServerURL); err != nil || !strings.Contains(out, strings.TrimSpace(latest)) {
+		t.Errorf("got %q, %v, want the latest %s", out, err, latest)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+// doneOperation sends the error of the operation to errCh when it's done.
+type doneOperation struct {
+	errCh chan error
+}
+
+func (o *doneOperation) Printf(string, ...interface{}) {}
+
+func (o *doneOperation) Done(err error) {
+	o.errCh <- err
+}
+
+func TestClientCancel_UpstreamFetch(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamLatency:   3 * time.Second,
+	})
+	defer ts.Close()
+	fetchErrCh := make(chan error, 10)
+	ts.ServerConfig.LongRunningOperationLogger = func(action string, u *url.URL) goblet.RunningOperation {
+		if action != "FetchUpstream" {
+			return &doneOperation{make(chan error, 1)}
+		}
+		return &doneOperation{fetchErrCh}
+	}
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := time.Now()
+	sendCanceledFetch(t, ts, hash, 500*time.Millisecond)
+
+	// The upstream fetch is stopped without waiting for the upstream.
+	select {
+	case err := <-fetchErrCh:
+		if err == nil || !strings.Contains(err.Error(), "canceled") {
+			t.Errorf("got %v, want the upstream fetch canceled", err)
+		}
+		if d := time.Since(startTime); d >= 3*time.Second {
+			t.Errorf("got the upstream fetch stopped in %v, want before the upstream responds", d)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the upstream fetch is not stopped")
+	}
+}
+
+func TestClientCancel_NextFetch(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamLatency:   time.Second,
+	})
+	defer ts.Close()
+	fetchErrCh := make(chan error, 10)
+	ts.ServerConfig.LongRunningOperationLogger = func(action string, u *url.URL) goblet.RunningOperation {
+		if action != "FetchUpstream" {
+			return &doneOperation{make(chan error, 1)}
+		}
+		return &doneOperation{fetchErrCh}
+	}
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendCanceledFetch(t, ts, hash, 1500*time.Millisecond)
+	select {
+	case err := <-fetchErrCh:
+		if err == nil {
+			t.Fatal("got the upstream fetch done, want it stopped")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("the upstream fetch is not stopped")
+	}
+
+	// The stopped fetch leaves no locks behind, and the next fetch of the
+	// repository succeeds.
+	err = filepath.Walk(ts.ServerConfig.LocalDiskCacheRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name := info.Name(); strings.HasSuffix(name, ".lock") || strings.HasPrefix(name, "tmp_pack_") {
+			t.Errorf("got %s left behind", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fetchesPack(t, ts, fetchRequest(hash)) {
+		t.Error("cannot fetch after the upstream fetch is stopped")
+	}
+}
+
+func TestClientCancel_SharedUpstreamFetch(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamLatency:   2 * time.Second,
+	})
+	defer ts.Close()
+	fetchErrCh := make(chan error, 10)
+	ts.ServerConfig.LongRunningOperationLogger = func(action string, u *url.URL) goblet.RunningOperation {
+		if action != "FetchUpstream" {
+			return &doneOperation{make(chan error, 1)}
+		}
+		return &doneOperation{fetchErrCh}
+	}
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One of the two clients waiting for the upstream fetch goes away. The
+	// fetch continues for the other.
+	fetched := make(chan bool, 1)
+	go func() {
+		fetched <- fetchesPack(t, ts, fetchRequest(hash))
+	}()
+	sendCanceledFetch(t, ts, hash, 500*time.Millisecond)
+	if !<-fetched {
+		t.Error("cannot fetch after the other client goes away")
+	}
+	select {
+	case err := <-fetchErrCh:
+		if err != nil {
+			t.Errorf("got %v, want the upstream fetch done", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the upstream fetch is not done")
+	}
+}
+
+// sendCanceledFetch sends a fetch request of hash, and goes away after
+// timeout.
+func sendCanceledFetch(t *testing.T, ts *goblettest.TestServer, hash string, timeout time.Duration) {
+	b := new(bytes.Buffer)
+	for _, c := range fetchRequest(hash) {
+		b.Write(c.EncodeToPktLine())
+	}
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+"git-upload-pack", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Add("Git-Protocol", "version=2")
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		resp.Body.Close()
+	}
+}
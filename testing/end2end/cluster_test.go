@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+func TestLsRefs_Cluster(t *testing.T) {
+	forwards := &view.View{Name: "test/cluster-forward-count", Measure: goblet.ClusterForwardCount, Aggregation: view.Count()}
+	if err := view.Register(forwards); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(forwards)
+
+	replicas := []*goblettest.TestServer{}
+	for i := 0; i < 2; i++ {
+		ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+			RequestAuthorizer: goblettest.TestRequestAuthorizer,
+			TokenSource:       goblettest.TestTokenSource,
+		})
+		defer ts.Close()
+		replicas = append(replicas, ts)
+	}
+	hash, err := replicas[0].CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{}
+	for _, ts := range replicas {
+		urls = append(urls, strings.TrimSuffix(ts.ProxyServerURL, "/"))
+	}
+	for i, ts := range replicas {
+		// Both replicas serve the same upstream.
+		ts.ServerConfig.URLCanonializer = replicas[0].ServerConfig.URLCanonializer
+		ts.ServerConfig.ClusterReplicas = urls
+		ts.ServerConfig.ClusterSelf = urls[i]
+	}
+
+	// Exactly one of the replicas forwards the request to the other, and
+	// both respond the same.
+	responses := [][]byte{}
+	for _, ts := range replicas {
+		bs, err := ts.SendProtocolV2Request(lsRefsRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(bs), strings.TrimSpace(hash)) {
+			t.Errorf("got %q, want %s", bs, hash)
+		}
+		responses = append(responses, bs)
+	}
+	if !bytes.Equal(responses[0], responses[1]) {
+		t.Errorf("got %q and %q, want the same response", responses[0], responses[1])
+	}
+	if got := viewCount(t, forwards.Name); got != 1 {
+		t.Errorf("got %d forwards, want 1", got)
+	}
+}
+
+func TestSSHFetch_Cluster(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("no ssh client")
+	}
+	forwards := &view.View{Name: "test/cluster-forward-count", Measure: goblet.ClusterForwardCount, Aggregation: view.Count()}
+	if err := view.Register(forwards); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(forwards)
+
+	// The SSH clients have no credentials that the owner replica can
+	// check. It trusts the identity signed by the other replica with the
+	// secret. Without it, the requests are not forwarded.
+	for _, secret := range []string{"cluster-secret", ""} {
+		before := viewCount(t, forwards.Name)
+		fetchOverSSHFromCluster(t, secret)
+		if got := viewCount(t, forwards.Name) - before; secret != "" && got == 0 {
+			t.Errorf("got no forwards, want the requests to the other replica forwarded")
+		} else if secret == "" && got != 0 {
+			t.Errorf("got %d forwards without the secret, want none", got)
+		}
+	}
+}
+
+// fetchOverSSHFromCluster fetches over SSH from each replica of a cluster of
+// two with the secret.
+func fetchOverSSHFromCluster(t *testing.T, secret string) {
+	dir, err := ioutil.TempDir("", "goblet_ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostKey, _ := newSSHKey(t, dir, "host")
+	clientKey, clientKeyPath := newSSHKey(t, dir, "client")
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	replicas := []*goblettest.TestServer{}
+	for i := 0; i < 2; i++ {
+		ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+			RequestAuthorizer: goblettest.TestRequestAuthorizer,
+			TokenSource:       goblettest.TestTokenSource,
+			AccessRules: []*goblet.AccessRule{
+				{Identities: []string{"team-a/*"}, SourceRanges: []*net.IPNet{loopback}, Repos: []string{"*"}},
+			},
+		})
+		defer ts.Close()
+		replicas = append(replicas, ts)
+	}
+	want, err := replicas[0].CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{}
+	for _, ts := range replicas {
+		urls = append(urls, strings.TrimSuffix(ts.ProxyServerURL, "/"))
+	}
+	for i, ts := range replicas {
+		ts.ServerConfig.URLCanonializer = replicas[0].ServerConfig.URLCanonializer
+		ts.ServerConfig.ClusterReplicas = urls
+		ts.ServerConfig.ClusterSelf = urls[i]
+		ts.ServerConfig.ClusterSecret = secret
+	}
+
+	for _, ts := range replicas {
+		l := serveSSHOnTestServer(t, ts, hostKey, clientKey, "team-a/builder")
+		defer l.Close()
+		client := goblettest.NewLocalGitRepo()
+		defer client.Close()
+		if _, err := client.Run("-c", sshCommand(clientKeyPath), "fetch", fmt.Sprintf("ssh://git@%s/example.com/repo.git", l.Addr())); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+			t.Error(err)
+		} else if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
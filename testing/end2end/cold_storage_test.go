@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// memoryColdStorage is a ColdStorage in memory.
+type memoryColdStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memoryColdStorage) Upload(ctx context.Context, name string, r io.Reader) error {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[name] = bs
+	return nil
+}
+
+func (s *memoryColdStorage) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, ok := s.objects[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(bs)), nil
+}
+
+func TestFetch_ColdStorage(t *testing.T) {
+	restores := &view.View{Name: "test/cold-storage-restore-count", Measure: goblet.ColdStorageRestoreCount, Aggregation: view.Count()}
+	if err := view.Register(restores); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(restores)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	storage := &memoryColdStorage{objects: map[string][]byte{}}
+	ts.ServerConfig.ColdStorage = storage
+	ts.ServerConfig.ColdStorageAfter = time.Nanosecond
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	fetch := func() {
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetch()
+
+	if err := goblet.MoveColdRepositories(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.objects) != 1 {
+		t.Fatalf("got %d objects in the cold storage, want 1", len(storage.objects))
+	}
+	filepath.Walk(ts.ServerConfig.LocalDiskCacheRoot, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == "HEAD" {
+			t.Errorf("got %s, want the repository to be removed from the disk", p)
+		}
+		return nil
+	})
+
+	// The next fetch restores the repository.
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	fetch()
+	if got := viewCount(t, restores.Name); got != 1 {
+		t.Errorf("got %d restores, want 1", got)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestCommitGraph(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := filepath.Glob(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, "*"))
+	if err != nil || len(repos) != 1 {
+		t.Fatalf("cannot find the cached repository: %v %v", repos, err)
+	}
+	chain := filepath.Join(repos[0], "objects", "info", "commit-graphs", "commit-graph-chain")
+	if _, err := os.Stat(chain); err != nil {
+		t.Fatalf("the commit-graph is not written: %v", err)
+	}
+	if _, err := goblettest.GitRepo(repos[0]).Run("commit-graph", "verify"); err != nil {
+		t.Errorf("the commit-graph is broken: %v", err)
+	}
+
+	// The commit-graph is updated by the following fetches.
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.Stat(chain); err != nil {
+		t.Fatal(err)
+	} else if !after.ModTime().After(before.ModTime()) {
+		t.Errorf("the commit-graph is not updated")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_MaxUpstreamFetches(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:  goblettest.TestRequestAuthorizer,
+		TokenSource:        goblettest.TestTokenSource,
+		UpstreamLatency:    500 * time.Millisecond,
+		MaxUpstreamFetches: 1,
+	})
+	defer ts.Close()
+	for _, p := range []string{"first", "second"} {
+		if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(p string) error {
+		client := goblettest.NewLocalGitRepo()
+		defer client.Close()
+		_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+p)
+		return err
+	}
+
+	// The first repository is fetched from the upstream after its ls-refs,
+	// and the second one is fetched after its ls-refs while the first one
+	// is still fetched.
+	done := make(chan error, 1)
+	go func() {
+		done <- fetch("first")
+	}()
+	time.Sleep(600 * time.Millisecond)
+	if err := fetch("second"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want the fetch to be rejected while the other repository is fetched", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// The requests of the first repository can leave a redundant upstream
+	// fetch running after they finish.
+	for i := 0; ; i++ {
+		err := fetch("second")
+		if err == nil {
+			break
+		}
+		if i == 10 {
+			t.Fatalf("cannot fetch after the other fetch: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func TestFetch_MaxRepoRequests(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamLatency:   time.Second,
+		MaxRepoRequests:   1,
+	})
+	defer ts.Close()
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ts.SendProtocolV2Request(fetchRequest(hash))
+		done <- err
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := ts.SendProtocolV2Request(fetchRequest(hash)); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want the second request to be rejected", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.SendProtocolV2Request(fetchRequest(hash)); err != nil {
+		t.Errorf("cannot fetch after the first request: %v", err)
+	}
+}
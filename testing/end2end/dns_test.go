@@ -0,0 +1,79 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_PinnedUpstreamHostIP(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+		UpstreamHostname:  "goblet-upstream.invalid",
+		UpstreamHostIPs:   map[string]string{"goblet-upstream.invalid": "127.0.0.1"},
+	})
+	defer ts.Close()
+
+	fetchAndCheckDNSCache(t, ts, `"host": "goblet-upstream.invalid"`)
+}
+
+func TestFetch_DNSCache(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+		UpstreamHostname:  "localhost",
+		DNSCacheTTL:       time.Minute,
+	})
+	defer ts.Close()
+
+	fetchAndCheckDNSCache(t, ts, `"host": "localhost"`)
+}
+
+func fetchAndCheckDNSCache(t *testing.T, ts *goblettest.TestServer, wantEntry string) {
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Run("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	req := httptest.NewRequest("GET", "/admin/info", nil)
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	rec := httptest.NewRecorder()
+	goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), wantEntry) {
+		t.Errorf("got %s, want a DNS cache entry %s", rec.Body.String(), wantEntry)
+	}
+}
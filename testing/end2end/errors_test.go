@@ -0,0 +1,155 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"golang.org/x/oauth2"
+)
+
+// postUploadPack sends a protocol v2 request to the proxy server, and returns
+// the response status and header.
+func postUploadPack(ts *goblettest.TestServer, chunks []*gitprotocolio.ProtocolV2RequestChunk) (int, http.Header, error) {
+	b := new(bytes.Buffer)
+	for _, c := range chunks {
+		b.Write(c.EncodeToPktLine())
+	}
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+"git-upload-pack", b)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Add("Git-Protocol", "version=2")
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header, nil
+}
+
+func TestErrorCategory(t *testing.T) {
+	missing := strings.Repeat("1", 40)
+	tests := []struct {
+		name         string
+		tokenSource  oauth2.TokenSource
+		prepare      func(ts *goblettest.TestServer)
+		request      []*gitprotocolio.ProtocolV2RequestChunk
+		wantStatus   int
+		wantCategory goblet.ErrorCategory
+		wantReported bool
+	}{
+		{
+			name:         "upstream-auth",
+			tokenSource:  oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "invalid-server-auth-token"}),
+			request:      lsRefsRequest,
+			wantStatus:   http.StatusOK,
+			wantCategory: goblet.ErrorCategoryUpstreamAuth,
+			wantReported: true,
+		},
+		{
+			name: "upstream-unavailable",
+			prepare: func(ts *goblettest.TestServer) {
+				ts.FailUpstreamRequests(1)
+			},
+			request:      lsRefsRequest,
+			wantStatus:   http.StatusOK,
+			wantCategory: goblet.ErrorCategoryUpstreamUnavailable,
+			wantReported: true,
+		},
+		{
+			name:         "not-found",
+			request:      fetchRequest(missing),
+			wantStatus:   http.StatusOK,
+			wantCategory: goblet.ErrorCategoryNotFound,
+		},
+		{
+			name: "overloaded",
+			prepare: func(ts *goblettest.TestServer) {
+				ts.ServerConfig.ShedDuringEviction = true
+			},
+			request:      fetchRequest(missing),
+			wantStatus:   http.StatusServiceUnavailable,
+			wantCategory: goblet.ErrorCategoryOverloaded,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			reported := []error{}
+			tokenSource := tc.tokenSource
+			if tokenSource == nil {
+				tokenSource = goblettest.TestTokenSource
+			}
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer: goblettest.TestRequestAuthorizer,
+				TokenSource:       tokenSource,
+				ErrorReporter: func(r *http.Request, err error) {
+					mu.Lock()
+					reported = append(reported, err)
+					mu.Unlock()
+				},
+			})
+			defer ts.Close()
+			if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+				t.Fatal(err)
+			}
+			if tc.prepare != nil {
+				tc.prepare(ts)
+			}
+
+			// The eviction pass sheds the cache misses only with
+			// ShedDuringEviction.
+			endEviction := goblet.StartEvictionPass()
+			code, header, err := postUploadPack(ts, tc.request)
+			endEviction()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tc.wantStatus {
+				t.Errorf("got %d, want %d", code, tc.wantStatus)
+			}
+			if got := header.Get("X-Goblet-Error-Category"); got != string(tc.wantCategory) {
+				t.Errorf("got %q, want %q in the header", got, tc.wantCategory)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !tc.wantReported {
+				if len(reported) != 0 {
+					t.Errorf("got %v reported, want none", reported)
+				}
+				return
+			}
+			if len(reported) != 1 {
+				t.Fatalf("got %v reported, want one error", reported)
+			}
+			if got := goblet.ErrorCategoryOf(reported[0]); got != tc.wantCategory {
+				t.Errorf("got %q reported, want %q", got, tc.wantCategory)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFakeUpstream(t *testing.T) {
+	upstream := goblettest.NewFakeUpstream(&goblettest.FakeUpstreamConfig{RequireAuthentication: true})
+	defer upstream.Close()
+	upstream.AddRepository("org/a")
+	upstream.AddRepository("org/b")
+
+	dir, err := ioutil.TempDir("", "goblet_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	proxy := httptest.NewServer(goblet.HTTPHandler(&goblet.ServerConfig{
+		LocalDiskCacheRoot: dir,
+		URLCanonializer:    upstream.URLCanonicalizer,
+		RequestAuthorizer:  goblettest.TestRequestAuthorizer,
+		TokenSource:        goblettest.TestTokenSource,
+	}))
+	defer proxy.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	fetch := func(name string) (string, error) {
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", proxy.URL+"/"+name, "master"); err != nil {
+			return "", err
+		}
+		return client.Run("rev-parse", "FETCH_HEAD")
+	}
+
+	for _, name := range []string{"org/a", "org/b"} {
+		want, err := upstream.CreateRandomCommit(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fetch(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %s, want %s from %s", got, want, name)
+		}
+		if upstream.RequestCount(name) == 0 {
+			t.Errorf("got no upstream request for %s", name)
+		}
+	}
+
+	// An injected failure fails the fetch through the proxy.
+	upstream.FailRequests(1, http.StatusServiceUnavailable)
+	if _, err := fetch("org/a"); err == nil {
+		t.Error("got no error, want the injected failure")
+	}
+
+	upstream.SetLatency(100 * time.Millisecond)
+	startTime := time.Now()
+	if _, err := fetch("org/a"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(startTime); d < 100*time.Millisecond {
+		t.Errorf("got %v, want the fetch to take the latency", d)
+	}
+
+	if _, err := fetch("org/missing"); err == nil || !strings.Contains(err.Error(), "fatal") {
+		t.Errorf("got %v, want an error for the missing repository", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+func TestFetch_Coalesced(t *testing.T) {
+	coalesced := &view.View{Name: "test/coalesced-fetch-count", Measure: goblet.CoalescedFetchCount, Aggregation: view.Count()}
+	if err := view.Register(coalesced); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(coalesced)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		CoalesceFetches:   true,
+	})
+	defer ts.Close()
+
+	// An incompressible blob makes the pack generation long enough for the
+	// fetches to overlap.
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	blob := make([]byte, 4<<20)
+	if _, err := rand.Read(blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(string(pushClient), "blob"), blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("add", "blob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("commit", "-m", "blob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("push", "-f", string(ts.UpstreamGitRepo), "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := pushClient.Run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache the repository first.
+	if _, err := ts.SendProtocolV2Request(fetchRequest(hash)); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	resps := make([][]byte, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bs, err := ts.SendProtocolV2Request(fetchRequest(hash))
+			if err != nil {
+				t.Error(err)
+			}
+			resps[i] = bs
+		}(i)
+	}
+	wg.Wait()
+	for i, bs := range resps {
+		if !bytes.Contains(bs, []byte("PACK")) || !bytes.Equal(bs, resps[0]) {
+			t.Errorf("response %d differs from the first one", i)
+		}
+	}
+
+	if viewCount(t, coalesced.Name) == 0 {
+		t.Errorf("no fetch is coalesced")
+	}
+}
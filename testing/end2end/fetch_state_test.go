@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"context"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+// memoryFetchStateStore is a FetchStateStore in memory.
+type memoryFetchStateStore struct {
+	mu         sync.Mutex
+	fetchTimes map[string]time.Time
+	locked     map[string]bool
+}
+
+func (s *memoryFetchStateStore) LastFetchTime(ctx context.Context, repo string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetchTimes[repo], nil
+}
+
+func (s *memoryFetchStateStore) SetLastFetchTime(ctx context.Context, repo string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetchTimes[repo] = t
+	return nil
+}
+
+func (s *memoryFetchStateStore) TryLockFetch(ctx context.Context, repo string, ttl time.Duration) (func(), bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked[repo] {
+		return nil, false, nil
+	}
+	s.locked[repo] = true
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.locked, repo)
+	}, true, nil
+}
+
+func TestFetch_SharedFetchState(t *testing.T) {
+	shared := &view.View{Name: "test/shared-fetch-count", Measure: goblet.SharedFetchCount, Aggregation: view.Count()}
+	if err := view.Register(shared); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(shared)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	store := &memoryFetchStateStore{fetchTimes: map[string]time.Time{}, locked: map[string]bool{}}
+	ts.ServerConfig.FetchStateStore = store
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	fetch := func() error {
+		_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+		return err
+	}
+	if err := fetch(); err != nil {
+		t.Fatal(err)
+	}
+	repo := strings.TrimSuffix(ts.UpstreamServerURL, "/")
+	firstFetch, _ := store.LastFetchTime(context.Background(), repo)
+	if firstFetch.IsZero() {
+		t.Fatalf("got no last fetch time of %s", repo)
+	}
+
+	// Another replica fetches the new commit while holding the lock.
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, _, _ := store.TryLockFetch(context.Background(), repo, time.Minute)
+	errCh := make(chan error, 1)
+	go func() { errCh <- fetch() }()
+
+	u, err := url.Parse(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := goblettest.TestTokenSource.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "-c", "http.extraHeader=Authorization: Bearer "+token.AccessToken, "fetch", "origin")
+	cmd.Dir = filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, u.Host, u.Path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	store.SetLastFetchTime(context.Background(), repo, time.Now())
+	release()
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := viewCount(t, shared.Name); got == 0 {
+		t.Error("got no shared fetches, want the fetch of the other replica to be used")
+	}
+}
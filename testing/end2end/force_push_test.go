@@ -0,0 +1,104 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestForcePush_KeepOldObjects(t *testing.T) {
+	if !fetchOldTipAfterForcePush(t, goblet.ForcePushKeepOldObjects) {
+		t.Errorf("cannot fetch the force-pushed commit")
+	}
+}
+
+func TestForcePush_ServeImmediately(t *testing.T) {
+	if fetchOldTipAfterForcePush(t, goblet.ForcePushServeImmediately) {
+		t.Errorf("the force-pushed commit is unexpectedly retained")
+	}
+}
+
+// fetchOldTipAfterForcePush simulates a client that has seen the ref
+// advertisement before a force-push, and sends the fetch request after the
+// cache is updated and garbage-collected. It returns true if the client gets
+// a pack.
+func fetchOldTipAfterForcePush(t *testing.T, policy goblet.ForcePushPolicy) bool {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		ForcePushPolicy:   policy,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+
+	oldHash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// CreateRandomCommitUpstream force-pushes an unrelated commit.
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "gc", "--prune=now", "--quiet")
+	cmd.Dir = filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, u.Host)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git gc failed: %v\n%s", err, out)
+	}
+
+	bs, err := ts.SendProtocolV2Request([]*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want " + strings.TrimSpace(oldHash) + "\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	})
+	if err != nil {
+		return false
+	}
+	sc := gitprotocolio.NewPacketScanner(bytes.NewReader(bs))
+	for sc.Scan() {
+		p, ok := sc.Packet().(gitprotocolio.BytesPacket)
+		if !ok {
+			continue
+		}
+		if sb, ok := gitprotocolio.ParseSideBandPacket(p).(gitprotocolio.SideBandMainPacket); ok && bytes.HasPrefix(sb, []byte("PACK")) {
+			return true
+		}
+	}
+	return false
+}
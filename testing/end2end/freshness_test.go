@@ -0,0 +1,68 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestLsRefs_RepoOverrideFreshnessWindow(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+		RepoOverrides: []*goblet.RepoOverride{
+			{Pattern: "*", FetchFreshnessWindow: time.Hour},
+		},
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new commit is not visible until the freshness window passes.
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL, "refs/heads/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(out)[0]; got != strings.TrimSpace(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	req := httptest.NewRequest("GET", "/admin/repos", nil)
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	rec := httptest.NewRecorder()
+	goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"fetch_freshness_window": "1h0m0s"`) {
+		t.Errorf("got %s, want the effective freshness window", rec.Body.String())
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestGerritChangeRefPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        goblet.GerritChangeRefPolicy
+		wantAdvertise bool
+		wantFetch     bool
+		wantCached    []string
+	}{
+		{"advertise", goblet.GerritChangeRefsAdvertise, true, true, []string{"refs/changes/01/1/1", "refs/changes/02/2/1"}},
+		{"hide", goblet.GerritChangeRefsHide, false, false, nil},
+		{"fetch-on-demand", goblet.GerritChangeRefsFetchOnDemand, false, true, []string{"refs/changes/01/1/1"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer:     goblettest.TestRequestAuthorizer,
+				TokenSource:           goblettest.TestTokenSource,
+				GerritChangeRefPolicy: tc.policy,
+			})
+			defer ts.Close()
+
+			pushClient := goblettest.NewLocalGitRepo()
+			defer pushClient.Close()
+			master, err := pushClient.CreateRandomCommit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			change1, err := pushClient.CreateRandomCommit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			change2, err := pushClient.CreateRandomCommit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo),
+				strings.TrimSpace(master)+":refs/heads/master",
+				strings.TrimSpace(change1)+":refs/changes/01/1/1",
+				strings.TrimSpace(change2)+":refs/changes/02/2/1"); err != nil {
+				t.Fatal(err)
+			}
+
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(out, "refs/changes/"); got != tc.wantAdvertise {
+				t.Errorf("change refs advertised = %t, want %t: %s", got, tc.wantAdvertise, out)
+			}
+
+			_, err = client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "refs/changes/01/1/1")
+			if got := err == nil; got != tc.wantFetch {
+				t.Fatalf("change ref fetched = %t, want %t: %v", got, tc.wantFetch, err)
+			}
+			if tc.wantFetch {
+				got, err := client.Run("rev-parse", "FETCH_HEAD")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != change1 {
+					t.Errorf("got %s, want %s", got, change1)
+				}
+			}
+
+			if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "master"); err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(ts.UpstreamServerURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("git", "for-each-ref", "--format=%(refname)", "refs/changes/")
+			cmd.Dir = filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, u.Host)
+			bs, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.Fields(string(bs)), tc.wantCached; strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("cached change refs = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestGitDaemonFetch(t *testing.T) {
+	_, otherRange, _ := net.ParseCIDR("192.0.2.0/24")
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The upstream test server serves the repository at the root.
+	proxy := goblet.HTTPHandler(ts.ServerConfig)
+	go goblet.ServeGitDaemon(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/repo.git")
+		proxy.ServeHTTP(w, r)
+	}))
+	remote := fmt.Sprintf("git://%s/example.com/repo.git", l.Addr())
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "protocol.version=2", "fetch", remote); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := client.Run("-c", "protocol.version=0", "fetch", remote); err == nil {
+		t.Errorf("the fetch with the protocol v0 succeeds")
+	}
+	if _, err := client.Run("push", remote, "FETCH_HEAD:refs/heads/other"); err == nil {
+		t.Errorf("the push succeeds")
+	}
+
+	for _, p := range []string{"/example.com/../repo.git", "/../repo.git", "/example.com/./repo.git"} {
+		if _, err := client.Run("-c", "protocol.version=2", "fetch", fmt.Sprintf("git://%s%s", l.Addr(), p)); err == nil {
+			t.Errorf("the fetch of %s succeeds", p)
+		}
+	}
+
+	if err := goblet.UpdateSettings(ts.ServerConfig, &goblet.ServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AccessRules:       []*goblet.AccessRule{{SourceRanges: []*net.IPNet{otherRange}, Repos: []string{"*"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "protocol.version=2", "fetch", remote); err == nil {
+		t.Errorf("the fetch from outside of the source ranges succeeds")
+	}
+}
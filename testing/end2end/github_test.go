@@ -0,0 +1,140 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet/github"
+)
+
+func TestGitHubAppTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != "POST" || r.URL.Path != "/app/installations/42/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			http.Error(w, "not a JWT", http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims struct {
+			Issuer string `json:"iss"`
+		}
+		if err := json.Unmarshal(payload, &claims); err != nil || claims.Issuer != "7" {
+			http.Error(w, "wrong issuer", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      "installation-token",
+			"expires_at": time.Now().Add(time.Hour),
+		})
+	}))
+	defer api.Close()
+
+	ts, err := github.NewAppTokenSource(&github.AppConfig{
+		AppID:          7,
+		InstallationID: 42,
+		PrivateKeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		APIURL:         api.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := token.Type(); got != "Basic" {
+			t.Errorf("got the token type %q, want Basic", got)
+		}
+		bs, err := base64.StdEncoding.DecodeString(token.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(bs), "x-access-token:installation-token"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("got %d access token requests, want the token to be reused", requests)
+	}
+}
+
+func TestGitHubURLCanonicalizer(t *testing.T) {
+	canonicalize := github.NewURLCanonicalizer("github.com")
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/google/goblet", "https://github.com/google/goblet"},
+		{"https://github.com/Google/Goblet.git", "https://github.com/google/goblet"},
+		{"https://github.com/google/goblet/info/refs", "https://github.com/google/goblet"},
+		{"https://github.com/google/goblet.git/git-upload-pack", "https://github.com/google/goblet"},
+		{"https://github.com/google", ""},
+		{"https://github.com/google/goblet/tree/master", ""},
+		{"https://github.com/google/..", ""},
+		{"https://github.com/google/...git", ""},
+		{"https://github.com/google/%2e%2e/info/refs", ""},
+		{"https://gitlab.com/google/goblet", ""},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := canonicalize(u)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", tc.url, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+		} else if got.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.url, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/google/goblet/gitlab"
+	"golang.org/x/oauth2"
+)
+
+func TestGitLabTokenSource(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   oauth2.TokenSource
+		want string
+	}{
+		{"personal", gitlab.NewPersonalAccessTokenSource("glpat-token"), "oauth2:glpat-token"},
+		{"job", gitlab.NewJobTokenSource("job-token"), "gitlab-ci-token:job-token"},
+	}
+	for _, tc := range tests {
+		token, err := tc.ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := token.Type(); got != "Basic" {
+			t.Errorf("%s: got the token type %q, want Basic", tc.name, got)
+		}
+		bs, err := base64.StdEncoding.DecodeString(token.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(bs); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGitLabURLCanonicalizer(t *testing.T) {
+	canonicalize := gitlab.NewURLCanonicalizer("gitlab.example.com")
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://gitlab.example.com/group/project", "https://gitlab.example.com/group/project"},
+		{"https://gitlab.example.com/Group/Project.git", "https://gitlab.example.com/group/project"},
+		{"https://gitlab.example.com/group/sub/project.git/info/refs", "https://gitlab.example.com/group/sub/project"},
+		{"https://gitlab.example.com/group/sub/project/git-upload-pack", "https://gitlab.example.com/group/sub/project"},
+		{"https://gitlab.example.com/group/project/-/tree/main", "https://gitlab.example.com/group/project"},
+		{"http://gitlab.example.com/group/project", "http://gitlab.example.com/group/project"},
+		{"https://gitlab.example.com/project", ""},
+		{"https://gitlab.example.com/group/../project", ""},
+		{"https://gitlab.com/group/project", ""},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := canonicalize(u)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", tc.url, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+		} else if got.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.url, got, tc.want)
+		}
+	}
+}
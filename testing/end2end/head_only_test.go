@@ -0,0 +1,139 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestLsRefs_HeadOnly(t *testing.T) {
+	ttl := 500 * time.Millisecond
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		HeadOnlyCacheTTL:  ttl,
+	})
+	defer ts.Close()
+
+	master, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsRefsHead := func() string {
+		bs, err := ts.SendProtocolV2Request([]*gitprotocolio.ProtocolV2RequestChunk{
+			{Command: "ls-refs"},
+			{EndCapability: true},
+			{Argument: []byte("symrefs\n")},
+			{Argument: []byte("ref-prefix HEAD\n")},
+			{EndRequest: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(bs)
+	}
+	wantHead := func(target string) string {
+		return strings.TrimSpace(master) + " HEAD symref-target:" + target
+	}
+
+	if got := lsRefsHead(); !strings.Contains(got, wantHead("refs/heads/master")) {
+		t.Errorf("got %q, want HEAD pointing to master", got)
+	}
+	// Populate the cache.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the upstream HEAD to another branch.
+	if _, err := ts.UpstreamGitRepo.Run("branch", "main", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.UpstreamGitRepo.Run("symbolic-ref", "HEAD", "refs/heads/main"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The change is not visible until the TTL passes.
+	if got := lsRefsHead(); !strings.Contains(got, wantHead("refs/heads/master")) {
+		t.Errorf("got %q, want the cached HEAD", got)
+	}
+	time.Sleep(ttl)
+	if got := lsRefsHead(); !strings.Contains(got, wantHead("refs/heads/main")) {
+		t.Errorf("got %q, want HEAD pointing to main", got)
+	}
+	// The local HEAD follows the upstream.
+	if got := lsRefsHead(); !strings.Contains(got, wantHead("refs/heads/main")) {
+		t.Errorf("got %q, want the cached HEAD pointing to main", got)
+	}
+}
+
+func TestLsRefs_HeadOnlyTag(t *testing.T) {
+	headOnlyView := &view.View{Name: "test/head-only-command-count", Measure: goblet.InboundCommandCount, TagKeys: []tag.Key{goblet.CommandTypeKey, goblet.HeadOnlyKey}, Aggregation: view.Count()}
+	if err := view.Register(headOnlyView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(headOnlyView)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"HEAD", "refs/heads/"} {
+		if _, err := ts.SendProtocolV2Request([]*gitprotocolio.ProtocolV2RequestChunk{
+			{Command: "ls-refs"},
+			{EndCapability: true},
+			{Argument: []byte("symrefs\n")},
+			{Argument: []byte("ref-prefix " + prefix + "\n")},
+			{EndRequest: true},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := view.RetrieveData(headOnlyView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, row := range rows {
+		var command, headOnly string
+		for _, tg := range row.Tags {
+			switch tg.Key {
+			case goblet.CommandTypeKey:
+				command = tg.Value
+			case goblet.HeadOnlyKey:
+				headOnly = tg.Value
+			}
+		}
+		got[command+" "+headOnly] += row.Data.(*view.CountData).Value
+	}
+	if got["ls-refs true"] != 1 || got["ls-refs false"] != 1 {
+		t.Errorf("got %v, want one HEAD-only and one other ls-refs", got)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"strings"
+
+	"github.com/google/gitprotocolio"
+)
+
+// fetchRequest returns a protocol v2 fetch request that wants hash.
+func fetchRequest(hash string) []*gitprotocolio.ProtocolV2RequestChunk {
+	return []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want " + strings.TrimSpace(hash) + "\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	}
+}
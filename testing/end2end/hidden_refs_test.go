@@ -0,0 +1,91 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestHiddenRefs(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		HiddenRefs:        []string{"refs/heads/internal"},
+	})
+	defer ts.Close()
+
+	// The internal branch is one commit ahead of master.
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	public, err := pushClient.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hidden, err := pushClient.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), strings.TrimSpace(public)+":refs/heads/master", strings.TrimSpace(hidden)+":refs/heads/internal/secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "internal") || strings.Contains(out, strings.TrimSpace(hidden)) {
+		t.Errorf("the hidden ref is advertised: %s", out)
+	}
+
+	// This populates the cache with all upstream refs, including the hidden
+	// one.
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "master"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("cat-file", "-e", strings.TrimSpace(hidden)); err == nil {
+		t.Errorf("the hidden commit is fetched")
+	}
+
+	if !fetchesPack(t, ts, fetchRequest(public)) {
+		t.Errorf("cannot fetch a visible commit by SHA-1")
+	}
+	if fetchesPack(t, ts, fetchRequest(hidden)) {
+		t.Errorf("can fetch a hidden commit by SHA-1")
+	}
+	if fetchesPack(t, ts, []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want-ref refs/heads/internal/secret\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	}) {
+		t.Errorf("can fetch a hidden ref by want-ref")
+	}
+}
+
+func fetchesPack(t *testing.T, ts *goblettest.TestServer, chunks []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	bs, err := ts.SendProtocolV2Request(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Contains(bs, []byte("PACK")) && !bytes.Contains(bs, []byte("ERR "))
+}
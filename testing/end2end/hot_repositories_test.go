@@ -0,0 +1,77 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestRefreshHotRepositories(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		FetchFreshnessWindow: time.Hour,
+	})
+	defer ts.Close()
+	for _, p := range []string{"hot", "cold"} {
+		if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts.ServerConfig.HotRepositoryCount = 1
+
+	first, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache them ahead so that the requests don't fetch them in the
+	// background.
+	ts.ServerConfig.WarmRepositories = []string{ts.ProxyServerURL + "hot", ts.ProxyServerURL + "cold"}
+	if err := goblet.WarmUpRepositories(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	fetch := func(p string) {
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		fetch("hot")
+	}
+	fetch("cold")
+
+	second, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goblet.RefreshHotRepositories(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedMaster(t, ts, "hot"); got != strings.TrimSpace(second) {
+		t.Errorf("got %q, want the hot repository refreshed to %s", got, second)
+	}
+	if got := cachedMaster(t, ts, "cold"); got != strings.TrimSpace(first) {
+		t.Errorf("got %q, want the cold repository left at %s", got, first)
+	}
+}
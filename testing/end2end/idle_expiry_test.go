@@ -0,0 +1,62 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestEvictIdleRepositories(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		TenantExtractor: func(r *http.Request) string {
+			return r.Header.Get(tenantHeader)
+		},
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tenant a's cache becomes idle while tenant b's is fetched.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	for _, tenant := range []string{"a", "b"} {
+		time.Sleep(time.Second)
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader="+tenantHeader+": "+tenant, "fetch", ts.ProxyServerURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts.ServerConfig.IdleRepositoryTTL = 500 * time.Millisecond
+	if err := goblet.EvictIdleRepositories(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	root := ts.ServerConfig.LocalDiskCacheRoot
+	if repos, err := filepath.Glob(filepath.Join(root, "a", "*")); err != nil || len(repos) != 0 {
+		t.Errorf("the idle repository is not evicted: %v %v", repos, err)
+	}
+	if repos, err := filepath.Glob(filepath.Join(root, "b", "*")); err != nil || len(repos) != 1 {
+		t.Errorf("the recently fetched repository is evicted: %v %v", repos, err)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	goblettest "github.com/google/goblet/testing"
+)
+
+type sidebandStats struct {
+	emptyMainPackets     int
+	keepaliveProgress    int
+	otherProgressPackets int
+	hasPack              bool
+}
+
+func TestFetch_ClientKeepalive(t *testing.T) {
+	st := fetchWithSlowUpstream(t, false)
+	if st.keepaliveProgress == 0 {
+		t.Errorf("got no keepalive progress packets")
+	}
+	if !st.hasPack {
+		t.Errorf("got no pack")
+	}
+}
+
+func TestFetch_ClientKeepaliveNoProgress(t *testing.T) {
+	st := fetchWithSlowUpstream(t, true)
+	if st.emptyMainPackets == 0 {
+		t.Errorf("got no keepalive packets")
+	}
+	if st.keepaliveProgress != 0 || st.otherProgressPackets != 0 {
+		t.Errorf("got progress packets with no-progress")
+	}
+	if !st.hasPack {
+		t.Errorf("got no pack")
+	}
+}
+
+func TestFetch_ClientKeepaliveWantRef(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:       goblettest.TestRequestAuthorizer,
+		TokenSource:             goblettest.TestTokenSource,
+		ClientKeepaliveInterval: 100 * time.Millisecond,
+		UpstreamLatency:         500 * time.Millisecond,
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The wanted-refs section precedes the packfile section, so no
+	// keepalives can be sent before it.
+	bs, err := ts.SendProtocolV2Request([]*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want-ref refs/heads/master\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantedRef := gitprotocolio.BytesPacket(strings.TrimSpace(hash) + " refs/heads/master\n").EncodeToPktLine()
+	packfile := gitprotocolio.BytesPacket("packfile\n").EncodeToPktLine()
+	if i, j := bytes.Index(bs, wantedRef), bytes.Index(bs, packfile); i < 0 || j < i {
+		t.Errorf("the response doesn't have the wanted-refs section before the packfile: %q", bs)
+	}
+	if !bytes.Contains(bs, []byte("PACK")) {
+		t.Errorf("the response doesn't have a pack")
+	}
+}
+
+func fetchWithSlowUpstream(t *testing.T, noProgress bool) sidebandStats {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:       goblettest.TestRequestAuthorizer,
+		TokenSource:             goblettest.TestTokenSource,
+		ClientKeepaliveInterval: 100 * time.Millisecond,
+		UpstreamLatency:         500 * time.Millisecond,
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want " + strings.TrimSpace(hash) + "\n")},
+	}
+	if noProgress {
+		chunks = append(chunks, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("no-progress\n")})
+	}
+	chunks = append(chunks,
+		&gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("done\n")},
+		&gitprotocolio.ProtocolV2RequestChunk{EndRequest: true},
+	)
+	bs, err := ts.SendProtocolV2Request(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := sidebandStats{}
+	sc := gitprotocolio.NewPacketScanner(bytes.NewReader(bs))
+	seenHeader := false
+	for sc.Scan() {
+		p, ok := sc.Packet().(gitprotocolio.BytesPacket)
+		if !ok {
+			continue
+		}
+		if !seenHeader {
+			if string(p) != "packfile\n" {
+				t.Fatalf("got %q, want the packfile section header", string(p))
+			}
+			seenHeader = true
+			continue
+		}
+		switch sb := gitprotocolio.ParseSideBandPacket(p).(type) {
+		case gitprotocolio.SideBandMainPacket:
+			if len(sb) == 0 {
+				st.emptyMainPackets++
+			} else if bytes.HasPrefix(sb, []byte("PACK")) {
+				st.hasPack = true
+			}
+		case gitprotocolio.SideBandReportPacket:
+			if bytes.HasPrefix(sb, []byte("Waiting for the upstream fetch")) {
+				st.keepaliveProgress++
+			} else {
+				st.otherProgressPackets++
+			}
+		case gitprotocolio.SideBandErrorPacket:
+			t.Fatalf("got an error: %s", string(sb))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+type lfsBatchObject struct {
+	OID     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Actions map[string]struct {
+		Href   string            `json:"href"`
+		Header map[string]string `json:"header"`
+	} `json:"actions"`
+	Error *struct {
+		Code int `json:"code"`
+	} `json:"error"`
+}
+
+func lfsBatch(t *testing.T, ts *goblettest.TestServer, operation string, oids ...string) (int, []*lfsBatchObject) {
+	return lfsBatchIn(t, ts, "repo.git", operation, oids...)
+}
+
+// lfsBatchIn sends a batch request to the LFS API of the repository at the
+// path of the proxy server.
+func lfsBatchIn(t *testing.T, ts *goblettest.TestServer, repoPath, operation string, oids ...string) (int, []*lfsBatchObject) {
+	var objects []map[string]interface{}
+	for _, oid := range oids {
+		objects = append(objects, map[string]interface{}{"oid": oid, "size": 0})
+	}
+	bs, _ := json.Marshal(map[string]interface{}{"operation": operation, "transfers": []string{"basic"}, "objects": objects})
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+repoPath+"/info/lfs/objects/batch", bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	var body struct {
+		Objects []*lfsBatchObject `json:"objects"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body.Objects
+}
+
+func lfsDownload(t *testing.T, o *lfsBatchObject) []byte {
+	action, ok := o.Actions["download"]
+	if !ok {
+		t.Fatalf("no download action for %s", o.OID)
+	}
+	req, err := http.NewRequest("GET", action.Href, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range action.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cannot download %s: %d %s", o.OID, resp.StatusCode, bs)
+	}
+	return bs
+}
+
+func TestLFSDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goblet_lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		LFSCacheRoot:      dir,
+	})
+	defer ts.Close()
+	content := []byte("large binary")
+	oid := ts.AddUpstreamLFSObject(content)
+	missing := fmt.Sprintf("%064x", 0)
+
+	for i := 0; i < 2; i++ {
+		code, objects := lfsBatch(t, ts, "download", oid, missing)
+		if code != http.StatusOK {
+			t.Fatalf("got %d, want 200", code)
+		}
+		if len(objects) != 2 {
+			t.Fatalf("got %d objects, want 2", len(objects))
+		}
+		if got := lfsDownload(t, objects[0]); !bytes.Equal(got, content) {
+			t.Errorf("got %q, want %q", got, content)
+		}
+		if objects[1].Error == nil || objects[1].Error.Code != http.StatusNotFound {
+			t.Errorf("got %+v for a missing object, want a 404 error", objects[1])
+		}
+	}
+	if got := ts.UpstreamLFSObjectServedCount(); got != 1 {
+		t.Errorf("the upstream served the object %d times, want 1", got)
+	}
+
+	if code, _ := lfsBatch(t, ts, "upload", oid); code == http.StatusOK {
+		t.Errorf("the upload succeeds")
+	}
+}
+
+func TestLFSEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goblet_lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		LFSCacheRoot:      dir,
+		LFSCacheMaxBytes:  150,
+	})
+	defer ts.Close()
+	first := ts.AddUpstreamLFSObject(bytes.Repeat([]byte("a"), 100))
+	second := ts.AddUpstreamLFSObject(bytes.Repeat([]byte("b"), 100))
+
+	for _, oid := range []string{first, second, first} {
+		_, objects := lfsBatch(t, ts, "download", oid)
+		lfsDownload(t, objects[0])
+	}
+	// The first object is evicted when the second one is cached.
+	if got := ts.UpstreamLFSObjectServedCount(); got != 3 {
+		t.Errorf("the upstream served the objects %d times, want 3", got)
+	}
+}
+
+func TestLFSDownload_OtherRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goblet_lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		LFSCacheRoot:      dir,
+	})
+	defer ts.Close()
+	oid := ts.AddUpstreamLFSObjectToRepo("/a.git", []byte("only in a"))
+
+	// Cache the object through the repository that has it.
+	_, objects := lfsBatchIn(t, ts, "a.git", "download", oid)
+	if len(objects) != 1 {
+		t.Fatalf("got %d objects, want 1", len(objects))
+	}
+	lfsDownload(t, objects[0])
+
+	// Another repository gets neither the action nor the object.
+	_, objects = lfsBatchIn(t, ts, "b.git", "download", oid)
+	if len(objects) != 1 || objects[0].Error == nil || objects[0].Error.Code != http.StatusNotFound {
+		t.Errorf("got %+v from the other repository, want a 404 error", objects)
+	}
+	req, err := http.NewRequest("GET", ts.ProxyServerURL+"b.git/info/lfs/objects/"+oid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %d for the object from the other repository, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func countBitmapIndexes(t *testing.T, repo string) int {
+	fis, err := ioutil.ReadDir(filepath.Join(repo, "objects", "pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmaps := 0
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".bitmap") {
+			bitmaps++
+		}
+	}
+	return bitmaps
+}
+
+func TestMaintenance(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repos, err := filepath.Glob(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, "*"))
+	if err != nil || len(repos) != 1 {
+		t.Fatalf("cannot find the cached repository: %v %v", repos, err)
+	}
+	cached := goblettest.GitRepo(repos[0])
+
+	ts.ServerConfig.MaintenanceInterval = time.Hour
+	if err := goblet.RunMaintenancePass(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := cached.Run("count-objects", "-v"); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(out, "packs: 1\n") {
+		t.Errorf("the objects are not repacked: %s", out)
+	}
+	if bitmaps := countBitmapIndexes(t, repos[0]); bitmaps != 1 {
+		t.Errorf("got %d bitmap indexes, want 1", bitmaps)
+	}
+
+	// The repository is not maintained again within the interval.
+	marker := filepath.Join(repos[0], "goblet-last-maintenance")
+	before, err := os.Stat(marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goblet.RunMaintenancePass(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.Stat(marker); err != nil {
+		t.Fatal(err)
+	} else if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("the repository is maintained again within the interval")
+	}
+
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Errorf("cannot fetch after the maintenance: %v", err)
+	}
+}
+
+func TestMaintenance_InitialFetch(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:   goblettest.TestRequestAuthorizer,
+		TokenSource:         goblettest.TestTokenSource,
+		MaintenanceInterval: time.Hour,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bitmap index is written in the background without waiting for
+	// a maintenance pass.
+	repos, err := filepath.Glob(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, "*"))
+	if err != nil || len(repos) != 1 {
+		t.Fatalf("cannot find the cached repository: %v %v", repos, err)
+	}
+	// Wait for the whole maintenance as the old and the new bitmap indexes
+	// coexist while repacking.
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(repos[0], "goblet-last-maintenance")); err == nil {
+			break
+		}
+	}
+	if bitmaps := countBitmapIndexes(t, repos[0]); bitmaps != 1 {
+		t.Errorf("got %d bitmap indexes, want 1", bitmaps)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestNegativeCache_MissingRepository(t *testing.T) {
+	ttl := time.Second
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		NegativeCacheTTL:  ttl,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	lsRemote := func() (string, error) {
+		return client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL+"missing")
+	}
+
+	if _, err := lsRemote(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("got %v, want the upstream 404", err)
+	}
+
+	// The repository is created upstream, but the 404 is remembered until
+	// the TTL passes.
+	if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), "missing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsRemote(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want the cached 404", err)
+	}
+	time.Sleep(ttl)
+	if out, err := lsRemote(); err != nil || !strings.Contains(out, "refs/heads/master") {
+		t.Errorf("got %q, %v, want the upstream refs", out, err)
+	}
+}
+
+func TestNegativeCache_Disabled(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	lsRemote := func() (string, error) {
+		return client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL+"missing")
+	}
+
+	if _, err := lsRemote(); err == nil {
+		t.Fatal("ls-remote of a missing repository succeeded")
+	}
+	if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), "missing")); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := lsRemote(); err != nil || !strings.Contains(out, "refs/heads/master") {
+		t.Errorf("got %q, %v, want the upstream refs", out, err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_MaxNegotiationRounds(t *testing.T) {
+	var mu sync.Mutex
+	var reported []error
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		MaxNegotiationRounds: 3,
+		ErrorReporter: func(r *http.Request, err error) {
+			mu.Lock()
+			reported = append(reported, err)
+			mu.Unlock()
+		},
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that keeps sending unknown haves never converges.
+	negotiate := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want " + strings.TrimSpace(hash) + "\n")},
+		{Argument: []byte("have 0123456789012345678901234567890123456789\n")},
+		{EndRequest: true},
+	}
+	for i := 0; i < 3; i++ {
+		bs, err := ts.SendProtocolV2Request(negotiate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(bs, []byte("ERR ")) {
+			t.Fatalf("round %d is aborted: %s", i+1, bs)
+		}
+	}
+	bs, err := ts.SendProtocolV2Request(negotiate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bs, []byte("ERR ")) {
+		t.Errorf("got %q, want the negotiation to be aborted", bs)
+	}
+	mu.Lock()
+	if len(reported) != 1 {
+		t.Errorf("got %d reported errors, want 1", len(reported))
+	}
+	mu.Unlock()
+
+	// The limit is per negotiation.
+	if _, err := ts.SendProtocolV2Request(fetchRequest(hash)); err != nil {
+		t.Errorf("cannot fetch after an aborted negotiation: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestObjectPool(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		RepoOverrides: []*goblet.RepoOverride{
+			{Pattern: "*/fork-*", ObjectPool: "project"},
+		},
+	})
+	defer ts.Close()
+
+	// The upstream serves the same repository as two forks.
+	for _, fork := range []string{"fork-a", "fork-b"} {
+		if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), fork)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+"fork-a"); err != nil {
+		t.Fatal(err)
+	}
+	ts.ServerConfig.MaintenanceInterval = time.Hour
+	if err := goblet.RunMaintenancePass(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// The objects of fork-a are moved to the pool, and fork-b borrows
+	// them without storing its own copy.
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+"fork-b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	hosts, err := filepath.Glob(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range hosts {
+		if filepath.Base(host) == "goblet-object-pools" {
+			continue
+		}
+		for _, fork := range []string{"fork-a", "fork-b"} {
+			out, err := goblettest.GitRepo(filepath.Join(host, fork)).Run("count-objects", "-v")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, "count: 0\n") || !strings.Contains(out, "in-pack: 0\n") {
+				t.Errorf("%s stores its own objects: %s", fork, out)
+			}
+		}
+	}
+	out, err := goblettest.GitRepo(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, "goblet-object-pools", "project")).Run("cat-file", "-t", strings.TrimSpace(want))
+	if err != nil || strings.TrimSpace(out) != "commit" {
+		t.Errorf("the pool doesn't have the commit: %s %v", out, err)
+	}
+}
+
+func TestObjectPool_CacheQuota(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		RepoOverrides: []*goblet.RepoOverride{
+			{Pattern: "*/fork-*", ObjectPool: "project"},
+		},
+	})
+	defer ts.Close()
+
+	for _, fork := range []string{"fork-a", "fork-b"} {
+		if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), fork)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+"fork-a"); err != nil {
+		t.Fatal(err)
+	}
+	ts.ServerConfig.MaintenanceInterval = time.Hour
+	if err := goblet.RunMaintenancePass(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+"fork-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	root := ts.ServerConfig.LocalDiskCacheRoot
+	pool := filepath.Join(root, "goblet-object-pools", "project")
+	total := dirSize(t, root)
+	ts.ServerConfig.MaxCacheBytes = total
+	if err := goblet.EnforceCacheQuota(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pool); err != nil {
+		t.Errorf("the pool is removed within the quota: %v", err)
+	}
+
+	// The repositories are within the quota only without the pool. The
+	// pool is removed after both forks are evicted.
+	ts.ServerConfig.MaxCacheBytes = total - dirSize(t, pool)
+	if err := goblet.EnforceCacheQuota(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pool); !os.IsNotExist(err) {
+		t.Errorf("the orphaned pool is not removed: %v", err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+"fork-b"); err != nil {
+		t.Errorf("cannot fetch after the pool is removed: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_Offline(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), "uncached")); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := goblettest.NewLocalGitRepo()
+	defer seed.Close()
+	if _, err := seed.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any upstream request fails from now on.
+	ts.Restart(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		Offline:           true,
+	})
+	ts.FailUpstreamRequests(1000)
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	run := func(args ...string) (string, error) {
+		return client.Run(append([]string{"-c", "http.extraHeader=Authorization: Bearer " + goblettest.ValidClientAuthToken}, args...)...)
+	}
+	if _, err := run("fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("rev-parse", "FETCH_HEAD"); err != nil || strings.TrimSpace(out) != strings.TrimSpace(cached) {
+		t.Errorf("got %q, %v, want the cached %s", out, err, cached)
+	}
+	if _, err := run("fetch", ts.ProxyServerURL, strings.TrimSpace(latest)); err == nil || !strings.Contains(err.Error(), "goblet is offline") {
+		t.Errorf("got %v, want the uncached objects not to be fetched", err)
+	}
+	if _, err := run("ls-remote", ts.ProxyServerURL+"uncached"); err == nil || !strings.Contains(err.Error(), "is not cached, and goblet is offline") {
+		t.Errorf("got %v, want the repository not to be cached", err)
+	}
+	filepath.Walk(ts.ServerConfig.LocalDiskCacheRoot, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == "uncached" {
+			t.Errorf("got %s created for the uncached repository", p)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/goblet/oidc"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestOIDCRequestAuthorizer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": issuer.URL + "/jwks"})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kid": "key1",
+					"kty": "RSA",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer issuer.Close()
+
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key1", "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		hash := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	authorizer, err := oidc.NewRequestAuthorizer(issuer.URL, "goblet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: authorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", sign(map[string]interface{}{"iss": issuer.URL, "aud": "goblet", "exp": exp}), true},
+		{"audience list", sign(map[string]interface{}{"iss": issuer.URL, "aud": []string{"other", "goblet"}, "exp": exp}), true},
+		{"wrong audience", sign(map[string]interface{}{"iss": issuer.URL, "aud": "other", "exp": exp}), false},
+		{"wrong issuer", sign(map[string]interface{}{"iss": "https://example.com", "aud": "goblet", "exp": exp}), false},
+		{"expired", sign(map[string]interface{}{"iss": issuer.URL, "aud": "goblet", "exp": time.Now().Add(-time.Hour).Unix()}), false},
+		{"not a JWT", goblettest.ValidClientAuthToken, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+tc.token, "ls-remote", ts.ProxyServerURL)
+			if tc.ok && err != nil {
+				t.Errorf("got %v, want the token to be accepted", err)
+			} else if !tc.ok && err == nil {
+				t.Errorf("the token is accepted")
+			}
+		})
+	}
+
+	v, err := oidc.NewVerifier(issuer.URL, "goblet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		token string
+		want  string
+	}{
+		{sign(map[string]interface{}{"iss": issuer.URL, "aud": "goblet", "exp": exp, "sub": "builder@example.com"}), "builder@example.com"},
+		{sign(map[string]interface{}{"iss": issuer.URL, "aud": "other", "exp": exp, "sub": "builder@example.com"}), ""},
+	} {
+		r, _ := http.NewRequest("GET", ts.ProxyServerURL, nil)
+		r.Header.Set("Authorization", "Bearer "+tc.token)
+		if got := v.Subject(r); got != tc.want {
+			t.Errorf("got the subject %q, want %q", got, tc.want)
+		}
+		// The claims verified by Authorize are used for the
+		// subject.
+		if err := v.Authorize(r); (err == nil) != (tc.want != "") {
+			t.Errorf("got %v, want the token to be accepted %t", err, tc.want != "")
+		}
+		if got := v.Subject(r); got != tc.want {
+			t.Errorf("got the subject %q after Authorize, want %q", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestOperationsHandler(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamLatency:   200 * time.Millisecond,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+		errCh <- err
+	}()
+
+	handler := goblet.OperationsHandler(ts.ServerConfig)
+	dump := func() string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/operations", nil))
+		return rec.Body.String()
+	}
+	waitForDump := func(cond func(string) bool, msg string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for got := dump(); !cond(got); got = dump() {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %q, want %s", got, msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	want := "FetchUpstream " + strings.TrimSuffix(ts.UpstreamServerURL, "/")
+	waitForDump(func(got string) bool {
+		return strings.Contains(got, want) && strings.Contains(got, "goroutine ")
+	}, "the upstream fetch in flight and the goroutine dump")
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	waitForDump(func(got string) bool {
+		return strings.HasPrefix(got, "0 operations in flight\n")
+	}, "no operations in flight after the fetch")
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// otlpMetricRequest is the part of the OTLP/HTTP metrics request that the
+// test checks.
+type otlpMetricRequest struct {
+	ResourceMetrics []struct {
+		ScopeMetrics []struct {
+			Metrics []struct {
+				Name string
+				Sum  *struct {
+					DataPoints []struct {
+						Attributes []struct {
+							Key   string
+							Value struct{ StringValue string }
+						}
+						AsInt string
+					}
+				}
+				Histogram *struct {
+					DataPoints []struct {
+						Count        string
+						BucketCounts []string
+					}
+				}
+			}
+		}
+	}
+}
+
+// otlpCollector records the data points of the metrics sent to it by
+// "<metric name> <attribute values>".
+type otlpCollector struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &otlpMetricRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Sum != nil {
+					for _, p := range m.Sum.DataPoints {
+						key := m.Name
+						for _, a := range p.Attributes {
+							key += " " + a.Key + "=" + a.Value.StringValue
+						}
+						c.values[key] = p.AsInt
+					}
+				}
+				if m.Histogram != nil {
+					for _, p := range m.Histogram.DataPoints {
+						c.values[m.Name] = p.Count
+						if len(p.BucketCounts) != 3 {
+							c.values[m.Name] = "bad bucket counts"
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func (c *otlpCollector) value(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func TestOTLPMetricExporter(t *testing.T) {
+	views := []*view.View{
+		{
+			Name:        "test/otlp-inbound-command-count",
+			TagKeys:     []tag.Key{goblet.CommandTypeKey},
+			Measure:     goblet.InboundCommandCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "test/otlp-upstream-fetch-blocking-time",
+			Measure:     goblet.UpstreamFetchWaitingTime,
+			Aggregation: view.Distribution(100, 1000),
+		},
+	}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	c := &otlpCollector{values: map[string]string{}}
+	collector := httptest.NewServer(c)
+	defer collector.Close()
+	e := goblet.NewOTLPMetricExporter(collector.URL, nil, "goblet-test")
+	defer e.Close()
+	view.RegisterExporter(e)
+	defer view.UnregisterExporter(e)
+	view.SetReportingPeriod(50 * time.Millisecond)
+	defer view.SetReportingPeriod(0)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// The views are reported to the exporter periodically.
+	deadline := time.Now().Add(10 * time.Second)
+	for c.value("test/otlp-inbound-command-count command-type=fetch") == "" && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if err := e.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := c.value("test/otlp-inbound-command-count command-type=fetch"); got != "1" {
+		t.Errorf("got the fetch count %q, want 1", got)
+	}
+	if got := c.value("test/otlp-upstream-fetch-blocking-time"); got != "1" {
+		t.Errorf("got the upstream fetch count %q, want 1", got)
+	}
+}
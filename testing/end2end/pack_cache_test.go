@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+func TestPackCache(t *testing.T) {
+	hits := &view.View{Name: "test/pack-cache-hit-count", Measure: goblet.PackCacheHitCount, Aggregation: view.Count()}
+	misses := &view.View{Name: "test/pack-cache-miss-count", Measure: goblet.PackCacheMissCount, Aggregation: view.Count()}
+	evictions := &view.View{Name: "test/pack-cache-eviction-count", Measure: goblet.PackCacheEvictionCount, Aggregation: view.Count()}
+	if err := view.Register(hits, misses, evictions); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(hits, misses, evictions)
+
+	packCacheRoot, err := ioutil.TempDir("", "goblet_pack_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packCacheRoot)
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		PackCacheRoot:     packCacheRoot,
+		// Only the latest response fits.
+		PackCacheMaxBytes: 1,
+	})
+	defer ts.Close()
+
+	first, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(hash string) []byte {
+		bs, err := ts.SendProtocolV2Request(fetchRequest(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(bs, []byte("PACK")) {
+			t.Fatalf("got %q, want a pack", bs)
+		}
+		return bs
+	}
+	want := fetch(first)
+	if got := fetch(first); !bytes.Equal(got, want) {
+		t.Errorf("the cached response differs from the generated one")
+	}
+	if got := viewCount(t, hits.Name); got != 1 {
+		t.Errorf("got %d hits, want 1", got)
+	}
+	if got := viewCount(t, misses.Name); got != 1 {
+		t.Errorf("got %d misses, want 1", got)
+	}
+
+	// The upstream fetch invalidates the cached responses, and the new
+	// response evicts the old one.
+	second, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch(second)
+	fetch(first)
+	if got := viewCount(t, misses.Name); got != 3 {
+		t.Errorf("got %d misses, want 3", got)
+	}
+	if got := viewCount(t, evictions.Name); got != 2 {
+		t.Errorf("got %d evictions, want 2", got)
+	}
+}
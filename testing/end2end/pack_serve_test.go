@@ -0,0 +1,213 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+func TestPackServe_Retry(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		PackServeTimeout:  time.Minute,
+		RetryPackServe:    true,
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Run("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPackServe_Timeout(t *testing.T) {
+	retries := &view.View{Name: "test/pack-serve-retry-count", Measure: goblet.PackServeRetryCount, Aggregation: view.Count()}
+	kills := &view.View{Name: "test/pack-serve-kill-count", Measure: goblet.PackServeKillCount, Aggregation: view.Count()}
+	if err := view.Register(retries, kills); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(retries, kills)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		PackServeTimeout:  time.Nanosecond,
+		RetryPackServe:    true,
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ts.SendProtocolV2Request(fetchRequest(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bs, []byte("ERR ")) || bytes.Contains(bs, []byte("PACK")) {
+		t.Errorf("got %q, want only an error", bs)
+	}
+
+	if got := viewCount(t, retries.Name); got != 1 {
+		t.Errorf("got %d retries, want 1", got)
+	}
+	if got := viewCount(t, kills.Name); got != 2 {
+		t.Errorf("got %d kills, want 2", got)
+	}
+}
+
+func TestPackServe_RequestErrorIsNotRetried(t *testing.T) {
+	retries := &view.View{Name: "test/pack-serve-retry-count", Measure: goblet.PackServeRetryCount, Aggregation: view.Count()}
+	if err := view.Register(retries); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(retries)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		PackServeTimeout:  time.Minute,
+		RetryPackServe:    true,
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Populate the cache.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// git-upload-pack rejects an unknown argument.
+	bs, _ := ts.SendProtocolV2Request([]*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("unknown-argument\n")},
+		{Argument: []byte("want " + strings.TrimSpace(hash) + "\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	})
+	if bytes.Contains(bs, []byte("PACK")) {
+		t.Errorf("got %q, want no pack", bs)
+	}
+	if got := viewCount(t, retries.Name); got != 0 {
+		t.Errorf("got %d retries, want none for an error of the request", got)
+	}
+}
+
+func TestPackServe_TimeoutDoesNotCoverStreaming(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		PackServeTimeout:  time.Second,
+	})
+	defer ts.Close()
+
+	// A pack larger than the socket buffers keeps git-upload-pack running
+	// while the client doesn't read it.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	content := make([]byte, 16<<20)
+	rand.Read(content)
+	if err := ioutil.WriteFile(filepath.Join(string(client), "large"), content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("add", "large"); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := client.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("push", string(ts.UpstreamGitRepo), "master"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Populate the cache before the request.
+	if err := goblet.SetWarmRepositories(ts.ServerConfig, []string{ts.ProxyServerURL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := goblet.WarmUpRepositories(ts.ServerConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	b := new(bytes.Buffer)
+	for _, c := range fetchRequest(hash) {
+		b.Write(c.EncodeToPktLine())
+	}
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+"git-upload-pack", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Add("Git-Protocol", "version=2")
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// A slow client.
+	time.Sleep(2 * time.Second)
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bs, []byte("ERR ")) || !bytes.HasSuffix(bs, []byte("0000")) {
+		t.Errorf("got a broken response of %d bytes, want the whole pack", len(bs))
+	}
+}
+
+func viewCount(t *testing.T, name string) int64 {
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, row := range rows {
+		n += row.Data.(*view.CountData).Value
+	}
+	return n
+}
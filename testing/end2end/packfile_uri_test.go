@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+// testPackStorage is a storage that the base packs are uploaded to.
+type testPackStorage struct {
+	mu         sync.Mutex
+	packs      map[string][]byte
+	downloaded int
+	server     *httptest.Server
+}
+
+func newTestPackStorage() *testPackStorage {
+	s := &testPackStorage{packs: map[string][]byte{}}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		bs, ok := s.packs[strings.TrimPrefix(r.URL.Path, "/")]
+		if ok {
+			s.downloaded++
+		}
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(bs)
+	}))
+	return s
+}
+
+func (s *testPackStorage) upload(ctx context.Context, name string, pack io.Reader) (string, error) {
+	bs, err := ioutil.ReadAll(pack)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packs[name] = bs
+	return s.server.URL + "/" + name, nil
+}
+
+func (s *testPackStorage) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.packs), s.downloaded
+}
+
+func TestPackfileURI(t *testing.T) {
+	storage := newTestPackStorage()
+	defer storage.server.Close()
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:   goblettest.TestRequestAuthorizer,
+		TokenSource:         goblettest.TestTokenSource,
+		PackfileURIUploader: storage.upload,
+	})
+	defer ts.Close()
+
+	base, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The base pack is uploaded in the background after the repository
+	// is fetched.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if uploaded, _ := storage.counts(); uploaded != 0 {
+			break
+		}
+	}
+	if uploaded, _ := storage.counts(); uploaded != 1 {
+		t.Fatalf("got %d uploaded packs, want 1", uploaded)
+	}
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloned := goblettest.NewLocalGitRepo()
+	defer cloned.Close()
+	if _, err := cloned.Run("-c", "fetch.uriProtocols=http", "-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cloned.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, err := cloned.Run("cat-file", "-e", strings.TrimSpace(base)); err != nil {
+		t.Errorf("the base commit is not fetched: %v", err)
+	}
+	if _, downloaded := storage.counts(); downloaded != 1 {
+		t.Errorf("got %d pack downloads, want 1", downloaded)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+// pushCommitsWithFiles pushes n commits that each add a file to the upstream.
+func pushCommitsWithFiles(t *testing.T, ts *goblettest.TestServer, n int) {
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if err := ioutil.WriteFile(filepath.Join(string(pushClient), name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pushClient.Run("add", name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pushClient.Run("commit", "--message="+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), "master:master"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartialAndShallowFetch(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:         goblettest.TestRequestAuthorizer,
+		TokenSource:               goblettest.TestTokenSource,
+		AllowedClientCapabilities: []string{"agent", "object-format", "symrefs", "peel", "unborn", "thin-pack", "ofs-delta", "no-progress", "include-tag", "filter", "shallow"},
+	})
+	defer ts.Close()
+	pushCommitsWithFiles(t, ts, 3)
+
+	fetch := func(args ...string) goblettest.GitRepo {
+		client := goblettest.NewLocalGitRepo()
+		args = append([]string{"-c", "http.extraHeader=Authorization: Bearer " + goblettest.ValidClientAuthToken, "fetch"}, args...)
+		if _, err := client.Run(append(args, ts.ProxyServerURL, "master")...); err != nil {
+			client.Close()
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	// Cache the repository, and drop the filter setting from it as if it
+	// were created by an older version.
+	fetch().Close()
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := goblettest.GitRepo(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, u.Host))
+	if _, err := cache.Run("config", "--unset", "uploadpack.allowfilter"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := fetch("--filter=blob:none")
+	out, err := client.Run("rev-list", "--objects", "--missing=print", "FETCH_HEAD")
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(out, "?"); got != 3 {
+		t.Errorf("got %d missing objects with blob:none, want 3", got)
+	}
+
+	for _, tc := range []struct {
+		arg  string
+		want string
+	}{
+		{"--depth=1", "1"},
+		{"--depth=2", "2"},
+		{"--shallow-since=2000-01-01", "3"},
+	} {
+		client := fetch(tc.arg)
+		out, err := client.Run("rev-list", "--count", "FETCH_HEAD")
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out = strings.TrimSpace(out); out != tc.want {
+			t.Errorf("%s: got %s commits, want %s", tc.arg, out, tc.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+	"golang.org/x/oauth2"
+)
+
+func TestFetch_Peer(t *testing.T) {
+	peer := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer peer.Close()
+	peerOnly, err := peer.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	ts.ServerConfig.PeerURL = func(u *url.URL) (*url.URL, error) {
+		return url.Parse(peer.ProxyServerURL + strings.TrimPrefix(u.Path, "/"))
+	}
+	ts.ServerConfig.PeerTokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: goblettest.ValidClientAuthToken})
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The commit only in the peer is fetched as the repository is not
+	// cached.
+	bs, err := ts.SendProtocolV2Request(fetchRequest(peerOnly))
+	if err != nil || !strings.Contains(string(bs), "packfile") {
+		t.Errorf("got %q, %v, want the peer commit to be served", bs, err)
+	}
+}
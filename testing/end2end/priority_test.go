@@ -0,0 +1,182 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goblettest "github.com/google/goblet/testing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFetchPriority(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		// The first fetch holds the only slot while it's waiting for
+		// the slow upstream.
+		UpstreamLatency:      500 * time.Millisecond,
+		MaxConcurrentFetches: 1,
+		HighPriorityAuthorizer: func(r *http.Request) error {
+			if r.Header.Get("X-Test-Interactive") == "" {
+				return status.Error(codes.PermissionDenied, "not interactive")
+			}
+			return nil
+		},
+		ShedLowPriority: true,
+	})
+	defer ts.Close()
+
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	hash, err := pushClient.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), "master:master"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	send := func(name string, header http.Header) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ts.SendProtocolV2RequestWithHeader(header, fetchRequest(hash)); err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}()
+		time.Sleep(200 * time.Millisecond)
+	}
+	send("first", nil)
+	send("normal", nil)
+	send("unauthorized-high", http.Header{"Goblet-Priority": {"high"}})
+	send("high", http.Header{"Goblet-Priority": {"high"}, "X-Test-Interactive": {"1"}})
+
+	_, err = ts.SendProtocolV2RequestWithHeader(http.Header{"Goblet-Priority": {"low"}}, fetchRequest(hash))
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("a low priority request is not shed: %v", err)
+	}
+
+	wg.Wait()
+	want := []string{"first", "high", "normal", "unauthorized-high"}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", order, want)
+	}
+	if _, err := ts.SendProtocolV2RequestWithHeader(http.Header{"Goblet-Priority": {"low"}}, fetchRequest(hash)); err != nil {
+		t.Errorf("a low priority request is shed without contention: %v", err)
+	}
+}
+
+func TestUpstreamFetchPriority(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		// The upstream fetches of the normal priority requests take the
+		// three slots they can take while they're waiting for the slow
+		// upstream.
+		UpstreamLatency:    time.Second,
+		MaxUpstreamFetches: 4,
+		ClientIdentifier: func(r *http.Request) string {
+			return r.Header.Get("X-Test-Client")
+		},
+		HighPriorityClients: []string{"interactive-*"},
+	})
+	defer ts.Close()
+	repos := []string{"first", "second", "third", "other"}
+	for _, p := range repos {
+		if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(p, client, priority string) error {
+		b := new(bytes.Buffer)
+		for _, c := range fetchRequest(hash) {
+			b.Write(c.EncodeToPktLine())
+		}
+		req, err := http.NewRequest("POST", ts.ProxyServerURL+p+"/git-upload-pack", b)
+		if err != nil {
+			return err
+		}
+		req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
+		req.Header.Add("Git-Protocol", "version=2")
+		req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+		req.Header.Add("X-Test-Client", client)
+		req.Header.Add("Goblet-Priority", priority)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		bs, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got a non-OK response: %d %s", resp.StatusCode, string(bs))
+		}
+		return nil
+	}
+
+	done := make(chan error, 3)
+	for _, p := range repos[:3] {
+		go func(p string) {
+			done <- fetch(p, "batch", "normal")
+		}(p)
+	}
+	time.Sleep(500 * time.Millisecond)
+	for _, tc := range []struct {
+		client   string
+		priority string
+	}{
+		{"batch", "low"},
+		{"batch", "normal"},
+		{"batch", "high"},
+	} {
+		if err := fetch("other", tc.client, tc.priority); err == nil || !strings.Contains(err.Error(), "503") {
+			t.Errorf("%s %s: got %v, want the fetch to be rejected", tc.client, tc.priority, err)
+		}
+	}
+	if err := fetch("other", "interactive-alice", "high"); err != nil {
+		t.Errorf("a high priority fetch is rejected: %v", err)
+	}
+	for range repos[:3] {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	views := []*view.View{
+		{
+			Name:        "test/inbound-command-count",
+			Description: "Inbound command count",
+			TagKeys:     []tag.Key{goblet.CommandTypeKey},
+			Measure:     goblet.InboundCommandCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "test/inbound-command-latency",
+			Description: "Inbound command latency",
+			TagKeys:     []tag.Key{goblet.CommandTypeKey},
+			Measure:     goblet.InboundCommandProcessingTime,
+			Aggregation: view.Distribution(100, 1000),
+		},
+	}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	goblet.PrometheusHandler(views).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	bs, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(bs)
+	for _, want := range []string{
+		"# TYPE test_inbound_command_count_total counter\n",
+		`test_inbound_command_count_total{command_type="fetch"} 1` + "\n",
+		"# TYPE test_inbound_command_latency histogram\n",
+		`test_inbound_command_latency_bucket{command_type="fetch",le="+Inf"} 1` + "\n",
+		`test_inbound_command_latency_count{command_type="fetch"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q is not found in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	googlehook "github.com/google/goblet/google"
+	goblettest "github.com/google/goblet/testing"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const testSubscription = "projects/p/subscriptions/s"
+
+// newFakePubSub returns a Pub/Sub server that delivers the messages on the
+// first pull of testSubscription and sends the acknowledged IDs to acked.
+func newFakePubSub(t *testing.T, messages []string, acked chan<- []string) *httptest.Server {
+	pulled := false
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/" + testSubscription + ":pull":
+			resp := &pubsub.PullResponse{}
+			if !pulled {
+				pulled = true
+				for i, m := range messages {
+					resp.ReceivedMessages = append(resp.ReceivedMessages, &pubsub.ReceivedMessage{
+						AckId:   string(rune('a' + i)),
+						Message: &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString([]byte(m))},
+					})
+				}
+			} else {
+				// Pub/Sub holds the pulls until a message arrives.
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v1/" + testSubscription + ":acknowledge":
+			req := &pubsub.AcknowledgeRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				t.Error(err)
+			}
+			acked <- req.AckIds
+			w.Write([]byte("{}"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestPubSubRefresher(t *testing.T) {
+	testWebhookRefresh(t, "repo", func(ts *goblettest.TestServer) int {
+		acked := make(chan []string, 1)
+		fake := newFakePubSub(t, []string{
+			"not JSON",
+			`{"type": "ref-updated", "refUpdate": {"project": "repo", "refName": "refs/heads/master"}}`,
+			`{"type": "ref-updated", "refUpdate": {"project": "repo", "refName": "refs/heads/other"}}`,
+			`{"type": "patchset-created", "change": {"project": "repo"}}`,
+		}, acked)
+		defer fake.Close()
+		svc, err := pubsub.NewService(context.Background(), option.WithEndpoint(fake.URL+"/"), option.WithoutAuthentication())
+		if err != nil {
+			t.Fatal(err)
+		}
+		googlehook.RunPubSubRefresher(ts.ServerConfig, svc, testSubscription, strings.TrimSuffix(ts.ProxyServerURL, "/"), log.New(ioutil.Discard, "", 0))
+
+		select {
+		case ids := <-acked:
+			sort.Strings(ids)
+			if got := strings.Join(ids, ","); got != "a,b,c,d" {
+				t.Errorf("got the acknowledged IDs %s, want all of them", got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("the messages are not acknowledged")
+		}
+		return http.StatusOK
+	})
+}
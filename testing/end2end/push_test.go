@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestPush(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy goblet.PushPolicy
+		token  string
+		ok     bool
+	}{
+		{"reject", goblet.PushReject, goblettest.ValidClientAuthToken, false},
+		{"server credentials", goblet.PushWithServerCredentials, goblettest.ValidClientAuthToken, true},
+		{"server credentials, unauthorized client", goblet.PushWithServerCredentials, "invalid-token", false},
+		{"client credentials", goblet.PushWithClientCredentials, "valid-server-auth-token", true},
+		{"client credentials, invalid for upstream", goblet.PushWithClientCredentials, goblettest.ValidClientAuthToken, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer: goblettest.TestRequestAuthorizer,
+				TokenSource:       goblettest.TestTokenSource,
+				PushPolicy:        tc.policy,
+			})
+			defer ts.Close()
+			if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+				t.Fatal(err)
+			}
+
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			want, err := client.CreateRandomCommit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Run("-c", "http.extraHeader=Authorization: Bearer "+tc.token, "push", "-f", ts.ProxyServerURL, "master:master")
+			if !tc.ok {
+				if err == nil {
+					t.Errorf("the push is accepted")
+				}
+				// The rejected push doesn't create a cache entry.
+				if fis, err := ioutil.ReadDir(ts.ServerConfig.LocalDiskCacheRoot); err != nil || len(fis) != 0 {
+					t.Errorf("got %d cache entries, %v, want none", len(fis), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := ts.UpstreamGitRepo.Run("rev-parse", "master"); err != nil {
+				t.Error(err)
+			} else if got != want {
+				t.Errorf("got %s in the upstream, want %s", got, want)
+			}
+
+			// The cache is updated after the push.
+			fetcher := goblettest.NewLocalGitRepo()
+			defer fetcher.Close()
+			if _, err := fetcher.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "master"); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := fetcher.Run("rev-parse", "FETCH_HEAD"); err != nil {
+				t.Error(err)
+			} else if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
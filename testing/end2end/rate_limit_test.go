@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+func TestFetch_ClientRateLimit(t *testing.T) {
+	throttled := &view.View{Name: "test/throttled-request-count", Measure: goblet.ThrottledRequestCount, Aggregation: view.Count()}
+	if err := view.Register(throttled); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(throttled)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		ClientIdentifier: func(r *http.Request) string {
+			return r.Header.Get("X-Client")
+		},
+		ClientRateLimit: 0.01,
+		ClientRateBurst: 2,
+	})
+	defer ts.Close()
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ci := http.Header{"X-Client": []string{"ci"}}
+	for i := 0; i < 2; i++ {
+		if _, err := ts.SendProtocolV2RequestWithHeader(ci, fetchRequest(hash)); err != nil {
+			t.Fatalf("request %d within the burst is rejected: %v", i+1, err)
+		}
+	}
+	if _, err := ts.SendProtocolV2RequestWithHeader(ci, fetchRequest(hash)); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("got %v, want the request over the burst to be throttled", err)
+	}
+
+	req, err := http.NewRequest("GET", ts.ProxyServerURL+"info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("X-Client", "ci")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("got %d with Retry-After %q, want 429 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if n := viewCount(t, "test/throttled-request-count"); n != 2 {
+		t.Errorf("got %d throttled requests, want 2", n)
+	}
+
+	// The other clients are not affected.
+	if _, err := ts.SendProtocolV2RequestWithHeader(http.Header{"X-Client": []string{"developer"}}, fetchRequest(hash)); err != nil {
+		t.Errorf("a request of another client is rejected: %v", err)
+	}
+}
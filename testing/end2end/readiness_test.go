@@ -0,0 +1,104 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		setup      func(t *testing.T, ts *goblettest.TestServer)
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "cache root only",
+			setup:      func(t *testing.T, ts *goblettest.TestServer) {},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "canary",
+			setup: func(t *testing.T, ts *goblettest.TestServer) {
+				u, err := url.Parse(strings.TrimSuffix(ts.UpstreamServerURL, "/"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				ts.ServerConfig.ReadinessCanaryURL = u
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "canary failure",
+			setup: func(t *testing.T, ts *goblettest.TestServer) {
+				u, err := url.Parse(strings.TrimSuffix(ts.UpstreamServerURL, "/"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				ts.ServerConfig.ReadinessCanaryURL = u
+				ts.FailUpstreamRequests(1)
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "cannot run ls-refs",
+		},
+		{
+			name: "unwritable cache root",
+			setup: func(t *testing.T, ts *goblettest.TestServer) {
+				// A directory cannot be created under a file.
+				f := filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, "file")
+				if err := ioutil.WriteFile(f, nil, 0640); err != nil {
+					t.Fatal(err)
+				}
+				ts.ServerConfig.CacheShardRoots = []string{filepath.Join(f, "root")}
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "is not writable",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer: goblettest.TestRequestAuthorizer,
+				TokenSource:       goblettest.TestTokenSource,
+			})
+			defer ts.Close()
+			if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+				t.Fatal(err)
+			}
+			tc.setup(t, ts)
+
+			rec := httptest.NewRecorder()
+			goblet.ReadinessHandler(ts.ServerConfig).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got %d, want %d: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tc.wantBody) {
+				t.Errorf("got %q, want %q in the body", rec.Body, tc.wantBody)
+			}
+			if fs, err := filepath.Glob(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, ".goblet-readiness-*")); err != nil || len(fs) != 0 {
+				t.Errorf("got %v, %v, want the probe files to be removed", fs, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestRefInWant(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = strings.TrimSpace(want)
+
+	req, err := http.NewRequest("GET", ts.ProxyServerURL+"info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bs, []byte("ref-in-want")) {
+		t.Errorf("ref-in-want is not advertised: %s", bs)
+	}
+
+	bs, err = ts.SendProtocolV2Request([]*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want-ref refs/heads/master\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantedRefs := gitprotocolio.BytesPacket("wanted-refs\n").EncodeToPktLine()
+	wantedRef := gitprotocolio.BytesPacket(want + " refs/heads/master\n").EncodeToPktLine()
+	packfile := gitprotocolio.BytesPacket("packfile\n").EncodeToPktLine()
+	i := bytes.Index(bs, wantedRefs)
+	j := bytes.Index(bs, wantedRef)
+	k := bytes.Index(bs, packfile)
+	if i < 0 || j < i || k < j {
+		t.Errorf("the response doesn't have the wanted-refs section before the packfile: %q", bs)
+	}
+	if !bytes.Contains(bs, []byte("PACK")) {
+		t.Errorf("the response doesn't have a pack")
+	}
+
+	if fetchesPack(t, ts, []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want-ref refs/heads/unknown\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	}) {
+		t.Errorf("a fetch of an unknown ref succeeds")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestUpdateSettings_RequestAuthorizer(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := goblet.UpdateSettings(ts.ServerConfig, &goblet.ServerConfig{
+		RequestAuthorizer: func(*http.Request) error { return errors.New("revoked") },
+		TokenSource:       goblettest.TestTokenSource,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL); err == nil {
+		t.Errorf("ls-remote succeeded after the authorizer is replaced")
+	}
+}
+
+func TestAdmin_Reload(t *testing.T) {
+	var ts *goblettest.TestServer
+	ts = goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+		SettingsReloader: func() error {
+			return goblet.UpdateSettings(ts.ServerConfig, &goblet.ServerConfig{
+				RequestAuthorizer: goblettest.TestRequestAuthorizer,
+				TokenSource:       goblettest.TestTokenSource,
+				HiddenRefs:        []string{"refs/heads/internal"},
+			})
+		},
+	})
+	defer ts.Close()
+	admin := httptest.NewServer(goblet.AdminHandler(ts.ServerConfig))
+	defer admin.Close()
+
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	commit, err := pushClient.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), strings.TrimSpace(commit)+":refs/heads/master", strings.TrimSpace(commit)+":refs/heads/internal/secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	lsRemote := func() string {
+		out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if out := lsRemote(); !strings.Contains(out, "refs/heads/internal/secret") {
+		t.Fatalf("the ref is not advertised before the reload: %s", out)
+	}
+
+	req, err := http.NewRequest("POST", admin.URL+"/admin/reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if out := lsRemote(); strings.Contains(out, "refs/heads/internal/secret") {
+		t.Errorf("the ref is advertised after the reload: %s", out)
+	}
+	if out := lsRemote(); !strings.Contains(out, "refs/heads/master") {
+		t.Errorf("master is not advertised after the reload: %s", out)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+func TestFetch_CrossProcessLockingRecoversStaleLocks(t *testing.T) {
+	recoveries := &view.View{Name: "test/stale-lock-recovery-count", Measure: goblet.StaleLockRecoveryCount, Aggregation: view.Count()}
+	if err := view.Register(recoveries); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(recoveries)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	ts.ServerConfig.CrossProcessLocking = true
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	fetch := func() error {
+		_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+		return err
+	}
+	if err := fetch(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a process that died while fetching the repository.
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localDiskPath := filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, u.Host, u.Path)
+	for _, p := range []string{localDiskPath + ".goblet-lock", filepath.Join(localDiskPath, "packed-refs.lock"), filepath.Join(localDiskPath, "refs", "heads", "master.lock")} {
+		if err := ioutil.WriteFile(p, []byte("died-host:1\n"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	cmd := exec.Command("git", "rev-parse", "refs/heads/master")
+	cmd.Dir = localDiskPath
+	if out, err := cmd.Output(); err != nil {
+		t.Fatal(err)
+	} else if got := string(out); got != want {
+		t.Errorf("got the cached master %s, want %s", got, want)
+	}
+	if got := viewCount(t, recoveries.Name); got != 1 {
+		t.Errorf("got %d stale lock recoveries, want 1", got)
+	}
+	if bs, err := ioutil.ReadFile(localDiskPath + ".goblet-lock"); err != nil {
+		t.Fatal(err)
+	} else if len(bs) != 0 {
+		t.Errorf("got the lock holder %q after the fetch, want none", bs)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var repositoryCommandView = &view.View{Name: "test/repository-command-count", Measure: goblet.InboundCommandCount, TagKeys: []tag.Key{goblet.RepositoryKey, goblet.CommandTypeKey}, Aggregation: view.Count()}
+
+// repositoryCommands returns the inbound command counts by the RepositoryKey
+// and CommandTypeKey values.
+func repositoryCommands(t *testing.T) map[string]int64 {
+	rows, err := view.RetrieveData(repositoryCommandView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, row := range rows {
+		var repo, command string
+		for _, tg := range row.Tags {
+			switch tg.Key {
+			case goblet.RepositoryKey:
+				repo = tg.Value
+			case goblet.CommandTypeKey:
+				command = tg.Value
+			}
+		}
+		got[repo+" "+command] += row.Data.(*view.CountData).Value
+	}
+	return got
+}
+
+func TestRepositoryMetricTag(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		repositoryMetricTag bool
+	}{
+		{name: "enabled", repositoryMetricTag: true},
+		{name: "disabled"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := view.Register(repositoryCommandView); err != nil {
+				t.Fatal(err)
+			}
+			defer view.Unregister(repositoryCommandView)
+
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer: goblettest.TestRequestAuthorizer,
+				TokenSource:       goblettest.TestTokenSource,
+			})
+			defer ts.Close()
+			ts.ServerConfig.RepositoryMetricTag = tc.repositoryMetricTag
+			if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+				t.Fatal(err)
+			}
+
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+				t.Fatal(err)
+			}
+
+			repo := ""
+			if tc.repositoryMetricTag {
+				repo = strings.TrimSuffix(ts.UpstreamServerURL, "/")
+			}
+			got := repositoryCommands(t)
+			if got[repo+" ls-refs"] == 0 || got[repo+" fetch"] == 0 {
+				t.Errorf("got %v, want the ls-refs and fetch commands of %q", got, repo)
+			}
+		})
+	}
+}
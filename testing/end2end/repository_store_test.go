@@ -0,0 +1,231 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+// countingStore wraps a RepositoryStore and counts the fetches and the
+// commands served by its repositories, and the evictions.
+type countingStore struct {
+	goblet.RepositoryStore
+
+	mu      sync.Mutex
+	fetches int
+	serves  []string
+	evicts  int
+}
+
+func (s *countingStore) Open(tenant string, u *url.URL) (goblet.StoredRepository, error) {
+	repo, err := s.RepositoryStore.Open(tenant, u)
+	if err != nil {
+		return nil, err
+	}
+	return &countingRepository{StoredRepository: repo, s: s}, nil
+}
+
+func (s *countingStore) Evict(tenant string, u *url.URL) error {
+	s.mu.Lock()
+	s.evicts++
+	s.mu.Unlock()
+	return s.RepositoryStore.Evict(tenant, u)
+}
+
+type countingRepository struct {
+	goblet.StoredRepository
+	s *countingStore
+}
+
+func (r *countingRepository) Fetch(ctx context.Context) error {
+	r.s.mu.Lock()
+	r.s.fetches++
+	r.s.mu.Unlock()
+	return r.StoredRepository.Fetch(ctx)
+}
+
+func (r *countingRepository) ServeUploadPack(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	r.s.mu.Lock()
+	r.s.serves = append(r.s.serves, command[0].Command)
+	r.s.mu.Unlock()
+	return r.StoredRepository.ServeUploadPack(ctx, command, w)
+}
+
+func TestRepositoryStore(t *testing.T) {
+	var store *countingStore
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		FetchFreshnessWindow: time.Hour,
+		RepositoryStore: func(config *goblet.ServerConfig) goblet.RepositoryStore {
+			store = &countingStore{RepositoryStore: goblet.NewLocalDiskStore(config)}
+			return store
+		},
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "master"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := client.Run("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(got) != strings.TrimSpace(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	store.mu.Lock()
+	// The second fetch is served within the freshness window.
+	if store.fetches != 1 {
+		t.Errorf("got %d upstream fetches, want 1", store.fetches)
+	}
+	if s := strings.Join(store.serves, ","); s != "ls-refs,fetch,ls-refs" {
+		t.Errorf("got %s served, want ls-refs,fetch,ls-refs", s)
+	}
+	store.mu.Unlock()
+
+	usage, err := store.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := strings.TrimSuffix(ts.UpstreamServerURL, "/")
+	if len(usage) != 1 || usage[0].UpstreamURL.String() != upstream || usage[0].Bytes == 0 || usage[0].LastUpdateTime.IsZero() {
+		t.Fatalf("got %+v, want the usage of %s", usage, upstream)
+	}
+
+	// The eviction policies evict the repositories through the store.
+	if err := goblet.UpdateBlockedRepos(ts.ServerConfig, []string{"*"}); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	if store.evicts != 1 {
+		t.Errorf("got %d evictions, want 1", store.evicts)
+	}
+	store.mu.Unlock()
+	if usage, err := store.Usage(); err != nil || len(usage) != 0 {
+		t.Errorf("got %+v, %v, want no repository after the eviction", usage, err)
+	}
+}
+
+// plainUploadPackStore wraps a local disk store, and serves its repositories
+// with a plain git-upload-pack, which doesn't hide any ref, as a store outside
+// goblet would.
+type plainUploadPackStore struct {
+	goblet.RepositoryStore
+	root string
+}
+
+func (s *plainUploadPackStore) Open(tenant string, u *url.URL) (goblet.StoredRepository, error) {
+	repo, err := s.RepositoryStore.Open(tenant, u)
+	if err != nil {
+		return nil, err
+	}
+	return &plainUploadPackRepository{StoredRepository: repo, dir: filepath.Join(s.root, tenant, u.Host, u.Path)}, nil
+}
+
+type plainUploadPackRepository struct {
+	goblet.StoredRepository
+	dir string
+}
+
+func (r *plainUploadPackRepository) ServeUploadPack(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	req := new(bytes.Buffer)
+	for _, c := range command {
+		req.Write(c.EncodeToPktLine())
+	}
+	cmd := exec.CommandContext(ctx, "git", "upload-pack", "--stateless-rpc", r.dir)
+	cmd.Env = []string{"GIT_PROTOCOL=version=2"}
+	cmd.Stdin = req
+	cmd.Stdout = w
+	return cmd.Run()
+}
+
+func TestRepositoryStore_HiddenRefs(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		HiddenRefs:        []string{"refs/heads/internal"},
+		RepositoryStore: func(config *goblet.ServerConfig) goblet.RepositoryStore {
+			return &plainUploadPackStore{
+				RepositoryStore: goblet.NewLocalDiskStore(config),
+				root:            config.LocalDiskCacheRoot,
+			}
+		},
+	})
+	defer ts.Close()
+
+	// The internal branch is one commit ahead of master.
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	public, err := pushClient.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hidden, err := pushClient.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), strings.TrimSpace(public)+":refs/heads/master", strings.TrimSpace(hidden)+":refs/heads/internal/secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "refs/heads/master") || strings.Contains(out, "internal") || strings.Contains(out, strings.TrimSpace(hidden)) {
+		t.Errorf("got %s, want master without the hidden ref", out)
+	}
+
+	if !fetchesPack(t, ts, fetchRequest(public)) {
+		t.Errorf("cannot fetch a visible commit by SHA-1")
+	}
+	if fetchesPack(t, ts, fetchRequest(hidden)) {
+		t.Errorf("can fetch a hidden commit by SHA-1")
+	}
+	if fetchesPack(t, ts, []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want-ref refs/heads/internal/secret\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	}) {
+		t.Errorf("can fetch a hidden ref by want-ref")
+	}
+}
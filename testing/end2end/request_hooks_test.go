@@ -0,0 +1,128 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var hookTagKey = tag.MustNewKey("test/hook")
+
+// quotaHook rejects the requests with "X-Test-Quota: exceeded", tags the
+// others, and records the outcomes.
+type quotaHook struct {
+	mu           sync.Mutex
+	upstreamURLs []string
+	outcomes     []*goblet.RequestOutcome
+}
+
+func (h *quotaHook) BeforeRequest(header http.Header, r *http.Request, upstreamURL *url.URL) (*http.Request, error) {
+	h.mu.Lock()
+	h.upstreamURLs = append(h.upstreamURLs, upstreamURL.String())
+	h.mu.Unlock()
+	header.Set("X-Test-Hook", "called")
+	if r.Header.Get("X-Test-Quota") == "exceeded" {
+		return nil, status.Error(codes.ResourceExhausted, "quota exceeded")
+	}
+	ctx, err := tag.New(r.Context(), tag.Upsert(hookTagKey, "tagged"))
+	if err != nil {
+		return nil, err
+	}
+	return r.WithContext(ctx), nil
+}
+
+func (h *quotaHook) AfterRequest(r *http.Request, outcome *goblet.RequestOutcome) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.outcomes = append(h.outcomes, outcome)
+}
+
+func TestRequestHooks(t *testing.T) {
+	hookView := &view.View{Name: "test/hook-command-count", Measure: goblet.InboundCommandCount, TagKeys: []tag.Key{hookTagKey, goblet.CommandTypeKey}, Aggregation: view.Count()}
+	if err := view.Register(hookView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(hookView)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	h := &quotaHook{}
+	ts.ServerConfig.RequestHooks = []goblet.RequestHook{h}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, header, err := ts.SendProtocolV2RequestForHeader(nil, lsRefsRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("X-Test-Hook"); got != "called" {
+		t.Errorf("got X-Test-Hook %q, want the header set by the hook", got)
+	}
+	if _, _, err := ts.SendProtocolV2RequestForHeader(http.Header{"X-Test-Quota": {"exceeded"}}, lsRefsRequest); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("got %v, want the request rejected with 429", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	want := strings.TrimSuffix(ts.UpstreamServerURL, "/")
+	for _, u := range h.upstreamURLs {
+		if u != want {
+			t.Errorf("got the upstream URL %q, want %q", u, want)
+		}
+	}
+	if len(h.outcomes) != 2 {
+		t.Fatalf("got %d outcomes, want 2", len(h.outcomes))
+	}
+	if o := h.outcomes[0]; o.Status != http.StatusOK || o.CommandType != "ls-refs" || o.CacheState != "queried-upstream" || o.Err != nil {
+		t.Errorf("got %+v, want a successful ls-refs", o)
+	}
+	if o := h.outcomes[1]; o.Status != http.StatusTooManyRequests || status.Code(o.Err) != codes.ResourceExhausted {
+		t.Errorf("got %+v, want the request rejected by the hook", o)
+	}
+
+	// The command is recorded with the tag of the hook.
+	rows, err := view.RetrieveData(hookView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged := false
+	for _, row := range rows {
+		tags := map[tag.Key]string{}
+		for _, tg := range row.Tags {
+			tags[tg.Key] = tg.Value
+		}
+		if tags[hookTagKey] == "tagged" && tags[goblet.CommandTypeKey] == "ls-refs" {
+			tagged = true
+		}
+	}
+	if !tagged {
+		t.Errorf("got %v, want ls-refs tagged by the hook", rows)
+	}
+}
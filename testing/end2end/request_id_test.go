@@ -0,0 +1,113 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+// requestIDProxy is an HTTP proxy that records the X-Request-Id of the
+// proxied requests.
+type requestIDProxy struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (p *requestIDProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.ids = append(p.ids, r.Header.Get("X-Request-Id"))
+	p.mu.Unlock()
+
+	r.RequestURI = ""
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *requestIDProxy) proxied() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.ids...)
+}
+
+func TestRequestID(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		requestID string
+		want      *regexp.Regexp
+	}{
+		{
+			name:      "from the client",
+			requestID: "ci-build-42:clone.1",
+			want:      regexp.MustCompile(`^ci-build-42:clone\.1$`),
+		},
+		{
+			name: "generated",
+			want: regexp.MustCompile(`^[0-9a-f]{32}$`),
+		},
+		{
+			name:      "invalid",
+			requestID: "has spaces",
+			want:      regexp.MustCompile(`^[0-9a-f]{32}$`),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &requestIDProxy{}
+			proxy := httptest.NewServer(p)
+			defer proxy.Close()
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer: goblettest.TestRequestAuthorizer,
+				TokenSource:       goblettest.TestTokenSource,
+				UpstreamProxy:     proxy.URL,
+			})
+			defer ts.Close()
+			if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+				t.Fatal(err)
+			}
+
+			header := http.Header{}
+			if tc.requestID != "" {
+				header.Set("X-Request-Id", tc.requestID)
+			}
+			_, respHeader, err := ts.SendProtocolV2RequestForHeader(header, lsRefsRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := respHeader.Get("X-Request-Id")
+			if !tc.want.MatchString(id) {
+				t.Errorf("got the request ID %q, want %v", id, tc.want)
+			}
+			// ls-refs is sent to the upstream with the ID.
+			if got := p.proxied(); len(got) != 1 || got[0] != id {
+				t.Errorf("got the upstream request IDs %q, want [%q]", got, id)
+			}
+		})
+	}
+}
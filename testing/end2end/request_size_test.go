@@ -0,0 +1,83 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_MaxRequestBytes(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		MaxRequestBytes:   4096,
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.SendProtocolV2Request(fetchRequest(hash)); err != nil {
+		t.Fatalf("a small request is rejected: %v", err)
+	}
+
+	large := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{EndCapability: true},
+	}
+	for i := 0; i < 1000; i++ {
+		large = append(large, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte(fmt.Sprintf("ref-prefix refs/heads/%d\n", i))})
+	}
+	large = append(large, &gitprotocolio.ProtocolV2RequestChunk{EndRequest: true})
+	if _, err := ts.SendProtocolV2Request(large); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("got %v, want a large request to be rejected", err)
+	}
+
+	// The limit applies to the ungzipped request.
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	for _, c := range large {
+		zw.Write(c.EncodeToPktLine())
+	}
+	zw.Close()
+	if body.Len() > 4096 {
+		t.Fatalf("the gzipped request is %d bytes, want it under the limit", body.Len())
+	}
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+"git-upload-pack", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Add("Content-Encoding", "gzip")
+	req.Header.Add("Git-Protocol", "version=2")
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got %d, want a large gzipped request to be rejected", resp.StatusCode)
+	}
+}
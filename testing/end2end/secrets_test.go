@@ -0,0 +1,173 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/goblet/secrets"
+	goblettest "github.com/google/goblet/testing"
+	"golang.org/x/oauth2"
+)
+
+func TestSecretFetchers(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/goblet":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]string{"token": "kv2-secret"},
+					"metadata": map[string]interface{}{"version": 3},
+				},
+			})
+		case "/v1/kv/goblet":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"token": "kv1-secret"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+
+	secretManager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+goblettest.ValidClientAuthToken {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v1/projects/p/secrets/s/versions/latest:access" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte("gsm-secret"))},
+		})
+	}))
+	defer secretManager.Close()
+
+	dir, err := ioutil.TempDir("", "goblet_secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vaultTokenFile := filepath.Join(dir, "vault-token")
+	if err := ioutil.WriteFile(vaultTokenFile, []byte("vault-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &secrets.Config{
+		GoogleTokenSource:           oauth2.StaticTokenSource(&oauth2.Token{AccessToken: goblettest.ValidClientAuthToken}),
+		GoogleSecretManagerEndpoint: secretManager.URL,
+		VaultAddr:                   vault.URL,
+		VaultTokenFile:              vaultTokenFile,
+	}
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"vault:secret/data/goblet#token", "kv2-secret"},
+		{"vault:kv/goblet#token", "kv1-secret"},
+		{"gcp-secret-manager:projects/p/secrets/s/versions/latest", "gsm-secret"},
+		{"file:" + secretFile, "file-secret"},
+		{"vault:secret/data/goblet#password", ""},
+		{"vault:secret/data/missing#token", ""},
+		{"gcp-secret-manager:projects/p/secrets/missing/versions/latest", ""},
+	}
+	for _, tc := range tests {
+		fetch, err := config.Fetcher(tc.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fetch()
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %q, want an error", tc.ref, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.ref, err)
+		} else if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.ref, got, tc.want)
+		}
+	}
+
+	for _, ref := range []string{"token", "unknown:x", "vault:secret/data/goblet"} {
+		if _, err := config.Fetcher(ref); err == nil {
+			t.Errorf("%s: the reference is accepted", ref)
+		}
+	}
+}
+
+func TestRotatingTokenSource(t *testing.T) {
+	var mu sync.Mutex
+	secret := "secret-1"
+	var fetchErr error
+	fetch := func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return secret, fetchErr
+	}
+	set := func(s string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		secret, fetchErr = s, err
+	}
+	ts, err := secrets.NewRotatingTokenSource(fetch, 10*time.Millisecond, func(s string) oauth2.TokenSource {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: s})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(want string) {
+		t.Helper()
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != want {
+			t.Errorf("got %q, want %q", token.AccessToken, want)
+		}
+	}
+
+	check("secret-1")
+	set("secret-2", nil)
+	check("secret-1")
+	time.Sleep(20 * time.Millisecond)
+	check("secret-2")
+
+	// The previous secret is used while the secret store is unavailable.
+	set("", fmt.Errorf("unavailable"))
+	time.Sleep(20 * time.Millisecond)
+	check("secret-2")
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func BenchmarkServeFetch_LooseObjects(b *testing.B) {
+	benchmarkServeFetch(b, false)
+}
+
+func BenchmarkServeFetch_Packed(b *testing.B) {
+	benchmarkServeFetch(b, true)
+}
+
+func benchmarkServeFetch(b *testing.B, remoteFilesystemMode bool) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		RemoteFilesystemMode: remoteFilesystemMode,
+	})
+	defer ts.Close()
+
+	// Update the cache with many small fetches. Without
+	// RemoteFilesystemMode, they're stored as loose objects.
+	warmup := goblettest.NewLocalGitRepo()
+	defer warmup.Close()
+	for i := 0; i < 20; i++ {
+		if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := warmup.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client := goblettest.NewLocalGitRepo()
+		b.StartTimer()
+
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		client.Close()
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+func TestLsRefs_ServeStaleOnFailure(t *testing.T) {
+	staleServes := &view.View{Name: "test/stale-serve-count", Measure: goblet.StaleServeCount, Aggregation: view.Count()}
+	if err := view.Register(staleServes); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(staleServes)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	ts.ServerConfig.ServeStaleOnFailure = true
+	if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), "uncached")); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	run := func(args ...string) (string, error) {
+		return client.Run(append([]string{"-c", "http.extraHeader=Authorization: Bearer " + goblettest.ValidClientAuthToken}, args...)...)
+	}
+	if _, err := run("fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached refs are served while the upstream fails.
+	ts.FailUpstreamRequests(1)
+	bs, header, err := ts.SendProtocolV2RequestForHeader(nil, lsRefsRequest)
+	if err != nil || !strings.Contains(string(bs), strings.TrimSpace(cached)) {
+		t.Errorf("got %q, %v, want the cached %s", bs, err, cached)
+	}
+	if got := header.Get("Goblet-Served-Stale"); got != "true" {
+		t.Errorf("got Goblet-Served-Stale %q, want true", got)
+	}
+	ts.FailUpstreamRequests(1)
+	if _, err := run("fetch", ts.ProxyServerURL); err != nil {
+		t.Errorf("got %v, want the cached refs to be fetched", err)
+	}
+	if got := viewCount(t, staleServes.Name); got != 2 {
+		t.Errorf("got %d stale serves, want 2", got)
+	}
+
+	// The uncached repositories still fail.
+	ts.FailUpstreamRequests(1)
+	if _, err := run("ls-remote", ts.ProxyServerURL+"uncached"); err == nil {
+		t.Error("got no error, want the upstream failure")
+	}
+
+	// The responses are not stale once the upstream recovers.
+	_, header, err = ts.SendProtocolV2RequestForHeader(nil, lsRefsRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("Goblet-Served-Stale"); got != "" {
+		t.Errorf("got Goblet-Served-Stale %q, want none", got)
+	}
+}
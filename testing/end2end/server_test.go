@@ -0,0 +1,142 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestNewServer(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "goblet_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := goblet.NewServer(
+		goblet.WithServerConfig(&goblet.ServerConfig{WarmRepositories: []string{strings.TrimSuffix(ts.ProxyServerURL, "/")}}),
+		goblet.WithCacheRoot(dir),
+		goblet.WithURLCanonicalizer(ts.ServerConfig.URLCanonializer),
+		goblet.WithRequestAuthorizer(goblettest.TestRequestAuthorizer),
+		goblet.WithTokenSource(goblettest.TestTokenSource),
+		goblet.WithWarmUpInterval(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err == nil {
+		t.Error("got no error for the second Start")
+	}
+
+	// The repository is warmed up in the background after Start.
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := goblettest.GitRepo(filepath.Join(dir, u.Host))
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if got, err := cache.Run("rev-parse", "-q", "--verify", "refs/heads/master"); err == nil && strings.TrimSpace(got) == strings.TrimSpace(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the repository is not warmed up")
+		}
+	}
+
+	proxy := httptest.NewServer(srv)
+	defer proxy.Close()
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", proxy.URL+"/"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("got %v, want the server shut down", err)
+	}
+	if err := srv.Start(); err == nil {
+		t.Error("got no error for Start after Shutdown")
+	}
+}
+
+func TestNewServer_InvalidOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []goblet.Option
+	}{
+		{
+			name: "no cache root",
+			opts: []goblet.Option{
+				goblet.WithURLCanonicalizer(func(u *url.URL) (*url.URL, error) { return u, nil }),
+				goblet.WithRequestAuthorizer(goblettest.TestRequestAuthorizer),
+				goblet.WithTokenSource(goblettest.TestTokenSource),
+			},
+		},
+		{
+			name: "no token source",
+			opts: []goblet.Option{
+				goblet.WithCacheRoot(os.TempDir()),
+				goblet.WithURLCanonicalizer(func(u *url.URL) (*url.URL, error) { return u, nil }),
+				goblet.WithRequestAuthorizer(goblettest.TestRequestAuthorizer),
+			},
+		},
+		{
+			name: "negative limit",
+			opts: []goblet.Option{
+				goblet.WithCacheRoot(os.TempDir()),
+				goblet.WithURLCanonicalizer(func(u *url.URL) (*url.URL, error) { return u, nil }),
+				goblet.WithRequestAuthorizer(goblettest.TestRequestAuthorizer),
+				goblet.WithTokenSource(goblettest.TestTokenSource),
+				goblet.WithConcurrencyLimits(-1, 0, 0),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := goblet.NewServer(tc.opts...); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
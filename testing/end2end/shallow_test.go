@@ -0,0 +1,172 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestShallowCache(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        goblet.ShallowCachePolicy
+		wantFullClone bool
+	}{
+		{"unshallow", goblet.ShallowCacheUnshallow, true},
+		{"reject", goblet.ShallowCacheReject, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer:  goblettest.TestRequestAuthorizer,
+				TokenSource:        goblettest.TestTokenSource,
+				ShallowCachePolicy: tc.policy,
+			})
+			defer ts.Close()
+
+			pushClient := goblettest.NewLocalGitRepo()
+			defer pushClient.Close()
+			for i := 0; i < 3; i++ {
+				if _, err := pushClient.CreateRandomCommit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), "master:master"); err != nil {
+				t.Fatal(err)
+			}
+			seedShallowCache(t, ts)
+
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", "--depth=1", ts.ProxyServerURL, "master"); err != nil {
+				t.Fatal(err)
+			}
+
+			fullClient := goblettest.NewLocalGitRepo()
+			defer fullClient.Close()
+			_, err := fullClient.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "master")
+			if got := err == nil; got != tc.wantFullClone {
+				t.Fatalf("full clone succeeded = %t, want %t: %v", got, tc.wantFullClone, err)
+			}
+			if !tc.wantFullClone {
+				return
+			}
+			out, err := fullClient.Run("rev-list", "--count", "FETCH_HEAD")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(out); got != "3" {
+				t.Errorf("got %s commits, want 3", got)
+			}
+			if _, err := os.Stat(filepath.Join(string(fullClient), ".git", "shallow")); err == nil {
+				t.Errorf("the full clone is shallow")
+			}
+		})
+	}
+}
+
+func TestShallowCacheDeepen(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:  goblettest.TestRequestAuthorizer,
+		TokenSource:        goblettest.TestTokenSource,
+		ShallowCachePolicy: goblet.ShallowCacheDeepen,
+	})
+	defer ts.Close()
+
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := pushClient.CreateRandomCommit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	seedShallowCache(t, ts)
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := goblettest.GitRepo(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, u.Host))
+
+	fetch := func(args ...string) string {
+		client := goblettest.NewLocalGitRepo()
+		defer client.Close()
+		args = append([]string{"-c", "http.extraHeader=Authorization: Bearer " + goblettest.ValidClientAuthToken, "fetch"}, args...)
+		if _, err := client.Run(append(args, ts.ProxyServerURL, "master")...); err != nil {
+			t.Fatal(err)
+		}
+		out, err := client.Run("rev-list", "--count", "FETCH_HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	cachedCommits := func() string {
+		out, err := cache.Run("rev-list", "--count", "master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+
+	if got := fetch("--depth=2"); got != "2" {
+		t.Errorf("got %s commits with --depth=2, want 2", got)
+	}
+	if got := cachedCommits(); got != "2" {
+		t.Errorf("the cache has %s commits after --depth=2, want 2", got)
+	}
+	if got := fetch(); got != "4" {
+		t.Errorf("got %s commits without a depth, want 4", got)
+	}
+	if _, err := os.Stat(filepath.Join(string(cache), "shallow")); err == nil {
+		t.Errorf("the cache is still shallow after a full fetch")
+	}
+}
+
+// seedShallowCache creates a cached repository with a depth-1 clone of the
+// upstream.
+func seedShallowCache(t *testing.T, ts *goblettest.TestServer) {
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := goblettest.TestTokenSource.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := goblettest.GitRepo(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, u.Host))
+	if err := os.MkdirAll(string(cache), 0750); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "--bare"},
+		{"config", "protocol.version", "2"},
+		{"remote", "add", "--mirror=fetch", "origin", ts.UpstreamServerURL},
+		{"-c", "http.extraHeader=Authorization: Bearer " + tok.AccessToken, "fetch", "--depth=1", "origin"},
+	} {
+		if _, err := cache.Run(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
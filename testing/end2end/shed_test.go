@@ -0,0 +1,59 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_ShedDuringEviction(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:  goblettest.TestRequestAuthorizer,
+		TokenSource:        goblettest.TestTokenSource,
+		ShedDuringEviction: true,
+	})
+	defer ts.Close()
+
+	cached, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	uncached, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endEviction := goblet.StartEvictionPass()
+	if _, err := ts.SendProtocolV2Request(fetchRequest(cached)); err != nil {
+		t.Errorf("a cache hit is not served during an eviction: %v", err)
+	}
+	if _, err := ts.SendProtocolV2Request(fetchRequest(uncached)); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want a cache miss to be shed", err)
+	}
+	endEviction()
+
+	if _, err := ts.SendProtocolV2Request(fetchRequest(uncached)); err != nil {
+		t.Errorf("a cache miss is not served after an eviction: %v", err)
+	}
+}
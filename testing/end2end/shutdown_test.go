@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestShutdown_WaitsForUpstreamFetch(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamLatency:   200 * time.Millisecond,
+	})
+	defer ts.Close()
+
+	commit, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := make(chan bool, 1)
+	go func() {
+		fetched <- fetchesPack(t, ts, fetchRequest(commit))
+	}()
+	// Let the request start an upstream fetch.
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := goblet.Shutdown(ctx, ts.ServerConfig); err != nil {
+		t.Errorf("got %v, want the upstream fetch to complete", err)
+	}
+	if !<-fetched {
+		t.Errorf("the in-flight fetch is not served")
+	}
+
+	uncached, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchesPack(t, ts, fetchRequest(uncached)) {
+		t.Errorf("an upstream fetch is started after the shutdown")
+	}
+}
+
+func TestShutdown_AbortsUpstreamFetch(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamLatency:   2 * time.Second,
+	})
+	defer ts.Close()
+
+	commit, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := make(chan bool, 1)
+	go func() {
+		fetched <- fetchesPack(t, ts, fetchRequest(commit))
+	}()
+	// Let the request start an upstream fetch.
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	startTime := time.Now()
+	if err := goblet.Shutdown(ctx, ts.ServerConfig); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(startTime); d > time.Second {
+		t.Errorf("the upstream fetch is not aborted: Shutdown took %v", d)
+	}
+	if <-fetched {
+		t.Errorf("the aborted fetch is served")
+	}
+}
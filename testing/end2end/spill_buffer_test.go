@@ -0,0 +1,79 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+)
+
+func TestFetch_RequestMemoryBudget(t *testing.T) {
+	spilled := &view.View{Name: "test/request-spill-count", Measure: goblet.RequestSpillCount, Aggregation: view.Count()}
+	if err := view.Register(spilled); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(spilled)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:   goblettest.TestRequestAuthorizer,
+		TokenSource:         goblettest.TestTokenSource,
+		RetryPackServe:      true,
+		RequestMemoryBudget: 256,
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// The haves of the request are over the budget.
+	command := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want " + strings.TrimSpace(want) + "\n")},
+	}
+	for i := 0; i < 100; i++ {
+		command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte(fmt.Sprintf("have %040x\n", i+1))})
+	}
+	command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("done\n")}, &gitprotocolio.ProtocolV2RequestChunk{EndRequest: true})
+	bs, err := ts.SendProtocolV2Request(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bs, []byte("packfile\n")) {
+		t.Errorf("got %q, want a packfile", bs)
+	}
+	if n := viewCount(t, "test/request-spill-count"); n == 0 {
+		t.Errorf("got no spilled requests")
+	}
+}
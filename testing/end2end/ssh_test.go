@@ -0,0 +1,136 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHKey generates a key in dir, and returns its signer and the path of
+// the private key file.
+func newSSHKey(t *testing.T, dir, name string) (ssh.Signer, string) {
+	path := filepath.Join(dir, name)
+	if bs, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", path).CombinedOutput(); err != nil {
+		t.Fatalf("cannot generate a key: %v %s", err, bs)
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, path
+}
+
+// sshCommand returns the Git config that makes the ssh command use only the
+// key.
+func sshCommand(keyPath string) string {
+	return "core.sshCommand=ssh -F /dev/null -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -o IdentitiesOnly=yes -i " + keyPath
+}
+
+// serveSSHOnTestServer serves the proxy of the test server over SSH for the
+// clients with the key of clientKey, identified as identity. The repository
+// path is /example.com/repo.git.
+func serveSSHOnTestServer(t *testing.T, ts *goblettest.TestServer, hostKey, clientKey ssh.Signer, identity string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The upstream test server serves the repository at the root.
+	proxy := goblet.HTTPHandler(ts.ServerConfig)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/repo.git")
+		proxy.ServeHTTP(w, r)
+	})
+	go goblet.ServeSSH(l, handler, &goblet.SSHServerConfig{
+		HostKeys: []ssh.Signer{hostKey},
+		PublicKeyAuthorizer: func(user string, key ssh.PublicKey) (string, error) {
+			if string(key.Marshal()) != string(clientKey.PublicKey().Marshal()) {
+				return "", fmt.Errorf("unknown key")
+			}
+			return identity, nil
+		},
+	})
+	return l
+}
+
+func TestSSHFetch(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("no ssh client")
+	}
+	dir, err := ioutil.TempDir("", "goblet_ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostKey, _ := newSSHKey(t, dir, "host")
+	clientKey, clientKeyPath := newSSHKey(t, dir, "client")
+	_, unknownKeyPath := newSSHKey(t, dir, "unknown")
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AccessRules: []*goblet.AccessRule{
+			{Identities: []string{"team-a/*"}, SourceRanges: []*net.IPNet{loopback}, Repos: []string{"*"}},
+		},
+	})
+	defer ts.Close()
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := serveSSHOnTestServer(t, ts, hostKey, clientKey, "team-a/builder")
+	defer l.Close()
+	remote := fmt.Sprintf("ssh://git@%s/example.com/repo.git", l.Addr())
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", sshCommand(clientKeyPath), "fetch", remote); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := client.Run("-c", sshCommand(unknownKeyPath), "fetch", remote); err == nil {
+		t.Errorf("the fetch with an unknown key succeeds")
+	}
+	if _, err := client.Run("-c", sshCommand(clientKeyPath), "-c", "protocol.version=0", "fetch", remote); err == nil {
+		t.Errorf("the fetch with the protocol v0 succeeds")
+	}
+	for _, p := range []string{"/example.com/../repo.git", "/../repo.git", "/example.com/./repo.git"} {
+		if _, err := client.Run("-c", sshCommand(clientKeyPath), "fetch", fmt.Sprintf("ssh://git@%s%s", l.Addr(), p)); err == nil {
+			t.Errorf("the fetch of %s succeeds", p)
+		}
+	}
+}
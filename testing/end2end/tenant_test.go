@@ -0,0 +1,138 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const tenantHeader = "X-Goblet-Tenant"
+
+func TestTenant_Isolation(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		AdminAuthorizer:      goblettest.TestRequestAuthorizer,
+		FetchFreshnessWindow: time.Hour,
+		TenantExtractor: func(r *http.Request) string {
+			return r.Header.Get(tenantHeader)
+		},
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+
+	first, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader="+tenantHeader+": a", "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	second, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tenant a is within the freshness window and sees the cached ref.
+	// Tenant b has its own cache and sees the upstream ref.
+	for tenant, want := range map[string]string{"a": first, "b": second} {
+		out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader="+tenantHeader+": "+tenant, "ls-remote", ts.ProxyServerURL, "refs/heads/master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Fields(out)[0]; got != strings.TrimSpace(want) {
+			t.Errorf("tenant %s: got %s, want %s", tenant, got, want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, "a")); err != nil {
+		t.Errorf("the cache of tenant a is not partitioned: %v", err)
+	}
+
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL); err == nil {
+		t.Errorf("a request without a tenant is served")
+	}
+
+	req := httptest.NewRequest("GET", "/admin/repos", nil)
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	rec := httptest.NewRecorder()
+	goblet.AdminHandler(ts.ServerConfig).ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"tenant": "a"`) {
+		t.Errorf("got %s, want the tenant in the listing", rec.Body.String())
+	}
+}
+
+func TestTenant_InvalidTenantsAreNotTagged(t *testing.T) {
+	tenantView := &view.View{Name: "test/tenant-command-count", Measure: goblet.InboundCommandCount, TagKeys: []tag.Key{goblet.TenantKey}, Aggregation: view.Count()}
+	if err := view.Register(tenantView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(tenantView)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		TenantExtractor: func(r *http.Request) string {
+			return r.Header.Get(tenantHeader)
+		},
+	})
+	defer ts.Close()
+
+	// The requests are rejected as unauthenticated, and recorded with
+	// the tenants.
+	for _, tenant := range []string{"../invalid", "-invalid", "invalid/tenant", "valid-tenant"} {
+		req, err := http.NewRequest("GET", ts.ProxyServerURL+"info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Git-Protocol", "version=2")
+		req.Header.Add(tenantHeader, tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	rows, err := view.RetrieveData(tenantView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, row := range rows {
+		for _, tg := range row.Tags {
+			if tg.Key == goblet.TenantKey {
+				got[tg.Value] += row.Data.(*view.CountData).Value
+			}
+		}
+	}
+	want := map[string]int64{"(invalid)": 3, "valid-tenant": 1}
+	if len(got) != len(want) || got["(invalid)"] != want["(invalid)"] || got["valid-tenant"] != want["valid-tenant"] {
+		t.Errorf("got the tenant tags %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	goblettest "github.com/google/goblet/testing"
+)
+
+var lsRefsRequest = []*gitprotocolio.ProtocolV2RequestChunk{
+	{Command: "ls-refs"},
+	{EndCapability: true},
+	{EndRequest: true},
+}
+
+func TestLsRefs_UpstreamLsRefsTimeout(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:     goblettest.TestRequestAuthorizer,
+		TokenSource:           goblettest.TestTokenSource,
+		UpstreamLatency:       time.Second,
+		UpstreamLsRefsTimeout: 100 * time.Millisecond,
+	})
+	defer ts.Close()
+
+	bs, err := ts.SendProtocolV2Request(lsRefsRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bs), "the upstream did not respond in 100ms") {
+		t.Errorf("got %q, want the ls-refs to time out", bs)
+	}
+}
+
+func TestFetch_UpstreamFetchTimeout(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		UpstreamLatency:      time.Second,
+		UpstreamFetchTimeout: 100 * time.Millisecond,
+	})
+	defer ts.Close()
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ts.SendProtocolV2Request(fetchRequest(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bs), "the upstream fetch did not finish in 100ms") {
+		t.Errorf("got %q, want the upstream fetch to time out", bs)
+	}
+}
+
+func TestFetch_RequestTimeout(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamLatency:   500 * time.Millisecond,
+		RequestTimeout:    100 * time.Millisecond,
+		CloneTimeout:      10 * time.Second,
+	})
+	defer ts.Close()
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ts.SendProtocolV2Request(lsRefsRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bs), "the request did not finish in time") {
+		t.Errorf("got %q, want the ls-refs to time out", bs)
+	}
+
+	// The clone waits for the upstream fetch with the longer deadline.
+	bs, err = ts.SendProtocolV2Request(fetchRequest(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bs), "packfile") {
+		t.Errorf("got %q, want a packfile", bs)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/trace"
+)
+
+func TestTracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	var mu sync.Mutex
+	spans := map[string]string{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID string `json:"traceId"`
+						Name    string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s.TraceID
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	exporter := goblet.NewOTLPTraceExporter(collector.URL+"/v1/traces", nil, "goblet-test")
+	defer exporter.Close()
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader=traceparent: 00-"+traceID+"-00f067aa0ba902b7-01", "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// The spans end after the responses are sent.
+	want := []string{"goblet.Request", "goblet.ls-refs", "goblet.lsRefsUpstream", "goblet.fetch", "goblet.waitForUpstreamFetch", "goblet.uploadPack"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := exporter.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		missing := []string{}
+		for _, name := range want {
+			if id, ok := spans[name]; !ok {
+				missing = append(missing, name)
+			} else if id != traceID {
+				t.Errorf("%s has trace ID %s, want %s", name, id, traceID)
+			}
+		}
+		_, fetchTraced := spans["goblet.fetchUpstream"]
+		mu.Unlock()
+		if len(missing) == 0 && fetchTraced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spans are not exported: %v, goblet.fetchUpstream: %t", missing, fetchTraced)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestOTLPTraceExporter_KeepsUnsentSpans(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		names    []string
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						Name string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					names = append(names, s.Name)
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	exporter := goblet.NewOTLPTraceExporter(collector.URL+"/v1/traces", nil, "goblet-test")
+	now := time.Now()
+	exporter.ExportSpan(&trace.SpanData{Name: "first", StartTime: now, EndTime: now})
+	if err := exporter.Flush(); err == nil {
+		t.Fatal("the first flush succeeded while the collector is unavailable")
+	}
+	exporter.ExportSpan(&trace.SpanData{Name: "second", StartTime: now, EndTime: now})
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := strings.Join(names, ","), "first,second"; got != want {
+		t.Errorf("got the spans %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"golang.org/x/oauth2"
+)
+
+func TestUpstreamCredentialProvider(t *testing.T) {
+	invalidTokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "invalid-token"})
+	tests := []struct {
+		name     string
+		provider goblet.UpstreamCredentialProvider
+		ts       oauth2.TokenSource
+		ok       bool
+	}{
+		{
+			name: "matching provider",
+			provider: goblet.ChainUpstreamCredentialProviders(
+				goblet.NewTokenSourceCredentialProvider("example.com", invalidTokenSource),
+				goblet.NewTokenSourceCredentialProvider("*", goblettest.TestTokenSource),
+			),
+			ok: true,
+		},
+		{
+			name:     "provider before TokenSource",
+			provider: goblet.NewTokenSourceCredentialProvider("*", invalidTokenSource),
+			ts:       goblettest.TestTokenSource,
+			ok:       false,
+		},
+		{
+			name:     "fallback to TokenSource",
+			provider: goblet.NewTokenSourceCredentialProvider("example.com", invalidTokenSource),
+			ts:       goblettest.TestTokenSource,
+			ok:       true,
+		},
+		{
+			name:     "no credentials",
+			provider: goblet.NewTokenSourceCredentialProvider("example.com", goblettest.TestTokenSource),
+			ok:       false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer:          goblettest.TestRequestAuthorizer,
+				TokenSource:                tc.ts,
+				UpstreamCredentialProvider: tc.provider,
+			})
+			defer ts.Close()
+			if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+				t.Fatal(err)
+			}
+
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+			if tc.ok && err != nil {
+				t.Errorf("got %v, want the fetch to succeed", err)
+			} else if !tc.ok && err == nil {
+				t.Errorf("the fetch succeeds with the wrong credentials")
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+// forwardProxy is an HTTP proxy that records the paths of the proxied
+// requests.
+type forwardProxy struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.paths = append(p.paths, r.URL.Path)
+	p.mu.Unlock()
+
+	r.RequestURI = ""
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *forwardProxy) proxied() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return strings.Join(p.paths, " ")
+}
+
+func TestFetch_UpstreamProxy(t *testing.T) {
+	p := &forwardProxy{}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamProxy:     proxy.URL,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both ls-refs and git-fetch go through the proxy.
+	got := p.proxied()
+	if !strings.Contains(got, "/git-upload-pack") || !strings.Contains(got, "/info/refs") {
+		t.Errorf("got %q, want the upstream requests to be proxied", got)
+	}
+}
+
+func TestFetch_UpstreamNoProxy(t *testing.T) {
+	p := &forwardProxy{}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamProxy:     proxy.URL,
+	})
+	defer ts.Close()
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.ServerConfig.UpstreamNoProxy = []string{u.Hostname()}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.proxied(); got != "" {
+		t.Errorf("got %q, want the upstream to be connected directly", got)
+	}
+}
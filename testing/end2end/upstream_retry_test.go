@@ -0,0 +1,113 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var upstreamRetryView = &view.View{Name: "test/upstream-retry-count", Measure: goblet.UpstreamRetryCount, TagKeys: []tag.Key{goblet.CommandTypeKey}, Aggregation: view.Count()}
+
+func upstreamRetries(t *testing.T) map[string]int64 {
+	rows, err := view.RetrieveData(upstreamRetryView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, row := range rows {
+		got[row.Tags[0].Value] += row.Data.(*view.CountData).Value
+	}
+	return got
+}
+
+func TestLsRefs_UpstreamRetries(t *testing.T) {
+	if err := view.Register(upstreamRetryView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(upstreamRetryView)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		UpstreamRetries:      3,
+		UpstreamRetryBackoff: 10 * time.Millisecond,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.FailUpstreamRequests(2)
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if got := upstreamRetries(t)["ls-refs"]; got != 2 {
+		t.Errorf("got %d ls-refs retries, want 2", got)
+	}
+}
+
+func TestFetch_UpstreamRetries(t *testing.T) {
+	if err := view.Register(upstreamRetryView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(upstreamRetryView)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		UpstreamRetries:      3,
+		UpstreamRetryBackoff: 10 * time.Millisecond,
+	})
+	defer ts.Close()
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fetch of the missing commit fetches from the upstream.
+	ts.FailUpstreamRequests(1)
+	if _, err := ts.SendProtocolV2Request(fetchRequest(hash)); err != nil {
+		t.Fatal(err)
+	}
+	if got := upstreamRetries(t)["fetch"]; got != 1 {
+		t.Errorf("got %d fetch retries, want 1", got)
+	}
+}
+
+func TestLsRefs_NoUpstreamRetries(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.FailUpstreamRequests(1)
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL); err == nil {
+		t.Error("ls-remote succeeded without retries")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"strings"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestForceUpstreamHTTPS_Upgrade(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:  goblettest.TestRequestAuthorizer,
+		TokenSource:        goblettest.TestTokenSource,
+		AdminAuthorizer:    goblettest.TestRequestAuthorizer,
+		UpstreamHostname:   "localhost",
+		ForceUpstreamHTTPS: true,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test upstream speaks only plain HTTP, so the upgraded fetch
+	// fails.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err == nil {
+		t.Errorf("fetched from the upstream with plain HTTP")
+	}
+	if repos := listAdminRepos(t, ts); len(repos) != 1 || !strings.HasPrefix(repos[0].UpstreamURL, "https://localhost:") {
+		t.Errorf("got %v, want the upstream URL to be upgraded", repos)
+	}
+}
+
+func TestForceUpstreamHTTPS_PlaintextAllowed(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:      goblettest.TestRequestAuthorizer,
+		TokenSource:            goblettest.TestTokenSource,
+		AdminAuthorizer:        goblettest.TestRequestAuthorizer,
+		UpstreamHostname:       "localhost",
+		ForceUpstreamHTTPS:     true,
+		PlaintextUpstreamHosts: []string{"localhost"},
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Run("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if repos := listAdminRepos(t, ts); len(repos) != 1 || !strings.HasPrefix(repos[0].UpstreamURL, "http://localhost:") {
+		t.Errorf("got %v, want the upstream URL to be kept", repos)
+	}
+}
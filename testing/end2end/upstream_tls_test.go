@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_UpstreamTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		requireClientCert bool
+		upstreamTLS       func(ts *goblettest.TestServer) *goblet.UpstreamTLS
+		wantErr           bool
+	}{
+		{
+			name: "private CA",
+			upstreamTLS: func(ts *goblettest.TestServer) *goblet.UpstreamTLS {
+				return &goblet.UpstreamTLS{CAFile: ts.UpstreamCertFile, MinVersion: tls.VersionTLS12}
+			},
+		},
+		{
+			name: "unknown CA",
+			upstreamTLS: func(ts *goblettest.TestServer) *goblet.UpstreamTLS {
+				return nil
+			},
+			wantErr: true,
+		},
+		{
+			name:              "client certificate",
+			requireClientCert: true,
+			upstreamTLS: func(ts *goblettest.TestServer) *goblet.UpstreamTLS {
+				return &goblet.UpstreamTLS{CAFile: ts.UpstreamCertFile, CertFile: ts.UpstreamCertFile, KeyFile: ts.UpstreamKeyFile}
+			},
+		},
+		{
+			name:              "no client certificate",
+			requireClientCert: true,
+			upstreamTLS: func(ts *goblettest.TestServer) *goblet.UpstreamTLS {
+				return &goblet.UpstreamTLS{CAFile: ts.UpstreamCertFile}
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer:         goblettest.TestRequestAuthorizer,
+				TokenSource:               goblettest.TestTokenSource,
+				UpstreamOverTLS:           true,
+				RequireUpstreamClientCert: tc.requireClientCert,
+			})
+			defer ts.Close()
+			ts.ServerConfig.UpstreamTLS = tc.upstreamTLS(ts)
+			if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+				t.Fatal(err)
+			}
+
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			_, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("got %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestFetch_UpstreamConnReuse(t *testing.T) {
+	conns := &view.View{Name: "test/upstream-conn-count", Measure: goblet.UpstreamConnCount, TagKeys: []tag.Key{goblet.ConnReusedKey}, Aggregation: view.Count()}
+	if err := view.Register(conns); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(conns)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		UpstreamTransport: &goblet.UpstreamTransport{
+			MaxIdleConnsPerHost: 4,
+			DisableHTTP2:        true,
+		},
+	})
+	defer ts.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every ls-refs queries the upstream as the cache is never fresh.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := view.RetrieveData("test/upstream-conn-count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, row := range rows {
+		got[row.Tags[0].Value] += row.Data.(*view.CountData).Value
+	}
+	if got["true"] == 0 {
+		t.Errorf("got %v, want the upstream connections to be reused", got)
+	}
+}
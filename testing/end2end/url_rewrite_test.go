@@ -0,0 +1,108 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/goblet"
+	"golang.org/x/oauth2"
+)
+
+func TestRuleURLCanonicalizer(t *testing.T) {
+	canonicalize, err := goblet.NewRuleURLCanonicalizer([]*goblet.URLRewriteRule{
+		{Pattern: `git\.example\.com/mirror/(?P<repo>.+?)(\.git)?`, Upstream: "https://mirror.example.com/${repo}"},
+		{Pattern: `git\.example\.com/(.+?)(\.git)?`, Upstream: "https://upstream.example.com/git/$1"},
+		{Pattern: `broken\.example\.com/(.+)`, Upstream: "$1"},
+		{Pattern: `prefix\.example\.com/p-(.+)`, Upstream: "https://upstream.example.com/$1/repo"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://git.example.com/a/b.git/info/refs", "https://upstream.example.com/git/a/b"},
+		{"http://git.example.com/a/b/git-upload-pack", "https://upstream.example.com/git/a/b"},
+		{"http://git.example.com/mirror/c.git/info/refs", "https://mirror.example.com/c"},
+		{"http://other.example.com/git.example.com/a", ""},
+		{"http://broken.example.com/a", ""},
+		{"http://git.example.com/a/../b/info/refs", ""},
+		{"http://git.example.com/mirror/../../b", ""},
+		{"http://git.example.com/a/./b", ""},
+		{"http://git.example.com/mirror/..", ""},
+		{"http://prefix.example.com/p-a", "https://upstream.example.com/a/repo"},
+		{"http://prefix.example.com/p-..", ""},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := canonicalize(u)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", tc.url, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+		} else if got.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.url, got, tc.want)
+		}
+	}
+
+	if _, err := goblet.NewRuleURLCanonicalizer([]*goblet.URLRewriteRule{{Pattern: "(", Upstream: "https://example.com"}}); err == nil {
+		t.Errorf("an invalid pattern is accepted")
+	}
+}
+
+func TestRuleCredentialProvider(t *testing.T) {
+	provider := goblet.NewRuleCredentialProvider([]*goblet.URLRewriteRule{
+		{Pattern: `[^/]+/github/(.+?)(\.git)?`, Upstream: "https://github.com/$1", TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "github"})},
+		{Pattern: `[^/]+/gob/([^/]+)/(.+?)(\.git)?`, Upstream: "https://$1.googlesource.com/$2"},
+		{Pattern: `[^/]+/gitlab/(.+?)(\.git)?`, Upstream: "https://gitlab.example.com/$1", TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "gitlab"})},
+	})
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/a/b", "github"},
+		{"https://gitlab.example.com/a/b", "gitlab"},
+		{"https://gitlab.example.com.evil.example/a/b", ""},
+		{"https://go.googlesource.com/a", ""},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := provider.UpstreamCredential(u)
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+			continue
+		}
+		got := ""
+		if tok != nil {
+			got = tok.AccessToken
+		}
+		if got != tc.want {
+			t.Errorf("%s: got token %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+// cachedMaster returns the master branch of the cached repository at the
+// path, or an empty string if it's not cached.
+func cachedMaster(t *testing.T, ts *goblettest.TestServer, p string) string {
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := goblettest.GitRepo(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, u.Host, p)).Run("rev-parse", "-q", "--verify", "refs/heads/master")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+func TestWarmUp(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), "warm")); err != nil {
+		t.Fatal(err)
+	}
+	// A missing repository doesn't stop the others.
+	ts.ServerConfig.WarmRepositories = []string{ts.ProxyServerURL + "missing", ts.ProxyServerURL + "warm"}
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goblet.WarmUpRepositories(ts.ServerConfig); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("got %v, want an error for the missing repository", err)
+	}
+	if got := cachedMaster(t, ts, "warm"); got != strings.TrimSpace(want) {
+		t.Errorf("got %q, want %s cached", got, want)
+	}
+
+	// The next pass fetches the updates.
+	want, err = ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goblet.WarmUpRepositories(ts.ServerConfig)
+	if got := cachedMaster(t, ts, "warm"); got != strings.TrimSpace(want) {
+		t.Errorf("got %q, want %s cached", got, want)
+	}
+}
+
+func TestAdmin_WarmRepos(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		AdminAuthorizer:   goblettest.TestRequestAuthorizer,
+	})
+	defer ts.Close()
+	admin := httptest.NewServer(goblet.AdminHandler(ts.ServerConfig))
+	defer admin.Close()
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("PUT", admin.URL+"/admin/warm-repos", strings.NewReader(`["`+ts.ProxyServerURL+`"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	b.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(b.String(), ts.ProxyServerURL) {
+		t.Fatalf("cannot set the warm repositories: %d %s", resp.StatusCode, b.String())
+	}
+
+	// The repository is warmed up in the background.
+	for i := 0; cachedMaster(t, ts, "") != strings.TrimSpace(want); i++ {
+		if i == 50 {
+			t.Fatal("the repository is not warmed up")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+const testWebhookSecret = "webhook-secret"
+
+func sendWebhook(t *testing.T, ts *goblettest.TestServer, query string, header http.Header, payload string) int {
+	s := httptest.NewServer(goblet.WebhookHandler(ts.ServerConfig))
+	defer s.Close()
+	req, err := http.NewRequest("POST", s.URL+"/webhook"+query, strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func gitHubSignature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// testWebhookRefresh checks that the cached repository at the path is served
+// with the new commit right after the webhook is sent by send.
+func testWebhookRefresh(t *testing.T, p string, send func(ts *goblettest.TestServer) int) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:    goblettest.TestRequestAuthorizer,
+		TokenSource:          goblettest.TestTokenSource,
+		FetchFreshnessWindow: time.Hour,
+		WebhookSecret:        testWebhookSecret,
+	})
+	defer ts.Close()
+	if err := os.Symlink(".", filepath.Join(string(ts.UpstreamGitRepo), p)); err != nil {
+		t.Fatal(err)
+	}
+	ts.ServerConfig.WebhookGerritURL = strings.TrimSuffix(ts.ProxyServerURL, "/")
+
+	first, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	lsRemote := func() string {
+		out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL+p, "refs/heads/master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(out)[0]
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL+p); err != nil {
+		t.Fatal(err)
+	}
+	second, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lsRemote(); got != strings.TrimSpace(first) {
+		t.Fatalf("got %s, want the cached %s", got, first)
+	}
+
+	if code := send(ts); code != http.StatusOK {
+		t.Fatalf("the webhook got %d", code)
+	}
+	if got := lsRemote(); got != strings.TrimSpace(second) {
+		t.Errorf("got %s, want the pushed %s", got, second)
+	}
+}
+
+func TestWebhook_GitHub(t *testing.T) {
+	testWebhookRefresh(t, "repo", func(ts *goblettest.TestServer) int {
+		payload := `{"ref": "refs/heads/master", "repository": {"clone_url": "` + ts.ProxyServerURL + `repo.git"}}`
+		if code := sendWebhook(t, ts, "", http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {gitHubSignature(payload + " ")}}, payload); code != http.StatusUnauthorized {
+			t.Errorf("a payload with a wrong signature got %d", code)
+		}
+		ping := `{"zen": "Keep it logically awesome."}`
+		if code := sendWebhook(t, ts, "", http.Header{"X-Github-Event": {"ping"}, "X-Hub-Signature-256": {gitHubSignature(ping)}}, ping); code != http.StatusOK {
+			t.Errorf("a ping got %d", code)
+		}
+		return sendWebhook(t, ts, "", http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {gitHubSignature(payload)}}, payload)
+	})
+}
+
+func TestWebhook_GitLab(t *testing.T) {
+	testWebhookRefresh(t, "repo", func(ts *goblettest.TestServer) int {
+		payload := `{"object_kind": "push", "project": {"git_http_url": "` + ts.ProxyServerURL + `repo.git"}}`
+		if code := sendWebhook(t, ts, "", http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {"wrong"}}, payload); code != http.StatusUnauthorized {
+			t.Errorf("a payload with a wrong token got %d", code)
+		}
+		return sendWebhook(t, ts, "", http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {testWebhookSecret}}, payload)
+	})
+}
+
+func TestWebhook_Gerrit(t *testing.T) {
+	testWebhookRefresh(t, "repo", func(ts *goblettest.TestServer) int {
+		payload := `{"type": "ref-updated", "refUpdate": {"project": "repo", "refName": "refs/heads/master"}}`
+		if code := sendWebhook(t, ts, "?token=wrong", nil, payload); code != http.StatusUnauthorized {
+			t.Errorf("a payload with a wrong token got %d", code)
+		}
+		return sendWebhook(t, ts, "?token="+testWebhookSecret, nil, payload)
+	})
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeUpstream is an in-process Git upstream server for the tests of the
+// programs embedding goblet. It serves the bare repositories added by
+// AddRepository over the smart HTTP protocol with git-http-backend, so that
+// the tests need neither the network nor a real Git hosting service. The
+// latency and the failures of the requests can be injected.
+type FakeUpstream struct {
+	// URL is the base URL of the server, ending with "/". A repository
+	// is served at URL + name.
+	URL string
+
+	root   string
+	server *http.Server
+	config *FakeUpstreamConfig
+
+	mu       sync.Mutex
+	latency  time.Duration
+	failures int
+	failCode int
+	requests map[string]int
+}
+
+// FakeUpstreamConfig is the configuration of a FakeUpstream.
+type FakeUpstreamConfig struct {
+	// RequireAuthentication makes the server reject the requests without
+	// the token of TestTokenSource with 403 Forbidden.
+	RequireAuthentication bool
+
+	// Latency is added to every request. See SetLatency.
+	Latency time.Duration
+}
+
+// NewFakeUpstream starts a FakeUpstream on localhost.
+func NewFakeUpstream(config *FakeUpstreamConfig) *FakeUpstream {
+	if config == nil {
+		config = &FakeUpstreamConfig{}
+	}
+	root, err := ioutil.TempDir("", "goblet_upstream")
+	if err != nil {
+		log.Fatal(err)
+	}
+	u := &FakeUpstream{
+		root:     root,
+		config:   config,
+		latency:  config.Latency,
+		requests: map[string]int{},
+	}
+	u.server = &http.Server{Handler: http.HandlerFunc(u.serveHTTP)}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		u.server.Serve(l)
+	}()
+	u.URL = fmt.Sprintf("http://%s/", l.Addr().String())
+	return u
+}
+
+// AddRepository creates an empty bare repository served at URL + name. name
+// can contain slashes, such as "org/repo".
+func (u *FakeUpstream) AddRepository(name string) GitRepo {
+	r := u.Repository(name)
+	if err := os.MkdirAll(string(r), 0750); err != nil {
+		log.Fatal(err)
+	}
+	r.Run("init", "--bare")
+	r.Run("config", "http.receivepack", "1")
+	r.Run("config", "uploadpack.allowfilter", "1")
+	r.Run("config", "uploadpack.allowrefinwant", "1")
+	return r
+}
+
+// Repository returns the bare repository served at URL + name.
+func (u *FakeUpstream) Repository(name string) GitRepo {
+	return GitRepo(filepath.Join(u.root, filepath.FromSlash(name)))
+}
+
+// RepositoryURL returns the URL of the repository.
+func (u *FakeUpstream) RepositoryURL(name string) string {
+	return u.URL + name
+}
+
+// CreateRandomCommit creates a commit on the master branch of the repository
+// and returns its hash. The commit is pushed to the repository directly, not
+// through the server, so that it's not affected by the injected latency and
+// failures.
+func (u *FakeUpstream) CreateRandomCommit(name string) (string, error) {
+	pushClient := NewLocalGitRepo()
+	defer pushClient.Close()
+	hash, err := pushClient.CreateRandomCommit()
+	if err != nil {
+		return "", err
+	}
+	_, err = pushClient.Run("push", "-f", string(u.Repository(name)), "master:master")
+	return hash, err
+}
+
+// SetLatency changes the latency added to every request.
+func (u *FakeUpstream) SetLatency(d time.Duration) {
+	u.mu.Lock()
+	u.latency = d
+	u.mu.Unlock()
+}
+
+// FailRequests makes the next n requests fail with the HTTP status code, such
+// as http.StatusServiceUnavailable.
+func (u *FakeUpstream) FailRequests(n int, code int) {
+	u.mu.Lock()
+	u.failures = n
+	u.failCode = code
+	u.mu.Unlock()
+}
+
+// RequestCount returns the number of the requests to the repository,
+// including the failed ones.
+func (u *FakeUpstream) RequestCount(name string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests[name]
+}
+
+// URLCanonicalizer is a URLCanonializer of goblet.ServerConfig that maps the
+// path of a request to the proxy to the repository of the same name.
+func (u *FakeUpstream) URLCanonicalizer(r *url.URL) (*url.URL, error) {
+	ret, err := url.Parse(u.URL)
+	if err != nil {
+		return nil, err
+	}
+	ret.Path = "/" + repositoryName(r.Path)
+	return ret, nil
+}
+
+func (u *FakeUpstream) Close() {
+	u.server.Close()
+	os.RemoveAll(u.root)
+}
+
+func (u *FakeUpstream) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	name := repositoryName(req.URL.Path)
+	u.mu.Lock()
+	latency := u.latency
+	fail := u.failures > 0
+	if fail {
+		u.failures--
+	}
+	code := u.failCode
+	u.requests[name]++
+	u.mu.Unlock()
+
+	time.Sleep(latency)
+	if fail {
+		http.Error(w, "injected failure", code)
+		return
+	}
+	if u.config.RequireAuthentication && req.Header.Get("Authorization") != "Bearer "+validServerAuthToken {
+		http.Error(w, "invalid authenticator", http.StatusForbidden)
+		return
+	}
+	if _, err := os.Stat(string(u.Repository(name))); err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	serveGitHTTPBackend(w, req, u.root)
+}
+
+// repositoryName returns the repository name of a smart HTTP request path.
+func repositoryName(p string) string {
+	for _, suffix := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"} {
+		if strings.HasSuffix(p, suffix) {
+			p = strings.TrimSuffix(p, suffix)
+			break
+		}
+	}
+	return strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+}
@@ -15,7 +15,13 @@
 package testing
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -25,8 +31,10 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/gitprotocolio"
 	"github.com/google/goblet"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc/codes"
@@ -56,8 +64,25 @@ type TestServer struct {
 	UpstreamGitRepo   GitRepo
 	upstreamServer    *http.Server
 	UpstreamServerURL string
+	upstreamLatency   time.Duration
+	upstreamHostname  string
+	upstreamCertDir   string
 	proxyServer       *http.Server
 	ProxyServerURL    string
+	ServerConfig      *goblet.ServerConfig
+
+	// UpstreamCertFile and UpstreamKeyFile are the self-signed certificate
+	// and its private key of the upstream server with UpstreamOverTLS.
+	UpstreamCertFile string
+	UpstreamKeyFile  string
+
+	failuresMu       sync.Mutex
+	upstreamFailures int
+
+	lfsMu           sync.Mutex
+	lfsObjects      map[string][]byte
+	lfsObjectRepos  map[string]string
+	lfsObjectServed int
 }
 
 type TestServerConfig struct {
@@ -65,10 +90,129 @@ type TestServerConfig struct {
 	TokenSource       oauth2.TokenSource
 	ErrorReporter     func(*http.Request, error)
 	RequestLogger     func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
+
+	UpstreamCredentialProvider goblet.UpstreamCredentialProvider
+
+	RemoteFilesystemMode    bool
+	ClientKeepaliveInterval time.Duration
+
+	// UpstreamLatency is added to every request to the upstream server.
+	UpstreamLatency time.Duration
+
+	AccessLogFile       string
+	AccessLogFormat     string
+	AccessLogMaxBytes   int64
+	AccessLogMaxBackups int
+
+	FetchFreshnessWindow time.Duration
+	HeadOnlyCacheTTL     time.Duration
+	NegativeCacheTTL     time.Duration
+	RepoOverrides        []*goblet.RepoOverride
+
+	PackServeTimeout   time.Duration
+	RetryPackServe     bool
+	CoalesceFetches    bool
+	ShallowCachePolicy goblet.ShallowCachePolicy
+
+	RequestTimeout        time.Duration
+	CloneTimeout          time.Duration
+	UpstreamLsRefsTimeout time.Duration
+	UpstreamFetchTimeout  time.Duration
+
+	ForcePushPolicy      goblet.ForcePushPolicy
+	ForcePushGracePeriod time.Duration
+
+	// UpstreamHostname is used in the canonical URLs instead of the
+	// upstream server's IP address.
+	UpstreamHostname string
+	DNSCacheTTL      time.Duration
+	UpstreamHostIPs  map[string]string
+
+	UpstreamTransport *goblet.UpstreamTransport
+	UpstreamProxy     string
+	UpstreamNoProxy   []string
+
+	// UpstreamOverTLS serves the upstream with HTTPS at 127.0.0.1 with a
+	// self-signed certificate. RequireUpstreamClientCert makes it require
+	// the same certificate as the client certificate.
+	UpstreamOverTLS           bool
+	RequireUpstreamClientCert bool
+
+	UpstreamRetries      int
+	UpstreamRetryBackoff time.Duration
+
+	CircuitErrorRate    float64
+	CircuitMinRequests  int
+	CircuitOpenDuration time.Duration
+
+	ShedDuringEviction bool
+
+	MaxConcurrentFetches   int
+	HighPriorityClients    []string
+	HighPriorityAuthorizer func(r *http.Request) error
+	ShedLowPriority        bool
+
+	TenantExtractor func(r *http.Request) string
+
+	MaxNegotiationRounds int
+	MaxRequestBytes      int64
+	RequestMemoryBudget  int64
+
+	MaxUpstreamFetches int
+	MaxUploadPacks     int
+	MaxRepoRequests    int
+
+	HiddenRefs            []string
+	GerritChangeRefPolicy goblet.GerritChangeRefPolicy
+
+	AllowedClientCapabilities []string
+
+	ForceUpstreamHTTPS     bool
+	PlaintextUpstreamHosts []string
+
+	AdminAuthorizer  func(r *http.Request) error
+	SettingsReloader func() error
+
+	AccessRules      []*goblet.AccessRule
+	ClientIdentifier func(r *http.Request) string
+	ClientRateLimit  float64
+	ClientRateBurst  int
+
+	PushPolicy goblet.PushPolicy
+
+	LFSCacheRoot     string
+	LFSCacheMaxBytes int64
+
+	PackCacheRoot     string
+	PackCacheMaxBytes int64
+
+	BundleRoot    string
+	BundleMaxAge  time.Duration
+	BundleBaseURL string
+
+	PackfileURIUploader func(ctx context.Context, name string, pack io.Reader) (string, error)
+	PackfileURIMinBytes int64
+
+	MaintenanceInterval time.Duration
+
+	CacheShardRoots []string
+	Offline         bool
+
+	WarmRepositories []string
+
+	WebhookSecret    string
+	WebhookGerritURL string
+
+	// RepositoryStore, if set, returns the RepositoryStore of the proxy
+	// server config.
+	RepositoryStore func(config *goblet.ServerConfig) goblet.RepositoryStore
 }
 
 func NewTestServer(config *TestServerConfig) *TestServer {
-	s := &TestServer{}
+	s := &TestServer{
+		upstreamLatency:  config.UpstreamLatency,
+		upstreamHostname: config.UpstreamHostname,
+	}
 	{
 		s.UpstreamGitRepo = NewLocalBareGitRepo()
 		s.UpstreamGitRepo.Run("config", "http.receivepack", "1")
@@ -82,47 +226,150 @@ func NewTestServer(config *TestServerConfig) *TestServer {
 		if err != nil {
 			log.Fatal(err)
 		}
-		go func() {
-			s.upstreamServer.Serve(l)
-		}()
-		s.UpstreamServerURL = fmt.Sprintf("http://%s/", l.Addr().String())
-	}
-
-	{
-		dir, err := ioutil.TempDir("", "goblet_cache")
-		if err != nil {
-			log.Fatal(err)
-		}
-		config := &goblet.ServerConfig{
-			LocalDiskCacheRoot: dir,
-			URLCanonializer:    s.testURLCanonicalizer,
-			RequestAuthorizer:  config.RequestAuthorizer,
-			TokenSource:        config.TokenSource,
-			ErrorReporter:      config.ErrorReporter,
-			RequestLogger:      config.RequestLogger,
-		}
-		s.proxyServer = &http.Server{
-			Handler: goblet.HTTPHandler(config),
+		if config.UpstreamOverTLS {
+			if s.upstreamCertDir, err = ioutil.TempDir("", "goblet_cert"); err != nil {
+				log.Fatal(err)
+			}
+			s.UpstreamCertFile, s.UpstreamKeyFile = writeSelfSignedCertificate(s.upstreamCertDir)
+			s.upstreamServer.TLSConfig = upstreamTLSConfig(s.UpstreamCertFile, config.RequireUpstreamClientCert)
+			go func() {
+				s.upstreamServer.ServeTLS(l, s.UpstreamCertFile, s.UpstreamKeyFile)
+			}()
+			s.UpstreamServerURL = fmt.Sprintf("https://127.0.0.1:%d/", l.Addr().(*net.TCPAddr).Port)
+		} else {
+			go func() {
+				s.upstreamServer.Serve(l)
+			}()
+			s.UpstreamServerURL = fmt.Sprintf("http://%s/", l.Addr().String())
 		}
+	}
 
-		l, err := net.Listen("tcp", ":0")
-		if err != nil {
-			log.Fatal(err)
-		}
-		go func() {
-			s.proxyServer.Serve(l)
-		}()
-		s.ProxyServerURL = fmt.Sprintf("http://%s/", l.Addr().String())
+	dir, err := ioutil.TempDir("", "goblet_cache")
+	if err != nil {
+		log.Fatal(err)
 	}
+	s.startProxyServer(dir, config)
 	return s
 }
 
+// Restart replaces the proxy server with a new one of config that uses the
+// same cache root and upstream, so that the settings that cannot be changed
+// on a running server can be tested with a seeded cache. The upstream
+// settings of config are ignored.
+func (s *TestServer) Restart(config *TestServerConfig) {
+	s.proxyServer.Shutdown(context.Background())
+	goblet.Shutdown(context.Background(), s.ServerConfig)
+	s.startProxyServer(s.ServerConfig.LocalDiskCacheRoot, config)
+}
+
+func (s *TestServer) startProxyServer(dir string, config *TestServerConfig) {
+	serverConfig := &goblet.ServerConfig{
+		LocalDiskCacheRoot: dir,
+		URLCanonializer:    s.testURLCanonicalizer,
+		RequestAuthorizer:  config.RequestAuthorizer,
+		TokenSource:        config.TokenSource,
+		ErrorReporter:      config.ErrorReporter,
+		RequestLogger:      config.RequestLogger,
+
+		UpstreamCredentialProvider: config.UpstreamCredentialProvider,
+
+		RemoteFilesystemMode:      config.RemoteFilesystemMode,
+		ClientKeepaliveInterval:   config.ClientKeepaliveInterval,
+		AccessLogFile:             config.AccessLogFile,
+		AccessLogFormat:           config.AccessLogFormat,
+		AccessLogMaxBytes:         config.AccessLogMaxBytes,
+		AccessLogMaxBackups:       config.AccessLogMaxBackups,
+		FetchFreshnessWindow:      config.FetchFreshnessWindow,
+		HeadOnlyCacheTTL:          config.HeadOnlyCacheTTL,
+		NegativeCacheTTL:          config.NegativeCacheTTL,
+		PackServeTimeout:          config.PackServeTimeout,
+		RequestTimeout:            config.RequestTimeout,
+		CloneTimeout:              config.CloneTimeout,
+		UpstreamLsRefsTimeout:     config.UpstreamLsRefsTimeout,
+		UpstreamFetchTimeout:      config.UpstreamFetchTimeout,
+		RetryPackServe:            config.RetryPackServe,
+		CoalesceFetches:           config.CoalesceFetches,
+		ShallowCachePolicy:        config.ShallowCachePolicy,
+		RepoOverrides:             config.RepoOverrides,
+		ForcePushPolicy:           config.ForcePushPolicy,
+		ForcePushGracePeriod:      config.ForcePushGracePeriod,
+		DNSCacheTTL:               config.DNSCacheTTL,
+		UpstreamHostIPs:           config.UpstreamHostIPs,
+		UpstreamTransport:         config.UpstreamTransport,
+		UpstreamProxy:             config.UpstreamProxy,
+		UpstreamNoProxy:           config.UpstreamNoProxy,
+		UpstreamRetries:           config.UpstreamRetries,
+		UpstreamRetryBackoff:      config.UpstreamRetryBackoff,
+		CircuitErrorRate:          config.CircuitErrorRate,
+		CircuitMinRequests:        config.CircuitMinRequests,
+		CircuitOpenDuration:       config.CircuitOpenDuration,
+		ShedDuringEviction:        config.ShedDuringEviction,
+		MaxConcurrentFetches:      config.MaxConcurrentFetches,
+		HighPriorityClients:       config.HighPriorityClients,
+		HighPriorityAuthorizer:    config.HighPriorityAuthorizer,
+		ShedLowPriority:           config.ShedLowPriority,
+		TenantExtractor:           config.TenantExtractor,
+		MaxNegotiationRounds:      config.MaxNegotiationRounds,
+		MaxRequestBytes:           config.MaxRequestBytes,
+		RequestMemoryBudget:       config.RequestMemoryBudget,
+		MaxUpstreamFetches:        config.MaxUpstreamFetches,
+		MaxUploadPacks:            config.MaxUploadPacks,
+		MaxRepoRequests:           config.MaxRepoRequests,
+		HiddenRefs:                config.HiddenRefs,
+		GerritChangeRefPolicy:     config.GerritChangeRefPolicy,
+		AllowedClientCapabilities: config.AllowedClientCapabilities,
+		ForceUpstreamHTTPS:        config.ForceUpstreamHTTPS,
+		PlaintextUpstreamHosts:    config.PlaintextUpstreamHosts,
+		AdminAuthorizer:           config.AdminAuthorizer,
+		SettingsReloader:          config.SettingsReloader,
+		AccessRules:               config.AccessRules,
+		ClientIdentifier:          config.ClientIdentifier,
+		ClientRateLimit:           config.ClientRateLimit,
+		ClientRateBurst:           config.ClientRateBurst,
+		PushPolicy:                config.PushPolicy,
+		LFSCacheRoot:              config.LFSCacheRoot,
+		LFSCacheMaxBytes:          config.LFSCacheMaxBytes,
+		PackCacheRoot:             config.PackCacheRoot,
+		PackCacheMaxBytes:         config.PackCacheMaxBytes,
+		BundleRoot:                config.BundleRoot,
+		BundleMaxAge:              config.BundleMaxAge,
+		BundleBaseURL:             config.BundleBaseURL,
+		PackfileURIUploader:       config.PackfileURIUploader,
+		PackfileURIMinBytes:       config.PackfileURIMinBytes,
+		MaintenanceInterval:       config.MaintenanceInterval,
+		CacheShardRoots:           config.CacheShardRoots,
+		Offline:                   config.Offline,
+		WarmRepositories:          config.WarmRepositories,
+		WebhookSecret:             config.WebhookSecret,
+		WebhookGerritURL:          config.WebhookGerritURL,
+	}
+	if config.RepositoryStore != nil {
+		serverConfig.RepositoryStore = config.RepositoryStore(serverConfig)
+	}
+	s.ServerConfig = serverConfig
+	s.proxyServer = &http.Server{
+		Handler: goblet.HTTPHandler(serverConfig),
+	}
+
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		s.proxyServer.Serve(l)
+	}()
+	s.ProxyServerURL = fmt.Sprintf("http://%s/", l.Addr().String())
+}
+
 func (s *TestServer) testURLCanonicalizer(u *url.URL) (*url.URL, error) {
 	ret, err := url.Parse(s.UpstreamServerURL)
 	if err != nil {
 		return nil, err
 	}
 	ret.Path = u.Path
+	if s.upstreamHostname != "" {
+		ret.Host = net.JoinHostPort(s.upstreamHostname, ret.Port())
+	}
 
 	// Git endpoint suffixes.
 	if strings.HasSuffix(ret.Path, "/info/refs") {
@@ -136,17 +383,50 @@ func (s *TestServer) testURLCanonicalizer(u *url.URL) (*url.URL, error) {
 	return ret, nil
 }
 
+// FailUpstreamRequests makes the next n requests to the upstream server fail
+// with 503 Service Unavailable.
+func (s *TestServer) FailUpstreamRequests(n int) {
+	s.failuresMu.Lock()
+	s.upstreamFailures = n
+	s.failuresMu.Unlock()
+}
+
 func (s *TestServer) upstreamServerHandler(w http.ResponseWriter, req *http.Request) {
+	time.Sleep(s.upstreamLatency)
+	s.failuresMu.Lock()
+	fail := s.upstreamFailures > 0
+	if fail {
+		s.upstreamFailures--
+	}
+	s.failuresMu.Unlock()
+	if fail {
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	if req.Header.Get("Authorization") != "Bearer "+validServerAuthToken {
 		http.Error(w, "invalid authenticator", http.StatusForbidden)
 		return
 	}
+	if strings.HasSuffix(req.URL.Path, "/info/lfs/objects/batch") {
+		s.upstreamLFSBatchHandler(w, req)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/lfs-objects/") {
+		s.upstreamLFSObjectHandler(w, req)
+		return
+	}
 
+	serveGitHTTPBackend(w, req, string(s.UpstreamGitRepo))
+}
+
+// serveGitHTTPBackend serves a smart HTTP request with git-http-backend for
+// the repositories under the root.
+func serveGitHTTPBackend(w http.ResponseWriter, req *http.Request, root string) {
 	h := &cgi.Handler{
 		Path: gitBinary,
-		Dir:  string(s.UpstreamGitRepo),
+		Dir:  root,
 		Env: []string{
-			"GIT_PROJECT_ROOT=" + string(s.UpstreamGitRepo),
+			"GIT_PROJECT_ROOT=" + root,
 			"GIT_HTTP_EXPORT_ALL=1",
 		},
 		Args: []string{
@@ -173,15 +453,159 @@ func (s *TestServer) CreateRandomCommitUpstream() (string, error) {
 		return "", err
 	}
 
-	_, err = pushClient.Run("-c", "http.extraHeader=Authorization: Bearer "+validServerAuthToken, "push", "-f", s.UpstreamServerURL, "master:master")
+	args := []string{"-c", "http.extraHeader=Authorization: Bearer " + validServerAuthToken}
+	if s.UpstreamCertFile != "" {
+		args = append(args, "-c", "http.sslCAInfo="+s.UpstreamCertFile, "-c", "http.sslCert="+s.UpstreamCertFile, "-c", "http.sslKey="+s.UpstreamKeyFile)
+	}
+	_, err = pushClient.Run(append(args, "push", "-f", s.UpstreamServerURL, "master:master")...)
 	return hash, err
 
 }
 
+// AddUpstreamLFSObject adds a Git LFS object to the upstream and returns its
+// object ID.
+func (s *TestServer) AddUpstreamLFSObject(content []byte) string {
+	h := sha256.Sum256(content)
+	oid := hex.EncodeToString(h[:])
+	s.lfsMu.Lock()
+	defer s.lfsMu.Unlock()
+	if s.lfsObjects == nil {
+		s.lfsObjects = map[string][]byte{}
+	}
+	s.lfsObjects[oid] = content
+	return oid
+}
+
+// AddUpstreamLFSObjectToRepo adds a Git LFS object only to the upstream
+// repository at the path, such as "/repo.git", and returns its object ID. The
+// objects that AddUpstreamLFSObject adds are in all the repositories.
+func (s *TestServer) AddUpstreamLFSObjectToRepo(repoPath string, content []byte) string {
+	oid := s.AddUpstreamLFSObject(content)
+	s.lfsMu.Lock()
+	defer s.lfsMu.Unlock()
+	if s.lfsObjectRepos == nil {
+		s.lfsObjectRepos = map[string]string{}
+	}
+	s.lfsObjectRepos[oid] = repoPath
+	return oid
+}
+
+// UpstreamLFSObjectServedCount returns the number of the Git LFS objects that
+// the upstream has served.
+func (s *TestServer) UpstreamLFSObjectServedCount() int {
+	s.lfsMu.Lock()
+	defer s.lfsMu.Unlock()
+	return s.lfsObjectServed
+}
+
+func (s *TestServer) upstreamLFSBatchHandler(w http.ResponseWriter, req *http.Request) {
+	type object struct {
+		OID     string                 `json:"oid"`
+		Size    int64                  `json:"size"`
+		Actions map[string]interface{} `json:"actions,omitempty"`
+		Error   map[string]interface{} `json:"error,omitempty"`
+	}
+	var batch struct {
+		Operation string    `json:"operation"`
+		Objects   []*object `json:"objects"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&batch); err != nil || batch.Operation != "download" {
+		http.Error(w, "invalid batch request", http.StatusUnprocessableEntity)
+		return
+	}
+	repoPath := strings.TrimSuffix(req.URL.Path, "/info/lfs/objects/batch")
+	s.lfsMu.Lock()
+	defer s.lfsMu.Unlock()
+	for _, o := range batch.Objects {
+		content, ok := s.lfsObjects[o.OID]
+		if p, restricted := s.lfsObjectRepos[o.OID]; restricted && p != repoPath {
+			ok = false
+		}
+		if !ok {
+			o.Error = map[string]interface{}{"code": http.StatusNotFound, "message": "object not found"}
+			continue
+		}
+		o.Size = int64(len(content))
+		o.Actions = map[string]interface{}{
+			"download": map[string]interface{}{
+				"href":   strings.TrimSuffix(s.UpstreamServerURL, "/") + "/lfs-objects/" + o.OID,
+				"header": map[string]string{"Authorization": "Bearer " + validServerAuthToken},
+			},
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"transfer": "basic", "objects": batch.Objects})
+}
+
+func (s *TestServer) upstreamLFSObjectHandler(w http.ResponseWriter, req *http.Request) {
+	s.lfsMu.Lock()
+	content, ok := s.lfsObjects[strings.TrimPrefix(req.URL.Path, "/lfs-objects/")]
+	if ok {
+		s.lfsObjectServed++
+	}
+	s.lfsMu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(content)
+}
+
+// SendProtocolV2Request sends a protocol v2 request to the proxy server and
+// returns the raw response body.
+func (s *TestServer) SendProtocolV2Request(chunks []*gitprotocolio.ProtocolV2RequestChunk) ([]byte, error) {
+	return s.SendProtocolV2RequestWithHeader(nil, chunks)
+}
+
+// SendProtocolV2RequestWithHeader is SendProtocolV2Request with additional
+// request headers.
+func (s *TestServer) SendProtocolV2RequestWithHeader(header http.Header, chunks []*gitprotocolio.ProtocolV2RequestChunk) ([]byte, error) {
+	bs, _, err := s.SendProtocolV2RequestForHeader(header, chunks)
+	return bs, err
+}
+
+// SendProtocolV2RequestForHeader is SendProtocolV2RequestWithHeader that
+// returns the response headers as well.
+func (s *TestServer) SendProtocolV2RequestForHeader(header http.Header, chunks []*gitprotocolio.ProtocolV2RequestChunk) ([]byte, http.Header, error) {
+	b := new(bytes.Buffer)
+	for _, c := range chunks {
+		b.Write(c.EncodeToPktLine())
+	}
+	req, err := http.NewRequest("POST", s.ProxyServerURL+"git-upload-pack", b)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Add("Git-Protocol", "version=2")
+	req.Header.Add("Authorization", "Bearer "+ValidClientAuthToken)
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("got a non-OK response: %d %s", resp.StatusCode, string(bs))
+	}
+	return bs, resp.Header, nil
+}
+
 func (s *TestServer) Close() {
 	s.upstreamServer.Close()
 	s.proxyServer.Close()
 	s.UpstreamGitRepo.Close()
+	os.RemoveAll(s.ServerConfig.LocalDiskCacheRoot)
+	if s.upstreamCertDir != "" {
+		os.RemoveAll(s.upstreamCertDir)
+	}
 }
 
 func TestRequestAuthorizer(r *http.Request) error {
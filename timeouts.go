@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errRequestDeadlineExceeded = status.Error(codes.DeadlineExceeded, "the request did not finish in time")
+
+// inboundTimeout returns the deadline of an upload-pack request. The clones,
+// the fetches without haves, get CloneTimeout if it's set. No deadline if
+// zero.
+func inboundTimeout(config *ServerConfig, commands [][]*gitprotocolio.ProtocolV2RequestChunk) time.Duration {
+	if config.CloneTimeout > 0 {
+		for _, command := range commands {
+			if command[0].Command == "fetch" && isCacheableFetch(command) {
+				return config.CloneTimeout
+			}
+		}
+	}
+	return config.RequestTimeout
+}
+
+// deadlineWriter fails the writes after ctx is done so that git-upload-pack
+// writing the response is stopped.
+type deadlineWriter struct {
+	w   io.Writer
+	ctx context.Context
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	if d.ctx.Err() != nil {
+		return 0, errRequestDeadlineExceeded
+	}
+	return d.w.Write(p)
+}
+
+// upstreamTimeoutContext returns the context of an upstream operation with the
+// timeout. No timeout if zero.
+func upstreamTimeoutContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// withCancelOf returns a context derived from ctx that's also canceled when
+// other is done.
+func withCancelOf(ctx, other context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if other.Done() == nil {
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-other.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
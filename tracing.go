@@ -0,0 +1,61 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// traceFormat propagates the traces with the W3C traceparent header.
+var traceFormat = &tracecontext.HTTPFormat{}
+
+// startInboundSpan starts the span of an inbound request. The span continues
+// the client's trace if the request has a traceparent header.
+func startInboundSpan(r *http.Request) (*http.Request, *trace.Span) {
+	var ctx context.Context
+	var span *trace.Span
+	if sc, ok := traceFormat.SpanContextFromRequest(r); ok {
+		ctx, span = trace.StartSpanWithRemoteParent(r.Context(), "goblet.Request", sc, trace.WithSpanKind(trace.SpanKindServer))
+	} else {
+		ctx, span = trace.StartSpan(r.Context(), "goblet.Request", trace.WithSpanKind(trace.SpanKindServer))
+	}
+	span.AddAttributes(trace.StringAttribute("http.path", r.URL.Path))
+	return r.WithContext(ctx), span
+}
+
+// tracingErrorReporter sets the reported error to the span of the command.
+type tracingErrorReporter struct {
+	gitProtocolErrorReporter
+	span *trace.Span
+}
+
+func (r *tracingErrorReporter) reportError(ctx context.Context, startTime time.Time, err error) {
+	if err != nil {
+		st, _ := status.FromError(err)
+		code := codes.Internal
+		if st != nil {
+			code = st.Code()
+		}
+		r.span.SetStatus(trace.Status{Code: int32(code), Message: err.Error()})
+	}
+	r.gitProtocolErrorReporter.reportError(ctx, startTime, err)
+}
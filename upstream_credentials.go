@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/url"
+	"path"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+)
+
+// UpstreamCredentialProvider provides the credentials for the upstream
+// repositories.
+type UpstreamCredentialProvider interface {
+	// UpstreamCredential returns the token for the canonical upstream
+	// URL, or nil if the provider has no credentials for it. The token
+	// is sent in the Authorization header with its type. The provider is
+	// asked for a token for every upstream request, so it should reuse
+	// the token until its expiry.
+	UpstreamCredential(u *url.URL) (*oauth2.Token, error)
+}
+
+// UpstreamCredentialProviderFunc is an UpstreamCredentialProvider function.
+type UpstreamCredentialProviderFunc func(u *url.URL) (*oauth2.Token, error)
+
+// UpstreamCredential calls f(u).
+func (f UpstreamCredentialProviderFunc) UpstreamCredential(u *url.URL) (*oauth2.Token, error) {
+	return f(u)
+}
+
+// NewTokenSourceCredentialProvider returns an UpstreamCredentialProvider that
+// provides the tokens of ts for the upstream URLs that match with pattern.
+// The pattern is a glob pattern of the host, such as "*.googlesource.com", or
+// of the repository as in RepoOverride.
+func NewTokenSourceCredentialProvider(pattern string, ts oauth2.TokenSource) UpstreamCredentialProvider {
+	return UpstreamCredentialProviderFunc(func(u *url.URL) (*oauth2.Token, error) {
+		if ok, _ := path.Match(pattern, u.Host); !ok && !matchRepoPattern(pattern, u) {
+			return nil, nil
+		}
+		return ts.Token()
+	})
+}
+
+// ChainUpstreamCredentialProviders returns an UpstreamCredentialProvider that
+// asks the providers in order and returns the first token.
+func ChainUpstreamCredentialProviders(providers ...UpstreamCredentialProvider) UpstreamCredentialProvider {
+	return UpstreamCredentialProviderFunc(func(u *url.URL) (*oauth2.Token, error) {
+		for _, p := range providers {
+			t, err := p.UpstreamCredential(u)
+			if err != nil || t != nil {
+				return t, err
+			}
+		}
+		return nil, nil
+	})
+}
+
+// upstreamToken returns the token for the upstream URL. The token of
+// TokenSource is used if UpstreamCredentialProvider has no credentials for
+// it.
+func upstreamToken(config *ServerConfig, u *url.URL) (*oauth2.Token, error) {
+	config.settingsMu.RLock()
+	provider := config.UpstreamCredentialProvider
+	ts := config.TokenSource
+	config.settingsMu.RUnlock()
+	if provider != nil {
+		t, err := provider.UpstreamCredential(u)
+		if err != nil || t != nil {
+			return t, err
+		}
+	}
+	if ts == nil {
+		return nil, categoryErrorf(ErrorCategoryUpstreamAuth, codes.Unauthenticated, "no credentials for %s", u)
+	}
+	return ts.Token()
+}
+
+// authorizationHeader returns the Authorization header value of the token.
+// This is the same as what Token.SetAuthHeader sets.
+func authorizationHeader(t *oauth2.Token) string {
+	return t.Type() + " " + t.AccessToken
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// upstreamProxy returns the URL of the proxy that the connections to the
+// upstream URL go through, or nil if they are made directly. This is
+// UpstreamProxy unless the host matches UpstreamNoProxy. If UpstreamProxy is
+// empty, the proxy is taken from HTTPS_PROXY, HTTP_PROXY, and NO_PROXY as
+// http.ProxyFromEnvironment does. The connections to localhost are never
+// proxied.
+func upstreamProxy(config *ServerConfig, u *url.URL) (*url.URL, error) {
+	config.upstreamProxyOnce.Do(func() {
+		c := httpproxy.FromEnvironment()
+		if config.UpstreamProxy != "" {
+			c = &httpproxy.Config{
+				HTTPProxy:  config.UpstreamProxy,
+				HTTPSProxy: config.UpstreamProxy,
+				NoProxy:    strings.Join(config.UpstreamNoProxy, ","),
+			}
+		}
+		config.upstreamProxyFunc = c.ProxyFunc()
+	})
+	return config.upstreamProxyFunc(u)
+}
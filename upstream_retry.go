@@ -0,0 +1,210 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultUpstreamRetryBackoff = time.Second
+	maxUpstreamRetryBackoff     = 30 * time.Second
+	defaultUpstreamRetryBudget  = 0.1
+
+	// maxRetryTokens is the number of the retries that the budget saves
+	// up while the upstream is healthy. It's full when the server starts.
+	maxRetryTokens = 10
+
+	// gitOutputTailBytes is the size of the git output kept to tell
+	// whether a git command failed transiently.
+	gitOutputTailBytes = 4096
+)
+
+// transientGitErrors are the git outputs of the upstream failures that are
+// likely to go away on a retry, such as 5xx responses and broken
+// connections.
+var transientGitErrors = []string{
+	"The requested URL returned error: 5",
+	"Connection reset",
+	"Connection refused",
+	"Connection timed out",
+	"Operation timed out",
+	"Could not resolve host",
+	"early EOF",
+	"RPC failed",
+	"the remote end hung up unexpectedly",
+}
+
+// upstreamAuthGitErrors and upstreamNotFoundGitErrors are the git outputs of
+// the upstream authentication failures and the missing repositories.
+var (
+	upstreamAuthGitErrors = []string{
+		"The requested URL returned error: 401",
+		"The requested URL returned error: 403",
+		"Authentication failed",
+	}
+	upstreamNotFoundGitErrors = []string{
+		"The requested URL returned error: 404",
+		"' not found",
+	}
+)
+
+// retryBudget limits the retries to UpstreamRetryBudget of the upstream
+// operations so that the retries don't multiply the load of an upstream that
+// is down. Every operation deposits the ratio, and every retry withdraws one.
+type retryBudget struct {
+	mu          sync.Mutex
+	tokens      float64
+	initialized bool
+}
+
+func (b *retryBudget) deposit(ratio float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	b.tokens += ratio
+	if b.tokens > maxRetryTokens {
+		b.tokens = maxRetryTokens
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *retryBudget) init() {
+	if !b.initialized {
+		b.tokens = maxRetryTokens
+		b.initialized = true
+	}
+}
+
+// retryUpstream runs f, and retries it up to UpstreamRetries times while it
+// fails transiently. f returns whether its error is transient. The retries
+// wait for a jittered exponential backoff, and they stop when the retry
+// budget runs out or Shutdown aborts the upstream fetches. command is
+// recorded in UpstreamRetryCount. f is not run while the circuit breaker of
+// the upstream host is open.
+func (r *managedRepository) retryUpstream(command string, f func() (bool, error)) error {
+	config := r.config
+	breaker := config.upstreamCircuits.get(r.upstreamURL.Host)
+	ratio := config.UpstreamRetryBudget
+	if ratio == 0 {
+		ratio = defaultUpstreamRetryBudget
+	}
+	config.upstreamRetries.deposit(ratio)
+	backoff := config.UpstreamRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultUpstreamRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		if err := breaker.allow(config); err != nil {
+			return err
+		}
+		transient, err := f()
+		breaker.done(config, err != nil && transient)
+		if err == nil || !transient || attempt >= config.UpstreamRetries {
+			return err
+		}
+		if !config.upstreamRetries.withdraw() {
+			return err
+		}
+		ctx, _ := tag.New(context.Background(), tag.Upsert(CommandTypeKey, command))
+		stats.Record(ctx, UpstreamRetryCount.M(1))
+
+		// Wait for between the half of the backoff and the backoff so
+		// that the retries of the concurrent operations spread out.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-config.upstreamFetches.context().Done():
+			t.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > maxUpstreamRetryBackoff {
+			backoff = maxUpstreamRetryBackoff
+		}
+	}
+}
+
+// gitOutputRecorder keeps the tail of the output of a git command while
+// passing it to the operation.
+type gitOutputRecorder struct {
+	RunningOperation
+
+	mu   sync.Mutex
+	tail string
+}
+
+func (o *gitOutputRecorder) Printf(format string, a ...interface{}) {
+	s := fmt.Sprintf(format, a...)
+	o.mu.Lock()
+	o.tail += s
+	if len(o.tail) > gitOutputTailBytes {
+		o.tail = o.tail[len(o.tail)-gitOutputTailBytes:]
+	}
+	o.mu.Unlock()
+	o.RunningOperation.Printf("%s", s)
+}
+
+// failedTransiently returns true if the output shows that the git command
+// failed because of a transient upstream failure.
+func (o *gitOutputRecorder) failedTransiently() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range transientGitErrors {
+		if strings.Contains(o.tail, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// categorize returns the error of the git command with the ErrorCategory that
+// the output shows. The upstream authentication failures are not the clients'
+// fault, and they are sent with PermissionDenied rather than Unauthenticated
+// as upstreamErrorCodes.
+func (o *gitOutputRecorder) categorize(err error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range upstreamAuthGitErrors {
+		if strings.Contains(o.tail, s) {
+			return categoryErrorf(ErrorCategoryUpstreamAuth, codes.PermissionDenied, "%v", err)
+		}
+	}
+	for _, s := range upstreamNotFoundGitErrors {
+		if strings.Contains(o.tail, s) {
+			return categoryErrorf(ErrorCategoryNotFound, codes.NotFound, "%v", err)
+		}
+	}
+	return categoryErrorf(ErrorCategoryUpstreamUnavailable, codes.Unavailable, "%v", err)
+}
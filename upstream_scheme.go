@@ -0,0 +1,37 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/url"
+	"path"
+)
+
+// upgradeUpstreamScheme returns the URL to fetch from. With
+// ForceUpstreamHTTPS, http:// is replaced with https:// unless the host is in
+// PlaintextUpstreamHosts.
+func upgradeUpstreamScheme(config *ServerConfig, u *url.URL) *url.URL {
+	if !config.ForceUpstreamHTTPS || u.Scheme != "http" {
+		return u
+	}
+	for _, p := range config.PlaintextUpstreamHosts {
+		if ok, _ := path.Match(p, u.Hostname()); ok {
+			return u
+		}
+	}
+	ret := *u
+	ret.Scheme = "https"
+	return &ret
+}
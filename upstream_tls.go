@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// UpstreamTLS configures the TLS connections to the upstream, such as the
+// Git servers with a private PKI. Unlike UpstreamTransport, this applies to
+// git-fetch as well.
+type UpstreamTLS struct {
+	// CAFile is a PEM file of the root CA certificates that the upstream
+	// certificates are verified with, instead of the system ones.
+	CAFile string
+
+	// MinVersion is the minimum TLS version, such as tls.VersionTLS12.
+	// The default of Go and curl is used if zero.
+	MinVersion uint16
+
+	// CertFile and KeyFile are the PEM files of the client certificate
+	// and its private key presented to the upstream. No client
+	// certificate if empty.
+	CertFile string
+	KeyFile  string
+}
+
+// curlTLSVersions maps the TLS versions to the http.sslVersion values of git.
+var curlTLSVersions = map[uint16]string{
+	tls.VersionTLS10: "tlsv1.0",
+	tls.VersionTLS11: "tlsv1.1",
+	tls.VersionTLS12: "tlsv1.2",
+	tls.VersionTLS13: "tlsv1.3",
+}
+
+// ClientConfig returns the tls.Config of the connections to the upstream. It
+// returns an error if the files cannot be loaded.
+func (t *UpstreamTLS) ClientConfig() (*tls.Config, error) {
+	c := &tls.Config{MinVersion: t.MinVersion}
+	if t.MinVersion != 0 {
+		if _, ok := curlTLSVersions[t.MinVersion]; !ok {
+			return nil, fmt.Errorf("unsupported TLS version %#x", t.MinVersion)
+		}
+	}
+	if t.CAFile != "" {
+		bs, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the upstream CA file: %v", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("no certificates in the upstream CA file %s", t.CAFile)
+		}
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("both the upstream client certificate and key must be set")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the upstream client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// gitOptions returns the git options that make git-fetch use the settings.
+func (t *UpstreamTLS) gitOptions() []string {
+	opts := []string{}
+	if t.CAFile != "" {
+		opts = append(opts, "-c", "http.sslCAInfo="+t.CAFile)
+	}
+	if v, ok := curlTLSVersions[t.MinVersion]; ok {
+		opts = append(opts, "-c", "http.sslVersion="+v)
+	}
+	if t.CertFile != "" {
+		opts = append(opts, "-c", "http.sslCert="+t.CertFile, "-c", "http.sslKey="+t.KeyFile)
+	}
+	return opts
+}
+
+// errorTransport fails all requests with err, such as when UpstreamTLS cannot
+// be loaded.
+type errorTransport struct {
+	err error
+}
+
+func (t *errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
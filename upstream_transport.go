@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"golang.org/x/net/http2"
+)
+
+// UpstreamTransport tunes the connections of the HTTP requests to the
+// upstream, such as the ls-refs commands, the LFS objects, and the forwarded
+// pushes. git-fetch makes its own connections, and only DisableHTTP2 applies
+// to it.
+type UpstreamTransport struct {
+	// MaxIdleConns is the maximum number of the idle connections kept
+	// for reuse. It defaults to 100. MaxIdleConnsPerHost is the maximum
+	// per upstream host, and it defaults to MaxIdleConns as there are
+	// usually only a few upstream hosts.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost is the maximum number of the connections to an
+	// upstream host, including the ones in use. The requests over it
+	// wait for a connection. No limit if zero.
+	MaxConnsPerHost int
+
+	// IdleConnTimeout is the duration an idle connection is kept. It
+	// defaults to 90 seconds. KeepAlive is the interval of the TCP
+	// keep-alive probes. It defaults to 30 seconds.
+	IdleConnTimeout time.Duration
+	KeepAlive       time.Duration
+
+	// DisableHTTP2 makes the requests, and git-fetch, use HTTP/1.1 even if
+	// the upstream supports HTTP/2.
+	DisableHTTP2 bool
+}
+
+// upstreamHTTPClient returns an http.Client that connects to the resolved
+// address of the upstream with UpstreamTransport.
+func upstreamHTTPClient(config *ServerConfig) *http.Client {
+	config.upstreamClientOnce.Do(func() {
+		config.upstreamClient = &http.Client{
+			Transport: &requestIDTransport{&connReuseRecorder{rt: newUpstreamTransport(config)}},
+		}
+	})
+	return config.upstreamClient
+}
+
+func newUpstreamTransport(config *ServerConfig) http.RoundTripper {
+	if config.Offline {
+		return &errorTransport{errOffline}
+	}
+	if config.UpstreamTransport == nil && config.DNSCacheTTL <= 0 && len(config.UpstreamHostIPs) == 0 && config.UpstreamProxy == "" && config.UpstreamTLS == nil {
+		return http.DefaultTransport
+	}
+	var tlsConfig *tls.Config
+	if config.UpstreamTLS != nil {
+		var err error
+		if tlsConfig, err = config.UpstreamTLS.ClientConfig(); err != nil {
+			return &errorTransport{err}
+		}
+	}
+	opts := config.UpstreamTransport
+	if opts == nil {
+		opts = &UpstreamTransport{}
+	}
+	maxIdleConns := opts.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = 100
+	}
+	maxIdleConnsPerHost := opts.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = maxIdleConns
+	}
+	idleConnTimeout := opts.IdleConnTimeout
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = 90 * time.Second
+	}
+	keepAlive := opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 30 * time.Second
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: keepAlive,
+	}
+	t := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return upstreamProxy(config, req.URL)
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ip, err := resolveUpstreamHost(ctx, config, host)
+			if err != nil {
+				return nil, err
+			}
+			if ip != "" {
+				addr = net.JoinHostPort(ip, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if !opts.DisableHTTP2 {
+		// A transport with a custom dialer doesn't try HTTP/2 by
+		// itself.
+		http2.ConfigureTransport(t)
+	}
+	return t
+}
+
+// connReuseRecorder records whether the requests to the upstream reuse the
+// connections.
+type connReuseRecorder struct {
+	rt http.RoundTripper
+}
+
+func (t *connReuseRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			stats.RecordWithTags(
+				context.Background(),
+				[]tag.Mutator{tag.Upsert(ConnReusedKey, strconv.FormatBool(info.Reused))},
+				UpstreamConnCount.M(1),
+			)
+		},
+	}
+	return t.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// URLRewriteRule rewrites the request URLs that match with Pattern to the
+// upstream URL.
+type URLRewriteRule struct {
+	// Pattern is a regular expression that must match with the whole host
+	// and path of the request URL, without the Git HTTP endpoints such as
+	// "/info/refs". For example, "git\.example\.com/(.+?)(\.git)?".
+	Pattern string
+
+	// Upstream is the upstream URL. "$1" and "${name}" are replaced with
+	// the submatches of Pattern as in regexp.Regexp.Expand. For example,
+	// "https://upstream.example.com/$1".
+	Upstream string
+
+	// TokenSource provides the credentials for the upstream URLs of the
+	// rule, such as when the rules route to the upstream hosts with
+	// different credentials. UpstreamCredentialProvider and TokenSource
+	// of the server are used if nil. See NewRuleCredentialProvider.
+	TokenSource oauth2.TokenSource
+}
+
+// NewRuleURLCanonicalizer returns a URLCanonializer that rewrites the URLs
+// with the first matching rule. The URLs that match no rule are rejected.
+func NewRuleURLCanonicalizer(rules []*URLRewriteRule) (func(*url.URL) (*url.URL, error), error) {
+	res := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL rewrite rule pattern %q: %v", rule.Pattern, err)
+		}
+		res[i] = re
+	}
+	return func(u *url.URL) (*url.URL, error) {
+		p := TrimGitHTTPEndpoint(u.Path)
+		if _, err := SplitRepositoryPath(p); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "not a repository URL: %s", u)
+		}
+		s := u.Host + p
+		for i, re := range res {
+			m := re.FindStringSubmatchIndex(s)
+			if m == nil {
+				continue
+			}
+			upstream := string(re.ExpandString(nil, rules[i].Upstream, s, m))
+			ret, err := url.Parse(upstream)
+			if err != nil || (ret.Scheme != "https" && ret.Scheme != "http") || ret.Host == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "%s is rewritten to an invalid URL %q", u, upstream)
+			}
+			// A submatch can be a path element of the upstream
+			// URL, such as "$1" in "https://host/$1/repo".
+			if _, err := SplitRepositoryPath(ret.Path); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%s is rewritten to an invalid URL %q", u, upstream)
+			}
+			return ret, nil
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "no URL rewrite rule matches with %s", u)
+	}, nil
+}
+
+// NewRuleCredentialProvider returns an UpstreamCredentialProvider that
+// provides the tokens of the TokenSource of the rules. An upstream URL belongs
+// to the first rule whose Upstream matches with it, with the "$1" and
+// "${name}" matching any string. For example, "https://$1.googlesource.com/$2"
+// covers all googlesource.com repositories. The provider has no credentials
+// for the URLs of the rules without a TokenSource.
+func NewRuleCredentialProvider(rules []*URLRewriteRule) UpstreamCredentialProvider {
+	res := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		res[i] = upstreamTemplatePattern(rule.Upstream)
+	}
+	return UpstreamCredentialProviderFunc(func(u *url.URL) (*oauth2.Token, error) {
+		s := u.String()
+		for i, re := range res {
+			if !re.MatchString(s) {
+				continue
+			}
+			if rules[i].TokenSource == nil {
+				return nil, nil
+			}
+			return rules[i].TokenSource.Token()
+		}
+		return nil, nil
+	})
+}
+
+// templateVariable matches with the variables of a regexp.Regexp.Expand
+// template, and "$$" for a literal "$".
+var templateVariable = regexp.MustCompile(`\$(\$|\{[^}]*\}|\w+)`)
+
+// upstreamTemplatePattern returns a regular expression that matches with the
+// URLs that the Upstream template expands to.
+func upstreamTemplatePattern(template string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, m := range templateVariable.FindAllStringIndex(template, -1) {
+		b.WriteString(regexp.QuoteMeta(template[last:m[0]]))
+		if template[m[0]:m[1]] == "$$" {
+			b.WriteString(`\$`)
+		} else {
+			b.WriteString(".*")
+		}
+		last = m[1]
+	}
+	b.WriteString(regexp.QuoteMeta(template[last:]))
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"sync"
+)
+
+// waitedFetch is an upstream fetch that the clients wanting the objects not
+// cached yet wait for. It's shared by the clients of the repository, and it's
+// canceled only when all of them go away before it finishes.
+type waitedFetch struct {
+	done   chan struct{}
+	err    error
+	cancel context.CancelFunc
+
+	// waiters is the number of the clients waiting for the fetch.
+	// detached is true once a client stops waiting other than by going
+	// away, after which the fetch runs to the end. Guarded by
+	// managedRepository.waitedFetchMu.
+	waiters  int
+	detached bool
+}
+
+// joinUpstreamFetch returns the upstream fetch that the other clients are
+// waiting for, or starts one. joined is true if the fetch is started by
+// another client, and it may not have the objects pushed since it started.
+// Call leave when the client stops waiting, with gone set if the client went
+// away.
+func (r *managedRepository) joinUpstreamFetch(ctx context.Context) (f *waitedFetch, joined bool, leave func(gone bool)) {
+	r.waitedFetchMu.Lock()
+	defer r.waitedFetchMu.Unlock()
+	f = r.waitedFetch
+	joined = f != nil
+	if f == nil {
+		fetchCtx, cancel := context.WithCancel(withPriority(context.Background(), priorityFromContext(ctx)))
+		f = &waitedFetch{done: make(chan struct{}), cancel: cancel}
+		r.waitedFetch = f
+		go func() {
+			err := r.fetchUpstreamContext(fetchCtx)
+			cancel()
+			r.waitedFetchMu.Lock()
+			if r.waitedFetch == f {
+				r.waitedFetch = nil
+			}
+			r.waitedFetchMu.Unlock()
+			f.err = err
+			close(f.done)
+		}()
+	}
+	f.waiters++
+
+	var once sync.Once
+	return f, joined, func(gone bool) {
+		once.Do(func() {
+			r.waitedFetchMu.Lock()
+			defer r.waitedFetchMu.Unlock()
+			f.waiters--
+			if !gone {
+				f.detached = true
+			}
+			if f.waiters == 0 && !f.detached {
+				f.cancel()
+				if r.waitedFetch == f {
+					r.waitedFetch = nil
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// SetWarmRepositories replaces the WarmRepositories of the config. This is
+// safe to call while the server is running. The new repositories are fetched
+// by the next WarmUpRepositories.
+func SetWarmRepositories(config *ServerConfig, urls []string) error {
+	if err := validateWarmRepositories(urls); err != nil {
+		return err
+	}
+	config.settingsMu.Lock()
+	defer config.settingsMu.Unlock()
+	config.WarmRepositories = urls
+	return nil
+}
+
+func validateWarmRepositories(urls []string) error {
+	for _, raw := range urls {
+		if _, err := url.Parse(raw); err != nil {
+			return fmt.Errorf("invalid warm repository URL %q: %v", raw, err)
+		}
+	}
+	return nil
+}
+
+// WarmUpRepositories fetches WarmRepositories from the upstream unless they
+// are fresh. The repositories not cached yet are cloned. A failure of a
+// repository doesn't stop the others, and the first error is returned.
+func WarmUpRepositories(config *ServerConfig) error {
+	config.settingsMu.RLock()
+	urls := config.WarmRepositories
+	config.settingsMu.RUnlock()
+
+	var firstErr error
+	for _, raw := range urls {
+		if err := warmUpRepository(config, raw); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("cannot warm up %s: %v", raw, err)
+		}
+	}
+	return firstErr
+}
+
+func warmUpRepository(config *ServerConfig, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	repo, err := openStoredRepository(config, "", u)
+	if err != nil {
+		return err
+	}
+	if isStoredRepositoryFresh(config, repo) {
+		return nil
+	}
+	return repo.Fetch(context.Background())
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxWebhookPayloadBytes is the size limit of the webhook payloads. GitHub
+// caps them at 25 MB.
+const maxWebhookPayloadBytes = 25 << 20
+
+type webhookServer struct {
+	config *ServerConfig
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	s.config.settingsMu.RLock()
+	secret := s.config.WebhookSecret
+	s.config.settingsMu.RUnlock()
+	if secret == "" {
+		writeAdminError(w, status.Error(codes.PermissionDenied, "the webhook is not enabled"))
+		return
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookPayloadBytes))
+	if err != nil {
+		writeAdminError(w, status.Errorf(codes.InvalidArgument, "cannot read the payload: %v", err))
+		return
+	}
+
+	var rawURL string
+	switch {
+	case r.Header.Get("X-GitHub-Event") != "":
+		rawURL, err = s.gitHubRepositoryURL(r, secret, payload)
+	case r.Header.Get("X-Gitlab-Event") != "":
+		rawURL, err = s.gitLabRepositoryURL(r, secret, payload)
+	default:
+		rawURL, err = s.gerritRepositoryURL(r, secret, payload)
+	}
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			writeAdminError(w, status.Errorf(codes.InvalidArgument, "cannot parse the repository URL: %v", err))
+			return
+		}
+		if err := RefreshRepositories(s.config, u); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// gitHubRepositoryURL returns the repository URL of a push event. The payload
+// is signed with the secret in X-Hub-Signature-256. The other events, such as
+// ping, are accepted and ignored.
+func (s *webhookServer) gitHubRepositoryURL(r *http.Request, secret string, payload []byte) (string, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")), []byte(want)) {
+		return "", status.Error(codes.Unauthenticated, "invalid X-Hub-Signature-256")
+	}
+	if r.Header.Get("X-GitHub-Event") != "push" {
+		return "", nil
+	}
+	var event struct {
+		Repository struct {
+			CloneURL string `json:"clone_url"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil || event.Repository.CloneURL == "" {
+		return "", status.Errorf(codes.InvalidArgument, "cannot parse the push event: %v", err)
+	}
+	return event.Repository.CloneURL, nil
+}
+
+// gitLabRepositoryURL returns the repository URL of a push or a tag push
+// event. The secret is sent as is in X-Gitlab-Token.
+func (s *webhookServer) gitLabRepositoryURL(r *http.Request, secret string, payload []byte) (string, error) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+		return "", status.Error(codes.Unauthenticated, "invalid X-Gitlab-Token")
+	}
+	if e := r.Header.Get("X-Gitlab-Event"); e != "Push Hook" && e != "Tag Push Hook" {
+		return "", nil
+	}
+	var event struct {
+		Project struct {
+			GitHTTPURL string `json:"git_http_url"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil || event.Project.GitHTTPURL == "" {
+		return "", status.Errorf(codes.InvalidArgument, "cannot parse the push event: %v", err)
+	}
+	return event.Project.GitHTTPURL, nil
+}
+
+// gerritRepositoryURL returns the repository URL of a ref-updated event under
+// WebhookGerritURL. The webhooks plugin of Gerrit can neither sign the
+// payloads nor add headers, so the secret is sent in the token query
+// parameter of the webhook URL.
+func (s *webhookServer) gerritRepositoryURL(r *http.Request, secret string, payload []byte) (string, error) {
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(secret)) != 1 {
+		return "", status.Error(codes.Unauthenticated, "invalid token")
+	}
+	if s.config.WebhookGerritURL == "" {
+		return "", status.Error(codes.FailedPrecondition, "the Gerrit URL is not configured")
+	}
+	return GerritEventRepositoryURL(s.config.WebhookGerritURL, payload)
+}
+
+// GerritEventRepositoryURL returns the URL of the repository updated by a
+// Gerrit event in the stream-events format, such as the ones sent by the
+// webhooks plugin and published by the events-gcloud-pubsub plugin.
+// gerritURL is the URL of the Gerrit server, such as
+// https://gerrit.example.com. This returns an empty string for the events
+// other than ref-updated.
+func GerritEventRepositoryURL(gerritURL string, event []byte) (string, error) {
+	var e struct {
+		Type      string `json:"type"`
+		RefUpdate struct {
+			Project string `json:"project"`
+		} `json:"refUpdate"`
+	}
+	if err := json.Unmarshal(event, &e); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "cannot parse the event: %v", err)
+	}
+	if e.Type != "ref-updated" {
+		return "", nil
+	}
+	if e.RefUpdate.Project == "" {
+		return "", status.Error(codes.InvalidArgument, "no project in the ref-updated event")
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(gerritURL, "/"), e.RefUpdate.Project), nil
+}
+
+// RefreshRepositories marks the managed repositories of the upstream URL of
+// all tenants stale so that the requests query the upstream, and fetches them
+// in the background. The URL is canonicalized with URLCanonializer. The
+// repositories not opened since the server started are already queried with
+// the upstream.
+func RefreshRepositories(config *ServerConfig, u *url.URL) error {
+	u, err := canonicalizeURL(config, u)
+	if err != nil {
+		return err
+	}
+	u = upgradeUpstreamScheme(config, u)
+	managedRepos.Range(func(key, value interface{}) bool {
+		m := value.(*managedRepository)
+		if m.upstreamURL.String() == u.String() {
+			m.invalidate()
+			go m.fetchUpstream()
+		}
+		return true
+	})
+	return nil
+}
+
+// invalidate makes the repository not fresh until the next upstream fetch.
+func (r *managedRepository) invalidate() {
+	r.lastUpdateMu.Lock()
+	r.lastUpdate = time.Time{}
+	r.lastUpdateMu.Unlock()
+	r.headMu.Lock()
+	r.headSyncTime = time.Time{}
+	r.headMu.Unlock()
+}